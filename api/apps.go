@@ -3,39 +3,184 @@ package api
 import (
 	"encoding/hex"
 	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/simpleauthlink/authapi/db"
 	"github.com/simpleauthlink/authapi/helpers"
 )
 
-// authApp method creates a new app based on the provided name, email, redirectURL
-// and duration. It returns the app id and the app secret. If the name, email or
-// redirectURL are empty, it returns an error. If the duration is less than the
-// minimum duration, it returns an error. If something fails during the process,
-// it returns an error. The app id and the app secret are generated based on the
-// email using the generateApp function. The app is stored in the database using
-// the app id as the key. The secret is stored in the database using the hashed
-// secret as the key. The hashed secret is required to be compared with the
-// secret provided by the user in the requests.
-func (s *Service) authApp(name, email, redirectURL string, duration uint64) (string, string, error) {
+// authApp method creates a new app based on the provided app data (name,
+// email, redirectURL, duration, users quota and notifier). It returns the app
+// id and the app secret. If the redirectURL is empty, the default redirect URL
+// of the service is used (and set in the provided app data). The name is
+// sanitized (see sanitizeAppName) and updated in the provided app data. If the
+// name, email or redirectURL are still empty, it returns an error. The
+// redirectURL is normalized (using https if it has no scheme) and, if it is
+// invalid, it returns an error. If the duration is less than the minimum
+// duration, the users quota, the maximum refreshes, the token size or the
+// token requests limit are out of range, the notifier or any channel is not
+// registered, the auth mode or the delivery policy are unknown or any allowed
+// origin, the webhook url or the custom email subjects are invalid, it returns
+// an error. If the users quota, the maximum refreshes, the token size, the
+// token requests limit or the auth mode are zero, the default ones are used.
+// If something fails during the process, it returns an error. The app id and
+// the app secret are generated based on the email using the generateApp
+// function. The app is stored in the database using the app id as the key. The
+// secret is stored in the database using the hashed secret as the key. The
+// hashed secret is required to be compared with the secret provided by the
+// user in the requests.
+func (s *Service) authApp(app *AppData) (string, string, error) {
+	// use the default redirect URL if the app does not provide one
+	if len(app.RedirectURL) == 0 {
+		app.RedirectURL = s.cfg.DefaultRedirectURL
+	}
+	// sanitize the name, which is used in the subjects of the emails
+	app.Name = sanitizeAppName(app.Name, s.maxAppNameLength())
 	// check if the name, email, and redirectURL are not empty
-	if len(name) == 0 || len(email) == 0 || len(redirectURL) == 0 {
+	if len(app.Name) == 0 || len(app.Email) == 0 || len(app.RedirectURL) == 0 {
 		return "", "", fmt.Errorf("name, email, and redirectURL are required")
 	}
+	// normalize the redirect URL, adding the default scheme if it is missing
+	redirectURL, err := normalizeAppRedirectURL(app.RedirectURL)
+	if err != nil {
+		return "", "", err
+	}
+	app.RedirectURL = redirectURL
 	// check if the duration is valid
-	if duration < helpers.MinTokenDuration {
-		return "", "", fmt.Errorf("duration must be at least %d seconds", helpers.MinTokenDuration)
+	if app.Duration < helpers.MinTokenDuration {
+		return "", "", fmt.Errorf("%w: it must be at least %d seconds", errInvalidDuration, helpers.MinTokenDuration)
+	}
+	if app.Duration > helpers.MaxTokenDuration {
+		return "", "", fmt.Errorf("%w: it must be at most %d seconds", errInvalidDuration, helpers.MaxTokenDuration)
+	}
+	// check if the users quota is valid, by default, the default users quota
+	// is used
+	if app.UsersQuota < 0 || app.UsersQuota > helpers.MaxUsersQuota {
+		return "", "", fmt.Errorf("%w: it must be between 1 and %d", errInvalidUsersQuota, helpers.MaxUsersQuota)
+	}
+	usersQuota := app.UsersQuota
+	if usersQuota == 0 {
+		usersQuota = helpers.DefaultUsersQuota
+	}
+	// check if the maximum number of refreshes is valid, by default, the
+	// default maximum is used
+	if app.MaxRefreshes < 0 || app.MaxRefreshes > helpers.MaxRefreshesLimit {
+		return "", "", fmt.Errorf("%w: it must be between 1 and %d", errInvalidMaxRefreshes, helpers.MaxRefreshesLimit)
+	}
+	maxRefreshes := app.MaxRefreshes
+	if maxRefreshes == 0 {
+		maxRefreshes = helpers.DefaultMaxRefreshes
+	}
+	// check if the token size is valid, by default, the default token size
+	// is used
+	if app.TokenSize != 0 && (app.TokenSize < helpers.TokenSize || app.TokenSize > helpers.MaxTokenSize) {
+		return "", "", fmt.Errorf("%w: it must be between %d and %d bytes", errInvalidTokenSize, helpers.TokenSize, helpers.MaxTokenSize)
+	}
+	tokenSize := app.TokenSize
+	if tokenSize == 0 {
+		tokenSize = helpers.TokenSize
+	}
+	// check if the token requests limit is valid, by default, the default
+	// limit and window are used
+	if err := validTokenRequestsLimit(app.MaxTokenRequests, app.TokenRequestsWindow); err != nil {
+		return "", "", err
+	}
+	maxTokenRequests := app.MaxTokenRequests
+	if maxTokenRequests == 0 {
+		maxTokenRequests = helpers.DefaultMaxTokenRequests
+	}
+	tokenRequestsWindow := app.TokenRequestsWindow
+	if tokenRequestsWindow == 0 {
+		tokenRequestsWindow = helpers.DefaultTokenRequestsWindow
+	}
+	// check if the notifier is registered
+	if _, err := s.notifier(app.Notifier); err != nil {
+		return "", "", err
+	}
+	// check if the token delivery mode is valid, by default, the token is
+	// sent in the body
+	if !validTokenDelivery(app.TokenDelivery) {
+		return "", "", errInvalidTokenDelivery
+	}
+	tokenDelivery := app.TokenDelivery
+	if tokenDelivery == "" {
+		tokenDelivery = TokenDeliveryBody
+	}
+	// check if the auth mode is valid, by default, the users get a magic
+	// link
+	if !validAuthMode(app.AuthMode) {
+		return "", "", errInvalidAuthMode
+	}
+	authMode := app.AuthMode
+	if authMode == "" {
+		authMode = AuthModeLink
+	}
+	// check if the additional channels and the delivery policy are valid,
+	// by default, at least one channel must deliver the magic links
+	channels, err := s.appChannels(app.Channels)
+	if err != nil {
+		return "", "", err
+	}
+	if !validDeliveryPolicy(app.DeliveryPolicy) {
+		return "", "", errInvalidDeliveryPolicy
+	}
+	deliveryPolicy := app.DeliveryPolicy
+	if deliveryPolicy == "" {
+		deliveryPolicy = DeliveryPolicyAny
+	}
+	// normalize the allowed origins of the app frontends
+	allowedOrigins, err := normalizeOrigins(app.AllowedOrigins)
+	if err != nil {
+		return "", "", err
+	}
+	// normalize the additional domains allowed in the redirect URLs
+	redirectDomains, err := normalizeRedirectDomains(app.AllowedRedirectDomains)
+	if err != nil {
+		return "", "", err
+	}
+	// check if the webhook url is valid, by default, the app has no webhook
+	if !validWebhookURL(app.WebhookURL) {
+		return "", "", errInvalidWebhookURL
+	}
+	// check if the custom email subjects are valid, by default, the default
+	// subjects are used
+	if err := validEmailSubjects(app.TokenEmailSubject, app.AppEmailSubject); err != nil {
+		return "", "", err
 	}
 	// compose the app struct for the database
 	appData := &db.App{
-		Name:            name,
-		AdminEmail:      email,
-		SessionDuration: duration,
-		RedirectURL:     redirectURL,
-		UsersQuota:      helpers.DefaultUsersQuota,
+		Name:                   app.Name,
+		AdminEmail:             app.Email,
+		SessionDuration:        app.Duration,
+		RedirectURL:            app.RedirectURL,
+		UsersQuota:             usersQuota,
+		MaxRefreshes:           maxRefreshes,
+		TokenSize:              tokenSize,
+		MaxTokenRequests:       maxTokenRequests,
+		TokenRequestsWindow:    tokenRequestsWindow,
+		Notifier:               app.Notifier,
+		NotifierTarget:         app.NotifierTarget,
+		TokenDelivery:          tokenDelivery,
+		AuthMode:               authMode,
+		AllowedOrigins:         allowedOrigins,
+		AllowedRedirectDomains: redirectDomains,
+		Channels:               channels,
+		DeliveryPolicy:         deliveryPolicy,
+		WebhookURL:             app.WebhookURL,
+		TokenEmailSubject:      app.TokenEmailSubject,
+		AppEmailSubject:        app.AppEmailSubject,
+		// the magic links are not sent in the responses unless the app
+		// explicitly allows it
+		Features: map[db.Feature]bool{
+			db.FeatureLinkInResponse: app.AllowLinkInResponse != nil && *app.AllowLinkInResponse,
+		},
 	}
 	// generate app based on email
-	appId, secret, hSecret, err := generateApp(appData.AdminEmail)
+	appId, secret, hSecret, err := generateApp(s.cfg.HashAlgorithm, appData.AdminEmail)
 	if err != nil {
 		return "", "", err
 	}
@@ -43,13 +188,24 @@ func (s *Service) authApp(name, email, redirectURL string, duration uint64) (str
 	if err := s.db.SetApp(appId, appData); err != nil {
 		return "", "", err
 	}
-	// store secret in the database
-	if err := s.db.SetSecret(hSecret, appId); err != nil {
+	// store secret in the database, without expiration
+	if err := s.db.SetSecret(hSecret, appId, time.Time{}); err != nil {
 		return "", "", err
 	}
 	return appId, secret, nil
 }
 
+// CreateApp method creates a new app with the provided data, like the app
+// token requests do, but without sending the app secret by email, so the
+// operators can create apps locally (for example, the first app of a new
+// deployment). It returns the app id and the app secret, which can not be
+// recovered later. The app data is validated and completed with the default
+// values like in the authApp method, which returns an error if something
+// fails.
+func (s *Service) CreateApp(app *AppData) (string, string, error) {
+	return s.authApp(app)
+}
+
 // appMetadata method retrieves the app data based on the app id. If the app id is
 // empty, it returns an error. If something fails during the process, it returns
 // an error. The app data includes the name, the email of the admin, the redirect
@@ -61,30 +217,196 @@ func (s *Service) appMetadata(appId string) (AppData, error) {
 	if err != nil {
 		return AppData{}, err
 	}
+	return s.appData(appId, dbApp), nil
+}
+
+// listApps method retrieves the data of the apps registered in the service,
+// sorted by app id and paginated with the provided limit and offset. It is
+// intended for the service admins. If something fails during the process, it
+// returns an error.
+func (s *Service) listApps(limit, offset int) ([]*AdminAppData, error) {
+	dbApps, err := s.db.ListApps(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]*AdminAppData, 0, len(dbApps))
+	for _, dbApp := range dbApps {
+		apps = append(apps, &AdminAppData{ID: dbApp.ID, AppData: s.appData(dbApp.ID, dbApp)})
+	}
+	return apps, nil
+}
+
+// appUsers method retrieves the active sessions of the app with the provided
+// id, which are its tokens that are not expired, including the id of the
+// user and the expiration of each one. If the app id is empty or something
+// fails during the process, it returns an error.
+func (s *Service) appUsers(appId string) (*AppUsers, error) {
+	if len(appId) == 0 {
+		return nil, fmt.Errorf("app id is required")
+	}
+	tokens, err := s.db.TokensByPrefix(appId + helpers.TokenSeparator)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	users := &AppUsers{Users: []*AppUser{}}
+	for _, token := range tokens {
+		if now.After(token.Expiration) {
+			continue
+		}
+		_, userId, err := helpers.DecodeUserToken(string(token.Token))
+		if err != nil {
+			continue
+		}
+		users.Users = append(users.Users, &AppUser{UserID: userId, Expiration: token.Expiration})
+	}
+	users.Count = int64(len(users.Users))
+	return users, nil
+}
+
+// redactedTokenPart is the text that replaces the random part of the tokens
+// listed to the app admins, which is the secret part of the tokens.
+const redactedTokenPart = "[redacted]"
+
+// appTokens method retrieves a page of the tokens of the app with the provided
+// id, sorted by token, including the expired ones that are not removed yet.
+// The random part of every token is redacted, so the listed tokens can not be
+// used, only the app id and the user id are kept. The page is selected with
+// the provided limit and offset. If the app id is empty or something fails
+// during the process, it returns an error.
+func (s *Service) appTokens(appId string, limit, offset int) ([]*AppToken, error) {
+	if len(appId) == 0 {
+		return nil, fmt.Errorf("app id is required")
+	}
+	tokens, err := s.db.ListTokensByPrefix(appId+helpers.TokenSeparator, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	appTokens := make([]*AppToken, 0, len(tokens))
+	for _, token := range tokens {
+		tokenAppId, userId, err := helpers.DecodeUserToken(string(token.Token))
+		if err != nil {
+			continue
+		}
+		appTokens = append(appTokens, &AppToken{
+			TokenID:    strings.Join([]string{tokenAppId, userId, redactedTokenPart}, helpers.TokenSeparator),
+			UserID:     userId,
+			Expiration: token.Expiration,
+		})
+	}
+	return appTokens, nil
+}
+
+// appData method composes the app data of the provided app stored in the
+// database, including its current users, which are counted from the tokens
+// of the app in the database (0 if it fails), and its token requests limit.
+func (s *Service) appData(appId string, dbApp *db.App) AppData {
+	allowLink := dbApp.Enabled(db.FeatureLinkInResponse)
+	// the apps created before the token requests limit use the default one
+	maxTokenRequests, tokenRequestsWindow := tokenRequestsLimit(dbApp)
 	app := AppData{
-		Name:        dbApp.Name,
-		Email:       dbApp.AdminEmail,
-		RedirectURL: dbApp.RedirectURL,
-		Duration:    dbApp.SessionDuration,
-		UsersQuota:  dbApp.UsersQuota,
+		Name:                dbApp.Name,
+		Email:               dbApp.AdminEmail,
+		RedirectURL:         dbApp.RedirectURL,
+		Duration:            dbApp.SessionDuration,
+		UsersQuota:          dbApp.UsersQuota,
+		MaxRefreshes:        dbApp.MaxRefreshes,
+		TokenSize:           dbApp.TokenSize,
+		MaxTokenRequests:    maxTokenRequests,
+		TokenRequestsWindow: uint64(tokenRequestsWindow / time.Second),
+		Notifier:            dbApp.Notifier,
+		// the notifier target is only exposed to the app admin
+		NotifierTarget:         dbApp.NotifierTarget,
+		AllowLinkInResponse:    &allowLink,
+		TokenDelivery:          dbApp.TokenDelivery,
+		AuthMode:               authModeOf(dbApp),
+		AllowedOrigins:         dbApp.AllowedOrigins,
+		AllowedRedirectDomains: dbApp.AllowedRedirectDomains,
+		DeliveryPolicy:         deliveryPolicyOf(dbApp),
+		WebhookURL:             dbApp.WebhookURL,
+		TokenEmailSubject:      dbApp.TokenEmailSubject,
+		AppEmailSubject:        dbApp.AppEmailSubject,
+	}
+	for _, channel := range dbApp.Channels {
+		app.Channels = append(app.Channels, ChannelData{Notifier: channel.Notifier, Target: channel.Target})
 	}
-	// get the number of current tokens for the app, if it fails, it returns 0
 	app.CurrentUsers, _ = s.db.CountTokens(appId)
-	return app, nil
+	return app
 }
 
-// updateAppMetadata method updates the app metadata based on the app id, name,
-// redirectURL, and duration. If the app id is empty, it returns an error. If
-// the duration is non zero an less than the minimum duration, it returns an
-// error. If something fails during the process, it returns an error.
-func (s *Service) updateAppMetadata(appId, name, redirectURL string, duration uint64) error {
+// updateAppMetadata method updates the app metadata based on the app id and
+// the provided app data (name, redirectURL, duration, maximum refreshes, token
+// size, token requests limit and window, notifier, if the magic links are
+// allowed in the responses, the token delivery mode, the auth mode, the
+// delivery policy, the webhook url, the custom email subjects, and the allowed
+// origins, redirect domains and channels, which are replaced if they are
+// provided, even if empty). Only the non empty fields are updated. The name is
+// sanitized and the redirectURL is normalized like when the app is created. If
+// the app id is empty or the sanitized name is empty, it returns an error. If
+// the duration is non zero an less than the minimum duration, the token size
+// or the token requests limit are out of range, the notifier or any channel is
+// not registered, the token delivery mode, the auth mode or the delivery
+// policy are unknown or the redirectURL, the webhook url or the custom email
+// subjects are invalid, it returns an error. If something fails during the
+// process, it returns an error.
+func (s *Service) updateAppMetadata(appId string, data *AppData) error {
 	// check if the app id is not empty
 	if len(appId) == 0 {
 		return fmt.Errorf("app id is required")
 	}
+	// check if the name is valid once sanitized
+	name := sanitizeAppName(data.Name, s.maxAppNameLength())
+	if data.Name != "" && name == "" {
+		return errInvalidAppName
+	}
 	// check if the duration is valid
-	if duration != 0 && duration < helpers.MinTokenDuration {
-		return fmt.Errorf("duration must be at least %d seconds", helpers.MinTokenDuration)
+	if data.Duration != 0 && data.Duration < helpers.MinTokenDuration {
+		return fmt.Errorf("%w: it must be at least %d seconds", errInvalidDuration, helpers.MinTokenDuration)
+	}
+	if data.Duration > helpers.MaxTokenDuration {
+		return fmt.Errorf("%w: it must be at most %d seconds", errInvalidDuration, helpers.MaxTokenDuration)
+	}
+	// check if the maximum number of refreshes is valid
+	if data.MaxRefreshes < 0 || data.MaxRefreshes > helpers.MaxRefreshesLimit {
+		return fmt.Errorf("%w: it must be between 1 and %d", errInvalidMaxRefreshes, helpers.MaxRefreshesLimit)
+	}
+	// check if the token size is valid
+	if data.TokenSize != 0 && (data.TokenSize < helpers.TokenSize || data.TokenSize > helpers.MaxTokenSize) {
+		return fmt.Errorf("%w: it must be between %d and %d bytes", errInvalidTokenSize, helpers.TokenSize, helpers.MaxTokenSize)
+	}
+	// check if the token requests limit is valid
+	if err := validTokenRequestsLimit(data.MaxTokenRequests, data.TokenRequestsWindow); err != nil {
+		return err
+	}
+	// check if the token delivery mode is valid
+	if !validTokenDelivery(data.TokenDelivery) {
+		return errInvalidTokenDelivery
+	}
+	// check if the auth mode is valid
+	if !validAuthMode(data.AuthMode) {
+		return errInvalidAuthMode
+	}
+	// check if the delivery policy is valid
+	if !validDeliveryPolicy(data.DeliveryPolicy) {
+		return errInvalidDeliveryPolicy
+	}
+	// check if the webhook url is valid
+	if !validWebhookURL(data.WebhookURL) {
+		return errInvalidWebhookURL
+	}
+	// check if the custom email subjects are valid
+	if err := validEmailSubjects(data.TokenEmailSubject, data.AppEmailSubject); err != nil {
+		return err
+	}
+	// check if the notifier and the channels are registered
+	if data.Notifier != "" {
+		if _, err := s.notifier(data.Notifier); err != nil {
+			return err
+		}
+	}
+	channels, err := s.appChannels(data.Channels)
+	if err != nil {
+		return err
 	}
 	// get app from the database
 	app, err := s.db.AppById(appId)
@@ -95,18 +417,396 @@ func (s *Service) updateAppMetadata(appId, name, redirectURL string, duration ui
 	if name != "" {
 		app.Name = name
 	}
-	if redirectURL != "" {
-		app.RedirectURL = redirectURL
+	if data.RedirectURL != "" {
+		if app.RedirectURL, err = normalizeAppRedirectURL(data.RedirectURL); err != nil {
+			return err
+		}
+	}
+	if data.Duration != 0 {
+		app.SessionDuration = data.Duration
+	}
+	if data.MaxRefreshes != 0 {
+		app.MaxRefreshes = data.MaxRefreshes
+	}
+	if data.TokenSize != 0 {
+		app.TokenSize = data.TokenSize
+	}
+	if data.MaxTokenRequests != 0 {
+		app.MaxTokenRequests = data.MaxTokenRequests
 	}
-	if duration != 0 {
-		app.SessionDuration = duration
+	if data.TokenRequestsWindow != 0 {
+		app.TokenRequestsWindow = data.TokenRequestsWindow
+	}
+	if data.Notifier != "" {
+		app.Notifier = data.Notifier
+	}
+	if data.NotifierTarget != "" {
+		app.NotifierTarget = data.NotifierTarget
+	}
+	if data.AllowLinkInResponse != nil {
+		app.SetFeature(db.FeatureLinkInResponse, *data.AllowLinkInResponse)
+	}
+	if data.TokenDelivery != "" {
+		app.TokenDelivery = data.TokenDelivery
+	}
+	if data.AuthMode != "" {
+		app.AuthMode = data.AuthMode
+	}
+	if data.DeliveryPolicy != "" {
+		app.DeliveryPolicy = data.DeliveryPolicy
+	}
+	if data.WebhookURL != "" {
+		app.WebhookURL = data.WebhookURL
+	}
+	if data.TokenEmailSubject != "" {
+		app.TokenEmailSubject = data.TokenEmailSubject
+	}
+	if data.AppEmailSubject != "" {
+		app.AppEmailSubject = data.AppEmailSubject
+	}
+	if data.Channels != nil {
+		app.Channels = channels
+	}
+	if data.AllowedOrigins != nil {
+		if app.AllowedOrigins, err = normalizeOrigins(data.AllowedOrigins); err != nil {
+			return err
+		}
+	}
+	if data.AllowedRedirectDomains != nil {
+		if app.AllowedRedirectDomains, err = normalizeRedirectDomains(data.AllowedRedirectDomains); err != nil {
+			return err
+		}
 	}
 	// store app in the database
 	return s.db.SetApp(appId, app)
 }
 
+// normalizeAppRedirectURL function normalizes the provided redirect URL of an
+// app like normalizeRedirectURL, but it also rejects the URLs that include
+// credentials, which would be sent in every magic link of the app. It returns
+// an error that wraps errInvalidRedirectURL if the URL is not valid.
+func normalizeAppRedirectURL(rawURL string) (string, error) {
+	redirectURL, err := normalizeRedirectURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	// the normalized URL is always parseable
+	if parsed, _ := url.Parse(redirectURL); parsed.User != nil {
+		return "", fmt.Errorf("%w: credentials not allowed", errInvalidRedirectURL)
+	}
+	return redirectURL, nil
+}
+
+// redirectURLUpdate method checks if the redirect URL of the app with the
+// provided id, once it has been updated, differs from the provided previous
+// one. If so, it counts the outstanding tokens of the app, whose magic links
+// point to the previous redirect URL, except the provided admin token used to
+// update the app, and revokes them if requested. It returns the result of the
+// update or an error if something fails during the process.
+func (s *Service) redirectURLUpdate(appId, prevURL, adminToken string, revoke bool) (*AppUpdate, error) {
+	app, err := s.db.AppById(appId)
+	if err != nil {
+		return nil, err
+	}
+	update := &AppUpdate{}
+	if app.RedirectURL == prevURL {
+		return update, nil
+	}
+	update.RedirectURLChanged, update.TokensRevoked = true, revoke
+	tokens, err := s.db.TokensByPrefix(appId)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		if string(token.Token) == adminToken {
+			continue
+		}
+		update.AffectedTokens++
+		if !revoke {
+			continue
+		}
+		if err := s.deleteToken(string(token.Token), db.DeleteReasonRevoked); err != nil && err != db.ErrTokenNotFound {
+			return nil, err
+		}
+	}
+	return update, nil
+}
+
+// errInvalidTokenDelivery error is returned when the token delivery mode of
+// an app is not one of the TokenDelivery modes.
+var errInvalidTokenDelivery = fmt.Errorf("invalid token delivery, it must be %q, %q or %q",
+	TokenDeliveryBody, TokenDeliveryHeader, TokenDeliveryBoth)
+
+// validTokenDelivery function returns if the provided token delivery mode is
+// one of the TokenDelivery modes or empty, to use the default one.
+func validTokenDelivery(mode string) bool {
+	switch mode {
+	case "", TokenDeliveryBody, TokenDeliveryHeader, TokenDeliveryBoth:
+		return true
+	}
+	return false
+}
+
+// errInvalidDuration error is returned when the session duration of an app or
+// a token is out of range.
+var errInvalidDuration = fmt.Errorf("invalid session duration")
+
+// errInvalidUsersQuota error is returned when the users quota of an app is
+// out of range.
+var errInvalidUsersQuota = fmt.Errorf("invalid users quota")
+
+// errInvalidMaxRefreshes error is returned when the maximum number of
+// refreshes of the tokens of an app is out of range.
+var errInvalidMaxRefreshes = fmt.Errorf("invalid max refreshes")
+
+// errInvalidTokenSize error is returned when the size of the tokens of an app
+// is out of range.
+var errInvalidTokenSize = fmt.Errorf("invalid token size")
+
+// errInvalidTokenRequestsLimit error is returned when the maximum number of
+// token requests of an app or its window are out of range.
+var errInvalidTokenRequestsLimit = fmt.Errorf("invalid token requests limit")
+
+// validTokenRequestsLimit function checks that the provided maximum number of
+// token requests and window (in seconds) are in range or zero, to use the
+// default ones. It returns errInvalidTokenRequestsLimit if any of them is out
+// of range.
+func validTokenRequestsLimit(maxRequests int64, window uint64) error {
+	if maxRequests < 0 || maxRequests > helpers.MaxTokenRequestsLimit {
+		return fmt.Errorf("%w: max token requests must be between 1 and %d",
+			errInvalidTokenRequestsLimit, helpers.MaxTokenRequestsLimit)
+	}
+	if window != 0 && (window < helpers.MinTokenRequestsWindow || window > helpers.MaxTokenRequestsWindow) {
+		return fmt.Errorf("%w: token requests window must be between %d and %d seconds",
+			errInvalidTokenRequestsLimit, helpers.MinTokenRequestsWindow, helpers.MaxTokenRequestsWindow)
+	}
+	return nil
+}
+
+// errInvalidAuthMode error is returned when the auth mode of an app is not
+// one of the AuthMode modes.
+var errInvalidAuthMode = fmt.Errorf("invalid auth mode, it must be %q, %q or %q",
+	AuthModeLink, AuthModeCode, AuthModeBoth)
+
+// validAuthMode function returns if the provided auth mode is one of the
+// AuthMode modes or empty, to use the default one.
+func validAuthMode(mode string) bool {
+	switch mode {
+	case "", AuthModeLink, AuthModeCode, AuthModeBoth:
+		return true
+	}
+	return false
+}
+
+// errInvalidDeliveryPolicy error is returned when the delivery policy of an
+// app is not one of the DeliveryPolicy policies.
+var errInvalidDeliveryPolicy = fmt.Errorf("invalid delivery policy, it must be %q or %q",
+	DeliveryPolicyAny, DeliveryPolicyAll)
+
+// errInvalidChannel error is returned when an additional channel of an app
+// has no notifier, repeats other channel or the app has too many channels.
+var errInvalidChannel = fmt.Errorf("invalid channel")
+
+// validDeliveryPolicy function returns if the provided delivery policy is one
+// of the DeliveryPolicy policies or empty, to use the default one.
+func validDeliveryPolicy(policy string) bool {
+	switch policy {
+	case "", DeliveryPolicyAny, DeliveryPolicyAll:
+		return true
+	}
+	return false
+}
+
+// deliveryPolicyOf function returns the delivery policy of the provided app,
+// the default one (DeliveryPolicyAny) if the app has none, like the apps
+// created before the delivery policies.
+func deliveryPolicyOf(app *db.App) string {
+	if app.DeliveryPolicy == "" {
+		return DeliveryPolicyAny
+	}
+	return app.DeliveryPolicy
+}
+
+// errInvalidWebhookURL error is returned when the webhook url of an app is
+// not an absolute http(s) url.
+var errInvalidWebhookURL = fmt.Errorf("invalid webhook url, it must be an absolute http(s) url")
+
+// validWebhookURL function returns if the provided webhook url is an absolute
+// http(s) url or empty, to not use a webhook.
+func validWebhookURL(rawURL string) bool {
+	if rawURL == "" {
+		return true
+	}
+	webhookURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return (webhookURL.Scheme == "http" || webhookURL.Scheme == "https") && webhookURL.Host != ""
+}
+
+// appChannels method validates the provided additional channels of an app
+// and converts them into the channels stored in the database. It returns
+// errInvalidChannel if there are more than helpers.MaxAppChannels channels, a
+// channel has no notifier or it is repeated, and an error if a notifier is
+// not registered.
+func (s *Service) appChannels(data []ChannelData) ([]db.Channel, error) {
+	if len(data) > helpers.MaxAppChannels {
+		return nil, fmt.Errorf("%w: at most %d channels are allowed", errInvalidChannel, helpers.MaxAppChannels)
+	}
+	channels := make([]db.Channel, 0, len(data))
+	seen := map[ChannelData]bool{}
+	for _, channel := range data {
+		if channel.Notifier == "" {
+			return nil, fmt.Errorf("%w: notifier is required", errInvalidChannel)
+		}
+		if seen[channel] {
+			return nil, fmt.Errorf("%w: repeated channel %q", errInvalidChannel, channel.Notifier)
+		}
+		seen[channel] = true
+		if _, err := s.notifier(channel.Notifier); err != nil {
+			return nil, err
+		}
+		channels = append(channels, db.Channel{Notifier: channel.Notifier, Target: channel.Target})
+	}
+	return channels, nil
+}
+
+// authModeOf function returns the auth mode of the provided app, the default
+// one (AuthModeLink) if the app has none, like the apps created before the
+// auth modes.
+func authModeOf(app *db.App) string {
+	if app.AuthMode == "" {
+		return AuthModeLink
+	}
+	return app.AuthMode
+}
+
+// errInvalidEmailSubject error is returned when a custom email subject of an
+// app is not a valid template, it is too long or it renders control
+// characters, like line breaks.
+var errInvalidEmailSubject = fmt.Errorf("invalid email subject")
+
+// emailSubjectData struct includes the data available in the custom email
+// subjects of the apps.
+type emailSubjectData struct {
+	AppName string
+}
+
+// renderEmailSubject function renders the provided custom email subject
+// template with the provided app name (for example, "Log in to
+// {{.AppName}}"). If the template is empty, it returns the default subject,
+// composed with the provided format and the app name. It returns an error
+// that wraps errInvalidEmailSubject if the template is longer than
+// helpers.MaxEmailSubjectLength characters, it can not be parsed or rendered,
+// or the result is empty or includes control characters.
+func renderEmailSubject(tmpl, defaultFormat, appName string) (string, error) {
+	if tmpl == "" {
+		return fmt.Sprintf(defaultFormat, appName), nil
+	}
+	if len([]rune(tmpl)) > helpers.MaxEmailSubjectLength {
+		return "", fmt.Errorf("%w: at most %d characters are allowed", errInvalidEmailSubject, helpers.MaxEmailSubjectLength)
+	}
+	parsed, err := template.New("subject").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidEmailSubject, err)
+	}
+	var subject strings.Builder
+	if err := parsed.Execute(&subject, &emailSubjectData{AppName: appName}); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidEmailSubject, err)
+	}
+	if strings.TrimSpace(subject.String()) == "" || strings.ContainsFunc(subject.String(), unicode.IsControl) {
+		return "", fmt.Errorf("%w: it must not be empty nor include control characters", errInvalidEmailSubject)
+	}
+	return subject.String(), nil
+}
+
+// validEmailSubjects function checks that the provided custom email subject
+// templates can be rendered (see renderEmailSubject). The empty ones are
+// valid, to use the default subjects. It returns an error that wraps
+// errInvalidEmailSubject if any of them is invalid.
+func validEmailSubjects(templates ...string) error {
+	for _, tmpl := range templates {
+		if _, err := renderEmailSubject(tmpl, "%s", "app"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errInvalidOrigin error is returned when an allowed origin is not a valid
+// http(s) origin.
+var errInvalidOrigin = fmt.Errorf("invalid origin")
+
+// normalizeOrigins function normalizes the provided CORS origins to their
+// lowercase "scheme://host[:port]" form, removing the duplicates. Every origin
+// must be an absolute http(s) URL without path, query or credentials, else it
+// returns an error that wraps errInvalidOrigin.
+func normalizeOrigins(rawOrigins []string) ([]string, error) {
+	origins := []string{}
+	seen := map[string]bool{}
+	for _, rawOrigin := range rawOrigins {
+		origin, err := url.Parse(strings.TrimSpace(rawOrigin))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidOrigin, err)
+		}
+		scheme := strings.ToLower(origin.Scheme)
+		if (scheme != "http" && scheme != "https") || origin.Host == "" || origin.User != nil ||
+			strings.TrimSuffix(origin.Path, "/") != "" || origin.RawQuery != "" || origin.Fragment != "" {
+			return nil, fmt.Errorf("%w: '%s'", errInvalidOrigin, rawOrigin)
+		}
+		normalized := scheme + "://" + strings.ToLower(origin.Host)
+		if !seen[normalized] {
+			seen[normalized] = true
+			origins = append(origins, normalized)
+		}
+	}
+	return origins, nil
+}
+
+// errInvalidRedirectDomain error is returned when an allowed redirect domain
+// is not a valid host name. It wraps errInvalidRedirectURL.
+var errInvalidRedirectDomain = fmt.Errorf("%w: invalid domain", errInvalidRedirectURL)
+
+// normalizeRedirectDomains function normalizes the provided redirect domains
+// to lowercase, removing the duplicates. Every domain must be a host name,
+// without scheme, port, path or credentials, else it returns an error that
+// wraps errInvalidRedirectDomain.
+func normalizeRedirectDomains(rawDomains []string) ([]string, error) {
+	domains := []string{}
+	seen := map[string]bool{}
+	for _, rawDomain := range rawDomains {
+		domain := strings.ToLower(strings.TrimSpace(rawDomain))
+		parsed, err := url.Parse("https://" + domain)
+		if err != nil || domain == "" || parsed.Host != domain || parsed.Hostname() != domain ||
+			parsed.User != nil || parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+			return nil, fmt.Errorf("%w: '%s'", errInvalidRedirectDomain, rawDomain)
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// appConfig method composes the integration config of the app with the
+// provided id, which includes the app id, the API endpoint of the service and
+// an example of the client code.
+func (s *Service) appConfig(appId string) *AppConfig {
+	endpoint := s.cfg.APIEndpoint
+	if endpoint == "" {
+		endpoint = helpers.DefaultAPIEndpoint
+	}
+	return &AppConfig{
+		AppID:       appId,
+		APIEndpoint: endpoint,
+		Example:     fmt.Sprintf(clientExampleSnippet, endpoint),
+	}
+}
+
 // removeApp method removes an app based on the app id. If the app id is empty,
-// it returns an error. If something fails during the process, it returns an
+// it returns an error. If the app does not exist, it returns
+// db.ErrAppNotFound. If something fails during the process, it returns an
 // error. It also removes all the tokens for the app from the database using
 // the app id as the prefix to find them.
 func (s *Service) removeApp(appId string) error {
@@ -114,42 +814,118 @@ func (s *Service) removeApp(appId string) error {
 	if len(appId) == 0 {
 		return fmt.Errorf("app id is required")
 	}
+	// check if the app exists, the drivers do not fail deleting missing apps
+	if _, err := s.db.AppById(appId); err != nil {
+		return err
+	}
 	// remove all the tokens for the app from the database, using the app id as
 	// the prefix
-	if err := s.db.DeleteTokensByPrefix(appId); err != nil {
+	if err := s.deleteTokensByPrefix(appId, db.DeleteReasonAppDeleted); err != nil {
 		return err
 	}
 	// remove app from the database
 	return s.db.DeleteApp(appId)
 }
 
-func (s *Service) validSecret(appId, rawSecret string) bool {
-	secret, err := helpers.Hash(rawSecret, helpers.SecretSize)
+// rotateAppSecret method issues a new secret for the app with the provided
+// id, keeping the provided raw secret, the current one, valid during the
+// configured grace period (24h by default), to allow to replace it without
+// downtime. It returns the new secret and the expiration of the current one,
+// or an error if something fails during the process.
+func (s *Service) rotateAppSecret(appId, currentSecret string) (string, time.Time, error) {
+	if len(appId) == 0 || len(currentSecret) == 0 {
+		return "", time.Time{}, fmt.Errorf("app id and current secret are required")
+	}
+	hCurrentSecret, err := helpers.Hash(currentSecret, helpers.SecretSize)
 	if err != nil {
-		return false
+		return "", time.Time{}, err
 	}
-	valid, err := s.db.ValidSecret(secret, appId)
+	secret, hSecret, err := appSecret()
 	if err != nil {
-		return false
+		return "", time.Time{}, err
+	}
+	// store the new secret before expiring the current one, so the app has
+	// always a valid secret
+	if err := s.db.SetSecret(hSecret, appId, time.Time{}); err != nil {
+		return "", time.Time{}, err
 	}
-	return valid
+	// the current secret is not extended if it already expires before, for
+	// example, if it was already rotated
+	expiration, err := s.db.ExpireSecret(hCurrentSecret, appId, time.Now().Add(s.secretGracePeriod()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return secret, expiration, nil
+}
+
+// newAppSecret method issues a new secret for the app with the provided id,
+// without expiring the current ones (see expireAppSecrets). It returns the
+// new secret and its hash, or an error if the app is not found or something
+// fails during the process.
+func (s *Service) newAppSecret(appId string) (string, string, error) {
+	if len(appId) == 0 {
+		return "", "", fmt.Errorf("app id is required")
+	}
+	secret, hSecret, err := appSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.db.SetSecret(hSecret, appId, time.Time{}); err != nil {
+		return "", "", err
+	}
+	return secret, hSecret, nil
+}
+
+// expireAppSecrets method expires every secret of the app with the provided
+// id except the provided hashed one, after the configured grace period (24h
+// by default), so the rest of the secrets can be replaced by it without
+// downtime. It returns the expiration of the secrets, or an error if
+// something fails during the process.
+func (s *Service) expireAppSecrets(appId, hKeepSecret string) (time.Time, error) {
+	if len(appId) == 0 || len(hKeepSecret) == 0 {
+		return time.Time{}, fmt.Errorf("app id and secret to keep are required")
+	}
+	expiration := time.Now().Add(s.secretGracePeriod())
+	if err := s.db.ExpireSecrets(appId, hKeepSecret, expiration); err != nil {
+		return time.Time{}, err
+	}
+	return expiration, nil
+}
+
+// appBySecret method returns the id and the app that owns the provided raw
+// secret. It returns an error if the secret is empty, the app is not found or
+// something fails during the process.
+func (s *Service) appBySecret(rawSecret string) (string, *db.App, error) {
+	if len(rawSecret) == 0 {
+		return "", nil, fmt.Errorf("secret is required")
+	}
+	secret, err := helpers.Hash(rawSecret, helpers.SecretSize)
+	if err != nil {
+		return "", nil, err
+	}
+	app, appId, err := s.db.AppBySecret(secret)
+	return appId, app, err
 }
 
 // generateApp function generates an app based on the email. It returns the app
 // id, the app secret and the hashed secret. If the email is empty or something
 // fails during the process, it returns an error. The app id is generated
-// hashing the email with a length of 4 bytes. The app secret is generated
-// using the appSecret function.
-func generateApp(email string) (string, string, string, error) {
+// hashing the email with the provided algorithm and a length of 4 bytes, like
+// the user ids, so it starts with the user id of the admin. The app secret is
+// generated using the appSecret function.
+func generateApp(alg helpers.HashAlgorithm, email string) (string, string, string, error) {
 	if len(email) == 0 {
 		return "", "", "", fmt.Errorf("email is required")
 	}
 	// hash email
-	hEmail, err := helpers.Hash(email, helpers.EmailHashSize)
+	hEmail, err := alg.Hash(email, helpers.EmailHashSize)
+	if err != nil {
+		return "", "", "", err
+	}
+	bAppNonce, err := helpers.RandBytes(helpers.AppNonceSize)
 	if err != nil {
 		return "", "", "", err
 	}
-	bAppNonce := helpers.RandBytes(helpers.AppNonceSize)
 	hAppNonce := hex.EncodeToString(bAppNonce)
 	appId := hEmail + hAppNonce
 	// generate secret
@@ -166,7 +942,10 @@ func generateApp(email string) (string, string, string, error) {
 // secret is required to store the secret in the database without exposing it.
 func appSecret() (string, string, error) {
 	// generate secret
-	bSecret := helpers.RandBytes(helpers.SecretSize)
+	bSecret, err := helpers.RandBytes(helpers.SecretSize)
+	if err != nil {
+		return "", "", err
+	}
 	secret := hex.EncodeToString(bSecret)
 	// hash secret
 	hSecret, err := helpers.Hash(secret, helpers.SecretSize)
@@ -175,3 +954,31 @@ func appSecret() (string, string, error) {
 	}
 	return secret, hSecret, nil
 }
+
+// errInvalidAppName error is returned when nothing is left of an app name
+// once it is sanitized.
+var errInvalidAppName = fmt.Errorf("invalid app name")
+
+// sanitizeAppName function sanitizes the provided app name to be used in the
+// subjects and the content of the emails. The invalid UTF-8 sequences and the
+// control characters are removed (the line breaks and tabs are replaced by a
+// space), the consecutive spaces are collapsed and the name is trimmed and
+// truncated to the provided maximum number of characters. It returns an empty
+// string if nothing is left.
+func sanitizeAppName(name string, maxLength int) string {
+	name = strings.ToValidUTF8(name, "")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if runes := []rune(name); len(runes) > maxLength {
+		name = strings.TrimSpace(string(runes[:maxLength]))
+	}
+	return name
+}
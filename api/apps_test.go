@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/simpleauthlink/authapi/helpers"
+	"github.com/simpleauthlink/authapi/notify"
+)
+
+func TestAuthAppDefaultRedirectURL(t *testing.T) {
+	defaultURL := "https://simpleauth.link/default"
+	srv := newTestService(t, &Config{DefaultRedirectURL: defaultURL})
+	// without redirect URL, the default one is used
+	appId, _, err := srv.authApp(&AppData{
+		Name:     "test app",
+		Email:    "admin@simpleauth.link",
+		Duration: helpers.MinTokenDuration,
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app, _ := srv.appMetadata(appId); app.RedirectURL != defaultURL {
+		t.Errorf("expected %s, got %s", defaultURL, app.RedirectURL)
+	}
+	// an explicit redirect URL overrides the default one
+	customURL := "https://simpleauth.link/custom"
+	appId, _ = createTestApp(t, srv, &AppData{RedirectURL: customURL})
+	if app, _ := srv.appMetadata(appId); app.RedirectURL != customURL {
+		t.Errorf("expected %s, got %s", customURL, app.RedirectURL)
+	}
+	// without default redirect URL, it is required
+	srv = newTestService(t, nil)
+	if _, _, err := srv.authApp(&AppData{
+		Name:     "test app",
+		Email:    "admin@simpleauth.link",
+		Duration: helpers.MinTokenDuration,
+	}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestCreateApp(t *testing.T) {
+	srv := newTestService(t, nil)
+	appId, secret, err := srv.CreateApp(&AppData{
+		Name:        "local app",
+		Email:       "admin@simpleauth.link",
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the app and its secret are persisted, without sending any email
+	if app, err := srv.appMetadata(appId); err != nil || app.Name != "local app" {
+		t.Errorf("expected app, got %+v and %v", app, err)
+	}
+	if gotId, _, err := srv.appBySecret(secret); err != nil || gotId != appId {
+		t.Errorf("expected %s, got %s and %v", appId, gotId, err)
+	}
+	if e := srv.emailQueue.Pop(); e != nil {
+		t.Errorf("expected no email, got %s", e.Subject)
+	}
+	// the app data is validated
+	if _, _, err := srv.CreateApp(&AppData{Name: "local app", Email: "admin@simpleauth.link"}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestAuthAppUsersQuota(t *testing.T) {
+	srv := newTestService(t, nil)
+	// without users quota, the default one is used
+	appId, _ := createTestApp(t, srv, nil)
+	if app, _ := srv.appMetadata(appId); app.UsersQuota != helpers.DefaultUsersQuota {
+		t.Errorf("expected %d, got %d", helpers.DefaultUsersQuota, app.UsersQuota)
+	}
+	// the users quota must be between 1 and the maximum
+	for _, quota := range []int64{-1, helpers.MaxUsersQuota + 1} {
+		if _, _, err := srv.authApp(&AppData{
+			Name:        "test app",
+			Email:       "admin@simpleauth.link",
+			RedirectURL: "https://simpleauth.link/callback",
+			Duration:    helpers.MinTokenDuration,
+			UsersQuota:  quota,
+		}); err == nil {
+			t.Errorf("expected error for quota %d, got nil", quota)
+		}
+	}
+	// a custom users quota limits the tokens of the app
+	appId, _ = createTestApp(t, srv, &AppData{Email: "custom@simpleauth.link", UsersQuota: 2})
+	app, err := srv.db.AppById(appId)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app.UsersQuota != 2 {
+		t.Fatalf("expected 2, got %d", app.UsersQuota)
+	}
+	for i := 0; i < 2; i++ {
+		req := &TokenRequest{Email: fmt.Sprintf("user%d@simpleauth.link", i)}
+		if _, _, err := srv.magicLink(context.Background(), appId, app, req); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	req := &TokenRequest{Email: "user2@simpleauth.link"}
+	if _, _, err := srv.magicLink(context.Background(), appId, app, req); err == nil || err.Error() != "users quota reached" {
+		t.Errorf("expected users quota reached error, got %v", err)
+	}
+}
+
+func TestAuthAppHashAlgorithm(t *testing.T) {
+	email := "admin@simpleauth.link"
+	defaultUserId, _ := helpers.Hash(email, helpers.UserIdSize)
+	srv := newTestService(t, &Config{HashAlgorithm: helpers.SHA3_256})
+	userId, err := helpers.SHA3_256.Hash(email, helpers.UserIdSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if userId == defaultUserId {
+		t.Fatalf("expected different ids for different algorithms, got %s", userId)
+	}
+	// the app id and the user ids of the admin and the users are generated
+	// with the configured algorithm
+	appId, secret := createTestApp(t, srv, &AppData{Email: email})
+	if appId[:len(userId)] != userId {
+		t.Errorf("expected app id starting with %s, got %s", userId, appId)
+	}
+	token := adminToken(t, srv, secret)
+	if _, tokenUserId, _ := helpers.DecodeUserToken(token); tokenUserId != userId {
+		t.Errorf("expected user id %s, got %s", userId, tokenUserId)
+	}
+	if !srv.validAdminToken(token, appId) {
+		t.Errorf("expected valid admin token")
+	}
+	// the ids are stable
+	otherToken := adminToken(t, srv, secret)
+	if _, tokenUserId, _ := helpers.DecodeUserToken(otherToken); tokenUserId != userId {
+		t.Errorf("expected user id %s, got %s", userId, tokenUserId)
+	}
+	// the user ids match when the tokens of a user are revoked
+	if err := srv.revokeUserTokens(appId, email); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if srv.validAdminToken(token, appId) || srv.validAdminToken(otherToken, appId) {
+		t.Errorf("expected revoked tokens")
+	}
+	// the algorithm must be supported
+	for _, alg := range []helpers.HashAlgorithm{"", helpers.SHA256, helpers.SHA512, helpers.SHA3_256, helpers.BLAKE2b256} {
+		if !alg.Valid() {
+			t.Errorf("expected %q to be valid", alg)
+		}
+	}
+	if _, err := New(srv.ctx, srv.db, &Config{
+		EmailConfig:   testTemplatesConfig("", ""),
+		HashAlgorithm: "md5",
+	}); err == nil || !strings.Contains(err.Error(), "hash algorithm") {
+		t.Errorf("expected hash algorithm error, got %v", err)
+	}
+}
+
+func TestAuthAppTokenRequestsLimit(t *testing.T) {
+	srv := newTestService(t, nil)
+	// without limit, the default one is used
+	appId, _ := createTestApp(t, srv, nil)
+	app, err := srv.db.AppById(appId)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app.MaxTokenRequests != helpers.DefaultMaxTokenRequests || app.TokenRequestsWindow != helpers.DefaultTokenRequestsWindow {
+		t.Errorf("expected default limit, got %d requests in %d seconds", app.MaxTokenRequests, app.TokenRequestsWindow)
+	}
+	// the limit and the window must be in range
+	for _, data := range []*AppData{
+		{MaxTokenRequests: -1},
+		{MaxTokenRequests: helpers.MaxTokenRequestsLimit + 1},
+		{TokenRequestsWindow: helpers.MinTokenRequestsWindow - 1},
+		{TokenRequestsWindow: helpers.MaxTokenRequestsWindow + 1},
+	} {
+		data.Name = "test app"
+		data.Email = "admin@simpleauth.link"
+		data.RedirectURL = "https://simpleauth.link/callback"
+		data.Duration = helpers.MinTokenDuration
+		if _, _, err := srv.authApp(data); err == nil {
+			t.Errorf("expected error for %d requests in %d seconds, got nil", data.MaxTokenRequests, data.TokenRequestsWindow)
+		}
+		if err := srv.updateAppMetadata(appId, data); err == nil {
+			t.Errorf("expected update error for %d requests in %d seconds, got nil", data.MaxTokenRequests, data.TokenRequestsWindow)
+		}
+	}
+	// the limit is updated and exposed in the app data
+	if err := srv.updateAppMetadata(appId, &AppData{MaxTokenRequests: 3, TokenRequestsWindow: 120}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app, err = srv.db.AppById(appId); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	data := srv.appData(appId, app)
+	if data.MaxTokenRequests != 3 || data.TokenRequestsWindow != 120 {
+		t.Errorf("expected 3 requests in 120 seconds, got %d in %d", data.MaxTokenRequests, data.TokenRequestsWindow)
+	}
+}
+
+func TestAuthAppSanitizeName(t *testing.T) {
+	srv := newTestService(t, &Config{MaxAppNameLength: 16})
+	// the control characters are removed and the name is trimmed
+	appId, _ := createTestApp(t, srv, &AppData{Name: "  test\r\nSubject: x\x00\x1b[31m  "})
+	app, err := srv.db.AppById(appId)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app.Name != "test Subject: x[" {
+		t.Errorf("expected sanitized name, got %q", app.Name)
+	}
+	// the long names are truncated to the configured length
+	if err := srv.updateAppMetadata(appId, &AppData{Name: strings.Repeat("ñ", 100)}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app, _ = srv.db.AppById(appId); app.Name != strings.Repeat("ñ", 16) {
+		t.Errorf("expected truncated name, got %q", app.Name)
+	}
+	// the names with only control characters are rejected
+	if err := srv.updateAppMetadata(appId, &AppData{Name: "\x00\x07 \t"}); !errors.Is(err, errInvalidAppName) {
+		t.Errorf("expected %v, got %v", errInvalidAppName, err)
+	}
+	if _, _, err := srv.authApp(&AppData{
+		Name:        "\x00\n",
+		Email:       "admin@simpleauth.link",
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+	}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	// the subject of the emails is sanitized even if the stored name is not
+	notifier := &emailNotifier{srv: srv}
+	if err := notifier.Notify(context.Background(), "", &notify.Message{
+		AppName:   "test\r\nBcc: other@simpleauth.link",
+		Email:     "user@simpleauth.link",
+		MagicLink: "https://simpleauth.link/callback?token=test",
+		Token:     "test",
+	}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	e := srv.emailQueue.Pop()
+	if e == nil || strings.ContainsAny(e.Subject, "\r\n") || !strings.Contains(e.Subject, "test Bcc: other") {
+		t.Errorf("expected sanitized subject, got %+v", e)
+	}
+}
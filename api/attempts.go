@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+const (
+	// validateAttempts is the action used to compose the keys of the failed
+	// token validation attempts counters.
+	validateAttempts = "validate"
+	// refreshAttempts is the action used to compose the keys of the
+	// consecutive token refreshes counters.
+	refreshAttempts = "refresh"
+	// tokenRequestAttempts is the action used to compose the keys of the
+	// token requests counters of every window, to limit the magic links sent
+	// to the same email.
+	tokenRequestAttempts = "token_request"
+	// codeAttempts is the action used to compose the keys of the wrong
+	// one-time codes counters of every user.
+	codeAttempts = "code"
+	// quotaWarningAttempts is the action used to compose the keys of the
+	// counters that track if the admin of an app has been warned about its
+	// users quota.
+	quotaWarningAttempts = "quota_warning"
+	// attemptsKeySeparator is the separator of the parts of an attempts key.
+	attemptsKeySeparator = ":"
+	// defaultLockoutDuration is the duration of a lockout when it is not
+	// configured.
+	defaultLockoutDuration = 15 * time.Minute
+)
+
+// ipAttempts and userAttempts are the actions whose counters are keyed by the
+// client ip and by the user id respectively, used to reset them.
+var (
+	ipAttempts   = []string{validateAttempts}
+	userAttempts = []string{codeAttempts}
+)
+
+// attemptsKey function composes the key of an attempts counter for the
+// provided action, app id and subject (for example, the client ip).
+func attemptsKey(action, appId, subject string) string {
+	return strings.Join([]string{action, appId, subject}, attemptsKeySeparator)
+}
+
+// clientIP function returns the ip address of the client that performs the
+// provided request, based on its remote address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lockedOut method checks if the attempts counter of the provided key has
+// reached the maximum number of failed attempts configured. If the lockout is
+// not configured or the counter can not be read, it returns false.
+func (s *Service) lockedOut(ctx context.Context, key string) bool {
+	if s.cfg.MaxFailedAttempts <= 0 {
+		return false
+	}
+	attempts, err := s.db.Attempts(key)
+	if err != nil {
+		s.contextLogger(ctx).Error("error getting attempts", "key", key, "error", err)
+		return false
+	}
+	return attempts >= s.cfg.MaxFailedAttempts
+}
+
+// failedAttempt method increments the attempts counter of the provided key.
+// The counter expires after the configured lockout duration. If the lockout
+// is not configured, it does nothing.
+func (s *Service) failedAttempt(ctx context.Context, key string) {
+	if s.cfg.MaxFailedAttempts <= 0 {
+		return
+	}
+	duration := s.cfg.LockoutDuration
+	if duration <= 0 {
+		duration = defaultLockoutDuration
+	}
+	if _, err := s.db.IncrAttempts(key, duration); err != nil {
+		s.contextLogger(ctx).Error("error incrementing attempts", "key", key, "error", err)
+	}
+}
+
+// tokenRequestsLimit function returns the maximum number of token requests
+// for the same email and the duration of the window of the provided app,
+// using the defaults if the app does not set them.
+func tokenRequestsLimit(app *db.App) (int64, time.Duration) {
+	maxRequests := app.MaxTokenRequests
+	if maxRequests <= 0 {
+		maxRequests = helpers.DefaultMaxTokenRequests
+	}
+	window := app.TokenRequestsWindow
+	if window == 0 {
+		window = helpers.DefaultTokenRequestsWindow
+	}
+	return maxRequests, time.Duration(window) * time.Second
+}
+
+// tokenRequestsKeys function composes the keys of the token requests counters
+// of the provided app id and user id for the window that includes the
+// provided time and the previous one. The windows are aligned to the unix
+// epoch, so every instance of the service uses the same keys. It also returns
+// the time elapsed since the start of the current window.
+func tokenRequestsKeys(appId, userId string, window time.Duration, now time.Time) (string, string, time.Duration) {
+	index := now.UnixNano() / int64(window)
+	elapsed := time.Duration(now.UnixNano() - index*int64(window))
+	key := attemptsKey(tokenRequestAttempts, appId, userId)
+	current := key + attemptsKeySeparator + strconv.FormatInt(index, 10)
+	previous := key + attemptsKeySeparator + strconv.FormatInt(index-1, 10)
+	return current, previous, elapsed
+}
+
+// tokenRequestAllowed method registers a token request of the provided app
+// for the provided email and checks if it is under the token requests limit
+// of the app. The limit is applied over a sliding window, approximated with
+// the counters of the current and the previous windows, weighting the
+// previous one by the part of it that is still inside the sliding window. If
+// the limit is exceeded, it returns false and the time to wait until the
+// next request is allowed. If the counters can not be updated, the request
+// is allowed.
+func (s *Service) tokenRequestAllowed(ctx context.Context, appId string, app *db.App, email string) (bool, time.Duration) {
+	userId, err := s.cfg.HashAlgorithm.Hash(email, helpers.UserIdSize)
+	if err != nil {
+		s.contextLogger(ctx).Error("error hashing email", "app_id", appId, "error", err)
+		return true, 0
+	}
+	maxRequests, window := tokenRequestsLimit(app)
+	currentKey, previousKey, elapsed := tokenRequestsKeys(appId, userId, window, time.Now())
+	// the counters are kept two windows, to be used as the previous one
+	current, err := s.db.IncrAttempts(currentKey, 2*window)
+	if err != nil {
+		s.contextLogger(ctx).Error("error incrementing token requests", "app_id", appId, "error", err)
+		return true, 0
+	}
+	previous, err := s.db.Attempts(previousKey)
+	if err != nil {
+		s.contextLogger(ctx).Error("error getting token requests", "app_id", appId, "error", err)
+		return true, 0
+	}
+	weight := float64(window-elapsed) / float64(window)
+	if float64(previous)*weight+float64(current) <= float64(maxRequests) {
+		return true, 0
+	}
+	// calculate when the next request fits in the sliding window, in the
+	// current window if the requests of the previous one are enough to
+	// release it, otherwise in the next one
+	var wait time.Duration
+	if current < maxRequests {
+		fits := 1 - float64(maxRequests-1-current)/float64(previous)
+		wait = time.Duration(fits*float64(window)) - elapsed
+	} else {
+		fits := 1 - float64(maxRequests-1)/float64(current)
+		wait = window - elapsed + time.Duration(fits*float64(window))
+	}
+	return false, wait
+}
+
+// retryAfter function returns the value of the Retry-After header for the
+// provided duration, in seconds rounded up, at least one.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
+
+// resetAttempts method deletes the attempts counters of the provided app for
+// the client ip and the user email provided, unlocking them. At least one of
+// them is required. It returns an error if both are empty or something fails
+// deleting the counters.
+func (s *Service) resetAttempts(appId string, app *db.App, ip, email string) error {
+	if ip == "" && email == "" {
+		return fmt.Errorf("ip or email are required")
+	}
+	keys := []string{}
+	if ip != "" {
+		for _, action := range ipAttempts {
+			keys = append(keys, attemptsKey(action, appId, ip))
+		}
+	}
+	if email != "" {
+		userId, err := s.cfg.HashAlgorithm.Hash(email, helpers.UserIdSize)
+		if err != nil {
+			return err
+		}
+		for _, action := range userAttempts {
+			keys = append(keys, attemptsKey(action, appId, userId))
+		}
+		// the token requests counters are keyed by window too
+		_, window := tokenRequestsLimit(app)
+		current, previous, _ := tokenRequestsKeys(appId, userId, window, time.Now())
+		keys = append(keys, current, previous)
+	}
+	for _, key := range keys {
+		if err := s.db.ResetAttempts(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// errInvalidCode error is returned when a one-time code does not match the
+// code of the user, or the user has no valid code.
+var errInvalidCode = fmt.Errorf("invalid code")
+
+// usesCodes function returns if the users of the provided app get a one-time
+// code, depending on its auth mode.
+func usesCodes(app *db.App) bool {
+	mode := authModeOf(app)
+	return mode == AuthModeCode || mode == AuthModeBoth
+}
+
+// usesLinks function returns if the users of the provided app get a magic
+// link, depending on its auth mode.
+func usesLinks(app *db.App) bool {
+	mode := authModeOf(app)
+	return mode == AuthModeLink || mode == AuthModeBoth
+}
+
+// generateCode function generates a random numeric one-time code of
+// helpers.CodeDigits digits, using a cryptographically secure random number
+// generator. It returns an error if the random number cannot be generated.
+func generateCode() (string, error) {
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(helpers.CodeDigits), nil)
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", fmt.Errorf("error generating code: %w", err)
+	}
+	return fmt.Sprintf("%0*d", helpers.CodeDigits, n), nil
+}
+
+// hashCode function returns the hash of the provided one-time code, salted
+// with the token it belongs to, to be stored instead of the code.
+func hashCode(token, code string) (string, error) {
+	return helpers.Hash(token+helpers.TokenSeparator+code, 0)
+}
+
+// tokenCode method generates a one-time code for the provided token and
+// stores it hashed with the token, expiring after helpers.CodeDuration. The
+// wrong codes counted for the user are reset, because they belong to the
+// previous code. It returns the code to be sent to the user. If something
+// fails during the process, it returns an error.
+func (s *Service) tokenCode(ctx context.Context, token string) (string, error) {
+	code, err := generateCode()
+	if err != nil {
+		return "", err
+	}
+	hashedCode, err := hashCode(token, code)
+	if err != nil {
+		return "", err
+	}
+	expiration := time.Now().Add(helpers.CodeDuration * time.Second)
+	if err := s.db.SetTokenCode(db.Token(token), hashedCode, expiration); err != nil {
+		return "", err
+	}
+	appId, userId, err := helpers.DecodeUserToken(token)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.ResetAttempts(attemptsKey(codeAttempts, appId, userId)); err != nil {
+		s.contextLogger(ctx).Error("error resetting code attempts", "app_id", appId, "error", err)
+	}
+	return code, nil
+}
+
+// verifyCode method checks the provided one-time code against the code of
+// the token of the user with the provided email in the provided app and, if
+// they match, it returns the token of the user. The codes can be used only
+// once, so the code is deleted when it matches. Every wrong code is counted
+// and, when the user reaches helpers.MaxCodeAttempts, the code is deleted to
+// avoid guessing it. If the code does not match, is expired or the user has
+// no code, it returns errInvalidCode. The provided context identifies the
+// request in the logs. If something fails during the process, it returns an
+// error.
+func (s *Service) verifyCode(ctx context.Context, appId, email, code string) (string, error) {
+	userId, err := s.cfg.HashAlgorithm.Hash(email, helpers.UserIdSize)
+	if err != nil {
+		return "", err
+	}
+	// hold the user lock to avoid using the same code twice and replacing
+	// the token meanwhile
+	tokenPrefix := strings.Join([]string{appId, userId}, helpers.TokenSeparator)
+	unlock := s.userLocks.Lock(tokenPrefix)
+	defer unlock()
+	tokens, err := s.db.TokensByPrefix(tokenPrefix)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	for _, info := range tokens {
+		if !info.Expiration.After(now) {
+			continue
+		}
+		hashedCode, expiration, err := s.db.TokenCode(info.Token)
+		if err != nil || hashedCode == "" || !expiration.After(now) {
+			continue
+		}
+		candidate, err := hashCode(string(info.Token), code)
+		if err != nil {
+			return "", err
+		}
+		if !db.EqualSecrets(hashedCode, candidate) {
+			continue
+		}
+		// the code matches, delete it and the wrong attempts
+		if err := s.db.SetTokenCode(info.Token, "", time.Time{}); err != nil {
+			return "", err
+		}
+		if err := s.db.ResetAttempts(attemptsKey(codeAttempts, appId, userId)); err != nil {
+			s.contextLogger(ctx).Error("error resetting code attempts", "app_id", appId, "error", err)
+		}
+		return string(info.Token), nil
+	}
+	// count the wrong code and invalidate the codes of the user when the
+	// maximum is reached
+	attempts, err := s.db.IncrAttempts(attemptsKey(codeAttempts, appId, userId), helpers.CodeDuration*time.Second)
+	if err != nil {
+		return "", err
+	}
+	if attempts >= helpers.MaxCodeAttempts {
+		for _, info := range tokens {
+			if err := s.db.SetTokenCode(info.Token, "", time.Time{}); err != nil && !errors.Is(err, db.ErrTokenNotFound) {
+				s.contextLogger(ctx).Error("error deleting code", "app_id", appId, "error", err)
+			}
+		}
+	}
+	return "", errInvalidCode
+}
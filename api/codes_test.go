@@ -0,0 +1,161 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+	"github.com/simpleauthlink/authapi/notify"
+)
+
+// verifyCode function performs a code verification request to the verify
+// code handler with the provided secret, email and code and returns the
+// response recorder.
+func verifyCode(srv *Service, secret, email, code string) *httptest.ResponseRecorder {
+	body := `{"email":"` + email + `","code":"` + code + `"}`
+	req := httptest.NewRequest(http.MethodPost, helpers.UserVerifyPath, strings.NewReader(body))
+	req.Header.Set(helpers.AppSecretHeader, secret)
+	res := httptest.NewRecorder()
+	srv.withAppSecret(srv.verifyCodeHandler)(res, req)
+	return res
+}
+
+// wrongCode function returns a code with the expected size that is different
+// from the provided one.
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestVerifyCodeHandler(t *testing.T) {
+	notifier := &fakeNotifier{}
+	srv := newTestService(t, &Config{
+		Notifiers: map[string]notify.Notifier{"fake": notifier},
+	})
+	appId, secret := createTestApp(t, srv, &AppData{
+		Notifier: "fake",
+		AuthMode: AuthModeCode,
+	})
+	email := "user@simpleauth.link"
+	// the user gets the code without the magic link
+	if res := requestToken(srv, secret, `{"email":"`+email+`"}`); res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	msg := notifier.msgs[len(notifier.msgs)-1]
+	if len(msg.Code) != helpers.CodeDigits || msg.MagicLink != "" || msg.Token != "" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	// the email and the code are required
+	if res := verifyCode(srv, secret, email, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, res.Code)
+	}
+	// a wrong code is rejected
+	res := verifyCode(srv, secret, email, wrongCode(msg.Code))
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+	if apiErr := responseError(t, res); apiErr.Code != ErrCodeInvalidCode {
+		t.Errorf("expected %s, got %s", ErrCodeInvalidCode, apiErr.Code)
+	}
+	// the code of a user can not be used by other
+	if res := verifyCode(srv, secret, "other@simpleauth.link", msg.Code); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+	// the correct code is exchanged by a valid token
+	res = verifyCode(srv, secret, email, msg.Code)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	token := res.Body.String()
+	if res := validateToken(srv, secret, token); res.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, res.Code)
+	}
+	if !strings.HasPrefix(token, appId+helpers.TokenSeparator) {
+		t.Errorf("expected a token of the app, got %s", token)
+	}
+	// the code can be used only once
+	if res := verifyCode(srv, secret, email, msg.Code); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+	// an expired code is rejected
+	if res := requestToken(srv, secret, `{"email":"`+email+`"}`); res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	msg = notifier.msgs[len(notifier.msgs)-1]
+	tokens, err := srv.db.TokensByPrefix(token[:strings.LastIndex(token, helpers.TokenSeparator)])
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("expected 1 token, got %d: %v", len(tokens), err)
+	}
+	hashedCode, _, err := srv.db.TokenCode(tokens[0].Token)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := srv.db.SetTokenCode(tokens[0].Token, hashedCode, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if res := verifyCode(srv, secret, email, msg.Code); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+}
+
+func TestVerifyCodeHandlerMaxAttempts(t *testing.T) {
+	notifier := &fakeNotifier{}
+	srv := newTestService(t, &Config{
+		Notifiers: map[string]notify.Notifier{"fake": notifier},
+	})
+	_, secret := createTestApp(t, srv, &AppData{
+		Notifier: "fake",
+		AuthMode: AuthModeBoth,
+	})
+	email := "user@simpleauth.link"
+	if res := requestToken(srv, secret, `{"email":"`+email+`"}`); res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	// the user gets the magic link and the code
+	msg := notifier.msgs[0]
+	if msg.Code == "" || msg.MagicLink == "" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	// the code is deleted when the maximum of wrong codes is reached
+	for i := 0; i < helpers.MaxCodeAttempts; i++ {
+		if res := verifyCode(srv, secret, email, wrongCode(msg.Code)); res.Code != http.StatusUnauthorized {
+			t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+		}
+	}
+	if res := verifyCode(srv, secret, email, msg.Code); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+	// but the magic link is still valid
+	if res := validateToken(srv, secret, msg.Token); res.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, res.Code)
+	}
+}
+
+func TestVerifyCodeHandlerLinkMode(t *testing.T) {
+	srv := newTestService(t, nil)
+	_, secret := createTestApp(t, srv, nil)
+	if res := verifyCode(srv, secret, "user@simpleauth.link", "123456"); res.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, res.Code)
+	}
+	if _, _, err := srv.authApp(&AppData{
+		Name:        "test app",
+		Email:       "admin@simpleauth.link",
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+		AuthMode:    "sms",
+	}); !errors.Is(err, errInvalidAuthMode) {
+		t.Errorf("expected %v, got %v", errInvalidAuthMode, err)
+	}
+	// the apps without auth mode use the magic links
+	app := &db.App{}
+	if !usesLinks(app) || usesCodes(app) {
+		t.Errorf("expected magic links by default")
+	}
+}
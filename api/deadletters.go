@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// deadLetterIdSize is the size of the random ids of the dead letters, in
+// bytes.
+const deadLetterIdSize = 8
+
+// dbDeadLetterStore struct implements the email.DeadLetterStore interface
+// recording the emails that could not be sent in the database of the service.
+type dbDeadLetterStore struct {
+	db db.DB
+}
+
+// StoreDeadLetter method records the provided email in the database as a dead
+// letter with a random id, the error of the last attempt and the current
+// time. It returns an error if something fails during the process.
+func (store *dbDeadLetterStore) StoreDeadLetter(e *email.Email, sendErr error) error {
+	bId, err := helpers.RandBytes(deadLetterIdSize)
+	if err != nil {
+		return err
+	}
+	letter := &db.DeadLetter{
+		ID:       hex.EncodeToString(bId),
+		To:       e.To,
+		Subject:  e.Subject,
+		Body:     e.Body,
+		TextBody: e.TextBody,
+		Priority: int(e.Priority),
+		FailedAt: time.Now(),
+	}
+	if sendErr != nil {
+		letter.Error = sendErr.Error()
+	}
+	return store.db.SetDeadLetter(letter)
+}
+
+// listDeadLetters method retrieves the emails that could not be sent, sorted
+// by the time when they failed and paginated with the provided limit and
+// offset. It is intended for the service admins, so the bodies of the emails
+// are not included to avoid exposing the magic links. If something fails
+// during the process, it returns an error.
+func (s *Service) listDeadLetters(limit, offset int) ([]*AdminDeadLetter, error) {
+	dbLetters, err := s.db.ListDeadLetters(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*AdminDeadLetter, 0, len(dbLetters))
+	for _, letter := range dbLetters {
+		letters = append(letters, &AdminDeadLetter{
+			ID:       letter.ID,
+			To:       letter.To,
+			Subject:  letter.Subject,
+			Error:    letter.Error,
+			FailedAt: letter.FailedAt,
+		})
+	}
+	return letters, nil
+}
+
+// retryDeadLetter method pushes the email of the dead letter with the provided
+// id back to the email queue and deletes the dead letter from the database.
+// If the dead letter is not found, it returns db.ErrDeadLetterNotFound. If
+// the email is rejected by the queue or something fails during the process,
+// it returns an error.
+func (s *Service) retryDeadLetter(id string) error {
+	letter, err := s.db.DeadLetterById(id)
+	if err != nil {
+		return err
+	}
+	if err := s.emailQueue.Push(&email.Email{
+		To:       letter.To,
+		Subject:  letter.Subject,
+		Body:     letter.Body,
+		TextBody: letter.TextBody,
+		Priority: email.EmailPriority(letter.Priority),
+	}); err != nil {
+		return err
+	}
+	return s.db.DeleteDeadLetter(id)
+}
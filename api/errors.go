@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes included in the error responses of the API, that allow the
+// clients to identify the error without parsing the message.
+const (
+	ErrCodeInternal             = "internal_error"
+	ErrCodeInvalidRequest       = "invalid_request"
+	ErrCodeBodyTooLarge         = "body_too_large"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeMissingToken         = "missing_token"
+	ErrCodeInvalidToken         = "invalid_token"
+	ErrCodeInvalidCode          = "invalid_code"
+	ErrCodeInsufficientScope    = "insufficient_scope"
+	ErrCodeMissingAppSecret     = "missing_app_secret"
+	ErrCodeInvalidAppSecret     = "invalid_app_secret"
+	ErrCodeInvalidAdminSecret   = "invalid_admin_secret"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeNotAcceptable        = "not_acceptable"
+	ErrCodeDisallowedDomain     = "disallowed_domain"
+	ErrCodeTooManyAttempts      = "too_many_attempts"
+	ErrCodeTooManyRequests      = "too_many_requests"
+	ErrCodeRefreshLimit         = "refresh_limit_reached"
+	ErrCodeUnavailable          = "unavailable"
+)
+
+// APIError struct represents the JSON body of the error responses of the API,
+// which includes an error code (see the ErrCode constants) and a human
+// readable message.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error method returns the error code and the message of the API error, to
+// allow the clients to use it as an error.
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// writeError method sends an error response to the provided request with the
+// provided status code and a JSON body that includes the provided error code
+// and message. Like http.Error, it is the caller's responsibility to not write
+// anything else to the response after calling it.
+func (s *Service) writeError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	body, err := json.Marshal(&APIError{Code: code, Message: msg})
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling error response", "error", err)
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		s.requestLogger(r).Error("error sending error response", "error", err)
+	}
+}
+
+// Security log levels, the levels of the entries of the security events of
+// the rejected requests (see Config.SecurityLogLevel).
+const (
+	SecurityLogDebug = "debug"
+	SecurityLogInfo  = "info"
+	SecurityLogWarn  = "warn"
+	SecurityLogError = "error"
+)
+
+// validSecurityLogLevel function returns if the provided security log level
+// is one of the supported ones or empty, to use the default one.
+func validSecurityLogLevel(level string) bool {
+	switch level {
+	case "", SecurityLogDebug, SecurityLogInfo, SecurityLogWarn, SecurityLogError:
+		return true
+	}
+	return false
+}
+
+// securityEvent method logs the rejection of the provided request as a
+// security event, at the configured security log level (warn by default).
+// The entry includes the id of the request and of the app, if they are known,
+// the client ip, the method and the path of the request, and the provided
+// status, error code and reason. The query and the headers of the request are
+// never included because they contain the tokens and the secrets.
+func (s *Service) securityEvent(r *http.Request, status int, code, reason string) {
+	fields := []any{
+		"event", "request_rejected",
+		"reason", reason,
+		"code", code,
+		"status", status,
+		"client_ip", clientIP(r),
+		"method", r.Method,
+		"path", r.URL.Path,
+	}
+	l := s.requestLogger(r)
+	switch s.cfg.SecurityLogLevel {
+	case SecurityLogDebug:
+		l.Debug("security event", fields...)
+	case SecurityLogInfo:
+		l.Info("security event", fields...)
+	case SecurityLogError:
+		l.Error("security event", fields...)
+	default:
+		l.Warn("security event", fields...)
+	}
+}
+
+// rejectRequest method logs the rejection of the provided request as a
+// security event (see securityEvent) and sends the error response with the
+// provided status, error code and message, which is also the reason of the
+// event.
+func (s *Service) rejectRequest(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	s.securityEvent(r, status, code, msg)
+	s.writeError(w, r, status, code, msg)
+}
@@ -1,180 +1,760 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/simpleauthlink/authapi/db"
 	"github.com/simpleauthlink/authapi/email"
 	"github.com/simpleauthlink/authapi/helpers"
+	"github.com/simpleauthlink/authapi/metrics"
+	"github.com/simpleauthlink/authapi/notify"
 )
 
-// userTokenHandler method generates a token for the user and sends it via email
-// to the user's email address. The token is generated based on the app id
+// healthHandler method reports the health of the service, checking that the
+// database is available to serve the requests. If the database cannot be
+// reached in healthCheckTimeout, it sends a service unavailable response, so
+// the load balancers can stop routing requests to this instance. Otherwise, it
+// sends an "Ok" response.
+func (s *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := s.db.Ping(ctx); err != nil {
+		s.requestLogger(r).Error("error checking database health", "error", err)
+		s.writeError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, "database not available")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// userTokenHandler method generates a token for the user and sends it to the
+// user using the notifier configured by the app (by default, via email to the
+// user's email address). The token is generated based on the app id
 // and the user's email address. The token is stored in the database with an
-// expiration time. It gets the app secret from the helpers.AppSecretHeader
-// header and the user's email address from the request body. If it success it
-// sends an "Ok" response. If something goes wrong, it sends an internal server
-// error response. If the app secret is missing or the request body is invalid,
-// it sends a bad request response.
+// expiration time. It gets the app from the request context, resolved by the
+// withAppSecret middleware, and the user's email address from the request
+// body. If it success it sends an "Ok" response or, if JSON is requested with
+// the Accept header and the app allows it, the magic link and the token. The
+// apps that allow it can also get the token in the helpers.TokenHeader header
+// of the response, in addition to or instead of the body, depending on their
+// token delivery mode. If something goes wrong, it sends an internal server
+// error response. If the request body is invalid, it sends a bad request
+// response. If the disposable domains are not loaded yet and the email checks
+// are strict, it sends a service unavailable response. If too many tokens
+// have been requested for the email in the token requests window of the app,
+// it sends a too many requests response with the Retry-After header, even if
+// the service is configured with uniform token responses, since it does not
+// depend on the email being accepted. Depending on the auth mode of the app,
+// the user gets the magic link, a one-time code that can be exchanged by the
+// token (see verifyCodeHandler) or both.
+// If the service is configured with uniform token responses, the errors after
+// parsing the request are only logged and an "Ok" response is sent.
 func (s *Service) userTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// read the app token header
-	appSecret := r.Header.Get(helpers.AppSecretHeader)
-	if appSecret == "" {
-		http.Error(w, "missing app token", http.StatusBadRequest)
+	// get the app resolved from the app secret
+	appId, app := appFromContext(r.Context())
+	// parse request
+	req := &TokenRequest{}
+	if !decodeJSON(s, w, r, req, s.cfg.AllowUnknownFields) {
 		return
 	}
-	// read body
-	defer r.Body.Close()
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Println("ERR: error reading request body:", err)
-		http.Error(w, "error reading request body", http.StatusInternalServerError)
+	// check if the template key is valid, the unknown ones fall back to the
+	// default template
+	if req.TemplateKey != "" && !email.ValidTemplateKey(req.TemplateKey) {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid template key")
 		return
 	}
-	// parse request
-	req := &TokenRequest{}
-	if err := json.Unmarshal(body, req); err != nil {
-		log.Println("ERR: error parsing request body:", err)
-		http.Error(w, "error parsing request body", http.StatusBadRequest)
+	// check if the locale is valid, the locales without templates fall back to
+	// the default ones
+	if req.Locale != "" && !email.ValidLocale(req.Locale) {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid locale")
+		return
+	}
+	// check if the email has reached the token requests limit of the app
+	if ok, wait := s.tokenRequestAllowed(r.Context(), appId, app, req.Email); !ok {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		s.rejectRequest(w, r, http.StatusTooManyRequests, ErrCodeTooManyRequests, "too many token requests")
 		return
 	}
 	// check if the email is allowed
-	if !s.emailQueue.Allowed(req.Email) {
-		http.Error(w, "disallowed domain", http.StatusBadRequest)
+	if err := s.emailQueue.CheckAddress(req.Email); err != nil {
+		if err == email.ErrDisposableDomainsNotLoaded {
+			s.tokenRequestError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, "email checks not available yet")
+			return
+		}
+		s.securityEvent(r, http.StatusBadRequest, ErrCodeDisallowedDomain, "disallowed domain")
+		s.tokenRequestError(w, r, http.StatusBadRequest, ErrCodeDisallowedDomain, "disallowed domain")
 		return
 	}
 	// generate token
-	magicLink, token, appName, err := s.magicLink(appSecret, req.Email, req.RedirectURL, req.Duration)
+	magicLink, token, err := s.magicLink(r.Context(), appId, app, req)
 	if err != nil {
-		log.Println("ERR: error generating token:", err)
-		http.Error(w, "error generating token", http.StatusInternalServerError)
+		if errors.Is(err, errInvalidRedirectURL) || errors.Is(err, errInvalidDuration) {
+			s.tokenRequestError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		s.requestLogger(r).Error("error generating token", "error", err)
+		s.tokenRequestError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error generating token")
 		return
 	}
-	// compose and push the email to the queue to be sent, if it fails, delete
-	// the token from the database, log the error and send an error response
-	emailData := email.NewUserEmailData(appName, req.Email, magicLink, token)
-	emailBody, err := email.ParseTemplate(s.cfg.TokenEmailTemplate, emailData)
-	if err != nil {
-		log.Println("ERR: error parsing email template:", err)
-		http.Error(w, "error parsing email template", http.StatusInternalServerError)
-		return
-	}
-	if err := s.emailQueue.Push(&email.Email{
-		To:      req.Email,
-		Subject: fmt.Sprintf(userTokenSubject, appName),
-		Body:    emailBody,
-	}); err != nil {
-		log.Println("ERR: error sending email:", err)
-		if err := s.db.DeleteToken(db.Token(token)); err != nil {
-			log.Println("ERR: error deleting token:", err)
+	// compose the message with the magic link and the token and, if the app
+	// uses them, the one-time code of the token
+	msg := &notify.Message{
+		AppName:  app.Name,
+		Email:    req.Email,
+		Template: req.TemplateKey,
+		Locale:   req.Locale,
+	}
+	if usesLinks(app) {
+		msg.MagicLink, msg.Token = magicLink, token
+	}
+	// render the custom subject of the app, if it has one, the default one is
+	// used if it fails
+	if app.TokenEmailSubject != "" {
+		appName := sanitizeAppName(app.Name, s.maxAppNameLength())
+		if msg.Subject, err = renderEmailSubject(app.TokenEmailSubject, userTokenSubject, appName); err != nil {
+			s.requestLogger(r).Warn("error rendering email subject", "error", err)
 		}
-		http.Error(w, "error sending email", http.StatusInternalServerError)
+	}
+	if usesCodes(app) {
+		if msg.Code, err = s.tokenCode(r.Context(), token); err != nil {
+			s.requestLogger(r).Error("error generating code", "error", err)
+			if err := s.db.DeleteToken(db.Token(token)); err != nil {
+				s.requestLogger(r).Error("error deleting token", "error", err)
+			}
+			s.tokenRequestError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error generating code")
+			return
+		}
+	}
+	// deliver the message using the notifier configured by the app (the
+	// email by default) and its additional channels, if it fails, log the
+	// error and send an error response, deleting the token from the database
+	// only if no channel has delivered it
+	if delivered, err := s.deliver(r.Context(), app, msg); err != nil {
+		s.requestLogger(r).Error("error sending magic link", "error", err)
+		if delivered == 0 {
+			if err := s.db.DeleteToken(db.Token(token)); err != nil {
+				s.requestLogger(r).Error("error deleting token", "error", err)
+			}
+		}
+		s.tokenRequestError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending magic link")
 		return
 	}
-	// send response
-	if _, err := w.Write([]byte("Ok")); err != nil {
-		log.Println("ERR: error sending response:", err)
-		http.Error(w, "error sending response", http.StatusInternalServerError)
+	s.metrics.IncrCounter(metrics.TokensIssued, 1)
+	// send response, including the magic link only if the app allows it to
+	// avoid leaking it by accident, in the header and/or the body, depending
+	// on the token delivery mode of the app
+	res := []byte("Ok")
+	if app.Enabled(db.FeatureLinkInResponse) && app.TokenDelivery != "" && app.TokenDelivery != TokenDeliveryBody {
+		setTokenHeader(w, token)
+	}
+	if app.Enabled(db.FeatureLinkInResponse) && app.TokenDelivery != TokenDeliveryHeader && acceptsJSON(r) {
+		if res, err = json.Marshal(&MagicLinkResponse{MagicLink: magicLink, Token: token}); err != nil {
+			s.requestLogger(r).Error("error marshaling magic link", "error", err)
+			s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling magic link")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Add("Vary", "Accept")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// setTokenHeader function sets the provided token in the helpers.TokenHeader
+// header of the response. The token is escaped as a query value, which keeps
+// the tokens generated by the service unchanged, to prevent any character
+// from breaking the header.
+func setTokenHeader(w http.ResponseWriter, token string) {
+	w.Header().Set(helpers.TokenHeader, url.QueryEscape(token))
+}
+
+// tokenRequestError method sends the error response of a token request. If
+// the service is configured with uniform token responses, it sends the same
+// "Ok" response that a successful request gets, to avoid leaking if the email
+// has been accepted. Otherwise, it sends the provided status code, error code
+// and message.
+func (s *Service) tokenRequestError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	if !s.cfg.UniformTokenResponses {
+		s.writeError(w, r, status, code, msg)
 		return
 	}
+	s.requestLogger(r).Warn("token request rejected", "reason", msg)
+	if _, err := w.Write([]byte("Ok")); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+	}
 }
 
 // validateUserTokenHandler method validates the user token. It gets the token
 // from the helpers.TokenQueryParam query string and checks if it is valid. If
-// the token is valid, it sends a response with the "Ok" message. If the token
-// is invalid, it sends an unauthorized response. If the token is missing, it
-// sends a bad request response.
+// a scope is provided in the helpers.ScopeQueryParam query string, the token
+// must include it to be valid. If the token is valid, it sends a response with
+// the "Ok" message or, if JSON is requested with the Accept header, the app id
+// and the user id of the token, without its random part, its expiration time
+// and the configured issuer (see TokenValidation). If the token is
+// invalid, it sends an unauthorized response. If the token is missing, it
+// sends a bad request response. If the client has reached the maximum number
+// of failed attempts for the app, it sends a too many requests response
+// until the lockout expires. Every response is delayed until the minimum
+// validation delay is reached, to avoid timing side-channels that allow to
+// distinguish real tokens from fake ones.
 func (s *Service) validateUserTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// read the app token header
-	appSecret := r.Header.Get(helpers.AppSecretHeader)
-	if appSecret == "" {
-		http.Error(w, "missing app token", http.StatusBadRequest)
+	defer s.padResponseTime(time.Now())
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// check if the client is locked out of the app due to failed attempts
+	lockKey := attemptsKey(validateAttempts, appId, clientIP(r))
+	if s.lockedOut(r.Context(), lockKey) {
+		s.rejectRequest(w, r, http.StatusTooManyRequests, ErrCodeTooManyAttempts, "too many failed attempts")
 		return
 	}
+	// validate the token
+	if !s.validUserToken(r.Context(), token, appId) {
+		s.failedAttempt(r.Context(), lockKey)
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// check if the token includes the required scope, if any
+	if scope := r.URL.Query().Get(helpers.ScopeQueryParam); scope != "" && !s.tokenHasScope(token, scope) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInsufficientScope, "insufficient token scope")
+		return
+	}
+	s.metrics.IncrCounter(metrics.TokensValidated, 1)
+	res := []byte("Ok")
+	if acceptsJSON(r) {
+		// the token is valid, so it can be decoded, and it is invalid if it
+		// has been deleted meanwhile
+		tokenAppId, userId, _ := helpers.DecodeUserToken(token)
+		expiration, err := s.db.TokenExpiration(db.Token(token))
+		if err != nil {
+			s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+			return
+		}
+		validation := &TokenValidation{
+			Valid:     true,
+			AppID:     tokenAppId,
+			UserID:    userId,
+			ExpiresAt: expiration,
+			Issuer:    s.cfg.Issuer,
+		}
+		if res, err = json.Marshal(validation); err != nil {
+			s.requestLogger(r).Error("error marshaling token validation", "error", err)
+			s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling token validation")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Add("Vary", "Accept")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// refreshUserTokenHandler method refreshes the user token, extending the user
+// session. It gets the token from the helpers.TokenQueryParam query string
+// and, if it is still valid, replaces it by a new one with a fresh expiration,
+// which is sent in the response. If the token is missing, it sends a bad
+// request response. If the token is invalid or expired, it sends an
+// unauthorized response. If the user has reached the maximum consecutive
+// refreshes of the app, it sends a forbidden response, so the user has to
+// request a new token. If the session duration of the app is out of range, it
+// sends a bad request response. The failed attempts count for the lockout of
+// the client like in the token validation.
+func (s *Service) refreshUserTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer s.padResponseTime(time.Now())
+	// get the app resolved from the app secret
+	appId, app := appFromContext(r.Context())
 	// get the token from the query
-	token := r.URL.Query().Get(helpers.TokenQueryParam)
+	token := tokenParam(r)
 	if token == "" {
-		http.Error(w, "missing token", http.StatusBadRequest)
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// check if the client is locked out of the app due to failed attempts
+	lockKey := attemptsKey(validateAttempts, appId, clientIP(r))
+	if s.lockedOut(r.Context(), lockKey) {
+		s.rejectRequest(w, r, http.StatusTooManyRequests, ErrCodeTooManyAttempts, "too many failed attempts")
 		return
 	}
 	// validate the token
-	if !s.validUserToken(token, appSecret) {
-		http.Error(w, "invalid token", http.StatusUnauthorized)
+	if !s.validUserToken(r.Context(), token, appId) {
+		s.failedAttempt(r.Context(), lockKey)
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
 		return
 	}
-	if _, err := w.Write([]byte("Ok")); err != nil {
-		log.Println("ERR: error sending response:", err)
-		http.Error(w, "error sending response", http.StatusInternalServerError)
+	// replace the token by a new one
+	newToken, err := s.refreshUserToken(r.Context(), appId, app, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, errRefreshLimitReached):
+			s.rejectRequest(w, r, http.StatusForbidden, ErrCodeRefreshLimit, err.Error())
+		case errors.Is(err, errInvalidDuration):
+			s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		case errors.Is(err, db.ErrTokenNotFound):
+			// the token was refreshed by a concurrent request
+			s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		default:
+			s.requestLogger(r).Error("error refreshing token", "error", err)
+			s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error refreshing token")
+		}
+		return
+	}
+	// send response
+	if _, err := w.Write([]byte(newToken)); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// verifyCodeHandler method exchanges the one-time code sent to a user by the
+// token of the user. It gets the app from the request context, resolved by the
+// withAppSecret middleware, and the email of the user and the code from the
+// request body. If the code matches, it sends the token in the response and
+// the code can not be used again. If the app does not use one-time codes, it
+// sends a forbidden response. If the email or the code are missing, it sends
+// a bad request response. If the code is wrong or expired, it sends an
+// unauthorized response, and if the client has reached the maximum number of
+// failed attempts for the app, it sends a too many requests response until
+// the lockout expires. Every response is delayed until the minimum validation
+// delay is reached, like the token validations.
+func (s *Service) verifyCodeHandler(w http.ResponseWriter, r *http.Request) {
+	defer s.padResponseTime(time.Now())
+	// get the app resolved from the app secret
+	appId, app := appFromContext(r.Context())
+	// parse request
+	req := &CodeVerificationRequest{}
+	if !decodeJSON(s, w, r, req, s.cfg.AllowUnknownFields) {
+		return
+	}
+	if req.Email == "" || req.Code == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "email and code are required")
+		return
+	}
+	// check if the app uses one-time codes
+	if !usesCodes(app) {
+		s.rejectRequest(w, r, http.StatusForbidden, ErrCodeForbidden, "one-time codes disabled for the app")
+		return
+	}
+	// check if the client is locked out of the app due to failed attempts
+	lockKey := attemptsKey(validateAttempts, appId, clientIP(r))
+	if s.lockedOut(r.Context(), lockKey) {
+		s.rejectRequest(w, r, http.StatusTooManyRequests, ErrCodeTooManyAttempts, "too many failed attempts")
+		return
+	}
+	// exchange the code by the token
+	token, err := s.verifyCode(r.Context(), appId, req.Email, req.Code)
+	if err != nil {
+		if errors.Is(err, errInvalidCode) {
+			s.failedAttempt(r.Context(), lockKey)
+			s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidCode, "invalid code")
+			return
+		}
+		s.requestLogger(r).Error("error verifying code", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error verifying code")
+		return
+	}
+	// send response
+	if _, err := w.Write([]byte(token)); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// tokenParam function returns the token of the helpers.TokenQueryParam query
+// param of the provided request, without the surrounding whitespace that
+// some clients and proxies add, which is never part of a token.
+func tokenParam(r *http.Request) string {
+	return strings.TrimSpace(r.URL.Query().Get(helpers.TokenQueryParam))
+}
+
+// decodeJSON function decodes the JSON body of the provided request into the
+// provided value. The request must not declare other content type than JSON
+// (requests without content type are accepted) and the body can not exceed
+// helpers.MaxRequestBodySize. Unless unknown fields are allowed, the body can
+// not include fields that the value does not define, to avoid ignoring
+// misspelled fields silently. If the body is not valid, it sends the error
+// response and returns false, so the handlers just have to return.
+func decodeJSON[T any](s *Service, w http.ResponseWriter, r *http.Request, v *T, allowUnknownFields bool) bool {
+	defer r.Body.Close()
+	// check the content type, if any
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			s.writeError(w, r, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType,
+				fmt.Sprintf("unsupported content type %q, expected application/json", contentType))
+			return false
+		}
+	}
+	// decode the body, limiting its size
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, helpers.MaxRequestBodySize))
+	if !allowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == nil {
+		// the body must include a single JSON value
+		if err = decoder.Decode(&struct{}{}); err == io.EOF {
+			return true
+		} else if err == nil {
+			err = fmt.Errorf("unexpected data after the JSON value")
+		}
+	}
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		s.writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge,
+			fmt.Sprintf("request body too large, the limit is %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &typeErr):
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest,
+			fmt.Sprintf("invalid value for field %q: expected %s", typeErr.Field, typeErr.Type))
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("malformed JSON body: %v", err))
+	case errors.Is(err, io.EOF):
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "empty request body")
+	default:
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("error parsing request body: %v", err))
+	}
+	return false
+}
+
+// acceptsJSON function returns if the Accept header of the provided request
+// includes the JSON media type.
+func acceptsJSON(r *http.Request) bool {
+	for _, mediaType := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, _ = strings.Cut(strings.TrimSpace(mediaType), ";"); mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// padResponseTime method sleeps until the configured minimum validation delay
+// has passed since the provided start time. If the delay is not configured or
+// it has already passed, it returns immediately.
+func (s *Service) padResponseTime(start time.Time) {
+	if remaining := s.cfg.MinValidationDelay - time.Since(start); remaining > 0 {
+		time.Sleep(remaining)
+	}
+}
+
+// checkEmailHandler method checks if the email provided in the request body
+// would be accepted by the service, without generating a token or sending any
+// email. It checks the email format and the disallowed domains. The app secret
+// is checked by the withAppSecret middleware. If the request body is invalid,
+// it sends a bad request response. Otherwise, it sends the result of the check
+// as JSON.
+func (s *Service) checkEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// parse request
+	req := &EmailCheckRequest{}
+	if !decodeJSON(s, w, r, req, s.cfg.AllowUnknownFields) {
+		return
+	}
+	// check the email and encode the result
+	check := &EmailCheck{Allowed: true}
+	if err := s.emailQueue.CheckAddress(req.Email); err != nil {
+		check.Allowed = false
+		check.Reason = err.Error()
+	}
+	res, err := json.Marshal(check)
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling email check", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling email check")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// qrHandler method sends the magic link of the token provided in the
+// helpers.TokenQueryParam query string as a QR code, to allow the users to
+// continue the login in other device. The magic link is composed with the app
+// redirect URL. The image format is negotiated with the Accept header, it can
+// be PNG (default) or SVG. If the token is missing, it sends a bad request
+// response. If the token is invalid, it sends an unauthorized response. If
+// none of the supported formats is accepted, it sends a not acceptable
+// response.
+func (s *Service) qrHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app resolved from the app secret
+	appId, app := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token
+	if !s.validUserToken(r.Context(), token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// negotiate the image format
+	contentType, ok := qrContentType(r.Header.Get("Accept"))
+	if !ok {
+		s.writeError(w, r, http.StatusNotAcceptable, ErrCodeNotAcceptable, "unsupported image format")
+		return
+	}
+	// compose the magic link and encode it as a QR code
+	link, err := helpers.BuildMagicLink(app.RedirectURL, helpers.TokenQueryParam, token)
+	if err != nil {
+		s.requestLogger(r).Error("error composing magic link", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error composing magic link")
+		return
+	}
+	qr, err := encodeQR(link, contentType)
+	if err != nil {
+		s.requestLogger(r).Error("error encoding QR code", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error encoding QR code")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+	if _, err := w.Write(qr); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// magicLinkHandler method sends the magic link of the token provided in the
+// helpers.TokenQueryParam query string again, with the token, to allow the
+// apps to resend it to the user without issuing a new token (see
+// MagicLinkForToken). If the token is missing, it sends a bad request
+// response. If the token is invalid, expired or it belongs to other app, it
+// sends an unauthorized response.
+func (s *Service) magicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// check if the token belongs to the app
+	if tokenAppId, _, err := helpers.DecodeUserToken(token); err != nil || tokenAppId != appId {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// rebuild the magic link of the token
+	link, err := s.MagicLinkForToken(token)
+	if err != nil {
+		if errors.Is(err, errInvalidToken) {
+			s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+			return
+		}
+		s.requestLogger(r).Error("error composing magic link", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error composing magic link")
+		return
+	}
+	res, err := json.Marshal(&MagicLinkResponse{MagicLink: link, Token: token})
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling magic link", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling magic link")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
 		return
 	}
 }
 
 // appTokenHandler method generates creates an app in the service, it generates
 // an app id and a secret for the app. It sends the app id and the secret via
-// email to the app's email address. It gets the app name, email, callback, and
+// email to the app's email address, with the custom subject of the app, if it
+// has one. It gets the app name, email, callback, and
 // duration from the request body. If it success it sends an "Ok" response. If
 // something goes wrong, it sends an internal server error response. If the
-// request body is invalid, it sends a bad request response.
+// request body or the callback are invalid, it sends a bad request response.
+// If the disposable domains are not loaded yet and the email checks are
+// strict, it sends a service unavailable response.
 func (s *Service) appTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// read body
-	defer r.Body.Close()
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Println("ERR: error reading request body:", err)
-		http.Error(w, "error reading request body", http.StatusInternalServerError)
-		return
-	}
+	// parse request
 	app := &AppData{}
-	if err := json.Unmarshal(body, app); err != nil {
-		log.Println("ERR: error parsing request body:", err)
-		http.Error(w, "error parsing request body", http.StatusBadRequest)
+	if !decodeJSON(s, w, r, app, s.cfg.AllowUnknownFields) {
 		return
 	}
 	// check if the email is allowed
-	if !s.emailQueue.Allowed(app.Email) {
-		http.Error(w, "disallowed domain", http.StatusBadRequest)
+	if err := s.emailQueue.CheckAddress(app.Email); err != nil {
+		if err == email.ErrDisposableDomainsNotLoaded {
+			s.writeError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, "email checks not available yet")
+			return
+		}
+		s.rejectRequest(w, r, http.StatusBadRequest, ErrCodeDisallowedDomain, "disallowed domain")
 		return
 	}
 	// generate token
-	appId, secret, err := s.authApp(app.Name, app.Email, app.RedirectURL, app.Duration)
+	appId, secret, err := s.authApp(app)
 	if err != nil {
-		log.Println("ERR: error generating token:", err)
-		http.Error(w, "error generating token", http.StatusInternalServerError)
+		if errors.Is(err, errInvalidRedirectURL) || errors.Is(err, errInvalidOrigin) ||
+			errors.Is(err, errInvalidTokenDelivery) || errors.Is(err, errInvalidAuthMode) ||
+			errors.Is(err, errInvalidDeliveryPolicy) || errors.Is(err, errInvalidChannel) ||
+			errors.Is(err, errInvalidWebhookURL) || errors.Is(err, errInvalidEmailSubject) ||
+			errors.Is(err, errInvalidUsersQuota) || errors.Is(err, errInvalidDuration) ||
+			errors.Is(err, errInvalidMaxRefreshes) || errors.Is(err, errInvalidTokenSize) ||
+			errors.Is(err, errInvalidTokenRequestsLimit) {
+			s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		s.requestLogger(r).Error("error generating token", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error generating token")
 		return
 	}
-	emailData := email.NewAppEmailData(appId, app.Name, app.RedirectURL, secret, app.Email)
-	emailBody, err := email.ParseTemplate(s.cfg.AppEmailTemplate, emailData)
+	appEmail, err := s.appSecretEmail(r, appId, secret, app)
 	if err != nil {
-		log.Println("ERR: error parsing email template:", err)
-		http.Error(w, "error parsing email template", http.StatusInternalServerError)
+		s.requestLogger(r).Error("error composing email", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error parsing email template")
 		return
 	}
-	// compose and push the email to the queue to be sent if it fails, delete
-	// the app from the database, log the error and send an error response
-	if err := s.emailQueue.Push(&email.Email{
-		To:      app.Email,
-		Subject: fmt.Sprintf(appTokenSubject, app.Name),
-		Body:    emailBody,
-	}); err != nil {
-		log.Println("ERR: error sending email:", err)
+	// push the email to the queue to be sent if it fails, delete the app from
+	// the database, log the error and send an error response
+	if err := s.emailQueue.Push(appEmail); err != nil {
+		s.requestLogger(r).Error("error sending email", "error", err)
 		if err := s.removeApp(appId); err != nil {
-			log.Println("ERR: error deleting app:", err)
+			s.requestLogger(r).Error("error deleting app", "error", err)
 		}
-		http.Error(w, "error sending email", http.StatusInternalServerError)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending email")
 		return
 	}
 	// send response
 	if _, err := w.Write([]byte("Ok")); err != nil {
-		log.Println("ERR: error sending response:", err)
-		http.Error(w, "error sending response", http.StatusInternalServerError)
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
 		return
 	}
 }
 
+// resendAppHandler method sends a new secret of the app to its admin email,
+// for the admins that lost the original one. The stored secrets are hashed, so
+// they can not be sent again; the secret is rotated instead: a new one is
+// issued and the previous ones expire after the configured grace period (24h
+// by default), like when it is rotated with the app secret. It gets the app id
+// from the admin token provided in the URL query, because the admin could not
+// provide the app secret. If the token is missing, it sends a bad request
+// response. If the token is invalid or is not an admin token, it sends an
+// unauthorized response. If it success it sends an "Ok" response. If something
+// goes wrong, it sends an internal server error response.
+func (s *Service) resendAppHandler(w http.ResponseWriter, r *http.Request) {
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// get the app id from the token and validate the token against it
+	appId, _, err := helpers.DecodeUserToken(token)
+	if err != nil || !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// get the app from the database
+	app, err := s.appMetadata(appId)
+	if err != nil {
+		if err == db.ErrAppNotFound {
+			s.writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "app not found")
+			return
+		}
+		s.requestLogger(r).Error("error getting app", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error getting app")
+		return
+	}
+	// issue a new secret for the app
+	secret, hSecret, err := s.newAppSecret(appId)
+	if err != nil {
+		s.requestLogger(r).Error("error generating app secret", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error generating app secret")
+		return
+	}
+	// compose and push the email to the queue to be sent, if it fails, delete
+	// the new secret from the database, log the error and send an error
+	// response
+	appEmail, err := s.appSecretEmail(r, appId, secret, &app)
+	if err == nil {
+		err = s.emailQueue.Push(appEmail)
+	}
+	if err != nil {
+		s.requestLogger(r).Error("error sending email", "error", err)
+		if err := s.db.DeleteSecret(hSecret); err != nil {
+			s.requestLogger(r).Error("error deleting app secret", "error", err)
+		}
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending email")
+		return
+	}
+	// expire the previous secrets once the new one is on its way
+	if _, err := s.expireAppSecrets(appId, hSecret); err != nil {
+		s.requestLogger(r).Error("error expiring app secrets", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error expiring app secrets")
+		return
+	}
+	// send response
+	if _, err := w.Write([]byte("Ok")); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// appSecretEmail method composes the email that sends the provided app id and
+// secret to the admin email of the provided app, with the custom subject of
+// the app, if it has one, or the default one if it fails to render. It
+// returns an error if the email templates can not be parsed.
+func (s *Service) appSecretEmail(r *http.Request, appId, secret string, app *AppData) (*email.Email, error) {
+	emailData := email.NewAppEmailData(appId, app.Name, app.RedirectURL, secret, app.Email)
+	emailBody, err := s.cfg.ParseConfigTemplate(s.cfg.AppEmailTemplate, "", emailData)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing email template: %w", err)
+	}
+	emailText, err := email.AppEmailText(emailData)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing email text template: %w", err)
+	}
+	subject, err := renderEmailSubject(app.AppEmailSubject, appTokenSubject, app.Name)
+	if err != nil {
+		s.requestLogger(r).Warn("error rendering email subject", "error", err)
+		subject = fmt.Sprintf(appTokenSubject, app.Name)
+	}
+	return &email.Email{
+		To:        app.Email,
+		Subject:   subject,
+		Body:      emailBody,
+		TextBody:  emailText,
+		Priority:  email.HighPriority,
+		RequestID: requestIDFromContext(r.Context()),
+	}, nil
+}
+
 // appHandler method gets the app metadata from the service. It gets the app id
 // from the token provided in the URL query. If the token is missing, it sends
 // a bad request response. If the token is invalid or is not an admin token, it
@@ -182,102 +762,122 @@ func (s *Service) appTokenHandler(w http.ResponseWriter, r *http.Request) {
 // response. If it success it sends the app metadata. If something goes wrong,
 // it sends an internal server error response.
 func (s *Service) appHandler(w http.ResponseWriter, r *http.Request) {
-	// read the app token header
-	appSecret := r.Header.Get(helpers.AppSecretHeader)
-	if appSecret == "" {
-		http.Error(w, "missing app token", http.StatusBadRequest)
-		return
-	}
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
 	// get the token from the query
-	token := r.URL.Query().Get(helpers.TokenQueryParam)
+	token := tokenParam(r)
 	if token == "" {
-		http.Error(w, "missing token", http.StatusBadRequest)
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
 		return
 	}
-	// validate the token and get the app id
-	appId, valid := s.validAdminToken(token, appSecret)
-	if !valid {
-		http.Error(w, "invalid token", http.StatusUnauthorized)
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
 		return
 	}
 	// get the app from the database
 	app, err := s.appMetadata(appId)
 	if err != nil {
 		if err == db.ErrAppNotFound {
-			http.Error(w, "app not found", http.StatusNotFound)
+			s.writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "app not found")
 			return
 		}
-		log.Println("ERR: error getting app:", err)
-		http.Error(w, "error getting app", http.StatusInternalServerError)
+		s.requestLogger(r).Error("error getting app", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error getting app")
 		return
 	}
 	// encode the app metadata
 	res, err := json.Marshal(&app)
 	if err != nil {
-		log.Println("ERR: error marshaling app:", err)
-		http.Error(w, "error marshaling app", http.StatusInternalServerError)
+		s.requestLogger(r).Error("error marshaling app", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling app")
 		return
 	}
 	// send response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(res); err != nil {
-		log.Println("ERR: error sending response:", err)
-		http.Error(w, "error sending response", http.StatusInternalServerError)
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
 		return
 	}
 }
 
 // updateAppHandler method updates an app in the service. It gets the app id
 // from the URL path and the app name, callback, and duration from the request
-// body. If the app id is missing, it sends a bad request response. If the app
-// is not found, it sends a not found response. If it success it sends an Ok
-// response. If something goes wrong, it sends an internal server error
-// response.
+// body. If the app id is missing or the callback is invalid, it sends a bad
+// request response. If the app is not found, for example, because it has been
+// deleted meanwhile, it sends a not found response. If the redirect URL
+// changes, the outstanding tokens of the app, except the admin token of the
+// request, are revoked if requested (see AppData). If it success it sends an
+// Ok response or, if JSON is requested with the Accept header, the result of
+// the update, including the number of tokens affected by the change of the
+// redirect URL (see AppUpdate). If something goes wrong, it sends an internal
+// server error response.
 func (s *Service) updateAppHandler(w http.ResponseWriter, r *http.Request) {
-	// read the app token header
-	appSecret := r.Header.Get(helpers.AppSecretHeader)
-	if appSecret == "" {
-		http.Error(w, "missing app token", http.StatusBadRequest)
-		return
-	}
+	// get the app id and the current app resolved from the app secret
+	appId, currentApp := appFromContext(r.Context())
 	// get the token from the query
-	token := r.URL.Query().Get(helpers.TokenQueryParam)
+	token := tokenParam(r)
 	if token == "" {
-		http.Error(w, "missing token", http.StatusBadRequest)
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
 		return
 	}
-	// validate the token and get the app id
-	appId, valid := s.validAdminToken(token, appSecret)
-	if !valid {
-		http.Error(w, "invalid token", http.StatusUnauthorized)
-		return
-	}
-	// read body
-	defer r.Body.Close()
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Println("ERR: error reading request body:", err)
-		http.Error(w, "error reading request body", http.StatusInternalServerError)
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
 		return
 	}
 	// decode the app from the request
 	app := &AppData{}
-	if err := json.Unmarshal(body, app); err != nil {
-		log.Println("ERR: error parsing request body:", err)
-		http.Error(w, "error parsing request body", http.StatusBadRequest)
+	if !decodeJSON(s, w, r, app, s.cfg.AllowUnknownFields) {
 		return
 	}
 	// update the app in the database
-	if err := s.updateAppMetadata(appId, app.Name, app.RedirectURL, app.Duration); err != nil {
-		log.Println("ERR: error updating app:", err)
-		http.Error(w, "error updating app", http.StatusInternalServerError)
+	if err := s.updateAppMetadata(appId, app); err != nil {
+		if errors.Is(err, errInvalidRedirectURL) || errors.Is(err, errInvalidOrigin) ||
+			errors.Is(err, errInvalidTokenDelivery) || errors.Is(err, errInvalidAppName) ||
+			errors.Is(err, errInvalidAuthMode) || errors.Is(err, errInvalidDeliveryPolicy) ||
+			errors.Is(err, errInvalidChannel) || errors.Is(err, errInvalidWebhookURL) ||
+			errors.Is(err, errInvalidEmailSubject) || errors.Is(err, errInvalidDuration) ||
+			errors.Is(err, errInvalidMaxRefreshes) || errors.Is(err, errInvalidTokenSize) ||
+			errors.Is(err, errInvalidTokenRequestsLimit) {
+			s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		if errors.Is(err, db.ErrAppNotFound) {
+			s.writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "app not found")
+			return
+		}
+		s.requestLogger(r).Error("error updating app", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error updating app")
 		return
 	}
+	// check the tokens affected by the change of the redirect URL, if any
+	update := &AppUpdate{}
+	if app.RedirectURL != "" && currentApp != nil {
+		var err error
+		if update, err = s.redirectURLUpdate(appId, currentApp.RedirectURL, token, app.RevokeTokens); err != nil {
+			s.requestLogger(r).Error("error checking the tokens of the redirect URL", "error", err)
+			s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error updating app")
+			return
+		}
+	}
 	// send response
-	if _, err := w.Write([]byte("Ok")); err != nil {
-		log.Println("ERR: error sending response:", err)
-		http.Error(w, "error sending response", http.StatusInternalServerError)
+	res := []byte("Ok")
+	if acceptsJSON(r) {
+		var err error
+		if res, err = json.Marshal(update); err != nil {
+			s.requestLogger(r).Error("error marshaling app update", "error", err)
+			s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling app update")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Add("Vary", "Accept")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
 		return
 	}
 }
@@ -285,37 +885,482 @@ func (s *Service) updateAppHandler(w http.ResponseWriter, r *http.Request) {
 // delAppHandler method deletes an app from the service. It gets the app id from
 // the token provided in the URL query. If the token is missing, it sends a bad
 // request response. If the token is invalid or is not an admin token, it sends
-// an unauthorized response. If it success it sends an Ok response. If something
-// goes wrong, it sends an internal server error response.
+// an unauthorized response. If the app is not found, for example, because it
+// has been deleted meanwhile, it sends a not found response. If it success it
+// sends an Ok response. If something goes wrong, it sends an internal server
+// error response.
 func (s *Service) delAppHandler(w http.ResponseWriter, r *http.Request) {
-	// read the app token header
-	appSecret := r.Header.Get(helpers.AppSecretHeader)
-	if appSecret == "" {
-		http.Error(w, "missing app token", http.StatusBadRequest)
-		return
-	}
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
 	// get the token from the query
-	token := r.URL.Query().Get(helpers.TokenQueryParam)
+	token := tokenParam(r)
 	if token == "" {
-		http.Error(w, "missing token", http.StatusBadRequest)
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
 		return
 	}
-	// validate the token and get the app id
-	appId, valid := s.validAdminToken(token, appSecret)
-	if !valid {
-		http.Error(w, "invalid token", http.StatusUnauthorized)
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
 		return
 	}
 	// remove the app from the service
 	if err := s.removeApp(appId); err != nil {
-		log.Println("ERR: error deleting app:", err)
-		http.Error(w, "error deleting app", http.StatusInternalServerError)
+		if errors.Is(err, db.ErrAppNotFound) {
+			s.writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "app not found")
+			return
+		}
+		s.requestLogger(r).Error("error deleting app", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error deleting app")
+		return
+	}
+	// send response
+	if _, err := w.Write([]byte("Ok")); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// appConfigHandler method sends a ready-to-use config snippet to integrate
+// the app with the service. It gets the app id from the request context and
+// the admin token from the URL query. If the token is missing, it sends a bad
+// request response. If the token is invalid or is not an admin token, it
+// sends an unauthorized response. The format of the snippet is selected with
+// the helpers.FormatQueryParam query param, which can be "env" (default) or
+// "json". If the format is not supported, it sends a bad request response.
+func (s *Service) appConfigHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// compose the snippet in the requested format
+	config := s.appConfig(appId)
+	var res []byte
+	switch format := r.URL.Query().Get(helpers.FormatQueryParam); format {
+	case "", envConfigFormat:
+		res = []byte(fmt.Sprintf(envConfigSnippet, config.AppID, config.APIEndpoint))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"simpleauth.env\"")
+	case jsonConfigFormat:
+		var err error
+		if res, err = json.Marshal(config); err != nil {
+			s.requestLogger(r).Error("error marshaling app config", "error", err)
+			s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling app config")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "unsupported format")
+		return
+	}
+	// send response
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// resetAttemptsHandler method resets the attempts counters (rate limits and
+// lockouts) of the app for the client ip and/or the user email provided in
+// the request body. It gets the app id from the request context and the admin
+// token from the URL query. If the token is missing, or the request body is
+// invalid, it sends a bad request response. If the token is invalid or is
+// not an admin token, it sends an unauthorized response. If it success it
+// sends an "Ok" response.
+func (s *Service) resetAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app resolved from the app secret
+	appId, app := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// parse request
+	req := &AttemptsResetRequest{}
+	if !decodeJSON(s, w, r, req, s.cfg.AllowUnknownFields) {
+		return
+	}
+	if req.IP == "" && req.Email == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "missing ip or email")
+		return
+	}
+	// reset the attempts counters
+	if err := s.resetAttempts(appId, app, req.IP, req.Email); err != nil {
+		s.requestLogger(r).Error("error resetting attempts", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error resetting attempts")
+		return
+	}
+	// send response
+	if _, err := w.Write([]byte("Ok")); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// appUsersHandler method sends the active sessions of the app as JSON, which
+// include the number of sessions and the id of the user and the expiration of
+// each one. It gets the app id from the request context and the admin token
+// from the URL query. If the token is missing, it sends a bad request
+// response. If the token is invalid or is not an admin token, it sends an
+// unauthorized response. If something goes wrong, it sends an internal server
+// error response.
+func (s *Service) appUsersHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// get the active sessions of the app
+	users, err := s.appUsers(appId)
+	if err != nil {
+		s.requestLogger(r).Error("error getting app users", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error getting app users")
+		return
+	}
+	res, err := json.Marshal(users)
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling app users", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling app users")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// appTokensHandler method sends a page of the tokens of the app as JSON,
+// sorted by token, with their random part redacted, including the id of the
+// user and the expiration of each one, to allow the app admins to inspect
+// them. The page is selected like in listAppsHandler. It gets the app id from
+// the request context and the admin token from the URL query. If the token is
+// missing or the pagination params are invalid, it sends a bad request
+// response. If the token is invalid or is not an admin token, it sends an
+// unauthorized response. If something goes wrong, it sends an internal server
+// error response.
+func (s *Service) appTokensHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// parse the pagination params
+	limit, offset, err := listPagination(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	// get the tokens of the page
+	tokens, err := s.appTokens(appId, limit, offset)
+	if err != nil {
+		s.requestLogger(r).Error("error listing app tokens", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error listing app tokens")
+		return
+	}
+	res, err := json.Marshal(tokens)
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling app tokens", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling app tokens")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// rotateSecretHandler method issues a new secret for the app and sends it as
+// JSON, with the expiration of the current secret, the one of the request,
+// which is still valid during the configured grace period (see
+// SecretRotation). It gets the app id from the request context and the admin
+// token from the URL query. If the token is missing, it sends a bad request
+// response. If the token is invalid or is not an admin token, it sends an
+// unauthorized response. If something goes wrong, it sends an internal server
+// error response.
+func (s *Service) rotateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app resolved from the app secret, including the secret
+	reqApp, _ := r.Context().Value(appContextKey{}).(*requestApp)
+	if reqApp == nil {
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "missing app")
+		return
+	}
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token against the app id
+	if !s.validAdminToken(token, reqApp.id) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// rotate the secret
+	secret, expiration, err := s.rotateAppSecret(reqApp.id, reqApp.secret)
+	if err != nil {
+		s.requestLogger(r).Error("error rotating app secret", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error rotating app secret")
+		return
+	}
+	res, err := json.Marshal(&SecretRotation{Secret: secret, PreviousSecretExpiresAt: expiration})
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling secret rotation", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling secret rotation")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// revokeUserHandler method revokes every token of the user with the email
+// provided in the request body, invalidating all of their sessions for the
+// app. It gets the app id from the request context and the admin token from
+// the URL query. If the token is missing, or the request body is invalid, it
+// sends a bad request response. If the token is invalid or is not an admin
+// token, it sends an unauthorized response. If it success it sends an "Ok"
+// response.
+func (s *Service) revokeUserHandler(w http.ResponseWriter, r *http.Request) {
+	// get the app id resolved from the app secret
+	appId, _ := appFromContext(r.Context())
+	// get the token from the query
+	token := tokenParam(r)
+	if token == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingToken, "missing token")
+		return
+	}
+	// validate the token against the app id
+	if !s.validAdminToken(token, appId) {
+		s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, "invalid token")
+		return
+	}
+	// parse request
+	req := &UserRevokeRequest{}
+	if !decodeJSON(s, w, r, req, s.cfg.AllowUnknownFields) {
+		return
+	}
+	if req.Email == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "missing email")
+		return
+	}
+	// revoke the tokens of the user
+	if err := s.revokeUserTokens(appId, req.Email); err != nil {
+		s.requestLogger(r).Error("error revoking user tokens", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error revoking user tokens")
+		return
+	}
+	// send response
+	if _, err := w.Write([]byte("Ok")); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+const (
+	// defaultListLimit is the number of items listed by default in the
+	// paginated admin responses.
+	defaultListLimit = 50
+	// maxListLimit is the maximum number of items that can be listed in a
+	// single page of the paginated admin responses.
+	maxListLimit = 500
+)
+
+// listAppsHandler method sends the apps registered in the service as JSON,
+// sorted by app id, to allow the service admins to audit them. The page is
+// selected with the helpers.LimitQueryParam (50 by default, 500 at most) and
+// helpers.OffsetQueryParam query params. The admin secret is checked by the
+// withAdminSecret middleware. If the pagination params are invalid, it sends a
+// bad request response. If something goes wrong, it sends an internal server
+// error response.
+func (s *Service) listAppsHandler(w http.ResponseWriter, r *http.Request) {
+	// parse the pagination params
+	limit, offset, err := listPagination(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	// get the apps from the database
+	apps, err := s.listApps(limit, offset)
+	if err != nil {
+		s.requestLogger(r).Error("error listing apps", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error listing apps")
+		return
+	}
+	res, err := json.Marshal(apps)
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling apps", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling apps")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// statsHandler method sends the aggregate statistics of the service as JSON,
+// to allow the service admins to monitor it: the number of apps and tokens,
+// the tokens issued in the last day and the emails waiting in the queue. The
+// admin secret is checked by the withAdminSecret middleware. If something
+// goes wrong, it sends an internal server error response.
+func (s *Service) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.stats()
+	if err != nil {
+		s.requestLogger(r).Error("error getting stats", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error getting stats")
+		return
+	}
+	res, err := json.Marshal(stats)
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling stats", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling stats")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// listPagination function parses the pagination params of the provided
+// paginated admin request, the helpers.LimitQueryParam (50 by default, 500 at
+// most) and the helpers.OffsetQueryParam query params. It returns an error if
+// they are invalid.
+func listPagination(r *http.Request) (int, int, error) {
+	limit, offset := defaultListLimit, 0
+	query := r.URL.Query()
+	if rawLimit := query.Get(helpers.LimitQueryParam); rawLimit != "" {
+		var err error
+		if limit, err = strconv.Atoi(rawLimit); err != nil || limit <= 0 || limit > maxListLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+	if rawOffset := query.Get(helpers.OffsetQueryParam); rawOffset != "" {
+		var err error
+		if offset, err = strconv.Atoi(rawOffset); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a positive number")
+		}
+	}
+	return limit, offset, nil
+}
+
+// listDeadLettersHandler method sends the emails that could not be sent after
+// all the attempts as JSON, sorted by the time when they failed, to allow the
+// service admins to investigate them. The page is selected like in
+// listAppsHandler. The admin secret is checked by the withAdminSecret
+// middleware. If the pagination params are invalid, it sends a bad request
+// response. If something goes wrong, it sends an internal server error
+// response.
+func (s *Service) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	// parse the pagination params
+	limit, offset, err := listPagination(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	// get the dead letters from the database
+	letters, err := s.listDeadLetters(limit, offset)
+	if err != nil {
+		s.requestLogger(r).Error("error listing dead letters", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error listing dead letters")
+		return
+	}
+	res, err := json.Marshal(letters)
+	if err != nil {
+		s.requestLogger(r).Error("error marshaling dead letters", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error marshaling dead letters")
+		return
+	}
+	// send response
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(res); err != nil {
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
+		return
+	}
+}
+
+// retryDeadLetterHandler method pushes the email of the dead letter with the
+// id provided in the request body back to the email queue, to allow the
+// service admins to retry it. The admin secret is checked by the
+// withAdminSecret middleware. If the request body is invalid, it sends a bad
+// request response. If the dead letter is not found, it sends a not found
+// response. If it success it sends an "Ok" response. If something goes
+// wrong, it sends an internal server error response.
+func (s *Service) retryDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	// parse request
+	req := &DeadLetterRetryRequest{}
+	if !decodeJSON(s, w, r, req, s.cfg.AllowUnknownFields) {
+		return
+	}
+	if req.ID == "" {
+		s.writeError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "missing id")
+		return
+	}
+	// push the email back to the queue
+	if err := s.retryDeadLetter(req.ID); err != nil {
+		if err == db.ErrDeadLetterNotFound {
+			s.writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "dead letter not found")
+			return
+		}
+		s.requestLogger(r).Error("error retrying dead letter", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error retrying dead letter")
 		return
 	}
 	// send response
 	if _, err := w.Write([]byte("Ok")); err != nil {
-		log.Println("ERR: error sending response:", err)
-		http.Error(w, "error sending response", http.StatusInternalServerError)
+		s.requestLogger(r).Error("error sending response", "error", err)
+		s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error sending response")
 		return
 	}
 }
@@ -0,0 +1,47 @@
+package api
+
+import "sync"
+
+// keyedMutex struct represents a set of mutexes identified by a key, that
+// allows to serialize the operations over the same resource (for example, the
+// tokens of a user) without blocking the operations over other resources. The
+// mutexes are created on demand and removed when nobody holds or waits for
+// them. The zero value is ready to use. It only serializes the operations of
+// the current process.
+type keyedMutex struct {
+	mtx   sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock struct represents the mutex of a key and the number of goroutines
+// that hold or wait for it.
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock method locks the mutex of the provided key, waiting until it is free,
+// and returns the function to unlock it.
+func (km *keyedMutex) Lock(key string) func() {
+	km.mtx.Lock()
+	if km.locks == nil {
+		km.locks = map[string]*keyedLock{}
+	}
+	lock, ok := km.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		km.locks[key] = lock
+	}
+	lock.refs++
+	km.mtx.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		km.mtx.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mtx.Unlock()
+	}
+}
@@ -0,0 +1,352 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+	"github.com/simpleauthlink/authapi/logger"
+)
+
+// defaultRetryAfter is the number of seconds that the clients are asked to
+// wait before retrying a request rejected because the service is busy.
+const defaultRetryAfter = 1
+
+// corsAllowedMethods are the methods allowed to the cross-origin requests.
+const corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// appContextKey type is the key used to store the app resolved from the app
+// secret of a request in the request context.
+type appContextKey struct{}
+
+// requestIDContextKey type is the key used to store the id of a request in
+// the request context.
+type requestIDContextKey struct{}
+
+// maxRequestIDSize is the maximum size of the request ids provided by the
+// clients, the longer ones are replaced by a generated one.
+const maxRequestIDSize = 64
+
+// requestIDSize is the number of random bytes of the generated request ids.
+const requestIDSize = 8
+
+// requestApp struct contains the id and the data of the app resolved from the
+// app secret of a request, and the secret itself, to sign the webhook events
+// of the app.
+type requestApp struct {
+	id     string
+	app    *db.App
+	secret string
+}
+
+// withRequestID method wraps the provided handler with a middleware that
+// assigns an id to every request, to identify it in the logs. It uses the id
+// provided by the client in the helpers.RequestIDHeader header, if it is
+// valid, else it generates a random one. The id is stored in the request
+// context and included in the response header.
+func (s *Service) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(helpers.RequestIDHeader)
+		if !validRequestID(id) {
+			bId, err := helpers.RandBytes(requestIDSize)
+			if err != nil {
+				s.logger.Error("error generating request id", "error", err)
+			}
+			id = hex.EncodeToString(bId)
+		}
+		w.Header().Set(helpers.RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID function returns if the provided request id can be used in
+// the logs, it must not be empty or too long, and only include printable
+// ascii characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDSize {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext function returns the id of the request stored in the
+// provided context, or an empty string if there is none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// contextLogger method returns the logger of the service including the id of
+// the request stored in the provided context, if any.
+func (s *Service) contextLogger(ctx context.Context) logger.Logger {
+	if id := requestIDFromContext(ctx); id != "" {
+		return logger.With(s.logger, "request_id", id)
+	}
+	return s.logger
+}
+
+// requestLogger method returns the logger of the service with the fields that
+// identify the provided request: its id and, if it has been resolved, the id
+// of the app of the request.
+func (s *Service) requestLogger(r *http.Request) logger.Logger {
+	if appId, _ := appFromContext(r.Context()); appId != "" {
+		return logger.With(s.contextLogger(r.Context()), "app_id", appId)
+	}
+	return s.contextLogger(r.Context())
+}
+
+// headResponseWriter struct wraps a http.ResponseWriter to answer a HEAD
+// request with a GET handler. It discards the body written by the handler but
+// keeps its status code and its size, to send the same headers that the GET
+// response would include.
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader method stores the status code of the response instead of
+// sending it, to send it once the size of the body is known.
+func (hw *headResponseWriter) WriteHeader(status int) {
+	if hw.status == 0 {
+		hw.status = status
+	}
+}
+
+// Write method discards the provided bytes of the body, counting them and
+// detecting the content type of the response if it is not set, as the http
+// server does for the GET responses.
+func (hw *headResponseWriter) Write(b []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	if hw.size == 0 && len(b) > 0 && hw.Header().Get("Content-Type") == "" {
+		hw.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	hw.size += len(b)
+	return len(b), nil
+}
+
+// headHandler function wraps the provided GET handler to answer the HEAD
+// requests, used by the load balancers and the uptime monitors. The response
+// has the same status code and headers than the GET one, including the
+// Content-Length of the body, but without it.
+func headHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hw := &headResponseWriter{ResponseWriter: w}
+		next(hw, r)
+		if hw.status == 0 {
+			hw.status = http.StatusOK
+		}
+		if hw.Header().Get("Content-Length") == "" {
+			hw.Header().Set("Content-Length", strconv.Itoa(hw.size))
+		}
+		w.WriteHeader(hw.status)
+	}
+}
+
+// limitConcurrency method wraps the provided handler with a middleware that
+// limits the number of requests handled concurrently to the configured
+// maximum. When the limit is reached, the new requests wait up to the
+// configured timeout for a free slot (or none if it is zero) and, if no slot
+// gets free, they are rejected with a service unavailable response that
+// includes a Retry-After header. If the limit is not configured, it returns
+// the handler as it is.
+func (s *Service) limitConcurrency(next http.Handler) http.Handler {
+	if s.cfg.MaxConcurrentRequests <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, s.cfg.MaxConcurrentRequests)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acquireSlot(r, slots, s.cfg.ConcurrencyWaitTimeout) {
+			retryAfter := defaultRetryAfter
+			if wait := int(s.cfg.ConcurrencyWaitTimeout.Seconds()); wait > retryAfter {
+				retryAfter = wait
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			s.writeError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, "service busy")
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// normalizeTrailingSlash method wraps the provided handler with a middleware
+// that routes the requests with a trailing slash in their path (for example,
+// "/user/") to the endpoint without it ("/user"). Depending on the configured
+// TrailingSlash mode, the request path is rewritten before handling it or
+// the client is redirected to the path without the trailing slash, keeping
+// the query params. The GET and HEAD requests are redirected with a moved
+// permanently response, while the rest of methods use a permanent redirect
+// response to keep the method and the body of the request.
+func (s *Service) normalizeTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) <= 1 || !strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := strings.TrimRight(r.URL.Path, "/")
+		if path == "" {
+			path = "/"
+		}
+		if s.cfg.TrailingSlash == TrailingSlashRedirect {
+			target := *r.URL
+			target.Path, target.RawPath = path, ""
+			code := http.StatusPermanentRedirect
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				code = http.StatusMovedPermanently
+			}
+			http.Redirect(w, r, target.RequestURI(), code)
+			return
+		}
+		rewritten := r.Clone(r.Context())
+		rewritten.URL.Path, rewritten.URL.RawPath = path, ""
+		next.ServeHTTP(w, rewritten)
+	})
+}
+
+// cors method wraps the provided handler with a middleware that sets the CORS
+// headers of the responses. The Access-Control-Allow-Origin header is set
+// based on the allowed origins of the config, allowing any origin if there
+// are none. The preflight requests are answered directly with an ok
+// response. The endpoints that resolve an app from its secret replace the
+// allowed origin based on the allowed origins of the app, if it has any (see
+// withAppSecret).
+func (s *Service) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		w.Header().Set("Access-Control-Expose-Headers", helpers.TokenHeader)
+		setAllowedOrigin(w, r, s.cfg.AllowedOrigins)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setAllowedOrigin function sets the Access-Control-Allow-Origin header of
+// the response to the provided request. If there are no allowed origins, any
+// origin is allowed. Otherwise, the header is set to the origin of the
+// request only if it is one of the allowed origins, and it is removed if it
+// is not.
+func setAllowedOrigin(w http.ResponseWriter, r *http.Request, allowedOrigins []string) {
+	if len(allowedOrigins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	for _, allowed := range allowedOrigins {
+		if origin != "" && origin == allowed {
+			w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+			return
+		}
+	}
+	w.Header().Del("Access-Control-Allow-Origin")
+}
+
+// acquireSlot function tries to take a slot of the provided channel, waiting
+// up to the provided timeout or until the request is cancelled. It returns
+// true if the slot was taken, otherwise it returns false.
+func acquireSlot(r *http.Request, slots chan struct{}, timeout time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// withAppSecret method wraps the provided handler with a middleware that reads
+// the app secret from the helpers.AppSecretHeader header, resolves the app
+// that owns it and stores the app and its id in the request context, so the
+// handler can get them using the appFromContext function. If the app has
+// allowed origins, they replace the ones of the config to allow the origin of
+// the request (CORS). If the app secret is missing, it sends a bad request
+// response. If it is invalid, it sends an unauthorized response. If something
+// fails resolving the app, it sends an internal server error response.
+func (s *Service) withAppSecret(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// read the app token header, ignoring the whitespace that some
+		// proxies and clients add around the values
+		appSecret := strings.TrimSpace(r.Header.Get(helpers.AppSecretHeader))
+		if appSecret == "" {
+			s.writeError(w, r, http.StatusBadRequest, ErrCodeMissingAppSecret, "missing app token")
+			return
+		}
+		// resolve the app that owns the secret
+		appId, app, err := s.appBySecret(appSecret)
+		if err != nil {
+			if err != db.ErrAppNotFound {
+				s.requestLogger(r).Error("error getting app", "error", err)
+				s.writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "error getting app")
+				return
+			}
+			s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidAppSecret, "invalid app token")
+			return
+		}
+		// restrict the cross-origin requests to the origins of the app
+		if len(app.AllowedOrigins) > 0 {
+			setAllowedOrigin(w, r, app.AllowedOrigins)
+		}
+		ctx := context.WithValue(r.Context(), appContextKey{}, &requestApp{id: appId, app: app, secret: appSecret})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// appFromContext function returns the id and the data of the app stored in the
+// provided context by the withAppSecret middleware. If there is no app in the
+// context, it returns an empty id and a nil app.
+func appFromContext(ctx context.Context) (string, *db.App) {
+	if reqApp, ok := ctx.Value(appContextKey{}).(*requestApp); ok {
+		return reqApp.id, reqApp.app
+	}
+	return "", nil
+}
+
+// withAdminSecret method wraps the provided handler with a middleware that
+// only allows the requests that include the service admin secret in the
+// helpers.AdminSecretHeader header. If the admin secret is not configured, the
+// admin endpoints are disabled and it sends a forbidden response. If the
+// secret is missing or invalid, it sends an unauthorized response.
+func (s *Service) withAdminSecret(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminSecret == "" {
+			s.rejectRequest(w, r, http.StatusForbidden, ErrCodeForbidden, "admin endpoints disabled")
+			return
+		}
+		adminSecret := strings.TrimSpace(r.Header.Get(helpers.AdminSecretHeader))
+		if subtle.ConstantTimeCompare([]byte(adminSecret), []byte(s.cfg.AdminSecret)) != 1 {
+			s.rejectRequest(w, r, http.StatusUnauthorized, ErrCodeInvalidAdminSecret, "invalid admin secret")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,481 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+func TestLimitConcurrency(t *testing.T) {
+	srv := newTestService(t, &Config{MaxConcurrentRequests: 2})
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	handler := srv.limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	// fill the available slots with blocked requests
+	var wg sync.WaitGroup
+	codes := make(chan int, 5)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes <- res.Code
+		}()
+	}
+	<-started
+	<-started
+	// the excess requests must be rejected
+	for i := 0; i < 3; i++ {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+		if res.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, res.Code)
+		}
+		if res.Header().Get("Retry-After") == "" {
+			t.Errorf("expected Retry-After header")
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected %d, got %d", http.StatusOK, code)
+		}
+	}
+	// once the slots are free, the requests are handled again
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, res.Code)
+	}
+}
+
+func TestWithAppSecret(t *testing.T) {
+	srv := newTestService(t, nil)
+	appId, secret := createTestApp(t, srv, nil)
+	var gotAppId, gotAppName string
+	handler := srv.withAppSecret(func(w http.ResponseWriter, r *http.Request) {
+		id, app := appFromContext(r.Context())
+		gotAppId, gotAppName = id, app.Name
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		secret string
+		code   int
+	}{
+		{"", http.StatusBadRequest},
+		{" \t", http.StatusBadRequest},
+		{"wrong-secret", http.StatusUnauthorized},
+		{secret, http.StatusOK},
+		// the surrounding whitespace added by some proxies is ignored
+		{" " + secret + "\t ", http.StatusOK},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, helpers.UserEndpointPath, nil)
+		if tc.secret != "" {
+			req.Header.Set(helpers.AppSecretHeader, tc.secret)
+		}
+		res := httptest.NewRecorder()
+		handler(res, req)
+		if res.Code != tc.code {
+			t.Errorf("expected %d for secret %q, got %d", tc.code, tc.secret, res.Code)
+		}
+	}
+	if gotAppId != appId || gotAppName != "test app" {
+		t.Errorf("expected app %s in context, got %s (%s)", appId, gotAppId, gotAppName)
+	}
+}
+
+// serviceEndpoints are the method and path of every endpoint of the service.
+var serviceEndpoints = []struct {
+	method, path string
+}{
+	{http.MethodGet, helpers.HealthCheckPath},
+	{http.MethodPost, helpers.UserEndpointPath},
+	{http.MethodGet, helpers.UserEndpointPath},
+	{http.MethodPost, helpers.UserCheckEmailPath},
+	{http.MethodGet, helpers.UserQRPath},
+	{http.MethodPost, helpers.UserRefreshPath},
+	{http.MethodGet, helpers.AppEndpointPath},
+	{http.MethodPost, helpers.AppEndpointPath},
+	{http.MethodPut, helpers.AppEndpointPath},
+	{http.MethodDelete, helpers.AppEndpointPath},
+	{http.MethodGet, helpers.AppConfigPath},
+	{http.MethodDelete, helpers.AppAttemptsPath},
+	{http.MethodGet, helpers.AppUsersPath},
+	{http.MethodDelete, helpers.AppUserPath},
+	{http.MethodGet, helpers.AdminAppsPath},
+	{http.MethodGet, helpers.AdminDeadLettersPath},
+	{http.MethodPost, helpers.AdminDeadLettersRetryPath},
+}
+
+func TestNormalizeTrailingSlash(t *testing.T) {
+	// every request uses a different address to avoid the rate limiter
+	requests := 0
+	serve := func(srv *Service, method, path string) *httptest.ResponseRecorder {
+		requests++
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", requests/256, requests%256)
+		res := httptest.NewRecorder()
+		srv.httpServer.Handler.ServeHTTP(res, req)
+		return res
+	}
+	// rewrite mode (default)
+	srv := newTestService(t, nil)
+	for _, endpoint := range serviceEndpoints {
+		expected := serve(srv, endpoint.method, endpoint.path).Code
+		if expected == http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected to be routed, got %d", endpoint.method, endpoint.path, expected)
+		}
+		if code := serve(srv, endpoint.method, endpoint.path+"/").Code; code != expected {
+			t.Errorf("%s %s/: expected %d, got %d", endpoint.method, endpoint.path, expected, code)
+		}
+	}
+	// redirect mode
+	srv = newTestService(t, &Config{TrailingSlash: TrailingSlashRedirect})
+	for _, endpoint := range serviceEndpoints {
+		if code := serve(srv, endpoint.method, endpoint.path).Code; code == http.StatusMethodNotAllowed ||
+			code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect {
+			t.Errorf("%s %s: expected to be handled, got %d", endpoint.method, endpoint.path, code)
+		}
+		expected := http.StatusPermanentRedirect
+		if endpoint.method == http.MethodGet {
+			expected = http.StatusMovedPermanently
+		}
+		res := serve(srv, endpoint.method, endpoint.path+"/?format=json")
+		if res.Code != expected {
+			t.Errorf("%s %s/: expected %d, got %d", endpoint.method, endpoint.path, expected, res.Code)
+		}
+		if location := res.Header().Get("Location"); location != endpoint.path+"?format=json" {
+			t.Errorf("%s %s/: expected location %s?format=json, got %s", endpoint.method, endpoint.path, endpoint.path, location)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	requests := 0
+	serve := func(srv *Service, method, path, secret, origin string) *httptest.ResponseRecorder {
+		requests++
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = fmt.Sprintf("10.1.%d.%d:1234", requests/256, requests%256)
+		if secret != "" {
+			req.Header.Set(helpers.AppSecretHeader, secret)
+		}
+		req.Header.Set("Origin", origin)
+		res := httptest.NewRecorder()
+		srv.httpServer.Handler.ServeHTTP(res, req)
+		return res
+	}
+	// without allowed origins, any origin is allowed
+	srv := newTestService(t, nil)
+	_, secret := createTestApp(t, srv, nil)
+	if res := serve(srv, http.MethodGet, helpers.UserEndpointPath, secret, "https://any.simpleauth.link"); res.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected any origin allowed, got %q", res.Header().Get("Access-Control-Allow-Origin"))
+	}
+	// the global origins are used by the endpoints without app and by the
+	// apps without their own origins
+	srv = newTestService(t, &Config{AllowedOrigins: []string{"https://Global.simpleauth.link/"}})
+	_, secret = createTestApp(t, srv, nil)
+	_, appSecret := createTestApp(t, srv, &AppData{
+		Email:          "other@simpleauth.link",
+		AllowedOrigins: []string{"https://app.simpleauth.link", "http://localhost:3000"},
+	})
+	tests := []struct {
+		name, method, path, secret, origin, expected string
+	}{
+		{"preflight from global origin", http.MethodOptions, helpers.UserEndpointPath, "", "https://global.simpleauth.link", "https://global.simpleauth.link"},
+		{"preflight from unknown origin", http.MethodOptions, helpers.UserEndpointPath, "", "https://evil.simpleauth.link", ""},
+		{"no app from global origin", http.MethodGet, helpers.HealthCheckPath, "", "https://global.simpleauth.link", "https://global.simpleauth.link"},
+		{"no app from app origin", http.MethodGet, helpers.HealthCheckPath, "", "https://app.simpleauth.link", ""},
+		{"app without origins from global origin", http.MethodGet, helpers.UserEndpointPath, secret, "https://global.simpleauth.link", "https://global.simpleauth.link"},
+		{"app from its origin", http.MethodGet, helpers.UserEndpointPath, appSecret, "https://app.simpleauth.link", "https://app.simpleauth.link"},
+		{"app from its other origin", http.MethodGet, helpers.UserEndpointPath, appSecret, "http://localhost:3000", "http://localhost:3000"},
+		{"app from global origin", http.MethodGet, helpers.UserEndpointPath, appSecret, "https://global.simpleauth.link", ""},
+		{"app from unknown origin", http.MethodGet, helpers.UserEndpointPath, appSecret, "https://evil.simpleauth.link", ""},
+	}
+	for _, tc := range tests {
+		res := serve(srv, tc.method, tc.path, tc.secret, tc.origin)
+		if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, origin)
+		}
+		if tc.method == http.MethodOptions && res.Code != http.StatusOK {
+			t.Errorf("%s: expected %d, got %d", tc.name, http.StatusOK, res.Code)
+		}
+		if res.Header().Get("Vary") == "" {
+			t.Errorf("%s: expected Vary header", tc.name)
+		}
+	}
+	// the origins must be valid
+	for _, origin := range []string{"app.simpleauth.link", "ftp://app.simpleauth.link", "https://app.simpleauth.link/path", "https://user@app.simpleauth.link"} {
+		app := &AppData{
+			Name:           "test app",
+			Email:          "admin@simpleauth.link",
+			RedirectURL:    "https://simpleauth.link/callback",
+			Duration:       helpers.MinTokenDuration,
+			AllowedOrigins: []string{origin},
+		}
+		if _, _, err := srv.authApp(app); !errors.Is(err, errInvalidOrigin) {
+			t.Errorf("%s: expected %v, got %v", origin, errInvalidOrigin, err)
+		}
+	}
+}
+
+// bufferEntry struct represents a log entry written to a bufferLogger.
+type bufferEntry struct {
+	level  string
+	msg    string
+	fields map[string]any
+}
+
+// bufferLogger struct implements the logger.Logger interface storing the
+// entries to check them in the tests.
+type bufferLogger struct {
+	mtx     sync.Mutex
+	entries []bufferEntry
+}
+
+func (bl *bufferLogger) write(level, msg string, fields []any) {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	entry := bufferEntry{level: level, msg: msg, fields: map[string]any{}}
+	for i := 0; i+1 < len(fields); i += 2 {
+		entry.fields[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+	bl.entries = append(bl.entries, entry)
+}
+
+func (bl *bufferLogger) Debug(msg string, fields ...any) { bl.write("debug", msg, fields) }
+func (bl *bufferLogger) Info(msg string, fields ...any)  { bl.write("info", msg, fields) }
+func (bl *bufferLogger) Warn(msg string, fields ...any)  { bl.write("warn", msg, fields) }
+func (bl *bufferLogger) Error(msg string, fields ...any) { bl.write("error", msg, fields) }
+
+// find method returns the first entry with the provided message, if any.
+func (bl *bufferLogger) find(msg string) (bufferEntry, bool) {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	for _, entry := range bl.entries {
+		if entry.msg == msg {
+			return entry, true
+		}
+	}
+	return bufferEntry{}, false
+}
+
+func TestWithRequestIDLogging(t *testing.T) {
+	bl := &bufferLogger{}
+	srv := newTestService(t, &Config{
+		EmailConfig:           email.EmailConfig{DisposableSrc: disposableServer(t, "disposable.com")},
+		UniformTokenResponses: true,
+		Logger:                bl,
+	})
+	appId, secret := createTestApp(t, srv, nil)
+	// the request id provided by the client is used in the logs
+	req := httptest.NewRequest(http.MethodPost, helpers.UserEndpointPath, strings.NewReader(`{"email":"user@disposable.com"}`))
+	req.Header.Set(helpers.AppSecretHeader, secret)
+	req.Header.Set(helpers.RequestIDHeader, "test-request")
+	res := httptest.NewRecorder()
+	srv.httpServer.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	if id := res.Header().Get(helpers.RequestIDHeader); id != "test-request" {
+		t.Errorf("expected test-request, got %q", id)
+	}
+	entry, ok := bl.find("token request rejected")
+	if !ok {
+		t.Fatalf("expected token request rejected entry, got %+v", bl.entries)
+	}
+	if entry.level != "warn" || entry.fields["request_id"] != "test-request" ||
+		entry.fields["app_id"] != appId || entry.fields["reason"] != "disallowed domain" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	// the emails pushed by the request carry its id to the queue
+	req = httptest.NewRequest(http.MethodPost, helpers.UserEndpointPath, strings.NewReader(`{"email":"user@simpleauth.link"}`))
+	req.Header.Set(helpers.AppSecretHeader, secret)
+	req.Header.Set(helpers.RequestIDHeader, "test-email")
+	srv.httpServer.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	if e := srv.emailQueue.Pop(); e == nil || e.RequestID != "test-email" {
+		t.Errorf("expected the email with the request id, got %+v", e)
+	}
+	// the invalid request ids are replaced by a generated one
+	for _, id := range []string{"", "invalid id", strings.Repeat("a", maxRequestIDSize+1)} {
+		req := httptest.NewRequest(http.MethodGet, helpers.HealthCheckPath, nil)
+		req.Header.Set(helpers.RequestIDHeader, id)
+		res := httptest.NewRecorder()
+		srv.httpServer.Handler.ServeHTTP(res, req)
+		if got := res.Header().Get(helpers.RequestIDHeader); got == id || len(got) != 2*requestIDSize {
+			t.Errorf("expected generated request id, got %q", got)
+		}
+	}
+}
+
+func TestSecurityEvents(t *testing.T) {
+	bl := &bufferLogger{}
+	srv := newTestService(t, &Config{
+		EmailConfig:       email.EmailConfig{DisposableSrc: disposableServer(t, "disposable.com")},
+		MaxFailedAttempts: 1,
+		AdminSecret:       "admin-secret",
+		Logger:            bl,
+	})
+	appId, secret := createTestApp(t, srv, &AppData{MaxTokenRequests: 1, TokenRequestsWindow: 60})
+	fake := appId + "-00000000-0000000000000000"
+	// every rejection path emits a security event with its reason
+	for _, tc := range []struct {
+		name   string
+		req    func() *http.Request
+		appId  string
+		status int
+		code   string
+	}{
+		{"invalid app secret", func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, helpers.UserEndpointPath+"?token="+fake, nil)
+			req.Header.Set(helpers.AppSecretHeader, "invalid-secret")
+			return req
+		}, "", http.StatusUnauthorized, ErrCodeInvalidAppSecret},
+		{"disallowed domain", func() *http.Request {
+			req := httptest.NewRequest(http.MethodPost, helpers.UserEndpointPath, strings.NewReader(`{"email":"user@disposable.com"}`))
+			req.Header.Set(helpers.AppSecretHeader, secret)
+			return req
+		}, appId, http.StatusBadRequest, ErrCodeDisallowedDomain},
+		{"too many token requests", func() *http.Request {
+			req := httptest.NewRequest(http.MethodPost, helpers.UserEndpointPath, strings.NewReader(`{"email":"user@simpleauth.link"}`))
+			req.Header.Set(helpers.AppSecretHeader, secret)
+			// the first request is allowed
+			srv.httpServer.Handler.ServeHTTP(httptest.NewRecorder(), req.Clone(req.Context()))
+			req.Body = io.NopCloser(strings.NewReader(`{"email":"user@simpleauth.link"}`))
+			return req
+		}, appId, http.StatusTooManyRequests, ErrCodeTooManyRequests},
+		{"invalid token", func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, helpers.UserEndpointPath+"?token="+fake, nil)
+			req.Header.Set(helpers.AppSecretHeader, secret)
+			return req
+		}, appId, http.StatusUnauthorized, ErrCodeInvalidToken},
+		{"too many failed attempts", func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, helpers.UserEndpointPath+"?token="+fake, nil)
+			req.Header.Set(helpers.AppSecretHeader, secret)
+			return req
+		}, appId, http.StatusTooManyRequests, ErrCodeTooManyAttempts},
+		{"invalid admin secret", func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, helpers.AdminStatsPath, nil)
+			req.Header.Set(helpers.AdminSecretHeader, "invalid-admin-secret")
+			return req
+		}, "", http.StatusUnauthorized, ErrCodeInvalidAdminSecret},
+	} {
+		req := tc.req()
+		bl.entries = nil
+		res := httptest.NewRecorder()
+		if req.URL.Path == helpers.AdminStatsPath {
+			srv.withAdminSecret(srv.statsHandler)(res, req)
+		} else {
+			srv.httpServer.Handler.ServeHTTP(res, req)
+		}
+		if res.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.status, res.Code, res.Body.String())
+			continue
+		}
+		entry, ok := bl.find("security event")
+		if !ok {
+			t.Errorf("%s: expected security event, got %+v", tc.name, bl.entries)
+			continue
+		}
+		if entry.level != "warn" || entry.fields["code"] != tc.code || entry.fields["status"] != tc.status ||
+			entry.fields["path"] != req.URL.Path || entry.fields["client_ip"] != clientIP(req) || entry.fields["reason"] == "" {
+			t.Errorf("%s: unexpected entry: %+v", tc.name, entry)
+		}
+		if tc.appId != "" && entry.fields["app_id"] != tc.appId {
+			t.Errorf("%s: expected app id %s, got %v", tc.name, tc.appId, entry.fields["app_id"])
+		}
+		// the secrets and the tokens are never logged
+		for _, value := range entry.fields {
+			if str := fmt.Sprint(value); strings.Contains(str, secret) || strings.Contains(str, fake) ||
+				strings.Contains(str, "invalid-secret") || strings.Contains(str, "admin-secret") {
+				t.Errorf("%s: expected no secrets, got %+v", tc.name, entry)
+			}
+		}
+	}
+	// the security events are logged at the configured level
+	bl = &bufferLogger{}
+	srv = newTestService(t, &Config{SecurityLogLevel: SecurityLogInfo, Logger: bl})
+	if res := validateToken(srv, "invalid-secret", fake); res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+	if entry, ok := bl.find("security event"); !ok || entry.level != "info" {
+		t.Errorf("expected info security event, got %+v", bl.entries)
+	}
+	// the unknown levels are rejected
+	testDB := new(db.TempDriver)
+	_ = testDB.Init(nil)
+	_, err := New(context.Background(), testDB, &Config{
+		EmailConfig:      testTemplatesConfig("", ""),
+		SecurityLogLevel: "verbose",
+	})
+	if err == nil || !strings.Contains(err.Error(), "security log level") {
+		t.Errorf("expected security log level error, got %v", err)
+	}
+}
+
+func TestHeadHandler(t *testing.T) {
+	srv := newTestService(t, nil)
+	_, secret := createTestApp(t, srv, nil)
+	token := userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	server := httptest.NewServer(srv.httpServer.Handler)
+	defer server.Close()
+	do := func(method, path, accept string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		req.Header.Set(helpers.AppSecretHeader, secret)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		defer res.Body.Close()
+		return res
+	}
+	validatePath := helpers.UserEndpointPath + "?" + helpers.TokenQueryParam + "="
+	for _, tc := range []struct {
+		path, accept string
+		status       int
+	}{
+		{helpers.HealthCheckPath, "", http.StatusOK},
+		{validatePath + url.QueryEscape(token), "", http.StatusOK},
+		{validatePath + url.QueryEscape(token), "application/json", http.StatusOK},
+		{validatePath + "invalid", "", http.StatusUnauthorized},
+		{helpers.UserEndpointPath, "", http.StatusBadRequest},
+	} {
+		get := do(http.MethodGet, tc.path, tc.accept)
+		head := do(http.MethodHead, tc.path, tc.accept)
+		if get.StatusCode != tc.status || head.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got GET %d and HEAD %d", tc.path, tc.status, get.StatusCode, head.StatusCode)
+		}
+		for _, header := range []string{"Content-Type", "Content-Length", "Vary", "X-Content-Type-Options"} {
+			if g, h := get.Header.Get(header), head.Header.Get(header); g != h {
+				t.Errorf("%s: expected %s %q, got %q", tc.path, header, g, h)
+			}
+		}
+		if head.ContentLength != get.ContentLength {
+			t.Errorf("%s: expected content length %d, got %d", tc.path, get.ContentLength, head.ContentLength)
+		}
+	}
+}
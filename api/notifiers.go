@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
+	"github.com/simpleauthlink/authapi/notify"
+)
+
+const (
+	// EmailNotifier is the name of the default notifier, that sends the magic
+	// link to the user email address.
+	EmailNotifier = "email"
+	// WebhookNotifier is the name of the built-in notifier that sends the
+	// magic link as JSON to the webhook url configured as the app target.
+	WebhookNotifier = "webhook"
+	// SlackNotifier is the name of the built-in notifier that sends the magic
+	// link to the Slack incoming webhook configured as the app target.
+	SlackNotifier = "slack"
+)
+
+// emailNotifier struct implements the notify.Notifier interface using the
+// service email queue. It composes the user email using the token email
+// template selected by the message (the default one if it is not registered)
+// and pushes it to the queue. The target is ignored because the
+// magic link is always sent to the user email address.
+type emailNotifier struct {
+	srv *Service
+}
+
+// Notify method composes the user token email with the message data, with the
+// app name sanitized and the template localized to the message locale, and
+// pushes it to the email queue, with a plaintext version as fallback and the
+// id of the request that originated the message, if the context has it. The
+// subject is the custom one of the message, the default one if it has none. It
+// returns an error if the templates can not be parsed or the email can not be
+// pushed to the queue.
+func (en *emailNotifier) Notify(ctx context.Context, _ string, msg *notify.Message) error {
+	// sanitize the app name again, the apps created before the names were
+	// sanitized can still include control characters
+	appName := sanitizeAppName(msg.AppName, en.srv.maxAppNameLength())
+	emailData := email.NewUserEmailData(appName, msg.Email, msg.MagicLink, msg.Token, msg.Locale)
+	if msg.Code != "" {
+		emailData.Code, emailData.CodeMinutes = msg.Code, helpers.CodeDuration/60
+	}
+	emailBody, err := en.srv.cfg.ParseConfigTemplate(en.srv.cfg.TokenTemplate(msg.Template), msg.Locale, emailData)
+	if err != nil {
+		return fmt.Errorf("error parsing email template: %w", err)
+	}
+	emailText, err := email.UserEmailText(emailData)
+	if err != nil {
+		return fmt.Errorf("error parsing email text template: %w", err)
+	}
+	subject := msg.Subject
+	if subject == "" {
+		subject = fmt.Sprintf(userTokenSubject, appName)
+	}
+	return en.srv.emailQueue.Push(&email.Email{
+		To:        msg.Email,
+		Subject:   subject,
+		Body:      emailBody,
+		TextBody:  emailText,
+		RequestID: requestIDFromContext(ctx),
+	})
+}
+
+// initNotifiers method registers the default notifiers (email, webhook and
+// slack) and the custom ones provided in the service config. The custom
+// notifiers overwrite the default ones if they share the same name. It also
+// creates the dispatcher used to deliver the messages with them.
+func (s *Service) initNotifiers() {
+	s.dispatcher = notify.NewDispatcher(notify.DispatcherConfig{
+		Timeout:  s.cfg.NotifierTimeout,
+		Attempts: s.cfg.NotifierAttempts,
+	})
+	s.notifiers = map[string]notify.Notifier{
+		EmailNotifier:   &emailNotifier{srv: s},
+		WebhookNotifier: notify.NewWebhookNotifier(nil),
+		SlackNotifier:   notify.NewSlackNotifier(nil),
+	}
+	for name, notifier := range s.cfg.Notifiers {
+		s.notifiers[name] = notifier
+	}
+}
+
+// notifier method returns the notifier registered with the provided name. If
+// the name is empty, it returns the default email notifier. If there is no
+// notifier registered with the name, it returns an error.
+func (s *Service) notifier(name string) (notify.Notifier, error) {
+	if name == "" {
+		name = EmailNotifier
+	}
+	notifier, ok := s.notifiers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown notifier '%s'", name)
+	}
+	return notifier, nil
+}
+
+// deliver method delivers the provided message to the notifier of the
+// provided app and to its additional channels at the same time, retrying the
+// attempts that time out. It returns the number of channels that delivered
+// the message and, depending on the delivery policy of the app, an error if
+// no channel delivered it (DeliveryPolicyAny) or if any channel failed
+// (DeliveryPolicyAll). The failures that do not break the policy are only
+// logged.
+func (s *Service) deliver(ctx context.Context, app *db.App, msg *notify.Message) (int, error) {
+	channels := append([]db.Channel{{Notifier: app.Notifier, Target: app.NotifierTarget}}, app.Channels...)
+	errs := make([]error, len(channels))
+	var wg sync.WaitGroup
+	for i, channel := range channels {
+		wg.Add(1)
+		go func(i int, channel db.Channel) {
+			defer wg.Done()
+			notifier, err := s.notifier(channel.Notifier)
+			if err == nil {
+				err = s.dispatcher.Dispatch(ctx, notifier, channel.Target, msg)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("channel %d (%s): %w", i, channel.Notifier, err)
+			}
+		}(i, channel)
+	}
+	wg.Wait()
+	delivered := 0
+	for _, err := range errs {
+		if err == nil {
+			delivered++
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil && delivered > 0 && deliveryPolicyOf(app) == DeliveryPolicyAny {
+		s.contextLogger(ctx).Warn("error delivering magic link to some channels", "app_id", app.ID, "error", err)
+		return delivered, nil
+	}
+	return delivered, err
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// pendingEmailIdSize is the size of the random ids of the pending emails, in
+// bytes.
+const pendingEmailIdSize = 8
+
+// dbPendingStore struct implements the email.PendingStore interface
+// persisting the emails of the queue in the database of the service until
+// they are sent.
+type dbPendingStore struct {
+	db db.DB
+}
+
+// StorePending method stores the provided email in the database as a pending
+// email, with the current time. If the email has no id, it sets a random one.
+// It returns an error if something fails during the process.
+func (store *dbPendingStore) StorePending(e *email.Email) error {
+	if e.ID == "" {
+		bId, err := helpers.RandBytes(pendingEmailIdSize)
+		if err != nil {
+			return err
+		}
+		e.ID = hex.EncodeToString(bId)
+	}
+	return store.db.EnqueueEmail(&db.PendingEmail{
+		ID:       e.ID,
+		To:       e.To,
+		Subject:  e.Subject,
+		Body:     e.Body,
+		TextBody: e.TextBody,
+		Priority: int(e.Priority),
+		QueuedAt: time.Now(),
+	})
+}
+
+// DeletePending method deletes the provided email from the pending emails of
+// the database. It returns an error if something fails during the process.
+func (store *dbPendingStore) DeletePending(e *email.Email) error {
+	if e.ID == "" {
+		return nil
+	}
+	return store.db.DequeueEmail(e.ID)
+}
+
+// PendingEmails method returns the pending emails stored in the database, in
+// the order they were queued. It returns an error if something fails during
+// the process.
+func (store *dbPendingStore) PendingEmails() ([]*email.Email, error) {
+	pending, err := store.db.PendingEmails()
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]*email.Email, 0, len(pending))
+	for _, e := range pending {
+		emails = append(emails, &email.Email{
+			ID:       e.ID,
+			To:       e.To,
+			Subject:  e.Subject,
+			Body:     e.Body,
+			TextBody: e.TextBody,
+			Priority: email.EmailPriority(e.Priority),
+		})
+	}
+	return emails, nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	pngContentType = "image/png"
+	svgContentType = "image/svg+xml"
+	// qrPNGSize is the size in pixels of the QR codes encoded as PNG.
+	qrPNGSize = 256
+)
+
+// qrContentType function negotiates the content type of a QR code based on
+// the provided Accept header. It returns the first supported content type
+// of the header (PNG or SVG), PNG if the header is empty or accepts any
+// image, and false if none of the supported content types are accepted.
+func qrContentType(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return pngContentType, true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case pngContentType, "image/*", "*/*":
+			return pngContentType, true
+		case svgContentType:
+			return svgContentType, true
+		}
+	}
+	return "", false
+}
+
+// encodeQR function encodes the provided content as a QR code image of the
+// provided content type (PNG or SVG). It returns an error if the content type
+// is not supported or the content can not be encoded.
+func encodeQR(content, contentType string) ([]byte, error) {
+	qr, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	switch contentType {
+	case pngContentType:
+		return qr.PNG(qrPNGSize)
+	case svgContentType:
+		return qrSVG(qr.Bitmap()), nil
+	default:
+		return nil, fmt.Errorf("unsupported content type: %s", contentType)
+	}
+}
+
+// qrSVG function renders the provided QR code bitmap as a SVG image, drawing
+// every dark module as a 1x1 square of a single path.
+func qrSVG(bitmap [][]bool) []byte {
+	size := len(bitmap)
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/>`, size, size)
+	fmt.Fprintf(&svg, `<path fill="#000" d="%s"/></svg>`, path.String())
+	return svg.Bytes()
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+func TestQRHandler(t *testing.T) {
+	srv := newTestService(t, nil)
+	_, secret := createTestApp(t, srv, nil)
+	token := userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+
+	getQR := func(token, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, helpers.UserQRPath+"?token="+token, nil)
+		req.Header.Set(helpers.AppSecretHeader, secret)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res := httptest.NewRecorder()
+		srv.withAppSecret(srv.qrHandler)(res, req)
+		return res
+	}
+	// png by default
+	res := getQR(token, "")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != pngContentType {
+		t.Fatalf("expected png response, got [%d] %s", res.Code, res.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != qrPNGSize || bounds.Dy() != qrPNGSize {
+		t.Errorf("expected %dx%d image, got %v", qrPNGSize, qrPNGSize, bounds)
+	}
+	// svg if preferred
+	res = getQR(token, "image/svg+xml, image/png;q=0.8")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != svgContentType {
+		t.Fatalf("expected svg response, got [%d] %s", res.Code, res.Header().Get("Content-Type"))
+	}
+	svg := struct {
+		XMLName xml.Name `xml:"svg"`
+		ViewBox string   `xml:"viewBox,attr"`
+	}{}
+	if err := xml.NewDecoder(bytes.NewReader(res.Body.Bytes())).Decode(&svg); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if svg.ViewBox == "" {
+		t.Errorf("expected svg with view box, got %s", res.Body.String())
+	}
+	// unsupported format, missing and invalid tokens
+	if res := getQR(token, "text/html"); res.Code != http.StatusNotAcceptable {
+		t.Errorf("expected %d, got %d", http.StatusNotAcceptable, res.Code)
+	}
+	if res := getQR("", ""); res.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, res.Code)
+	}
+	if res := getQR("invalid", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/email"
+)
+
+// quotaWarningTTL is the time that an app is considered notified once its
+// usage reaches the users quota warning threshold, the admin is notified
+// again after it if the usage is still above the threshold.
+const quotaWarningTTL = 30 * 24 * time.Hour
+
+// checkUsersQuota method checks the usage of the users quota of the provided
+// app, its current number of tokens, against the configured warning
+// threshold (a percentage of the quota). The first time that the usage
+// reaches the threshold, the app admin is notified (see notifyUsersQuota).
+// The notified state of the app is kept in a shared attempts counter, so a
+// single notification is sent even with several service instances, and it is
+// reset once the usage drops below the threshold, to notify the admin again
+// if it is reached again. If the threshold is not configured, it does nothing.
+// The provided context and user id are the ones of the token request that
+// checks the usage.
+func (s *Service) checkUsersQuota(ctx context.Context, appId string, app *db.App, userId string) {
+	threshold := int64(s.cfg.QuotaWarningThreshold)
+	if threshold <= 0 || app.UsersQuota <= 0 {
+		return
+	}
+	usage, err := s.db.CountTokens(appId)
+	if err != nil {
+		s.contextLogger(ctx).Error("error counting tokens", "app_id", appId, "error", err)
+		return
+	}
+	key := attemptsKey(quotaWarningAttempts, appId, "users")
+	// re-arm the notification when the usage drops below the threshold
+	if usage*100 < app.UsersQuota*threshold {
+		if notified, err := s.db.Attempts(key); err == nil && notified > 0 {
+			if err := s.db.ResetAttempts(key); err != nil {
+				s.contextLogger(ctx).Error("error resetting quota warning", "app_id", appId, "error", err)
+			}
+		}
+		return
+	}
+	// notify only the first time that the threshold is reached
+	notified, err := s.db.IncrAttempts(key, quotaWarningTTL)
+	if err != nil {
+		s.contextLogger(ctx).Error("error updating quota warning", "app_id", appId, "error", err)
+		return
+	}
+	if notified != 1 {
+		return
+	}
+	if err := s.notifyUsersQuota(ctx, appId, app, usage, userId); err != nil {
+		s.contextLogger(ctx).Error("error sending quota warning", "app_id", appId, "error", err)
+		// retry the notification in the next token request
+		if err := s.db.ResetAttempts(key); err != nil {
+			s.contextLogger(ctx).Error("error resetting quota warning", "app_id", appId, "error", err)
+		}
+	}
+}
+
+// notifyUsersQuota method warns the admin of the provided app that its usage
+// is reaching its users quota, by email and, if the app has a webhook, with
+// the WebhookQuotaWarning event. It returns an error if the email can not be
+// composed or pushed to the email queue.
+func (s *Service) notifyUsersQuota(ctx context.Context, appId string, app *db.App, usage int64, userId string) error {
+	s.emitWebhook(ctx, WebhookQuotaWarning, appId, userId)
+	appName := sanitizeAppName(app.Name, s.maxAppNameLength())
+	emailData := email.NewQuotaEmailData(appId, appName, usage, app.UsersQuota, app.AdminEmail)
+	emailBody, err := email.QuotaEmailHTML(emailData)
+	if err != nil {
+		return err
+	}
+	emailText, err := email.QuotaEmailText(emailData)
+	if err != nil {
+		return err
+	}
+	return s.emailQueue.Push(&email.Email{
+		To:        app.AdminEmail,
+		Subject:   fmt.Sprintf(quotaWarningSubject, appName),
+		Body:      emailBody,
+		TextBody:  emailText,
+		Priority:  email.HighPriority,
+		RequestID: requestIDFromContext(ctx),
+	})
+}
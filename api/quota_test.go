@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUsersQuotaWarning(t *testing.T) {
+	srv := newTestService(t, &Config{QuotaWarningThreshold: 50})
+	appId, secret := createTestApp(t, srv, &AppData{Name: "Acme", UsersQuota: 4})
+	for srv.emailQueue.Pop() != nil {
+	}
+	// issueToken function issues a token for the provided user and returns
+	// the number of quota warnings queued
+	issueToken := func(user string) int {
+		t.Helper()
+		userToken(t, srv, secret, &TokenRequest{Email: user + "@simpleauth.link"})
+		warnings := 0
+		for e := srv.emailQueue.Pop(); e != nil; e = srv.emailQueue.Pop() {
+			if e.Subject != fmt.Sprintf(quotaWarningSubject, "Acme") {
+				t.Errorf("unexpected email: %s", e.Subject)
+				continue
+			}
+			if !strings.Contains(e.TextBody, appId) {
+				t.Errorf("expected app id in the email, got %s", e.TextBody)
+			}
+			warnings++
+		}
+		return warnings
+	}
+	// below the threshold, no warning
+	if n := issueToken("user1"); n != 0 {
+		t.Errorf("expected no warning, got %d", n)
+	}
+	// crossing the threshold warns once
+	if n := issueToken("user2"); n != 1 {
+		t.Errorf("expected 1 warning, got %d", n)
+	}
+	if n := issueToken("user3"); n != 0 {
+		t.Errorf("expected no warning, got %d", n)
+	}
+	// dropping below the threshold re-arms the warning
+	for _, user := range []string{"user1", "user2", "user3"} {
+		if err := srv.revokeUserTokens(appId, user+"@simpleauth.link"); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if n := issueToken("user4"); n != 0 {
+		t.Errorf("expected no warning, got %d", n)
+	}
+	if n := issueToken("user5"); n != 1 {
+		t.Errorf("expected 1 warning, got %d", n)
+	}
+}
+
+func TestUsersQuotaWarningDisabled(t *testing.T) {
+	srv := newTestService(t, nil)
+	_, secret := createTestApp(t, srv, &AppData{UsersQuota: 2})
+	for srv.emailQueue.Pop() != nil {
+	}
+	for _, user := range []string{"user1", "user2"} {
+		userToken(t, srv, secret, &TokenRequest{Email: user + "@simpleauth.link"})
+	}
+	if e := srv.emailQueue.Pop(); e != nil {
+		t.Errorf("expected no email, got %s", e.Subject)
+	}
+}
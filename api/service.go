@@ -1,10 +1,16 @@
+// Package api implements the SimpleAuthLink service: the HTTP handlers of the
+// users, apps and admin endpoints, and the background processes that support
+// them (the email queue and the token cleaner). It is the only implementation
+// of the service, the consumers that embed it must create it with New, and
+// the command in cmd/authapi runs it as a standalone server.
 package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sync"
@@ -15,125 +21,489 @@ import (
 	"github.com/simpleauthlink/authapi/db"
 	"github.com/simpleauthlink/authapi/email"
 	"github.com/simpleauthlink/authapi/helpers"
+	"github.com/simpleauthlink/authapi/logger"
+	"github.com/simpleauthlink/authapi/metrics"
+	"github.com/simpleauthlink/authapi/notify"
 )
 
+// defaultShutdownTimeout is the maximum time to finish the requests in
+// progress and to send the pending emails when the service is stopped, if it
+// is not configured.
+const defaultShutdownTimeout = 5 * time.Second
+
+// defaultWebhookAttempts is the number of attempts to deliver a webhook event,
+// if it is not configured.
+const defaultWebhookAttempts = 3
+
+// defaultWebhookRetryDelay is the delay before the second attempt to deliver
+// a webhook event, it is doubled before every following attempt, if it is not
+// configured.
+const defaultWebhookRetryDelay = time.Second
+
+// defaultTombstoneRetention is the time that the tombstones of the soft
+// deleted tokens are kept before they are purged, if it is not configured.
+const defaultTombstoneRetention = 30 * 24 * time.Hour
+
+// defaultSecretGracePeriod is the time that the previous secret of an app is
+// still valid once it is rotated, if it is not configured.
+const defaultSecretGracePeriod = 24 * time.Hour
+
+// healthCheckTimeout is the maximum time to check the database connection in
+// the health checks.
+const healthCheckTimeout = 2 * time.Second
+
+// TrailingSlashMode type represents how the service handles the requests to
+// an endpoint path with a trailing slash (for example, "/user/").
+type TrailingSlashMode int
+
+const (
+	// TrailingSlashRewrite mode handles the requests with a trailing slash as
+	// the requests to the path without it. It is the default mode.
+	TrailingSlashRewrite TrailingSlashMode = iota
+	// TrailingSlashRedirect mode redirects the requests with a trailing slash
+	// to the path without it.
+	TrailingSlashRedirect
+)
+
+// ValidationHook type represents a custom function that is called after the
+// standard checks of a user token validation succeed. It receives the app id
+// and the user id of the token, and the validation is denied if it returns an
+// error. It allows to extend the authorization logic (for example, checking an
+// external allowlist) without forking the service.
+type ValidationHook func(ctx context.Context, appId, userId string) error
+
 // Config struct represents the configuration needed to init the service. It
-// includes the email configuration, the server hostname, the server port, the
-// data path to store the database, and the cleaner cooldown to clean the
-// expired tokens.
+// includes the email configuration and the options of the server, the
+// tokens, the apps and the background processes of the service. The zero
+// value of every option is a sensible default.
 type Config struct {
 	email.EmailConfig
-	Server          string
-	ServerPort      int
+	// Server is the hostname of the server.
+	Server string
+	// ServerPort is the port of the public listener of the server.
+	ServerPort int
+	// APIEndpoint is the public url of the service, used to compose the app
+	// config snippets (helpers.DefaultAPIEndpoint by default).
+	APIEndpoint string
+	// CleanerCooldown is the time between the runs of the cleaner of the
+	// expired tokens.
 	CleanerCooldown time.Duration
+	// Notifiers are the custom notifiers that the apps can use to deliver the
+	// magic links.
+	Notifiers map[string]notify.Notifier
+	// UniformTokenResponses makes the token requests always get the same "Ok"
+	// response, regardless of whether the email was accepted, to avoid
+	// leaking information (the detailed errors are only logged). Disable it
+	// to debug the token requests with detailed responses.
+	UniformTokenResponses bool
+	// MinValidationDelay is the minimum time that a token validation takes to
+	// respond, to make the valid and invalid tokens indistinguishable by the
+	// response time.
+	MinValidationDelay time.Duration
+	// MaxFailedAttempts, if it is greater than zero, is the number of failed
+	// token validations for an app that locks out a client during the
+	// LockoutDuration.
+	MaxFailedAttempts int64
+	LockoutDuration   time.Duration
+	// ValidationHook is an optional function called to approve every valid
+	// user token.
+	ValidationHook ValidationHook
+	// MaxConcurrentRequests, if it is greater than zero, limits the number of
+	// requests handled at the same time, the requests beyond the limit wait
+	// up to ConcurrencyWaitTimeout for a free slot before being rejected.
+	MaxConcurrentRequests  int
+	ConcurrencyWaitTimeout time.Duration
+	// AllowUnknownFields makes the request bodies with unknown fields to be
+	// accepted, ignoring those fields, instead of rejected.
+	AllowUnknownFields bool
+	// DefaultRedirectURL is the optional redirect URL of the apps created
+	// without one, it must be an absolute http(s) url.
+	DefaultRedirectURL string
+	// AdminSecret is the secret that the service admins (operators) must
+	// provide to use the admin endpoints, they are disabled if it is empty.
+	AdminSecret string
+	// AdminAddr, if it is set (for example, "127.0.0.1:9090"), is the address
+	// of a separate listener, which should be internal-only, that serves the
+	// admin endpoints instead of the public one.
+	AdminAddr string
+	// TrailingSlash sets how the requests to the endpoints with a trailing
+	// slash are handled (rewritten by default).
+	TrailingSlash TrailingSlashMode
+	// EmailSender is used, if it is set, to deliver the emails instead of the
+	// SMTP server of the email configuration.
+	EmailSender email.Sender
+	// AllowedOrigins are the origins allowed to read the responses of the API
+	// (CORS), any origin if it is empty. The apps can restrict them with their
+	// own allowed origins.
+	AllowedOrigins []string
+	// HashAlgorithm is used to generate the app ids and the user ids (SHA-256
+	// by default). It must not change once the service has apps, or their ids
+	// will not match anymore.
+	HashAlgorithm helpers.HashAlgorithm
+	// NotifierTimeout is the maximum time of every attempt to deliver a magic
+	// link with the notifiers, and the attempts that time out are retried up
+	// to NotifierAttempts times in total (see notify.DispatcherConfig for the
+	// defaults).
+	NotifierTimeout  time.Duration
+	NotifierAttempts int
+	// PersistEmails makes the emails pushed to the email queue to be stored in
+	// the database until they are sent, so the emails that are pending when
+	// the service stops unexpectedly are sent when it starts again.
+	PersistEmails bool
+	// ShutdownTimeout is the maximum time to finish the requests in progress
+	// and, then, to send the pending emails when the service is stopped (5
+	// seconds by default).
+	ShutdownTimeout time.Duration
+	// Logger is used to write the logs of the service, including the email
+	// queue, the default one (see logger.Default) if it is nil.
+	Logger logger.Logger
+	// MaxAppNameLength is the maximum number of characters of the app names,
+	// the longer ones are truncated (see helpers.DefaultMaxAppNameLength for
+	// the default).
+	MaxAppNameLength int
+	// CleanupGracePeriod is the time that the expired tokens are kept before
+	// they are cleaned, to allow inspecting the recently expired ones and to
+	// tolerate clock skews (none by default).
+	CleanupGracePeriod time.Duration
+	// Metrics is the sink used to emit the metrics of the service (the tokens
+	// issued and validated, the emails sent and the emails waiting in the
+	// queue), for example, to Prometheus (see metrics.PrometheusSink) or to
+	// StatsD (see metrics.StatsDSink), they are discarded if it is nil. If
+	// the sink is also an http.Handler, it is served in the
+	// helpers.AdminMetricsPath admin endpoint.
+	Metrics metrics.Sink
+	// SoftDeleteTokens makes the tokens deleted by the service (expired,
+	// replaced, refreshed, revoked or of deleted apps) to be replaced by
+	// tombstones with the reason and the deletion time for audit, which are
+	// purged by the tokens cleaner after the TombstoneRetention (30 days by
+	// default).
+	SoftDeleteTokens   bool
+	TombstoneRetention time.Duration
+	// WebhookAttempts is the number of attempts to post an event to an app
+	// webhook (3 by default), waiting WebhookRetryDelay before the second
+	// attempt (1s by default), which is doubled before every following one.
+	WebhookAttempts   int
+	WebhookRetryDelay time.Duration
+	// QuotaWarningThreshold, if it is greater than zero, is the percentage of
+	// the users quota of an app (for example, 90) that, once reached, warns
+	// its admin. The admin is warned again once the usage drops below it and
+	// reaches it again.
+	QuotaWarningThreshold int
+	// SecurityLogLevel is the level of the security events logged for the
+	// rejected requests (invalid secrets or tokens, disallowed domains, rate
+	// limits, etc.), to allow to feed them to a SIEM: "debug", "info", "warn"
+	// or "error" ("warn" by default).
+	SecurityLogLevel string
+	// Issuer identifies the service in the "iss" field of the token
+	// validations (see TokenValidation), to allow the clients to check it
+	// when several services are used.
+	Issuer string
+	// SecretGracePeriod is the time that the previous secrets of an app are
+	// still valid once it is rotated or a new one is resent (24h by
+	// default), to allow to update the app without downtime.
+	SecretGracePeriod time.Duration
 }
 
 // Service struct represents the service that is going to be started. It
 // includes the context and the cancel function to stop the service, the wait
 // group to wait for the background processes to finish, the configuration,
-// the database connection and the api handler.
+// the database connection, the logger, the metrics sink, the queue of the
+// webhook events, the api handler, the http servers (the admin one is nil if
+// no admin address is configured) and the locks that serialize the token
+// updates of every user.
 type Service struct {
-	ctx        context.Context
-	cancel     context.CancelFunc
-	wait       sync.WaitGroup
-	cfg        *Config
-	db         db.DB
-	emailQueue *email.EmailQueue
-	handler    *apihandler.Handler
-	httpServer *http.Server
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wait        sync.WaitGroup
+	stopOnce    sync.Once
+	cfg         *Config
+	db          db.DB
+	logger      logger.Logger
+	metrics     metrics.Sink
+	webhooks    chan *webhookDelivery
+	emailQueue  *email.EmailQueue
+	notifiers   map[string]notify.Notifier
+	dispatcher  *notify.Dispatcher
+	handler     *apihandler.Handler
+	httpServer  *http.Server
+	adminServer *http.Server
+	userLocks   keyedMutex
 }
 
 // New function creates a new service based on the provided context, the db
 // interface and configuration. It initializes the email queue, creates the
-// service and sets the api handlers. If something goes wrong during the
-// process, it returns an error.
+// service and sets the api handlers. If the default redirect URL, the allowed
+// origins, the hash algorithm or the email templates are not valid, or
+// something goes wrong during the process, it returns an error.
 func New(ctx context.Context, db db.DB, cfg *Config) (*Service, error) {
+	if err := email.ValidateTemplates(&cfg.EmailConfig); err != nil {
+		return nil, err
+	}
+	if cfg.DefaultRedirectURL != "" {
+		redirectURL, err := url.Parse(cfg.DefaultRedirectURL)
+		if err != nil || (redirectURL.Scheme != "http" && redirectURL.Scheme != "https") || redirectURL.Host == "" {
+			return nil, fmt.Errorf("invalid default redirect URL: %s", cfg.DefaultRedirectURL)
+		}
+	}
+	if !cfg.HashAlgorithm.Valid() {
+		return nil, fmt.Errorf("invalid hash algorithm: %s", cfg.HashAlgorithm)
+	}
+	if !validSecurityLogLevel(cfg.SecurityLogLevel) {
+		return nil, fmt.Errorf("invalid security log level: %s", cfg.SecurityLogLevel)
+	}
+	allowedOrigins, err := normalizeOrigins(cfg.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AllowedOrigins = allowedOrigins
 	internalCtx, cancel := context.WithCancel(ctx)
-	emailQueue, err := email.NewEmailQueue(internalCtx, &cfg.EmailConfig)
+	emailQueue, err := email.NewEmailQueue(internalCtx, &cfg.EmailConfig, cfg.EmailSender)
+	if err != nil && emailQueue == nil {
+		cancel()
+		return nil, err
+	}
+	serviceLogger := cfg.Logger
+	if serviceLogger == nil {
+		serviceLogger = logger.Default()
+	}
 	if err != nil {
-		if emailQueue == nil {
-			cancel()
-			return nil, err
-		}
-		log.Println("WRN: something occurs during email queue creation:", err)
+		serviceLogger.Warn("something occurs during email queue creation", "error", err)
+	}
+	emailQueue.SetLogger(serviceLogger)
+	metricsSink := cfg.Metrics
+	if metricsSink == nil {
+		metricsSink = metrics.Default()
 	}
+	emailQueue.SetMetrics(metricsSink)
 	// create the service
 	srv := &Service{
 		ctx:        internalCtx,
 		cancel:     cancel,
 		cfg:        cfg,
 		db:         db,
+		logger:     serviceLogger,
+		metrics:    metricsSink,
+		webhooks:   make(chan *webhookDelivery, webhookQueueSize),
 		emailQueue: emailQueue,
 		handler: apihandler.NewHandler(&apihandler.Config{
-			CORS: true,
+			// the CORS headers are set by the cors middleware
+			CORS: false,
 			RateLimitConfig: &apihandler.RateLimitConfig{
 				Rate:  2,
 				Limit: 10,
 			},
 		}),
 	}
-	srv.handler.Get(helpers.HealthCheckPath, func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	srv.initNotifiers()
+	// record the emails that could not be sent in the database
+	emailQueue.SetDeadLetterStore(&dbDeadLetterStore{db: db})
+	// persist the pending emails in the database to recover them after a
+	// restart, if it is enabled
+	if cfg.PersistEmails {
+		emailQueue.SetPendingStore(&dbPendingStore{db: db})
+	}
+	srv.handler.Get(helpers.HealthCheckPath, srv.healthHandler)
+	srv.handler.Head(helpers.HealthCheckPath, headHandler(srv.healthHandler))
 	// user handlers
-	srv.handler.Post(helpers.UserEndpointPath, srv.userTokenHandler)
-	srv.handler.Get(helpers.UserEndpointPath, srv.validateUserTokenHandler)
+	srv.handler.Post(helpers.UserEndpointPath, srv.withAppSecret(srv.userTokenHandler))
+	srv.handler.Get(helpers.UserEndpointPath, srv.withAppSecret(srv.validateUserTokenHandler))
+	srv.handler.Head(helpers.UserEndpointPath, headHandler(srv.withAppSecret(srv.validateUserTokenHandler)))
+	srv.handler.Post(helpers.UserCheckEmailPath, srv.withAppSecret(srv.checkEmailHandler))
+	srv.handler.Get(helpers.UserQRPath, srv.withAppSecret(srv.qrHandler))
+	srv.handler.Get(helpers.UserLinkPath, srv.withAppSecret(srv.magicLinkHandler))
+	srv.handler.Post(helpers.UserRefreshPath, srv.withAppSecret(srv.refreshUserTokenHandler))
+	srv.handler.Post(helpers.UserVerifyPath, srv.withAppSecret(srv.verifyCodeHandler))
 	// app handlers
-	srv.handler.Get(helpers.AppEndpointPath, srv.appHandler)
+	srv.handler.Get(helpers.AppEndpointPath, srv.withAppSecret(srv.appHandler))
 	srv.handler.Post(helpers.AppEndpointPath, srv.appTokenHandler)
-	srv.handler.Put(helpers.AppEndpointPath, srv.updateAppHandler)
-	srv.handler.Delete(helpers.AppEndpointPath, srv.delAppHandler)
+	srv.handler.Put(helpers.AppEndpointPath, srv.withAppSecret(srv.updateAppHandler))
+	srv.handler.Delete(helpers.AppEndpointPath, srv.withAppSecret(srv.delAppHandler))
+	srv.handler.Get(helpers.AppConfigPath, srv.withAppSecret(srv.appConfigHandler))
+	srv.handler.Delete(helpers.AppAttemptsPath, srv.withAppSecret(srv.resetAttemptsHandler))
+	srv.handler.Get(helpers.AppUsersPath, srv.withAppSecret(srv.appUsersHandler))
+	srv.handler.Get(helpers.AppTokensPath, srv.withAppSecret(srv.appTokensHandler))
+	srv.handler.Delete(helpers.AppUserPath, srv.withAppSecret(srv.revokeUserHandler))
+	srv.handler.Post(helpers.AppSecretRotatePath, srv.withAppSecret(srv.rotateSecretHandler))
+	srv.handler.Post(helpers.AppResendPath, srv.resendAppHandler)
+	// admin handlers, served by the public handler unless an admin address
+	// is configured
+	adminHandler := srv.handler
+	if cfg.AdminAddr != "" {
+		adminHandler = apihandler.NewHandler(nil)
+		adminHandler.Get(helpers.HealthCheckPath, srv.healthHandler)
+		adminHandler.Head(helpers.HealthCheckPath, headHandler(srv.healthHandler))
+		srv.adminServer = &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: srv.withRequestID(srv.normalizeTrailingSlash(adminHandler)),
+		}
+	}
+	adminHandler.Get(helpers.AdminAppsPath, srv.withAdminSecret(srv.listAppsHandler))
+	adminHandler.Get(helpers.AdminDeadLettersPath, srv.withAdminSecret(srv.listDeadLettersHandler))
+	adminHandler.Post(helpers.AdminDeadLettersRetryPath, srv.withAdminSecret(srv.retryDeadLetterHandler))
+	adminHandler.Get(helpers.AdminStatsPath, srv.withAdminSecret(srv.statsHandler))
+	if metricsHandler, ok := metricsSink.(http.Handler); ok {
+		adminHandler.Get(helpers.AdminMetricsPath, srv.withAdminSecret(metricsHandler.ServeHTTP))
+	}
 	// build the http server
 	srv.httpServer = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.Server, cfg.ServerPort),
-		Handler: srv.handler,
+		Handler: srv.withRequestID(srv.cors(srv.limitConcurrency(srv.normalizeTrailingSlash(srv.handler)))),
 	}
 	return srv, nil
 }
 
-// Start method starts the service. It starts the token cleaner and the api
-// server. If something goes wrong during the process, it returns an error.
+// Handler method returns the http handler of the public api server of the
+// service, including its middlewares, to allow serving it from other servers
+// (for example, in tests).
+func (s *Service) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+// Start method starts the service. It starts the token cleaner, the webhook
+// worker, the api server and the admin server, if it is configured. It blocks
+// until the servers are closed. If something goes wrong during the process, it
+// returns an error.
 func (s *Service) Start() error {
 	// start the email queue
 	s.emailQueue.Start()
 	// start the token cleaner in the background
 	s.sanityTokenCleaner()
-	// start the api server
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return err
+	// start the delivery of the webhook events in the background
+	s.webhookWorker()
+	// start the api server and the admin server
+	servers := []*http.Server{s.httpServer}
+	if s.adminServer != nil {
+		servers = append(servers, s.adminServer)
+	}
+	errCh := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("error listening on %s: %w", server.Addr, err)
+				return
+			}
+			errCh <- nil
+		}(server)
+	}
+	// wait for the servers, returning the first error
+	for range servers {
+		if err := <-errCh; err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Stop method stops the service. It cancels the context and waits for the
-// background processes to finish. It closes the database. If something goes
-// wrong during the process, it returns an error.
+// Stop method stops the service following a safe order: first it stops the
+// email queue (which stops accepting new emails) and drains the pending
+// emails, up to the configured shutdown timeout, then it cancels the context
+// and waits for the background processes (like the token cleaner) to finish,
+// and finally it closes the database, so no process uses it after it is
+// closed. It only stops the service once, the following calls do nothing. If
+// something goes wrong during the process, it returns an error.
 func (s *Service) Stop() error {
-	// close the database
-	if err := s.db.Close(); err != nil {
-		return fmt.Errorf("error closing db: %w", err)
-	}
-	// stop the email queue
-	s.emailQueue.Stop()
-	// cancel the context and wait for the background processes finish
-	s.cancel()
-	defer s.wait.Wait()
-	return nil
+	var err error
+	s.stopOnce.Do(func() {
+		// stop the email queue and send the pending emails
+		s.emailQueue.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+		defer cancel()
+		if err := s.emailQueue.Drain(ctx); err != nil {
+			s.logger.Warn("error draining email queue", "error", err)
+		}
+		// cancel the context and wait for the background processes finish
+		s.cancel()
+		s.wait.Wait()
+		// close the database
+		if cerr := s.db.Close(); cerr != nil {
+			err = fmt.Errorf("error closing db: %w", cerr)
+		}
+	})
+	return err
 }
 
 // WaitToShutdown method waits for the service to shutdown. It listens for the
-// interrupt signal and shutdown the http server and the service. If something
-// goes wrong during the process, it returns an error.
+// interrupt signal and shutdown the http servers and the service (see
+// Shutdown). If something goes wrong during the process, it returns an error.
 func (s *Service) WaitToShutdown() error {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	<-done
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return s.Shutdown()
+}
+
+// Shutdown method gracefully shuts down the http servers and then stops the
+// service. The servers stop accepting new requests and wait for the requests
+// in progress up to the configured shutdown timeout, when the connections
+// that are still open are closed. The service is stopped in any case. If
+// something goes wrong during the process, for example, the timeout is
+// reached, it returns an error.
+func (s *Service) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
 	defer cancel()
 	defer func() {
 		if err := s.Stop(); err != nil {
-			log.Println(err)
+			s.logger.Error("error stopping service", "error", err)
 		}
 	}()
-	return s.httpServer.Shutdown(ctx)
+	servers := []*http.Server{s.httpServer}
+	if s.adminServer != nil {
+		servers = append(servers, s.adminServer)
+	}
+	var err error
+	for _, server := range servers {
+		if serr := server.Shutdown(ctx); serr != nil {
+			// cut off the requests that are still in progress
+			err = errors.Join(err, serr, server.Close())
+		}
+	}
+	return err
+}
+
+// maxAppNameLength method returns the configured maximum length of the app
+// names or the default one if it is not configured.
+func (s *Service) maxAppNameLength() int {
+	if s.cfg.MaxAppNameLength <= 0 {
+		return helpers.DefaultMaxAppNameLength
+	}
+	return s.cfg.MaxAppNameLength
+}
+
+// shutdownTimeout method returns the configured shutdown timeout or the
+// default one if it is not configured.
+func (s *Service) shutdownTimeout() time.Duration {
+	if s.cfg.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return s.cfg.ShutdownTimeout
+}
+
+// cleanupGracePeriod method returns the configured cleanup grace period, or
+// zero if it is not configured or negative, to not clean the tokens that are
+// not expired yet.
+func (s *Service) cleanupGracePeriod() time.Duration {
+	if s.cfg.CleanupGracePeriod < 0 {
+		return 0
+	}
+	return s.cfg.CleanupGracePeriod
+}
+
+// tombstoneRetention method returns the configured retention of the
+// tombstones of the soft deleted tokens or the default one if it is not
+// configured.
+func (s *Service) tombstoneRetention() time.Duration {
+	if s.cfg.TombstoneRetention <= 0 {
+		return defaultTombstoneRetention
+	}
+	return s.cfg.TombstoneRetention
+}
+
+// secretGracePeriod method returns the configured time that the previous
+// secret of an app is still valid once it is rotated or the default one if it
+// is not configured.
+func (s *Service) secretGracePeriod() time.Duration {
+	if s.cfg.SecretGracePeriod <= 0 {
+		return defaultSecretGracePeriod
+	}
+	return s.cfg.SecretGracePeriod
 }
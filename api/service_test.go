@@ -2,13 +2,60 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/simpleauthlink/authapi/db"
 	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
 )
 
+// newTestService function creates a new service for testing purposes, using
+// a temporal database and a valid email configuration. The provided config
+// is completed with the required values if they are not set.
+func newTestService(t *testing.T, cfg *Config) *Service {
+	t.Helper()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if cfg.Server == "" {
+		cfg.Server = "localhost"
+	}
+	if cfg.CleanerCooldown == 0 {
+		cfg.CleanerCooldown = 30 * time.Second
+	}
+	if cfg.Address == "" {
+		cfg.Address = "test@simpleauth.link"
+		cfg.EmailHost = "smtp.simpleauth.link"
+		cfg.EmailPort = 587
+		cfg.Password = "password"
+	}
+	if cfg.TokenEmailTemplate == "" {
+		cfg.TokenEmailTemplate = "../assets/token_email_template.html"
+	}
+	if cfg.AppEmailTemplate == "" {
+		cfg.AppEmailTemplate = "../assets/app_email_template.html"
+	}
+	testDB := new(db.TempDriver)
+	if err := testDB.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	srv, err := New(context.Background(), testDB, cfg)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	t.Cleanup(srv.cancel)
+	return srv
+}
+
 func TestNew(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -20,10 +67,12 @@ func TestNew(t *testing.T) {
 		ServerPort:      8080,
 		CleanerCooldown: 30 * time.Second,
 		EmailConfig: email.EmailConfig{
-			EmailHost: "smtp.gmail.com",
-			EmailPort: 587,
-			Address:   "",
-			Password:  "",
+			EmailHost:          "smtp.gmail.com",
+			EmailPort:          587,
+			Address:            "test@simpleauth.link",
+			Password:           "password",
+			TokenEmailTemplate: "../assets/token_email_template.html",
+			AppEmailTemplate:   "../assets/app_email_template.html",
 		},
 	})
 	if err != nil {
@@ -35,3 +84,223 @@ func TestNew(t *testing.T) {
 		return
 	}
 }
+
+// testTemplatesConfig function returns an email config with the provided
+// token and app email templates paths. Empty paths are replaced by the
+// default templates.
+func testTemplatesConfig(tokenTemplate, appTemplate string) email.EmailConfig {
+	if tokenTemplate == "" {
+		tokenTemplate = "../assets/token_email_template.html"
+	}
+	if appTemplate == "" {
+		appTemplate = "../assets/app_email_template.html"
+	}
+	return email.EmailConfig{TokenEmailTemplate: tokenTemplate, AppEmailTemplate: appTemplate}
+}
+
+func TestNewInvalidDefaultRedirectURL(t *testing.T) {
+	testDB := new(db.TempDriver)
+	_ = testDB.Init(nil)
+	for _, rawURL := range []string{"not a url", "ftp://simpleauth.link", "/callback"} {
+		_, err := New(context.Background(), testDB, &Config{
+			EmailConfig:        testTemplatesConfig("", ""),
+			DefaultRedirectURL: rawURL,
+		})
+		if err == nil || !strings.Contains(err.Error(), "redirect URL") {
+			t.Errorf("expected redirect URL error for %q, got %v", rawURL, err)
+		}
+	}
+}
+
+func TestNewInvalidTemplates(t *testing.T) {
+	testDB := new(db.TempDriver)
+	_ = testDB.Init(nil)
+	dir := t.TempDir()
+	malformed := filepath.Join(dir, "malformed.html")
+	if err := os.WriteFile(malformed, []byte("<p>{{ .AppName </p>"), 0o600); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	missingField := filepath.Join(dir, "missing_field.html")
+	if err := os.WriteFile(missingField, []byte("<p>{{ .UnknownField }}</p>"), 0o600); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	withTemplates := func(templates map[string]string) email.EmailConfig {
+		cfg := testTemplatesConfig("", "")
+		cfg.TokenEmailTemplates = templates
+		return cfg
+	}
+	withTemplatesDir := func(templatesDir, tokenTemplate string) email.EmailConfig {
+		cfg := testTemplatesConfig(tokenTemplate, "")
+		cfg.TemplatesDir = templatesDir
+		return cfg
+	}
+	tests := []struct {
+		name string
+		cfg  email.EmailConfig
+	}{
+		{"malformed token template", testTemplatesConfig(malformed, "")},
+		{"token template with missing field", testTemplatesConfig(missingField, "")},
+		{"malformed app template", testTemplatesConfig("", malformed)},
+		{"app template with missing field", testTemplatesConfig("", missingField)},
+		{"missing template file", testTemplatesConfig(filepath.Join(dir, "unknown.html"), "")},
+		{"malformed keyed token template", withTemplates(map[string]string{"signup": malformed})},
+		{"invalid token template key", withTemplates(map[string]string{"../signup": "../assets/token_email_template.html"})},
+		{"template outside of the templates dir", withTemplatesDir(dir, "../assets/token_email_template.html")},
+	}
+	for _, tc := range tests {
+		if _, err := New(context.Background(), testDB, &Config{EmailConfig: tc.cfg}); err == nil {
+			t.Errorf("%s: expected error, got nil", tc.name)
+		}
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	listApps := func(handler http.Handler) int {
+		req := httptest.NewRequest(http.MethodGet, helpers.AdminAppsPath, nil)
+		req.Header.Set(helpers.AdminSecretHeader, "admin-secret")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	// without admin address, the admin endpoints are served by the public
+	// listener
+	srv := newTestService(t, &Config{AdminSecret: "admin-secret"})
+	if srv.adminServer != nil {
+		t.Errorf("expected no admin server, got %v", srv.adminServer.Addr)
+	}
+	if code := listApps(srv.httpServer.Handler); code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, code)
+	}
+	// with admin address, they are only served by the admin listener
+	srv = newTestService(t, &Config{AdminSecret: "admin-secret", AdminAddr: "127.0.0.1:9090"})
+	if srv.adminServer == nil || srv.adminServer.Addr != "127.0.0.1:9090" {
+		t.Fatalf("expected admin server on 127.0.0.1:9090, got %v", srv.adminServer)
+	}
+	if code := listApps(srv.httpServer.Handler); code == http.StatusOK {
+		t.Errorf("expected admin endpoint unreachable on public listener, got %d", code)
+	}
+	if code := listApps(srv.adminServer.Handler); code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, code)
+	}
+	// the public endpoints are not served by the admin listener
+	req := httptest.NewRequest(http.MethodGet, helpers.AppEndpointPath, nil)
+	res := httptest.NewRecorder()
+	srv.adminServer.Handler.ServeHTTP(res, req)
+	if res.Code == http.StatusOK || res.Code == http.StatusBadRequest {
+		t.Errorf("expected public endpoint unreachable on admin listener, got %d", res.Code)
+	}
+}
+
+// closeOrderDB struct wraps the temporal database to check that the service
+// resources are stopped before closing it.
+type closeOrderDB struct {
+	*db.TempDriver
+	srv *Service
+	err error
+}
+
+func (codb *closeOrderDB) Close() error {
+	if err := codb.srv.emailQueue.Push(&email.Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}); err != email.ErrQueueStopped {
+		codb.err = fmt.Errorf("expected email queue stopped before closing db, got %v", err)
+	}
+	if codb.srv.ctx.Err() == nil {
+		codb.err = fmt.Errorf("expected service context cancelled before closing db")
+	}
+	return codb.TempDriver.Close()
+}
+
+func TestStop(t *testing.T) {
+	srv := newTestService(t, nil)
+	testDB := &closeOrderDB{TempDriver: srv.db.(*db.TempDriver), srv: srv}
+	srv.db = testDB
+	srv.sanityTokenCleaner()
+	if err := srv.Stop(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if testDB.err != nil {
+		t.Error(testDB.err)
+	}
+	// stopping twice must be safe
+	if err := srv.Stop(); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// shutdown function shuts down a service with the provided timeout while
+	// it serves a request that takes the provided duration, and returns the
+	// error of the request and the error of the shutdown
+	shutdown := func(timeout, duration time.Duration) (error, error) {
+		srv := newTestService(t, &Config{ShutdownTimeout: timeout})
+		started := make(chan struct{})
+		srv.httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			time.Sleep(duration)
+			w.WriteHeader(http.StatusOK)
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		go func() { _ = srv.httpServer.Serve(ln) }()
+		reqErr := make(chan error, 1)
+		go func() {
+			res, err := http.Get("http://" + ln.Addr().String())
+			if err == nil {
+				err = res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("unexpected status code: %d", res.StatusCode)
+				}
+			}
+			reqErr <- err
+		}()
+		<-started
+		shutdownErr := srv.Shutdown()
+		return <-reqErr, shutdownErr
+	}
+	// the requests shorter than the timeout are completed
+	reqErr, err := shutdown(time.Second, 50*time.Millisecond)
+	if err != nil || reqErr != nil {
+		t.Errorf("expected completed request, got %v (shutdown: %v)", reqErr, err)
+	}
+	// the requests longer than the timeout are cut off
+	start := time.Now()
+	reqErr, err = shutdown(50*time.Millisecond, time.Second)
+	if !errors.Is(err, context.DeadlineExceeded) || reqErr == nil {
+		t.Errorf("expected cut off request, got %v (shutdown: %v)", reqErr, err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected shutdown before the request finishes, took %s", elapsed)
+	}
+}
+
+// unavailableDB struct wraps the temporal database to simulate that the
+// database cannot be reached.
+type unavailableDB struct {
+	*db.TempDriver
+}
+
+func (udb *unavailableDB) Ping(_ context.Context) error {
+	return db.ErrPing
+}
+
+func TestHealthHandler(t *testing.T) {
+	srv := newTestService(t, nil)
+	serve := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		srv.httpServer.Handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, helpers.HealthCheckPath, nil))
+		return res
+	}
+	if res := serve(); res.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, res.Code)
+	}
+	// the health check fails if the database is not available
+	srv.db = &unavailableDB{TempDriver: srv.db.(*db.TempDriver)}
+	res := serve()
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	if apiErr := responseError(t, res); apiErr.Code != ErrCodeUnavailable {
+		t.Errorf("expected %s, got %s", ErrCodeUnavailable, apiErr.Code)
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import "time"
+
+// statsPeriod is the period of the recent activity included in the service
+// statistics.
+const statsPeriod = 24 * time.Hour
+
+// stats method aggregates the statistics of the service: the apps and the
+// tokens stored in the database, the tokens issued in the last day and the
+// emails waiting in the queue. If something fails during the process, it
+// returns an error.
+func (s *Service) stats() (*ServiceStats, error) {
+	apps, err := s.db.CountApps()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := s.db.CountTokens("")
+	if err != nil {
+		return nil, err
+	}
+	issued, err := s.db.CountTokensIssuedSince(time.Now().Add(-statsPeriod))
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceStats{
+		Apps:                apps,
+		Tokens:              tokens,
+		TokensIssuedLastDay: issued,
+		QueuedEmails:        s.emailQueue.Len(),
+	}, nil
+}
@@ -1,8 +1,9 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"strings"
 	"time"
@@ -11,95 +12,211 @@ import (
 	"github.com/simpleauthlink/authapi/helpers"
 )
 
-// magicLink function generates and returns a magic link, the generated token
-// and the associated app name, based on the provided app secret and the user
-// email. If the secret or the email are empty, it returns an error. It gets
-// the app id from the database based on the secret. It generates a token and
-// calculates the expiration time based on the app session duration. It stores
-// the token and the expiration time in the database. It returns the magic link
-// composed of the app callback and the generated token.
-func (s *Service) magicLink(rawSecret, email, redirectURL string, duration uint64) (string, string, string, error) {
-	// check if the secret and email are not empty
-	if len(rawSecret) == 0 || len(email) == 0 {
-		return "", "", "", fmt.Errorf("secret and email are required")
-	}
-	// get app secret from raw secret
-	appSecret, err := helpers.Hash(rawSecret, helpers.SecretSize)
-	if err != nil {
-		return "", "", "", err
-	}
-	// get app and app id from the database based on the secret
-	app, appId, err := s.db.AppBySecret(appSecret)
-	if err != nil {
-		return "", "", "", err
+// magicLink function generates and returns a magic link and the generated
+// token, based on the provided app and the token request, that includes the
+// user email, and optionally the redirect URL, the session duration and the
+// scopes of the token. If the app or the email are empty, or the redirect URL
+// of the request is not in the domains allowed by the app, it returns an
+// error. It generates a token and calculates the expiration time based on the
+// app session duration. If the session duration overflows a time.Duration, it
+// returns an error. It replaces the previous tokens of the user in the
+// database by the new one, with its expiration time, holding the user lock to
+// leave exactly one token when there are concurrent requests, and resets the
+// count of consecutive refreshes of the user. It returns the magic link
+// composed of the app callback and the generated token. The provided context
+// identifies the request in the logs and, once the token is stored, the
+// WebhookTokenIssued event is sent to the app webhook, if it has one, and the
+// usage of the users quota of the app is checked (see checkUsersQuota).
+func (s *Service) magicLink(ctx context.Context, appId string, app *db.App, req *TokenRequest) (string, string, error) {
+	// check if the app and email are not empty
+	if len(appId) == 0 || app == nil || req == nil || len(req.Email) == 0 {
+		return "", "", fmt.Errorf("app and email are required")
 	}
 	// get the number of tokens for the app using the app id as the prefix
 	numberOfAppTokens, err := s.db.CountTokens(appId)
 	if err != nil {
-		return "", "", "", err
+		return "", "", err
 	}
 	// check if the number of tokens is greater than the users quota
 	if numberOfAppTokens >= app.UsersQuota {
-		return "", "", "", fmt.Errorf("users quota reached")
+		return "", "", fmt.Errorf("users quota reached")
+	}
+	// by default, the redirect URL is the app redirect URL but it can be
+	// overwritten by the request with an url of an allowed domain, check it
+	// before generating the token
+	baseRawURL := app.RedirectURL
+	if req.RedirectURL != "" {
+		baseRawURL = req.RedirectURL
 	}
-	// generate token and calculate expiration
-	token, userId, err := helpers.EncodeUserToken(appId, email)
+	redirectURL, err := normalizeRedirectURL(baseRawURL)
 	if err != nil {
-		return "", "", "", err
+		return "", "", err
+	}
+	if req.RedirectURL != "" {
+		if err := checkRedirectDomain(app, redirectURL); err != nil {
+			return "", "", err
+		}
+	}
+	// generate token, with the token size of the app, and calculate
+	// expiration
+	token, userId, err := s.cfg.HashAlgorithm.EncodeUserToken(appId, req.Email, int(app.TokenSize))
+	if err != nil {
+		return "", "", err
 	}
 	// by default, the session duration is the app session duration but it can
 	// be overwritten by the request
 	sessionDuration := app.SessionDuration
-	if duration > 0 {
-		sessionDuration = duration
+	if req.Duration > 0 {
+		sessionDuration = req.Duration
+	}
+	// check that the session duration in nanoseconds fits in a time.Duration
+	if sessionDuration > helpers.MaxTokenDuration {
+		return "", "", fmt.Errorf("%w: it must be at most %d seconds", errInvalidDuration, helpers.MaxTokenDuration)
 	}
 	expiration := time.Now().Add(time.Duration(sessionDuration) * time.Second)
 	// check if there is a token for the user and app in the database and delete
-	// it if it exists
+	// it if it exists, holding the user lock until the new token is set to
+	// avoid deleting the token of a concurrent request
 	tokenPrefix := strings.Join([]string{appId, userId}, helpers.TokenSeparator)
-	if err := s.db.DeleteTokensByPrefix(tokenPrefix); err != nil {
+	unlock := s.userLocks.Lock(tokenPrefix)
+	defer unlock()
+	if err := s.deleteTokensByPrefix(tokenPrefix, db.DeleteReasonReplaced); err != nil {
 		if err != db.ErrTokenNotFound {
-			log.Println("ERR: error checking token:", err)
+			s.contextLogger(ctx).Error("error checking token", "app_id", appId, "error", err)
 		}
 	}
-	// set token and expiration in the database
-	if err := s.db.SetToken(db.Token(token), expiration); err != nil {
-		return "", "", "", err
+	// set token, expiration and scopes in the database
+	if err := s.db.SetToken(db.Token(token), expiration, req.Scopes); err != nil {
+		return "", "", err
 	}
-	// return the magic link based on the app callback and the generated token
-	// by default, the redirect URL is the app redirect URL but it can be
-	// overwritten by the request
-	baseRawURL := app.RedirectURL
-	if redirectURL != "" {
-		baseRawURL = redirectURL
+	// the new session starts a new chain of token refreshes
+	if err := s.db.ResetAttempts(attemptsKey(refreshAttempts, appId, userId)); err != nil {
+		s.contextLogger(ctx).Error("error resetting refreshes", "app_id", appId, "error", err)
 	}
-	baseURL, err := url.Parse(baseRawURL)
+	s.emitWebhook(ctx, WebhookTokenIssued, appId, userId)
+	s.checkUsersQuota(ctx, appId, app, userId)
+	// return the magic link based on the redirect URL and the generated token
+	link, err := helpers.BuildMagicLink(baseRawURL, helpers.TokenQueryParam, token)
 	if err != nil {
-		return "", "", "", fmt.Errorf("invalid redirect URL: %w", err)
+		return "", "", err
 	}
-	urlQuery := baseURL.Query()
-	urlQuery.Set(helpers.TokenQueryParam, token)
-	baseURL.RawQuery = urlQuery.Encode()
-	return helpers.SafeURL(baseURL), token, app.Name, nil
+	return link, token, nil
 }
 
-// validUserToken function checks if the provided token is valid. It checks if
-// the token is not empty, if the app id is in the database, if the token is not
-// expired and if the token is in the database. If the token is invalid, it
-// returns false. If something goes wrong during the process, it logs the error
-// and returns false. If the token is valid, it returns true.
-func (s *Service) validUserToken(token, rawSecret string) bool {
-	// check if the token and secret are not empty
-	if len(token) == 0 || len(rawSecret) == 0 {
-		return false
+// errInvalidRedirectURL error is returned when a redirect URL can not be
+// normalized to an absolute http(s) URL.
+var errInvalidRedirectURL = fmt.Errorf("invalid redirect URL")
+
+// normalizeRedirectURL function normalizes the provided redirect URL to an
+// absolute URL. If the URL has no scheme (e.g. "app.com/callback"), https is
+// used. It returns an error that wraps errInvalidRedirectURL if the URL is
+// empty, malformed, has no host or its scheme is not http or https.
+func normalizeRedirectURL(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", fmt.Errorf("%w: empty URL", errInvalidRedirectURL)
+	}
+	// without scheme, url.Parse takes the host as part of the path, so add
+	// the default one
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + strings.TrimPrefix(rawURL, "//")
+	}
+	redirectURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidRedirectURL, err)
+	}
+	if redirectURL.Scheme = strings.ToLower(redirectURL.Scheme); redirectURL.Scheme != "http" && redirectURL.Scheme != "https" {
+		return "", fmt.Errorf("%w: unsupported scheme %q", errInvalidRedirectURL, redirectURL.Scheme)
+	}
+	if redirectURL.Host == "" || redirectURL.Hostname() == "" {
+		return "", fmt.Errorf("%w: missing host", errInvalidRedirectURL)
+	}
+	return redirectURL.String(), nil
+}
+
+// errDisallowedRedirectURL error is returned when the redirect URL of a token
+// request is not in the domains allowed by the app. It wraps
+// errInvalidRedirectURL.
+var errDisallowedRedirectURL = fmt.Errorf("%w: domain not allowed", errInvalidRedirectURL)
+
+// checkRedirectDomain function checks if the provided normalized redirect URL
+// can be used by the token requests of the provided app, to prevent leaking
+// the tokens to other sites. The allowed domains are the domain of the app
+// redirect URL and the allowed redirect domains of the app, which must match
+// exactly (the subdomains are not included). If the domain is not allowed, it
+// returns an error that wraps errDisallowedRedirectURL.
+func checkRedirectDomain(app *db.App, redirectURL string) error {
+	parsedURL, err := url.Parse(redirectURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRedirectURL, err)
+	}
+	domain := strings.ToLower(parsedURL.Hostname())
+	if appURL, err := normalizeRedirectURL(app.RedirectURL); err == nil {
+		if parsedAppURL, err := url.Parse(appURL); err == nil && strings.ToLower(parsedAppURL.Hostname()) == domain {
+			return nil
+		}
 	}
+	for _, allowed := range app.AllowedRedirectDomains {
+		if allowed == domain {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s'", errDisallowedRedirectURL, domain)
+}
+
+// errInvalidToken error is returned when a token is malformed, expired or it
+// is not in the database.
+var errInvalidToken = fmt.Errorf("invalid token")
+
+// MagicLinkForToken method rebuilds the magic link of the provided token,
+// composed of the redirect URL of the app of the token, like the magic links
+// sent when the tokens are issued, to allow the apps to resend it without
+// issuing a new token, which would replace the current session of the user.
+// It returns errInvalidToken if the token is malformed, expired or it is not
+// in the database, and an error if the app of the token can not be found or
+// something fails during the process.
+func (s *Service) MagicLinkForToken(token string) (string, error) {
 	// get the app id from the token
 	appId, _, err := helpers.DecodeUserToken(token)
 	if err != nil {
+		return "", errInvalidToken
+	}
+	// check if the token is in the database and not expired
+	expiration, err := s.db.TokenExpiration(db.Token(token))
+	if err != nil {
+		if errors.Is(err, db.ErrTokenNotFound) {
+			return "", errInvalidToken
+		}
+		return "", err
+	}
+	if time.Now().After(expiration) {
+		return "", errInvalidToken
+	}
+	// compose the magic link with the redirect URL of the app
+	app, err := s.db.AppById(appId)
+	if err != nil {
+		return "", err
+	}
+	return helpers.BuildMagicLink(app.RedirectURL, helpers.TokenQueryParam, token)
+}
+
+// validUserToken function checks if the provided token is valid for the app
+// with the provided id. It checks if the token is not empty, if it belongs to
+// the app, if the token is not expired and if the token is in the database. If
+// the service has a validation hook, it is called after these checks and the
+// token is invalid if the hook returns an error. If the token is invalid, it
+// returns false. If something goes wrong during the process, it logs the error
+// and returns false. If the token is valid, it sends the WebhookTokenValidated
+// event to the app webhook, if it has one, and returns true.
+func (s *Service) validUserToken(ctx context.Context, token, appId string) bool {
+	// check if the token and app id are not empty
+	if len(token) == 0 || len(appId) == 0 {
 		return false
 	}
-	// check if the secret is valid
-	if !s.validSecret(appId, rawSecret) {
+	// get the app id and the user id from the token and check if the token
+	// belongs to the app
+	tokenAppId, userId, err := helpers.DecodeUserToken(token)
+	if err != nil || tokenAppId != appId {
 		return false
 	}
 	// get the token expiration from the database
@@ -109,57 +226,212 @@ func (s *Service) validUserToken(token, rawSecret string) bool {
 	}
 	// check if the token is expired
 	if time.Now().After(expiration) {
-		if err := s.db.DeleteToken(db.Token(token)); err != nil {
-			log.Println("ERR: error deleting token:", err)
+		if err := s.deleteToken(token, db.DeleteReasonExpired); err != nil {
+			s.contextLogger(ctx).Error("error deleting token", "app_id", appId, "error", err)
 		}
 		return false
 	}
+	// run the custom validation hook if it is defined
+	if s.cfg.ValidationHook != nil {
+		if err := s.cfg.ValidationHook(ctx, appId, userId); err != nil {
+			s.contextLogger(ctx).Warn("token denied by validation hook", "app_id", appId, "error", err)
+			return false
+		}
+	}
+	s.emitWebhook(ctx, WebhookTokenValidated, appId, userId)
 	return true
 }
 
-// validAdminToken function checks if the provided token is a valid admin token.
-// It checks if the token is not empty, if the app id is in the database, if the
-// token is not expired and if the token is in the database. If the token is
-// invalid, it returns false. It also returns the app id if the token is valid.
-func (s *Service) validAdminToken(token, rawSecret string) (string, bool) {
-	// check if the token and secret are not empty
-	if len(token) == 0 || len(rawSecret) == 0 {
-		return "", false
-	}
-	// get the app id from the token
-	appId, userId, err := helpers.DecodeUserToken(token)
+// tokenHasScope method checks if the provided token includes the provided
+// scope. It returns false if the token is not scoped, it does not include the
+// scope or something fails getting its scopes from the database.
+func (s *Service) tokenHasScope(token, scope string) bool {
+	scopes, err := s.db.TokenScopes(db.Token(token))
 	if err != nil {
-		return "", false
+		return false
+	}
+	for _, tokenScope := range scopes {
+		if tokenScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validAdminToken function checks if the provided token is a valid admin token
+// for the app with the provided id. It checks if the token is not empty, if it
+// belongs to the app, if the token is not expired and if the token is in the
+// database. If the token is invalid, it returns false.
+func (s *Service) validAdminToken(token, appId string) bool {
+	// check if the token and app id are not empty
+	if len(token) == 0 || len(appId) == 0 {
+		return false
+	}
+	// get the app id from the token and check if the token belongs to the app
+	tokenAppId, userId, err := helpers.DecodeUserToken(token)
+	if err != nil || tokenAppId != appId {
+		return false
 	}
 	// the app id is composed by the admin user id hash and a nonce, so
 	// the app id starts with the admin user id, check if so
 	if !strings.HasPrefix(appId, userId) {
-		return "", false
-	}
-	// check if the secret is valid
-	if !s.validSecret(appId, rawSecret) {
-		return "", false
+		return false
 	}
 	// get the token expiration from the database
 	expiration, err := s.db.TokenExpiration(db.Token(token))
 	if err != nil {
-		return "", false
+		return false
 	}
 	// check if the token is expired
 	if time.Now().After(expiration) {
-		if err := s.db.DeleteToken(db.Token(token)); err != nil {
-			log.Println("ERR: error deleting token:", err)
+		if err := s.deleteToken(token, db.DeleteReasonExpired); err != nil {
+			s.logger.Error("error deleting token", "app_id", appId, "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// revokeUserTokens method deletes every token of the user with the provided
+// email for the app with the provided id, invalidating all of their sessions
+// without affecting the rest of the users of the app. It hashes the email to
+// get the user id and deletes the tokens using the app id and the user id as
+// the prefix, holding the user lock to avoid racing with a new token request.
+// If the app id or the email are empty or something fails during the process,
+// it returns an error.
+func (s *Service) revokeUserTokens(appId, email string) error {
+	if len(appId) == 0 || len(email) == 0 {
+		return fmt.Errorf("app id and email are required")
+	}
+	userId, err := s.cfg.HashAlgorithm.Hash(email, helpers.UserIdSize)
+	if err != nil {
+		return err
+	}
+	tokenPrefix := strings.Join([]string{appId, userId}, helpers.TokenSeparator)
+	unlock := s.userLocks.Lock(tokenPrefix)
+	defer unlock()
+	if err := s.deleteTokensByPrefix(tokenPrefix, db.DeleteReasonRevoked); err != nil && err != db.ErrTokenNotFound {
+		return err
+	}
+	return nil
+}
+
+// errRefreshLimitReached error is returned when a token can not be refreshed
+// because the user has reached the maximum consecutive refreshes of the app.
+var errRefreshLimitReached = fmt.Errorf("refresh limit reached")
+
+// refreshUserToken method replaces the provided token of the app with the
+// provided id by a new one for the same user, with the same scopes and a
+// fresh expiration based on the app session duration, extending the user
+// session. The token must be validated before. The consecutive refreshes of
+// a user are counted until they request a new token, if the count reaches
+// the maximum refreshes of the app (or the default one if it is not set), it
+// returns errRefreshLimitReached. It holds the user lock while the token is
+// replaced. The provided context identifies the request in the logs. If
+// something fails during the process, it returns an error.
+func (s *Service) refreshUserToken(ctx context.Context, appId string, app *db.App, token string) (string, error) {
+	if len(appId) == 0 || app == nil || len(token) == 0 {
+		return "", fmt.Errorf("app and token are required")
+	}
+	// generate the new token for the same user
+	newToken, userId, err := helpers.RenewUserToken(token)
+	if err != nil {
+		return "", err
+	}
+	tokenPrefix := strings.Join([]string{appId, userId}, helpers.TokenSeparator)
+	unlock := s.userLocks.Lock(tokenPrefix)
+	defer unlock()
+	// check that the token has not been replaced by a concurrent request
+	// while waiting for the lock, to avoid replaying it
+	if exists, err := s.db.TokenExists(db.Token(token)); err != nil {
+		return "", err
+	} else if !exists {
+		return "", db.ErrTokenNotFound
+	}
+	// check the number of consecutive refreshes of the user
+	maxRefreshes := app.MaxRefreshes
+	if maxRefreshes == 0 {
+		maxRefreshes = helpers.DefaultMaxRefreshes
+	}
+	refreshKey := attemptsKey(refreshAttempts, appId, userId)
+	refreshes, err := s.db.Attempts(refreshKey)
+	if err != nil {
+		return "", err
+	}
+	if refreshes >= maxRefreshes {
+		return "", errRefreshLimitReached
+	}
+	// keep the scopes of the current token
+	scopes, err := s.db.TokenScopes(db.Token(token))
+	if err != nil {
+		return "", err
+	}
+	// check that the session duration in nanoseconds fits in a time.Duration
+	sessionDuration := app.SessionDuration
+	if sessionDuration > helpers.MaxTokenDuration {
+		return "", fmt.Errorf("%w: it must be at most %d seconds", errInvalidDuration, helpers.MaxTokenDuration)
+	}
+	expiration := time.Now().Add(time.Duration(sessionDuration) * time.Second)
+	// replace the current token by the new one
+	if err := s.db.SetToken(db.Token(newToken), expiration, scopes); err != nil {
+		return "", err
+	}
+	if err := s.deleteToken(token, db.DeleteReasonRefreshed); err != nil {
+		s.contextLogger(ctx).Error("error deleting refreshed token", "app_id", appId, "error", err)
+	}
+	// count the refresh, the counter lasts as long as the longest chain of
+	// refreshes allowed, if it does not overflow
+	chainDuration := helpers.MaxTokenDuration
+	if sessionDuration < helpers.MaxTokenDuration/uint64(maxRefreshes+1) {
+		chainDuration = sessionDuration * uint64(maxRefreshes+1)
+	}
+	if _, err := s.db.IncrAttempts(refreshKey, time.Duration(chainDuration)*time.Second); err != nil {
+		s.contextLogger(ctx).Error("error incrementing refreshes", "app_id", appId, "error", err)
+	}
+	return newToken, nil
+}
+
+// deleteToken method deletes the provided token from the database or, if the
+// soft deletion of the tokens is enabled, replaces it by a tombstone with the
+// provided reason, to keep the record of the session for audit. It returns an
+// error if something goes wrong.
+func (s *Service) deleteToken(token, reason string) error {
+	if s.cfg.SoftDeleteTokens {
+		return s.db.SoftDeleteToken(db.Token(token), reason)
+	}
+	return s.db.DeleteToken(db.Token(token))
+}
+
+// deleteTokensByPrefix method deletes the tokens with the provided prefix
+// from the database or, if the soft deletion of the tokens is enabled,
+// replaces every one of them by a tombstone with the provided reason. It
+// returns an error if something goes wrong.
+func (s *Service) deleteTokensByPrefix(prefix, reason string) error {
+	if !s.cfg.SoftDeleteTokens {
+		return s.db.DeleteTokensByPrefix(prefix)
+	}
+	if prefix == "" {
+		return nil
+	}
+	tokens, err := s.db.TokensByPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := s.db.SoftDeleteToken(token.Token, reason); err != nil {
+			return err
 		}
-		return "", false
 	}
-	return appId, true
+	return nil
 }
 
-// sanityTokenCleaner function starts a goroutine that cleans the expired tokens
-// from the database every time the cooldown time is reached. It uses a ticker
-// to check the cooldown time and a context to stop the goroutine when the
-// service is stopped. If something goes wrong during the process, it logs the
-// error.
+// sanityTokenCleaner function starts a goroutine that cleans the expired
+// tokens from the database every time the cooldown time is reached, keeping
+// the ones that expired during the cleanup grace period. If the soft deletion
+// of the tokens is enabled, it also purges the tombstones older than the
+// tombstone retention. It uses a ticker to check the cooldown time and a
+// context to stop the goroutine when the service is stopped. If something goes
+// wrong during the process, it logs the error.
 func (s *Service) sanityTokenCleaner() {
 	s.wait.Add(1)
 	go func() {
@@ -170,8 +442,13 @@ func (s *Service) sanityTokenCleaner() {
 			case <-s.ctx.Done():
 				return
 			case <-ticker.C:
-				if err := s.db.DeleteExpiredTokens(); err != nil {
-					log.Println("ERR: error deleting expired tokens:", err)
+				if err := s.db.DeleteExpiredTokens(s.cleanupGracePeriod()); err != nil {
+					s.logger.Error("error deleting expired tokens", "error", err)
+				}
+				if s.cfg.SoftDeleteTokens {
+					if err := s.db.PurgeTombstones(s.tombstoneRetention()); err != nil {
+						s.logger.Error("error purging token tombstones", "error", err)
+					}
 				}
 			}
 		}
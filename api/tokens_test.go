@@ -0,0 +1,402 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+func TestMagicLinkDurationOverflow(t *testing.T) {
+	srv := newTestService(t, nil)
+	appId, secret := createTestApp(t, srv, nil)
+	_, app, err := srv.appBySecret(secret)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the max duration fits in a time.Duration so the token expires in the
+	// future
+	req := &TokenRequest{Email: "user@simpleauth.link", Duration: helpers.MaxTokenDuration}
+	_, token, err := srv.magicLink(context.Background(), appId, app, req)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !srv.validUserToken(srv.ctx, token, appId) {
+		t.Errorf("expected valid token with max duration, got invalid")
+	}
+	// beyond the max duration it would overflow, so it must fail
+	req.Duration = helpers.MaxTokenDuration + 1
+	if _, _, err := srv.magicLink(context.Background(), appId, app, req); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	req.Duration = ^uint64(0)
+	if _, _, err := srv.magicLink(context.Background(), appId, app, req); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+// slowTokensDB struct wraps the temporal database to delay the token writes,
+// making the concurrent token requests interleave.
+type slowTokensDB struct {
+	*db.TempDriver
+}
+
+func (sdb *slowTokensDB) SetToken(token db.Token, expiration time.Time, scopes []string) error {
+	time.Sleep(time.Millisecond)
+	return sdb.TempDriver.SetToken(token, expiration, scopes)
+}
+
+func TestMagicLinkConcurrentRequests(t *testing.T) {
+	srv := newTestService(t, nil)
+	srv.db = &slowTokensDB{TempDriver: srv.db.(*db.TempDriver)}
+	appId, secret := createTestApp(t, srv, nil)
+	_, app, err := srv.appBySecret(secret)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// request many tokens for the same user at the same time
+	const requests = 20
+	var wg sync.WaitGroup
+	tokens := make(chan string, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, token, err := srv.magicLink(context.Background(), appId, app, &TokenRequest{Email: "user@simpleauth.link"})
+			if err != nil {
+				t.Errorf("expected nil, got %v", err)
+				return
+			}
+			tokens <- token
+		}()
+	}
+	wg.Wait()
+	close(tokens)
+	// only one of the tokens must remain, and it must be valid
+	valid := 0
+	var userId string
+	for token := range tokens {
+		_, userId, _ = helpers.DecodeUserToken(token)
+		if srv.validUserToken(srv.ctx, token, appId) {
+			valid++
+		}
+	}
+	if valid != 1 {
+		t.Errorf("expected 1 valid token, got %d", valid)
+	}
+	prefix := strings.Join([]string{appId, userId}, helpers.TokenSeparator)
+	if count, err := srv.db.CountTokens(prefix); err != nil || count != 1 {
+		t.Errorf("expected 1 token, got %d (%v)", count, err)
+	}
+}
+
+func TestAuthAppDurationOverflow(t *testing.T) {
+	srv := newTestService(t, nil)
+	if _, _, err := srv.authApp(&AppData{
+		Name:        "test app",
+		Email:       "admin@simpleauth.link",
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MaxTokenDuration + 1,
+	}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	appId, _ := createTestApp(t, srv, nil)
+	if err := srv.updateAppMetadata(appId, &AppData{Duration: helpers.MaxTokenDuration + 1}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err := srv.updateAppMetadata(appId, &AppData{Duration: helpers.MaxTokenDuration}); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestNormalizeRedirectURL(t *testing.T) {
+	tests := []struct {
+		rawURL   string
+		expected string
+		err      bool
+	}{
+		{"https://app.com/cb", "https://app.com/cb", false},
+		{"http://localhost:3000/cb?state=1", "http://localhost:3000/cb?state=1", false},
+		{"app.com/cb", "https://app.com/cb", false},
+		{"//app.com/cb", "https://app.com/cb", false},
+		{"localhost:3000/cb", "https://localhost:3000/cb", false},
+		{" HTTPS://app.com ", "https://app.com", false},
+		{"", "", true},
+		{"/cb", "", true},
+		{"ftp://app.com/cb", "", true},
+		{"javascript:alert(1)", "", true},
+		{"https://app.com:port/cb", "", true},
+		{"https:///cb", "", true},
+	}
+	for _, tc := range tests {
+		got, err := normalizeRedirectURL(tc.rawURL)
+		if tc.err {
+			if !errors.Is(err, errInvalidRedirectURL) {
+				t.Errorf("%q: expected %v, got %v (%s)", tc.rawURL, errInvalidRedirectURL, err, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected nil, got %v", tc.rawURL, err)
+		} else if got != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.rawURL, tc.expected, got)
+		}
+	}
+}
+
+func TestMagicLinkSchemelessRedirectURL(t *testing.T) {
+	srv := newTestService(t, nil)
+	// the redirect URL is normalized when the app is created
+	appId, secret := createTestApp(t, srv, &AppData{RedirectURL: "app.com/cb"})
+	_, app, err := srv.appBySecret(secret)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app.RedirectURL != "https://app.com/cb" {
+		t.Errorf("expected https://app.com/cb, got %s", app.RedirectURL)
+	}
+	// the apps stored without scheme get valid links too
+	app.RedirectURL = "app.com/cb"
+	link, _, err := srv.magicLink(context.Background(), appId, app, &TokenRequest{Email: "user@simpleauth.link"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !strings.HasPrefix(link, "https://app.com/cb?token=") {
+		t.Errorf("expected https link, got %s", link)
+	}
+	// malformed redirect URLs are rejected before generating the token
+	req := &TokenRequest{Email: "other@simpleauth.link", RedirectURL: "https://app.com:port/cb"}
+	if _, _, err := srv.magicLink(context.Background(), appId, app, req); !errors.Is(err, errInvalidRedirectURL) {
+		t.Errorf("expected %v, got %v", errInvalidRedirectURL, err)
+	}
+	if count, _ := srv.db.CountTokens(appId); count != 1 {
+		t.Errorf("expected 1 token, got %d", count)
+	}
+	res := requestToken(srv, secret, `{"email":"other@simpleauth.link","redirect_url":"ftp://app.com/cb"}`)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "invalid redirect URL") {
+		t.Errorf("expected invalid redirect URL error, got [%d] %s", res.Code, res.Body.String())
+	}
+	// and so are they when the app is updated
+	if err := srv.updateAppMetadata(appId, &AppData{RedirectURL: "ftp://app.com/cb"}); !errors.Is(err, errInvalidRedirectURL) {
+		t.Errorf("expected %v, got %v", errInvalidRedirectURL, err)
+	}
+}
+
+func TestMagicLinkRedirectDomains(t *testing.T) {
+	srv := newTestService(t, nil)
+	appId, secret := createTestApp(t, srv, &AppData{
+		RedirectURL:            "https://simpleauth.link/callback",
+		AllowedRedirectDomains: []string{"App.SimpleAuth.link", "localhost"},
+	})
+	_, app, err := srv.appBySecret(secret)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	tests := []struct {
+		redirectURL string
+		expected    string
+		err         bool
+	}{
+		// without override, the app redirect URL is used
+		{"", "https://simpleauth.link/callback?token=", false},
+		{"https://simpleauth.link/other", "https://simpleauth.link/other?token=", false},
+		{"https://app.simpleauth.link/cb", "https://app.simpleauth.link/cb?token=", false},
+		{"http://localhost:3000/cb", "http://localhost:3000/cb?token=", false},
+		{"https://evil.com/cb", "", true},
+		{"https://sub.app.simpleauth.link/cb", "", true},
+		{"https://simpleauth.link.evil.com/cb", "", true},
+		{"https://app.simpleauth.link@evil.com/cb", "", true},
+	}
+	for _, tc := range tests {
+		link, _, err := srv.magicLink(context.Background(), appId, app, &TokenRequest{Email: "user@simpleauth.link", RedirectURL: tc.redirectURL})
+		if tc.err {
+			if !errors.Is(err, errDisallowedRedirectURL) {
+				t.Errorf("%q: expected %v, got %v (%s)", tc.redirectURL, errDisallowedRedirectURL, err, link)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected nil, got %v", tc.redirectURL, err)
+		} else if !strings.HasPrefix(link, tc.expected) {
+			t.Errorf("%q: expected %s..., got %s", tc.redirectURL, tc.expected, link)
+		}
+	}
+	// the token requests get a clear error
+	res := requestToken(srv, secret, `{"email":"user@simpleauth.link","redirect_url":"https://evil.com/cb"}`)
+	if res.Code != http.StatusBadRequest || !strings.Contains(responseError(t, res).Message, "domain not allowed") {
+		t.Errorf("expected domain not allowed error, got [%d] %s", res.Code, res.Body.String())
+	}
+	// the allowed domains can be replaced and must be valid
+	if err := srv.updateAppMetadata(appId, &AppData{AllowedRedirectDomains: []string{"evil.com"}}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, app, err = srv.appBySecret(secret); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, _, err := srv.magicLink(context.Background(), appId, app, &TokenRequest{Email: "user@simpleauth.link", RedirectURL: "https://evil.com/cb"}); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	for _, domain := range []string{"", "https://app.com", "app.com:3000", "app.com/cb", "user@app.com"} {
+		if err := srv.updateAppMetadata(appId, &AppData{AllowedRedirectDomains: []string{domain}}); !errors.Is(err, errInvalidRedirectDomain) {
+			t.Errorf("%q: expected %v, got %v", domain, errInvalidRedirectDomain, err)
+		}
+	}
+}
+
+func TestMagicLinkTokenSize(t *testing.T) {
+	srv := newTestService(t, nil)
+	// by default, the default token size is used
+	appId, secret := createTestApp(t, srv, nil)
+	if app, _ := srv.appMetadata(appId); app.TokenSize != helpers.TokenSize {
+		t.Errorf("expected %d, got %d", helpers.TokenSize, app.TokenSize)
+	}
+	token := userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	if parts := strings.Split(token, helpers.TokenSeparator); len(parts[2]) != 2*helpers.TokenSize {
+		t.Errorf("expected random part of %d bytes, got %s", helpers.TokenSize, token)
+	}
+	// the apps can choose longer tokens, which are still valid
+	appId, secret = createTestApp(t, srv, &AppData{Email: "other@simpleauth.link", TokenSize: 32})
+	token = userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	if parts := strings.Split(token, helpers.TokenSeparator); len(parts[2]) != 64 {
+		t.Errorf("expected random part of 32 bytes, got %s", token)
+	}
+	if !srv.validUserToken(context.Background(), token, appId) {
+		t.Errorf("expected valid token")
+	}
+	if err := srv.updateAppMetadata(appId, &AppData{TokenSize: helpers.MaxTokenSize}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	token = userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	if parts := strings.Split(token, helpers.TokenSeparator); len(parts[2]) != 2*helpers.MaxTokenSize {
+		t.Errorf("expected random part of %d bytes, got %s", helpers.MaxTokenSize, token)
+	}
+	// the size must be in range
+	for _, size := range []int64{-1, helpers.TokenSize - 1, helpers.MaxTokenSize + 1} {
+		if _, _, err := srv.authApp(&AppData{
+			Name:        "test app",
+			Email:       "admin@simpleauth.link",
+			RedirectURL: "https://simpleauth.link/callback",
+			Duration:    helpers.MinTokenDuration,
+			TokenSize:   size,
+		}); err == nil {
+			t.Errorf("%d: expected error, got nil", size)
+		}
+		if err := srv.updateAppMetadata(appId, &AppData{TokenSize: size}); err == nil {
+			t.Errorf("%d: expected error, got nil", size)
+		}
+	}
+}
+
+func TestSoftDeleteTokens(t *testing.T) {
+	srv := newTestService(t, &Config{SoftDeleteTokens: true})
+	appId, secret := createTestApp(t, srv, nil)
+	_, app, err := srv.appBySecret(secret)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// a new token replaces the previous one of the user
+	first := userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	second := userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	// the refreshed token is replaced by a new one
+	refreshed, err := srv.refreshUserToken(context.Background(), appId, app, second)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the revoked tokens are not valid anymore
+	if err := srv.revokeUserTokens(appId, "user@simpleauth.link"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, token := range []string{first, second, refreshed} {
+		if srv.validUserToken(context.Background(), token, appId) {
+			t.Errorf("%s: expected invalid token", token)
+		}
+	}
+	// but their tombstones are kept for audit with the reason
+	tombstones, err := srv.db.TombstonesByPrefix(appId)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	reasons := map[db.Token]string{}
+	for _, tombstone := range tombstones {
+		reasons[tombstone.Token] = tombstone.Reason
+	}
+	expected := map[db.Token]string{
+		db.Token(first):     db.DeleteReasonReplaced,
+		db.Token(second):    db.DeleteReasonRefreshed,
+		db.Token(refreshed): db.DeleteReasonRevoked,
+	}
+	for token, reason := range expected {
+		if reasons[token] != reason {
+			t.Errorf("%s: expected reason %q, got %q", token, reason, reasons[token])
+		}
+	}
+	// the expired tokens are recorded when they are found
+	expired := userToken(t, srv, secret, &TokenRequest{Email: "other@simpleauth.link"})
+	if err := srv.db.SetToken(db.Token(expired), time.Now().Add(-time.Minute), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if srv.validUserToken(context.Background(), expired, appId) {
+		t.Errorf("expected invalid token")
+	}
+	if tombstones, _ := srv.db.TombstonesByPrefix(expired); len(tombstones) != 1 || tombstones[0].Reason != db.DeleteReasonExpired {
+		t.Errorf("unexpected tombstones: %+v", tombstones)
+	}
+	// without soft deletion, the tokens are removed without tombstones
+	srv = newTestService(t, nil)
+	appId, secret = createTestApp(t, srv, nil)
+	userToken(t, srv, secret, &TokenRequest{Email: "user@simpleauth.link"})
+	if err := srv.revokeUserTokens(appId, "user@simpleauth.link"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tombstones, _ := srv.db.TombstonesByPrefix(appId); len(tombstones) != 0 {
+		t.Errorf("expected no tombstones, got %+v", tombstones)
+	}
+}
+
+func TestMagicLinkForToken(t *testing.T) {
+	srv := newTestService(t, nil)
+	appId, secret := createTestApp(t, srv, nil)
+	_, app, err := srv.appBySecret(secret)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	link, token, err := srv.magicLink(context.Background(), appId, app, &TokenRequest{Email: "user@simpleauth.link"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the rebuilt link is the same that the one sent when it was issued
+	got, err := srv.MagicLinkForToken(token)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got != link {
+		t.Errorf("expected %s, got %s", link, got)
+	}
+	// and the token is still valid
+	if !srv.validUserToken(context.Background(), token, appId) {
+		t.Errorf("expected valid token")
+	}
+	// the malformed, unknown and expired tokens have no magic link
+	unknownToken, _, err := helpers.EncodeUserToken(appId, "other@simpleauth.link", helpers.TokenSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expiredToken, _, err := helpers.EncodeUserToken(appId, "expired@simpleauth.link", helpers.TokenSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := srv.db.SetToken(db.Token(expiredToken), time.Now().Add(-time.Minute), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, token := range []string{"invalid", unknownToken, expiredToken} {
+		if _, err := srv.MagicLinkForToken(token); !errors.Is(err, errInvalidToken) {
+			t.Errorf("%s: expected %v, got %v", token, errInvalidToken, err)
+		}
+	}
+}
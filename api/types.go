@@ -1,27 +1,314 @@
 package api
 
+import "time"
+
 const (
 	userTokenSubject = "Here is your magic link for '%s' 🔐"
 	appTokenSubject  = "Your app '%s' is ready! 🎉"
+	// quotaWarningSubject is the subject of the emails that warn the app
+	// admins that their apps are reaching their users quota.
+	quotaWarningSubject = "Your app '%s' is reaching its users quota ⚠️"
+
+	// envConfigFormat and jsonConfigFormat are the supported formats of the
+	// app config snippet.
+	envConfigFormat  = "env"
+	jsonConfigFormat = "json"
+	// envConfigSnippet is the template of the app config snippet in env
+	// format, it receives the app id and the API endpoint.
+	envConfigSnippet = `SIMPLEAUTH_APP_ID="%s"
+SIMPLEAUTH_API_ENDPOINT="%s"
+SIMPLEAUTH_APP_SECRET="<your app secret>"
+`
+	// clientExampleSnippet is the template of the example client code
+	// included in the app config snippet, it receives the API endpoint.
+	clientExampleSnippet = `cli, err := client.New(&client.ClientConfig{
+	APIEndpoint: "%s",
+	Secret:      os.Getenv("SIMPLEAUTH_APP_SECRET"),
+})
+if err != nil {
+	return err
+}
+valid, err := cli.ValidateToken(ctx, token)`
 )
 
+// AppConfig struct includes the information required to integrate an app
+// with the API service: the app id, the API endpoint and an example of the
+// client code.
+type AppConfig struct {
+	AppID       string `json:"app_id"`
+	APIEndpoint string `json:"api_endpoint"`
+	Example     string `json:"example"`
+}
+
 // TokenRequest struct includes the required information by the API service to
 // create a token, which is the email of the user. The app secret is also
-// required but it is provided in the request headers.
+// required but it is provided in the request headers. The token can be
+// limited to a list of scopes (or audiences), then the resource servers can
+// require one of them when the token is validated. The optional TemplateKey
+// selects one of the token email templates registered in the service and the
+// optional Locale (a language tag like "es" or "pt-BR") selects its version for
+// the language of the user, if it exists.
 type TokenRequest struct {
-	Email       string `json:"email"`
-	RedirectURL string `json:"redirect_url"`
-	Duration    uint64 `json:"session_duration"`
+	Email       string   `json:"email"`
+	RedirectURL string   `json:"redirect_url"`
+	Duration    uint64   `json:"session_duration"`
+	Scopes      []string `json:"scopes,omitempty"`
+	TemplateKey string   `json:"template_key,omitempty"`
+	Locale      string   `json:"locale,omitempty"`
+}
+
+// CodeVerificationRequest struct includes the email of a user and the
+// one-time code sent to them, to exchange it by the token of the user. The app
+// secret is also required but it is provided in the request headers.
+type CodeVerificationRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+// EmailCheckRequest struct includes the email that an app wants to check
+// before requesting a token for it.
+type EmailCheckRequest struct {
+	Email string `json:"email"`
+}
+
+// EmailCheck struct includes the result of checking an email: if it would be
+// accepted by the API and, if not, the reason.
+type EmailCheck struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// TokenValidation struct includes the ids of the app and the user of a valid
+// token and its expiration time, as they are sent by the validation endpoint
+// when JSON is requested, to allow the clients to know when to refresh it. It
+// also includes the issuer of the service, if it is configured, to allow the
+// clients to check that the token is issued by the expected service.
+type TokenValidation struct {
+	Valid     bool      `json:"valid"`
+	AppID     string    `json:"app_id"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Issuer    string    `json:"iss,omitempty"`
+}
+
+// Token delivery modes, which set where the token is sent in the responses of
+// the token requests of the apps that allow it.
+const (
+	// TokenDeliveryBody mode sends the magic link and the token in the JSON
+	// body of the response, when JSON is requested. It is the default mode.
+	TokenDeliveryBody = "body"
+	// TokenDeliveryHeader mode sends the token in the helpers.TokenHeader
+	// header of the response instead of in the body.
+	TokenDeliveryHeader = "header"
+	// TokenDeliveryBoth mode sends the token in the header of the response and
+	// the magic link and the token in the JSON body, when JSON is requested.
+	TokenDeliveryBoth = "both"
+)
+
+// Auth modes, which set how the users of an app log in.
+const (
+	// AuthModeLink mode sends a magic link to the users. It is the default
+	// mode.
+	AuthModeLink = "link"
+	// AuthModeCode mode sends a one-time code to the users, that they
+	// exchange by their token with the helpers.UserVerifyPath endpoint.
+	AuthModeCode = "code"
+	// AuthModeBoth mode sends both the magic link and the one-time code to
+	// the users.
+	AuthModeBoth = "both"
+)
+
+// Delivery policies, which set when the magic links are considered delivered
+// for the apps with multiple channels.
+const (
+	// DeliveryPolicyAny policy requires at least one channel to deliver the
+	// magic link, the failures of the rest are only logged. It is the
+	// default policy.
+	DeliveryPolicyAny = "any"
+	// DeliveryPolicyAll policy requires every channel to deliver the magic
+	// link.
+	DeliveryPolicyAll = "all"
+)
+
+// ChannelData struct represents an additional channel to deliver the magic
+// links of an app, the name of a registered notifier and its target.
+type ChannelData struct {
+	Notifier string `json:"notifier"`
+	Target   string `json:"target,omitempty"`
+}
+
+// Webhook events, which are posted to the webhook of the apps that have one.
+const (
+	// WebhookTokenIssued event is sent when a user token of the app is
+	// issued.
+	WebhookTokenIssued = "token.issued"
+	// WebhookTokenValidated event is sent when a user token of the app is
+	// validated successfully.
+	WebhookTokenValidated = "token.validated"
+	// WebhookQuotaWarning event is sent when the number of users of the app
+	// reaches the users quota warning threshold, the user is the one whose
+	// token reached it.
+	WebhookQuotaWarning = "quota.warning"
+)
+
+// WebhookEvent struct includes the type of the event, the ids of the app and
+// the user of the token and the time of the event, as they are posted to the
+// app webhooks, signed with the app secret (see
+// helpers.WebhookSignatureHeader).
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	AppID     string    `json:"app_id"`
+	UserID    string    `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MagicLinkResponse struct includes the magic link and the token generated
+// for a user, as they are sent by the user token endpoint when JSON is
+// requested and the app allows it.
+type MagicLinkResponse struct {
+	MagicLink string `json:"magic_link"`
+	Token     string `json:"token"`
+}
+
+// AdminAppData struct includes the id and the data of an app, as it is listed
+// to the service admins.
+type AdminAppData struct {
+	ID string `json:"id"`
+	AppData
+}
+
+// AppUsers struct includes the number of active sessions of an app and the
+// id of the user and the expiration of each one. The tokens are not included
+// to avoid exposing them.
+type AppUsers struct {
+	Count int64      `json:"count"`
+	Users []*AppUser `json:"users"`
+}
+
+// AppUser struct includes the id of a user with an active session in an app
+// and the expiration of the session.
+type AppUser struct {
+	UserID     string    `json:"user_id"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// AppUpdate struct includes the result of an app update, as it is sent by the
+// update endpoint when JSON is requested: if the redirect URL has changed, the
+// number of outstanding tokens of the app affected by the change, whose magic
+// links point to the previous redirect URL, and if they have been revoked.
+type AppUpdate struct {
+	RedirectURLChanged bool  `json:"redirect_url_changed"`
+	AffectedTokens     int64 `json:"affected_tokens"`
+	TokensRevoked      bool  `json:"tokens_revoked"`
+}
+
+// SecretRotation struct includes the new secret of an app, once it has been
+// rotated, and the expiration of the previous one, which is still valid until
+// then, as they are sent by the secret rotation endpoint.
+type SecretRotation struct {
+	Secret                  string    `json:"secret"`
+	PreviousSecretExpiresAt time.Time `json:"previous_secret_expires_at"`
+}
+
+// AppToken struct includes the id of a token of an app, with its random part
+// redacted, the id of its user and its expiration, as it is listed to the app
+// admin.
+type AppToken struct {
+	TokenID    string    `json:"token_id"`
+	UserID     string    `json:"user_id"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// AdminDeadLetter struct includes the id, the recipient, the subject, the
+// error of the last attempt and the failure time of an email that could not
+// be sent, as it is listed to the service admins. The body is not included
+// to avoid exposing the magic links.
+type AdminDeadLetter struct {
+	ID       string    `json:"id"`
+	To       string    `json:"to"`
+	Subject  string    `json:"subject"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// ServiceStats struct includes the aggregate statistics of the service sent
+// to the service admins: the number of apps, the number of tokens stored
+// (the expired ones are included until they are removed), the number of
+// tokens issued in the last day that are still stored and the number of
+// emails waiting in the queue.
+type ServiceStats struct {
+	Apps                int64 `json:"apps"`
+	Tokens              int64 `json:"tokens"`
+	TokensIssuedLastDay int64 `json:"tokens_issued_last_day"`
+	QueuedEmails        int   `json:"queued_emails"`
+}
+
+// DeadLetterRetryRequest struct includes the id of the dead letter that a
+// service admin wants to send again.
+type DeadLetterRetryRequest struct {
+	ID string `json:"id"`
+}
+
+// AttemptsResetRequest struct includes the client ip and/or the user email
+// whose attempts counters (rate limits and lockouts) an app admin wants to
+// reset.
+type AttemptsResetRequest struct {
+	IP    string `json:"ip"`
+	Email string `json:"email"`
+}
+
+// UserRevokeRequest struct includes the email of the user whose tokens an app
+// admin wants to revoke.
+type UserRevokeRequest struct {
+	Email string `json:"email"`
 }
 
 // AppData struct includes the required information by the API service to
 // create an app, which are the name, the email of the admin, the session
-// duration and the callback URL.
+// duration and the callback URL. It also includes the maximum number of
+// consecutive token refreshes, the size in bytes of the random part of the
+// tokens (helpers.TokenSize by default), the maximum number of tokens that can
+// be requested for the same email in the token requests window (in seconds),
+// the optional notifier used to deliver the magic links and its target (by
+// default, the email), if the app allows to get the magic links in the token
+// responses, which is optional to keep the current value when the app is
+// updated, where the token is sent in those responses (see the TokenDelivery
+// modes), the origins of the app frontends allowed to read the responses
+// (CORS) and the domains, in addition to the domain of the redirect URL, that
+// the token requests can use in their redirect URLs, which are kept if they
+// are not provided when the app is updated, and how the users log in (see the
+// AuthMode modes). The apps can also deliver the magic links to additional
+// channels, which are replaced if they are provided when the app is updated,
+// with a delivery policy (see the DeliveryPolicy policies), and be notified of
+// the tokens issued and validated in an optional webhook url (see
+// WebhookEvent). The optional custom subjects of the emails sent to the users
+// and to the app admin are templates that can include the app name
+// ("{{.AppName}}"), the default ones are used if they are empty. When the app
+// is updated, if RevokeTokens is set and the redirect URL changes, the
+// outstanding tokens of the app, whose magic links point to the previous
+// redirect URL, are revoked.
 type AppData struct {
-	Name         string `json:"name"`
-	Email        string `json:"admin_email"`
-	Duration     uint64 `json:"session_duration"`
-	RedirectURL  string `json:"redirect_url"`
-	UsersQuota   int64  `json:"users_quota"`
-	CurrentUsers int64  `json:"current_users"`
+	Name                   string        `json:"name"`
+	Email                  string        `json:"admin_email"`
+	Duration               uint64        `json:"session_duration"`
+	RedirectURL            string        `json:"redirect_url"`
+	UsersQuota             int64         `json:"users_quota"`
+	MaxRefreshes           int64         `json:"max_refreshes"`
+	TokenSize              int64         `json:"token_size"`
+	MaxTokenRequests       int64         `json:"max_token_requests"`
+	TokenRequestsWindow    uint64        `json:"token_requests_window"`
+	CurrentUsers           int64         `json:"current_users"`
+	Notifier               string        `json:"notifier,omitempty"`
+	NotifierTarget         string        `json:"notifier_target,omitempty"`
+	AllowLinkInResponse    *bool         `json:"allow_link_in_response,omitempty"`
+	TokenDelivery          string        `json:"token_delivery,omitempty"`
+	AllowedOrigins         []string      `json:"allowed_origins,omitempty"`
+	AllowedRedirectDomains []string      `json:"allowed_redirect_domains,omitempty"`
+	AuthMode               string        `json:"auth_mode,omitempty"`
+	Channels               []ChannelData `json:"channels,omitempty"`
+	DeliveryPolicy         string        `json:"delivery_policy,omitempty"`
+	WebhookURL             string        `json:"webhook_url,omitempty"`
+	TokenEmailSubject      string        `json:"token_email_subject,omitempty"`
+	AppEmailSubject        string        `json:"app_email_subject,omitempty"`
+	RevokeTokens           bool          `json:"revoke_tokens,omitempty"`
 }
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// webhookQueueSize is the maximum number of webhook events waiting to be
+// delivered, the events emitted when it is full are discarded.
+const webhookQueueSize = 256
+
+// webhookTimeout is the maximum time of every attempt to deliver a webhook
+// event.
+const webhookTimeout = 5 * time.Second
+
+// webhookDelivery struct represents a webhook event waiting to be delivered:
+// the url of the app webhook, the app secret used to sign it and the encoded
+// event.
+type webhookDelivery struct {
+	url    string
+	secret string
+	body   []byte
+}
+
+// emitWebhook method queues the provided event of the user with the provided
+// id to be delivered to the webhook of the app with the provided id, if the
+// app, resolved from the provided context by the withAppSecret middleware,
+// has one. The event is signed with the app secret of the request, so it is
+// discarded if the context has no app or it is other app. It never blocks:
+// if the queue is full, the event is discarded and a warning is logged.
+func (s *Service) emitWebhook(ctx context.Context, event, appId, userId string) {
+	reqApp, ok := ctx.Value(appContextKey{}).(*requestApp)
+	if !ok || reqApp.id != appId || reqApp.app.WebhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(&WebhookEvent{
+		Event:     event,
+		AppID:     appId,
+		UserID:    userId,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		s.contextLogger(ctx).Error("error encoding webhook event", "app_id", appId, "error", err)
+		return
+	}
+	select {
+	case s.webhooks <- &webhookDelivery{url: reqApp.app.WebhookURL, secret: reqApp.secret, body: body}:
+	default:
+		s.contextLogger(ctx).Warn("webhook queue full, event discarded", "app_id", appId, "event", event)
+	}
+}
+
+// webhookWorker method starts a background process that delivers the queued
+// webhook events, one by one, until the service context is done. The events
+// that are still queued when the service stops are discarded.
+func (s *Service) webhookWorker() {
+	s.wait.Add(1)
+	go func() {
+		defer s.wait.Done()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case delivery := <-s.webhooks:
+				if err := s.deliverWebhook(delivery); err != nil {
+					s.logger.Error("error delivering webhook", "url", delivery.url, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// deliverWebhook method posts the provided webhook event to its url, up to
+// the configured number of attempts (3 by default), waiting the configured
+// retry delay (1s by default) before the second attempt, which is doubled
+// before every following attempt. It returns the error of the last attempt if
+// none succeeds or the service context is done while waiting.
+func (s *Service) deliverWebhook(delivery *webhookDelivery) error {
+	attempts, delay := s.cfg.WebhookAttempts, s.cfg.WebhookRetryDelay
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	if delay <= 0 {
+		delay = defaultWebhookRetryDelay
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-s.ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		if err = s.postWebhook(delivery); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// postWebhook method sends the provided webhook event as the JSON body of a
+// POST request to its url, including the signature of the body in the
+// helpers.WebhookSignatureHeader header. It returns an error if the request
+// fails or the receiver responds with a non 2xx status code.
+func (s *Service) postWebhook(delivery *webhookDelivery) error {
+	ctx, cancel := context.WithTimeout(s.ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(helpers.WebhookSignatureHeader, signWebhook(delivery.secret, delivery.body))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer res.Body.Close()
+	// drain the body to allow the connection to be reused
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook function returns the signature of the provided webhook body,
+// the hex encoded HMAC-SHA256 of the body using the provided app secret as
+// the key, to allow the receivers to verify that the event comes from the
+// service.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// webhookRequest struct represents a request received by the test webhook.
+type webhookRequest struct {
+	body      []byte
+	signature string
+}
+
+func TestWebhooks(t *testing.T) {
+	// the webhook fails the first request to check that it is retried
+	var calls atomic.Int64
+	received := make(chan *webhookRequest, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- &webhookRequest{body: body, signature: r.Header.Get(helpers.WebhookSignatureHeader)}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer webhook.Close()
+	srv := newTestService(t, &Config{WebhookAttempts: 2, WebhookRetryDelay: 10 * time.Millisecond})
+	// the webhook url must be an absolute http(s) url
+	if _, _, err := srv.authApp(&AppData{
+		Name:        "test app",
+		Email:       "admin@simpleauth.link",
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+		WebhookURL:  "ftp://simpleauth.link/webhook",
+	}); !errors.Is(err, errInvalidWebhookURL) {
+		t.Fatalf("expected %v, got %v", errInvalidWebhookURL, err)
+	}
+	appId, secret := createTestApp(t, srv, &AppData{WebhookURL: webhook.URL})
+	srv.webhookWorker()
+	// nextEvent function waits for the next request to the webhook, checks
+	// its signature and returns the decoded event
+	nextEvent := func() *WebhookEvent {
+		t.Helper()
+		var req *webhookRequest
+		select {
+		case req = <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected webhook request, got none")
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(req.body)
+		if expected := hex.EncodeToString(mac.Sum(nil)); req.signature != expected {
+			t.Errorf("expected signature %s, got %s", expected, req.signature)
+		}
+		event := &WebhookEvent{}
+		if err := json.Unmarshal(req.body, event); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		return event
+	}
+	// issue a token, the event is retried after the first failure
+	if res := requestToken(srv, secret, `{"email":"user@simpleauth.link"}`); res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	first, retried := nextEvent(), nextEvent()
+	if first.Event != WebhookTokenIssued || first.AppID != appId || first.UserID == "" || first.Timestamp.IsZero() {
+		t.Errorf("unexpected event: %+v", first)
+	}
+	if *retried != *first {
+		t.Errorf("expected %+v, got %+v", first, retried)
+	}
+	// validate a token issued without request, which sends no event
+	token := userToken(t, srv, secret, &TokenRequest{Email: "other@simpleauth.link"})
+	if res := validateToken(srv, secret, token); res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	_, userId, _ := helpers.DecodeUserToken(token)
+	if event := nextEvent(); event.Event != WebhookTokenValidated || event.AppID != appId || event.UserID != userId {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	// the invalid tokens send no event
+	if res := validateToken(srv, secret, "invalid"); res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+	select {
+	case req := <-received:
+		t.Errorf("expected no webhook request, got %s", req.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
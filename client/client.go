@@ -8,16 +8,23 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/simpleauthlink/authapi/api"
 	"github.com/simpleauthlink/authapi/helpers"
 )
 
+// ErrIssuerMismatch error is returned when the API server validates a token
+// with an issuer different from the one of the client configuration.
+var ErrIssuerMismatch = fmt.Errorf("token validated by other issuer")
+
 // Client struct represents the client to interact with the API server. It
 // contains the configuration of the client. The configuration includes the
 // secret of the app and the API endpoint. The API endpoint is optional and if
-// it is empty, it uses the default API endpoint. The client provides two
-// methods to interact with the API server, RequestToken and ValidateToken.
+// it is empty, it uses the default API endpoint. The client provides methods
+// to request and validate user tokens (RequestToken, ValidateToken,
+// ValidateTokenUser and ValidateTokenExpiration) and to manage the app
+// (CreateApp, GetApp, UpdateApp and DeleteApp).
 type Client struct {
 	config *ClientConfig
 }
@@ -43,7 +50,8 @@ func New(config *ClientConfig) (*Client, error) {
 // based on the API endpoint, encodes the request, creates the request, sets
 // the secret in the header, sets the content type and makes the request. It
 // checks the status code and returns an error if the status code is different
-// from 200, if so returns an error trying to decode the body of the response.
+// from 200, if so returns an error trying to decode the body of the response,
+// which wraps the api.APIError sent by the server.
 func (cli *Client) RequestToken(ctx context.Context, req *api.TokenRequest) error {
 	if req == nil || req.Email == "" {
 		return fmt.Errorf("email is required to request a token")
@@ -69,24 +77,62 @@ func (cli *Client) RequestToken(ctx context.Context, req *api.TokenRequest) erro
 	// set the content type
 	httpReq.Header.Set("Content-Type", "application/json")
 	// make the request
-	res, err := http.DefaultClient.Do(httpReq)
+	res, err := cli.config.HTTPClient.Do(httpReq)
 	if err != nil {
 		return fmt.Errorf("error making request: %w", err)
 	}
 	defer res.Body.Close()
 	// check the status code and return an error if the status code is different
-	// from 200, if so return an error trying to decode the body of the response
+	// from 200, if so return the error decoded from the body of the response
 	if res.StatusCode != http.StatusOK {
-		// decode body and return error
-		msg, err := io.ReadAll(res.Body)
-		if err != nil {
-			return fmt.Errorf("unexpected status code: %d", res.StatusCode)
-		}
-		return fmt.Errorf("unexpected response: [%d] %s", res.StatusCode, string(msg))
+		return responseError(res)
 	}
 	return nil
 }
 
+// CheckEmail function checks if the provided email would be accepted by the
+// API server to request a token, without generating it or sending any email.
+// It returns the result of the check, which includes if the email is allowed
+// and the reason if it is not, or an error if something goes wrong during the
+// process.
+func (cli *Client) CheckEmail(ctx context.Context, email string) (*api.EmailCheck, error) {
+	// create a new URL based on the API endpoint
+	url := new(url.URL)
+	*url = *cli.config.url
+	// set the path
+	url.Path = helpers.UserCheckEmailPath
+	// encode the request
+	encodedReq, err := json.Marshal(&api.EmailCheckRequest{Email: email})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request: %w", err)
+	}
+	// create the request
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url.String(), bytes.NewBuffer(encodedReq))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	// set the secret in the header and the content type
+	req.Header.Set(helpers.AppSecretHeader, cli.config.Secret)
+	req.Header.Set("Content-Type", "application/json")
+	// make the request
+	res, err := cli.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer res.Body.Close()
+	// check the status code and return an error if the status code is different
+	// from 200, if so return the error decoded from the body of the response
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	// decode the result of the check
+	check := &api.EmailCheck{}
+	if err := json.NewDecoder(res.Body).Decode(check); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return check, nil
+}
+
 // ValidateToken function validates the token provided using the API server. It
 // returns true if the token is valid, false if the token is invalid, or an
 // error if something goes wrong during the process. It receives the context,
@@ -94,7 +140,33 @@ func (cli *Client) RequestToken(ctx context.Context, req *api.TokenRequest) erro
 // least, the secret of your app. If the API endpoint is empty, it uses the
 // default API endpoint. It validates the config and returns an error if the
 // configuration is nil, the secret is empty or the API endpoint is invalid.
+// Use ValidateTokenUser or ValidateTokenExpiration to get also the expiration
+// of the token.
 func (cli *Client) ValidateToken(ctx context.Context, token string) (bool, error) {
+	validation, err := cli.ValidateTokenUser(ctx, token)
+	return validation != nil, err
+}
+
+// ValidateTokenExpiration function validates the token provided using the API
+// server, like ValidateToken, and returns its expiration time, to allow the
+// clients to refresh it before it expires. It returns the zero time if the
+// token is invalid, or an error if something goes wrong during the process.
+func (cli *Client) ValidateTokenExpiration(ctx context.Context, token string) (time.Time, error) {
+	validation, err := cli.ValidateTokenUser(ctx, token)
+	if err != nil || validation == nil {
+		return time.Time{}, err
+	}
+	return validation.ExpiresAt, nil
+}
+
+// ValidateTokenUser function validates the token provided using the API
+// server, like ValidateToken, but it also returns the ids of the app and the
+// user of the token, to allow the resource servers to identify the user, and
+// its expiration time, to know when to refresh it. It returns nil if the
+// token is invalid, or an error if something goes wrong during the process.
+// If the client configuration includes an issuer, it returns
+// ErrIssuerMismatch if the API server validates the token with other issuer.
+func (cli *Client) ValidateTokenUser(ctx context.Context, token string) (*api.TokenValidation, error) {
 	// create a new URL based on the API endpoint
 	url := new(url.URL)
 	*url = *cli.config.url
@@ -107,30 +179,184 @@ func (cli *Client) ValidateToken(ctx context.Context, token string) (bool, error
 	// create the request
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
 	if err != nil {
-		return false, fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
-	// set the secret in the header
+	// set the secret in the header and request the result as JSON
 	req.Header.Set(helpers.AppSecretHeader, cli.config.Secret)
+	req.Header.Set("Accept", "application/json")
 	// make the request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cli.config.HTTPClient.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("error making request: %w", err)
+		return nil, fmt.Errorf("error making request: %w", err)
 	}
 	defer resp.Body.Close()
-	// check the status code, return true if the status code is 200 or false if
-	// the status code is 401, otherwise return an error trying to decode the
-	// body of the response
+	// check the status code, decode the result if the status code is 200 or
+	// return nil if the status code is 401, otherwise return an error trying
+	// to decode the body of the response
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return true, nil
+		validation := &api.TokenValidation{}
+		if err := json.NewDecoder(resp.Body).Decode(validation); err != nil {
+			return nil, fmt.Errorf("error decoding response: %w", err)
+		}
+		if cli.config.Issuer != "" && validation.Issuer != cli.config.Issuer {
+			return nil, ErrIssuerMismatch
+		}
+		return validation, nil
 	case http.StatusUnauthorized:
-		return false, nil
+		return nil, nil
 	default:
-		// decode body and return error
-		msg, err := io.ReadAll(resp.Body)
+		return nil, responseError(resp)
+	}
+}
+
+// responseError function composes the error of an unexpected response. If the
+// body of the response is a JSON error of the API, the returned error wraps it
+// as an *api.APIError, so the callers can check its code using errors.As.
+// Otherwise, it includes the raw body of the response.
+func responseError(res *http.Response) error {
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	apiErr := &api.APIError{}
+	if err := json.Unmarshal(body, apiErr); err == nil && apiErr.Code != "" {
+		return fmt.Errorf("unexpected response: [%d] %w", res.StatusCode, apiErr)
+	}
+	return fmt.Errorf("unexpected response: [%d] %s", res.StatusCode, string(body))
+}
+
+// CreateApp function creates a new app in the API server based on the
+// provided app data, which must include, at least, the name of the app, the
+// email of its admin and the redirect URL. The app secret is not required to
+// create an app, the id and the secret of the new app are sent to the admin
+// email. It returns an error if the app data is nil, or if the server rejects
+// the app or something goes wrong during the process.
+func (cli *Client) CreateApp(ctx context.Context, app *api.AppData) error {
+	if app == nil {
+		return fmt.Errorf("app data is required to create an app")
+	}
+	res, err := cli.appRequest(ctx, http.MethodPost, "", app)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// GetApp function gets the data of the app of the client from the API server.
+// It requires an admin token of the app, which is a token of its admin email.
+// It returns an error if the token is empty, or if the server rejects it or
+// something goes wrong during the process.
+func (cli *Client) GetApp(ctx context.Context, token string) (*api.AppData, error) {
+	if token == "" {
+		return nil, fmt.Errorf("admin token is required to get the app")
+	}
+	res, err := cli.appRequest(ctx, http.MethodGet, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	// decode the app data
+	app := &api.AppData{}
+	if err := json.NewDecoder(res.Body).Decode(app); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return app, nil
+}
+
+// UpdateApp function updates the app of the client in the API server with
+// the provided app data, only the non empty fields are updated. It requires
+// an admin token of the app, which is a token of its admin email. It returns
+// an error if the token is empty or the app data is nil, or if the server
+// rejects the update or something goes wrong during the process.
+func (cli *Client) UpdateApp(ctx context.Context, token string, app *api.AppData) error {
+	if token == "" {
+		return fmt.Errorf("admin token is required to update the app")
+	}
+	if app == nil {
+		return fmt.Errorf("app data is required to update the app")
+	}
+	res, err := cli.appRequest(ctx, http.MethodPut, token, app)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// DeleteApp function deletes the app of the client from the API server,
+// including its tokens and secret, so the client can not be used anymore. It
+// requires an admin token of the app, which is a token of its admin email. It
+// returns an error if the token is empty, or if the server rejects it or
+// something goes wrong during the process.
+func (cli *Client) DeleteApp(ctx context.Context, token string) error {
+	if token == "" {
+		return fmt.Errorf("admin token is required to delete the app")
+	}
+	res, err := cli.appRequest(ctx, http.MethodDelete, token, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// appRequest function makes a request with the provided method to the app
+// endpoint of the API server. If a token is provided, it is included in the
+// query and the request is authenticated with the secret of the app, else the
+// secret is not sent (to create an app). If a body is provided, it is encoded
+// as JSON. It returns the response, which must be closed by the caller, or an
+// error if something goes wrong making the request.
+func (cli *Client) appRequest(ctx context.Context, method, token string, body any) (*http.Response, error) {
+	// create a new URL based on the API endpoint
+	url := new(url.URL)
+	*url = *cli.config.url
+	// set the path and the token in the query
+	url.Path = helpers.AppEndpointPath
+	if token != "" {
+		query := url.Query()
+		query.Set(helpers.TokenQueryParam, token)
+		url.RawQuery = query.Encode()
+	}
+	// encode the body, if any
+	var reqBody io.Reader
+	if body != nil {
+		encodedBody, err := json.Marshal(body)
 		if err != nil {
-			return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+			return nil, fmt.Errorf("error encoding request: %w", err)
 		}
-		return false, fmt.Errorf("unexpected response: [%d] %s", resp.StatusCode, string(msg))
+		reqBody = bytes.NewBuffer(encodedBody)
+	}
+	// create the request
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	// set the secret in the header and the content type
+	if token != "" {
+		req.Header.Set(helpers.AppSecretHeader, cli.config.Secret)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	// make the request
+	res, err := cli.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
 	}
+	return res, nil
 }
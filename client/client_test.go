@@ -0,0 +1,288 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simpleauthlink/authapi/api"
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+const testAdminEmail = "admin@simpleauth.link"
+
+// newTestServer function starts a test server with the handlers of a new
+// service, with the provided issuer, backed by a temporary database, which is
+// also returned to prepare the test data.
+func newTestServer(t *testing.T, issuer string) (*httptest.Server, db.DB) {
+	t.Helper()
+	testDB := new(db.TempDriver)
+	if err := testDB.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv, err := api.New(ctx, testDB, &api.Config{
+		EmailConfig: email.EmailConfig{
+			Address:            "test@simpleauth.link",
+			EmailHost:          "smtp.simpleauth.link",
+			EmailPort:          587,
+			Password:           "password",
+			TokenEmailTemplate: "../assets/token_email_template.html",
+			AppEmailTemplate:   "../assets/app_email_template.html",
+		},
+		Server: "localhost",
+		Issuer: issuer,
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	server := httptest.NewServer(srv.Handler())
+	t.Cleanup(server.Close)
+	return server, testDB
+}
+
+// appCredentials function sets a known secret and an admin token for the
+// provided app in the database, as they are only sent by email.
+func appCredentials(t *testing.T, testDB db.DB, appId string) (string, string) {
+	t.Helper()
+	secret := "0123456789abcdef0123456789abcdef"
+	hSecret, err := helpers.Hash(secret, helpers.SecretSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := testDB.SetSecret(hSecret, appId, time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	token, _, err := helpers.EncodeUserToken(appId, testAdminEmail, 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := testDB.SetToken(db.Token(token), time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	return secret, token
+}
+
+func TestAppMethods(t *testing.T) {
+	server, testDB := newTestServer(t, "")
+	ctx := context.Background()
+	// create the app, no secret is needed
+	cli, err := New(&ClientConfig{APIEndpoint: server.URL, Secret: "unknown"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := cli.CreateApp(ctx, nil); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err := cli.CreateApp(ctx, &api.AppData{Name: "test app", Email: testAdminEmail}); err == nil {
+		t.Errorf("expected error without redirect URL, got nil")
+	}
+	if err := cli.CreateApp(ctx, &api.AppData{
+		Name:        "test app",
+		Email:       testAdminEmail,
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+	}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	apps, err := testDB.ListApps(10, 0)
+	if err != nil || len(apps) != 1 {
+		t.Fatalf("expected 1 app, got %d (%v)", len(apps), err)
+	}
+	secret, token := appCredentials(t, testDB, apps[0].ID)
+	cli, err = New(&ClientConfig{APIEndpoint: server.URL, Secret: secret})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// get the app
+	if _, err := cli.GetApp(ctx, ""); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	var apiErr *api.APIError
+	if _, err := cli.GetApp(ctx, "invalid-token"); !errors.As(err, &apiErr) || apiErr.Code != api.ErrCodeInvalidToken {
+		t.Errorf("expected %s error, got %v", api.ErrCodeInvalidToken, err)
+	}
+	app, err := cli.GetApp(ctx, token)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app.Name != "test app" || app.Email != testAdminEmail || app.RedirectURL != "https://simpleauth.link/callback" {
+		t.Errorf("unexpected app: %+v", app)
+	}
+	// update the app
+	if err := cli.UpdateApp(ctx, token, nil); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err := cli.UpdateApp(ctx, token, &api.AppData{Name: "new name", Duration: 1}); err == nil {
+		t.Errorf("expected error with invalid duration, got nil")
+	}
+	if err := cli.UpdateApp(ctx, token, &api.AppData{Name: "new name"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app, err := cli.GetApp(ctx, token); err != nil || app.Name != "new name" || app.Duration != helpers.MinTokenDuration {
+		t.Errorf("expected updated app, got %+v (%v)", app, err)
+	}
+	// delete the app, the client can not be used anymore
+	if err := cli.DeleteApp(ctx, token); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := testDB.AppById(apps[0].ID); !errors.Is(err, db.ErrAppNotFound) {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+	if err := cli.DeleteApp(ctx, token); !errors.As(err, &apiErr) || apiErr.Code != api.ErrCodeInvalidAppSecret {
+		t.Errorf("expected %s error, got %v", api.ErrCodeInvalidAppSecret, err)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	server, testDB := newTestServer(t, "")
+	ctx := context.Background()
+	cli, err := New(&ClientConfig{APIEndpoint: server.URL, Secret: "unknown"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := cli.CreateApp(ctx, &api.AppData{
+		Name:        "test app",
+		Email:       testAdminEmail,
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+	}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	apps, err := testDB.ListApps(10, 0)
+	if err != nil || len(apps) != 1 {
+		t.Fatalf("expected 1 app, got %d (%v)", len(apps), err)
+	}
+	secret, token := appCredentials(t, testDB, apps[0].ID)
+	cli, err = New(&ClientConfig{APIEndpoint: server.URL, Secret: secret})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if valid, err := cli.ValidateToken(ctx, token); err != nil || !valid {
+		t.Errorf("expected valid token, got %v (%v)", valid, err)
+	}
+	// the expiration of the token is returned
+	expiration, err := testDB.TokenExpiration(db.Token(token))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got, err := cli.ValidateTokenExpiration(ctx, token); err != nil || !got.Equal(expiration) {
+		t.Errorf("expected %v, got %v (%v)", expiration, got, err)
+	}
+	// the invalid tokens have no expiration
+	if got, err := cli.ValidateTokenExpiration(ctx, "invalid-token"); err != nil || !got.IsZero() {
+		t.Errorf("expected zero time, got %v (%v)", got, err)
+	}
+	if valid, err := cli.ValidateToken(ctx, "invalid-token"); err != nil || valid {
+		t.Errorf("expected invalid token, got %v (%v)", valid, err)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	// the default client has a timeout
+	cli, err := New(&ClientConfig{Secret: "secret"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if cli.config.HTTPClient == nil || cli.config.HTTPClient.Timeout != DefaultTimeout {
+		t.Errorf("expected default client with %s timeout, got %+v", DefaultTimeout, cli.config.HTTPClient)
+	}
+	// the custom client is used in the requests
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	cli, err = New(&ClientConfig{
+		APIEndpoint: server.URL,
+		Secret:      "secret",
+		HTTPClient:  &http.Client{Timeout: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	var netErr net.Error
+	if err := cli.RequestToken(context.Background(), &api.TokenRequest{Email: "user@simpleauth.link"}); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if _, err := cli.ValidateToken(context.Background(), "token"); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestValidateTokenIssuer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"valid":true,"app_id":"app","user_id":"user","iss":"https://simpleauth.link"}`))
+	}))
+	defer server.Close()
+	// the issuer is only checked if it is configured
+	for _, issuer := range []string{"", "https://simpleauth.link"} {
+		cli, err := New(&ClientConfig{APIEndpoint: server.URL, Secret: "secret", Issuer: issuer})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		validation, err := cli.ValidateTokenUser(context.Background(), "token")
+		if err != nil || validation == nil || validation.Issuer != "https://simpleauth.link" {
+			t.Errorf("expected validation with issuer, got %+v (%v)", validation, err)
+		}
+	}
+	// the validations of other issuer fail
+	cli, err := New(&ClientConfig{APIEndpoint: server.URL, Secret: "secret", Issuer: "https://other.link"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if valid, err := cli.ValidateToken(context.Background(), "token"); !errors.Is(err, ErrIssuerMismatch) || valid {
+		t.Errorf("expected %v, got %v (%v)", ErrIssuerMismatch, valid, err)
+	}
+}
+
+func TestValidateTokenIssuerEndToEnd(t *testing.T) {
+	server, testDB := newTestServer(t, "https://simpleauth.link")
+	ctx := context.Background()
+	cli, err := New(&ClientConfig{APIEndpoint: server.URL, Secret: "unknown"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := cli.CreateApp(ctx, &api.AppData{
+		Name:        "test app",
+		Email:       testAdminEmail,
+		RedirectURL: "https://simpleauth.link/callback",
+		Duration:    helpers.MinTokenDuration,
+	}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	apps, err := testDB.ListApps(10, 0)
+	if err != nil || len(apps) != 1 {
+		t.Fatalf("expected 1 app, got %d (%v)", len(apps), err)
+	}
+	secret, token := appCredentials(t, testDB, apps[0].ID)
+	// the service includes its issuer in the validation of the token
+	cli, err = New(&ClientConfig{APIEndpoint: server.URL, Secret: secret, Issuer: "https://simpleauth.link"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	validation, err := cli.ValidateTokenUser(ctx, token)
+	if err != nil || validation == nil || validation.Issuer != "https://simpleauth.link" {
+		t.Errorf("expected validation with issuer, got %+v (%v)", validation, err)
+	}
+	// the clients that expect other issuer reject it
+	cli, err = New(&ClientConfig{APIEndpoint: server.URL, Secret: secret, Issuer: "https://other.link"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if valid, err := cli.ValidateToken(ctx, token); !errors.Is(err, ErrIssuerMismatch) || valid {
+		t.Errorf("expected %v, got %v (%v)", ErrIssuerMismatch, valid, err)
+	}
+	if validation, err := cli.ValidateTokenUser(ctx, token); !errors.Is(err, ErrIssuerMismatch) || validation != nil {
+		t.Errorf("expected %v, got %+v (%v)", ErrIssuerMismatch, validation, err)
+	}
+}
@@ -2,11 +2,17 @@ package client
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/simpleauthlink/authapi/helpers"
 )
 
+// DefaultTimeout is the timeout of the requests to the API server when no
+// custom HTTP client is provided.
+const DefaultTimeout = 10 * time.Second
+
 // ClientConfig struct represents the configuration needed to use the client.
 type ClientConfig struct {
 	// APIEndpoint is the API hostname.
@@ -14,12 +20,21 @@ type ClientConfig struct {
 	url         *url.URL
 	// Secret is the app secret on the API server.
 	Secret string
+	// HTTPClient is the client used to make the requests to the API server,
+	// to allow setting timeouts, proxies or custom transports. If it is nil,
+	// a client with the DefaultTimeout is used.
+	HTTPClient *http.Client
+	// Issuer is the issuer that the API server must include in the token
+	// validations, to check that the tokens are validated by the expected
+	// service. If it is empty, the issuer is not checked.
+	Issuer string
 }
 
 // check function validates the configuration and returns an error if the
 // configuration is invalid. It checks if the configuration is nil, if the
 // secret is empty, and if the API endpoint is invalid. If the API endpoint is
-// empty, it uses the default API endpoint. It returns an error if the
+// empty, it uses the default API endpoint, and if the HTTP client is nil, it
+// uses a client with the default timeout. It returns an error if the
 // configuration is nil, the secret is empty or the API endpoint is invalid.
 func (conf *ClientConfig) check() error {
 	if conf == nil {
@@ -28,6 +43,9 @@ func (conf *ClientConfig) check() error {
 	if conf.APIEndpoint == "" {
 		conf.APIEndpoint = helpers.DefaultAPIEndpoint
 	}
+	if conf.HTTPClient == nil {
+		conf.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
 	if conf.Secret == "" {
 		return fmt.Errorf("secret is required")
 	}
@@ -12,6 +12,7 @@ import (
 	"github.com/simpleauthlink/authapi/api"
 	"github.com/simpleauthlink/authapi/db/mongo"
 	"github.com/simpleauthlink/authapi/email"
+	"github.com/simpleauthlink/authapi/helpers"
 )
 
 const (
@@ -23,9 +24,17 @@ const (
 	defaultEmailPass          = ""
 	defaultEmailHost          = ""
 	defaultEmailPort          = 587
+	defaultTemplatesDir       = "."
 	defaultTokenEmailTemplate = "assets/token_email_template.html"
 	defaultAppEmailTemplate   = "assets/app_email_template.html"
 	defaultDisposableSrcURL   = "https://raw.githubusercontent.com/disposable-email-domains/disposable-email-domains/master/disposable_email_blocklist.conf"
+	defaultHashAlgorithm      = string(helpers.SHA256)
+	defaultAppDuration        = 3600
+	// createAppSenderAddr is the sender address of the email queue of the
+	// createapp subcommand, which never sends emails
+	createAppSenderAddr = "noreply@simpleauth.link"
+
+	createAppCmd = "createapp"
 
 	hostFlag               = "host"
 	portFlag               = "port"
@@ -35,9 +44,15 @@ const (
 	emailPassFlag          = "email-pass"
 	emailHostFlag          = "email-host"
 	emailPortFlag          = "email-port"
+	templatesDirFlag       = "templates-dir"
 	tokenEmailTemplateFlag = "email-token-template"
 	appEmailTemplateFlag   = "email-app-template"
 	disposableSrcFlag      = "disposable-src"
+	hashAlgorithmFlag      = "hash-algorithm"
+	appNameFlag            = "name"
+	appEmailFlag           = "email"
+	appRedirectFlag        = "redirect"
+	appDurationFlag        = "duration"
 	hostFlagDesc           = "service host"
 	portFlagDesc           = "service port"
 	dbURIFlagDesc          = "database uri"
@@ -46,9 +61,15 @@ const (
 	emailPassFlagDesc      = "email account password"
 	emailHostFlagDesc      = "email server host"
 	emailPortFlagDesc      = "email server port"
+	templatesDirDesc       = "root directory of the email templates, their paths can not escape it"
 	tokenEmailTemplateDesc = "path to the html template of new token email"
 	appEmailTemplateDesc   = "path to the html template of new app email"
 	disposableSrcDesc      = "source url of list of disposable emails domains"
+	hashAlgorithmDesc      = "algorithm to hash the app and user ids (sha256, sha512, sha3-256 or blake2b-256), it must not change once there are apps"
+	appNameDesc            = "name of the app to create"
+	appEmailDesc           = "email of the admin of the app to create"
+	appRedirectDesc        = "redirect url of the app to create"
+	appDurationDesc        = "session duration of the app to create, in seconds"
 
 	hostEnv               = "SIMPLEAUTH_HOST"
 	portEnv               = "SIMPLEAUTH_PORT"
@@ -58,9 +79,11 @@ const (
 	emailPassEnv          = "SIMPLEAUTH_EMAIL_PASS"
 	emailHostEnv          = "SIMPLEAUTH_EMAIL_HOST"
 	emailPortEnv          = "SIMPLEAUTH_EMAIL_PORT"
+	templatesDirEnv       = "SIMPLEAUTH_TEMPLATES_DIR"
 	tokenEmailTemplateEnv = "SIMPLEAUTH_TOKEN_EMAIL_TEMPLATE"
 	appEmailTemplateEnv   = "SIMPLEAUTH_APP_EMAIL_TEMPLATE"
 	disposableSrcEnv      = "SIMPLEAUTH_DISPOSABLE_SRC"
+	hashAlgorithmEnv      = "SIMPLEAUTH_HASH_ALGORITHM"
 )
 
 type config struct {
@@ -72,13 +95,22 @@ type config struct {
 	emailPass          string
 	emailHost          string
 	emailPort          int
+	templatesDir       string
 	tokenEmailTemplate string
 	appEmailTemplate   string
 	disposableSrc      string
+	hashAlgorithm      string
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	// run the createapp subcommand instead of the service if it is requested
+	if len(os.Args) > 1 && os.Args[1] == createAppCmd {
+		if err := createApp(os.Args[2:]); err != nil {
+			log.Fatalln("ERR: error creating app:", err)
+		}
+		return
+	}
 	c, err := parseConfig()
 	if err != nil {
 		log.Fatalln("ERR: error parsing config:", err)
@@ -99,12 +131,14 @@ func main() {
 			EmailHost:          c.emailHost,
 			EmailPort:          c.emailPort,
 			DisposableSrc:      c.disposableSrc,
+			TemplatesDir:       c.templatesDir,
 			TokenEmailTemplate: c.tokenEmailTemplate,
 			AppEmailTemplate:   c.appEmailTemplate,
 		},
 		Server:          c.host,
 		ServerPort:      c.port,
 		CleanerCooldown: 30 * time.Minute,
+		HashAlgorithm:   helpers.HashAlgorithm(c.hashAlgorithm),
 	})
 	if err != nil {
 		log.Fatalln("ERR: error creating service:", err)
@@ -118,8 +152,91 @@ func main() {
 	service.WaitToShutdown()
 }
 
+// discardSender struct implements the email.Sender interface without sending
+// any email, it is used by the createapp subcommand, that does not need the
+// SMTP server.
+type discardSender struct{}
+
+func (discardSender) Send(*email.Email) error {
+	return fmt.Errorf("emails are not sent by the %s command", createAppCmd)
+}
+
+// createApp function runs the createapp subcommand with the provided
+// arguments: it creates an app with the provided name, admin email, redirect
+// url and session duration directly in the database, without sending any
+// email, and prints its id and secret to stdout. The database, the hash
+// algorithm and the email templates are configured with the same flags and
+// env vars as the service. It returns an error if the arguments are not
+// valid or the app can not be created.
+func createApp(args []string) error {
+	fs := flag.NewFlagSet(createAppCmd, flag.ExitOnError)
+	dbURI := fs.String(dbURIFlag, defaultDatabaseURI, dbURIFlagDesc)
+	dbName := fs.String(dbNameFlag, defaultDatabaseName, dbNameFlagDesc)
+	templatesDir := fs.String(templatesDirFlag, defaultTemplatesDir, templatesDirDesc)
+	tokenEmailTemplate := fs.String(tokenEmailTemplateFlag, defaultTokenEmailTemplate, tokenEmailTemplateDesc)
+	appEmailTemplate := fs.String(appEmailTemplateFlag, defaultAppEmailTemplate, appEmailTemplateDesc)
+	hashAlgorithm := fs.String(hashAlgorithmFlag, defaultHashAlgorithm, hashAlgorithmDesc)
+	name := fs.String(appNameFlag, "", appNameDesc)
+	adminEmail := fs.String(appEmailFlag, "", appEmailDesc)
+	redirectURL := fs.String(appRedirectFlag, "", appRedirectDesc)
+	duration := fs.Uint64(appDurationFlag, defaultAppDuration, appDurationDesc)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *adminEmail == "" {
+		return fmt.Errorf("app name and email are required, use -%s and -%s", appNameFlag, appEmailFlag)
+	}
+	// the env vars overwrite the flags, like in the service config
+	for value, env := range map[*string]string{
+		dbURI:              dbURIEnv,
+		dbName:             dbNameEnv,
+		templatesDir:       templatesDirEnv,
+		tokenEmailTemplate: tokenEmailTemplateEnv,
+		appEmailTemplate:   appEmailTemplateEnv,
+		hashAlgorithm:      hashAlgorithmEnv,
+	} {
+		if envValue := os.Getenv(env); envValue != "" {
+			*value = envValue
+		}
+	}
+	db := new(mongo.MongoDriver)
+	if err := db.Init(mongo.Config{
+		MongoURI: *dbURI,
+		Database: *dbName,
+	}); err != nil {
+		return fmt.Errorf("error initializing db: %w", err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service, err := api.New(ctx, db, &api.Config{
+		EmailConfig: email.EmailConfig{
+			Address:            createAppSenderAddr,
+			TemplatesDir:       *templatesDir,
+			TokenEmailTemplate: *tokenEmailTemplate,
+			AppEmailTemplate:   *appEmailTemplate,
+		},
+		EmailSender:   discardSender{},
+		HashAlgorithm: helpers.HashAlgorithm(*hashAlgorithm),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating service: %w", err)
+	}
+	appId, secret, err := service.CreateApp(&api.AppData{
+		Name:        *name,
+		Email:       *adminEmail,
+		RedirectURL: *redirectURL,
+		Duration:    *duration,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("app id: %s\napp secret: %s\n", appId, secret)
+	return nil
+}
+
 func parseConfig() (*config, error) {
-	var fhost, fdbURI, fdbName, femailAddr, femailPass, femailHost, ftokenEmailTemplate, fappEmailTemplate, fdisposableSrc string
+	var fhost, fdbURI, fdbName, femailAddr, femailPass, femailHost, ftemplatesDir, ftokenEmailTemplate, fappEmailTemplate, fdisposableSrc, fhashAlgorithm string
 	var fport, femailPort int
 	// get config from flags
 	flag.StringVar(&fhost, hostFlag, defaultHost, hostFlagDesc)
@@ -129,10 +246,12 @@ func parseConfig() (*config, error) {
 	flag.StringVar(&femailAddr, emailAddrFlag, defaultEmailAddr, emailAddrFlagDesc)
 	flag.StringVar(&femailPass, emailPassFlag, defaultEmailPass, emailPassFlagDesc)
 	flag.StringVar(&femailHost, emailHostFlag, defaultEmailHost, emailHostFlagDesc)
+	flag.StringVar(&ftemplatesDir, templatesDirFlag, defaultTemplatesDir, templatesDirDesc)
 	flag.StringVar(&ftokenEmailTemplate, tokenEmailTemplateFlag, defaultTokenEmailTemplate, tokenEmailTemplateDesc)
 	flag.StringVar(&fappEmailTemplate, appEmailTemplateFlag, defaultAppEmailTemplate, appEmailTemplateDesc)
 	flag.IntVar(&femailPort, emailPortFlag, defaultEmailPort, emailPortFlagDesc)
 	flag.StringVar(&fdisposableSrc, disposableSrcFlag, defaultDisposableSrcURL, disposableSrcDesc)
+	flag.StringVar(&fhashAlgorithm, hashAlgorithmFlag, defaultHashAlgorithm, hashAlgorithmDesc)
 	flag.Parse()
 	// get config from env
 	envHost := os.Getenv(hostEnv)
@@ -143,9 +262,11 @@ func parseConfig() (*config, error) {
 	envEmailPass := os.Getenv(emailPassEnv)
 	envEmailHost := os.Getenv(emailHostEnv)
 	envEmailPort := os.Getenv(emailPortEnv)
+	envTemplatesDir := os.Getenv(templatesDirEnv)
 	envtokenEmailTemplate := os.Getenv(tokenEmailTemplateEnv)
 	envAppEmailTemplate := os.Getenv(appEmailTemplateEnv)
 	envDisposableSrc := os.Getenv(disposableSrcEnv)
+	envHashAlgorithm := os.Getenv(hashAlgorithmEnv)
 
 	// check if the required flags are set
 	if femailAddr == "" && envEmailAddr == "" {
@@ -167,9 +288,11 @@ func parseConfig() (*config, error) {
 		emailPass:          femailPass,
 		emailHost:          femailHost,
 		emailPort:          femailPort,
+		templatesDir:       ftemplatesDir,
 		tokenEmailTemplate: ftokenEmailTemplate,
 		appEmailTemplate:   fappEmailTemplate,
 		disposableSrc:      fdisposableSrc,
+		hashAlgorithm:      fhashAlgorithm,
 	}
 	// if some flags are not set, set them by env
 	if envHost != "" {
@@ -204,6 +327,9 @@ func parseConfig() (*config, error) {
 			return nil, fmt.Errorf("invalid email port value: %s", envEmailPort)
 		}
 	}
+	if envTemplatesDir != "" {
+		c.templatesDir = envTemplatesDir
+	}
 	if envtokenEmailTemplate != "" {
 		c.tokenEmailTemplate = envtokenEmailTemplate
 	}
@@ -213,5 +339,8 @@ func parseConfig() (*config, error) {
 	if envDisposableSrc != "" {
 		c.disposableSrc = envDisposableSrc
 	}
+	if envHashAlgorithm != "" {
+		c.hashAlgorithm = envHashAlgorithm
+	}
 	return c, nil
 }
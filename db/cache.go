@@ -0,0 +1,232 @@
+package db
+
+import (
+	"container/list"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize is the maximum number of apps kept by the CachingDB, if it
+// is not configured.
+const defaultCacheSize = 1024
+
+// defaultCacheTTL is the time that the CachingDB keeps an app, if it is not
+// configured.
+const defaultCacheTTL = time.Minute
+
+// cacheEntry struct represents an app kept by the CachingDB, with the key used
+// to find it (by id or by secret), the id of the app and when it expires.
+type cacheEntry struct {
+	key        string
+	appId      string
+	app        *App
+	expiration time.Time
+}
+
+// CachingDB struct implements the DB interface wrapping other DB to keep the
+// apps read by id or by secret in memory, the hot path of the token requests,
+// up to a maximum number of apps (the least recently used ones are evicted)
+// and during a time to live. The cached apps are invalidated when the apps or
+// their secrets are stored or deleted through it, the rest of the methods are
+// served by the wrapped DB. If the database is shared by several service
+// instances, the changes made by the other instances are only seen once the
+// cached apps expire.
+type CachingDB struct {
+	DB
+	size       int
+	ttl        time.Duration
+	lock       sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	generation uint64
+}
+
+// NewCachingDB function creates a new CachingDB that wraps the provided DB,
+// keeping up to the provided number of apps (1024 by default) during the
+// provided time to live (1 minute by default).
+func NewCachingDB(db DB, size int, ttl time.Duration) *CachingDB {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	return &CachingDB{
+		DB:      db,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// AppById method gets the app with the provided id from the cache or, if it is
+// not cached or it is expired, from the wrapped DB, caching it. It returns
+// an error if something goes wrong reading it from the wrapped DB.
+func (cdb *CachingDB) AppById(appId string) (*App, error) {
+	key := "id:" + appId
+	if _, app, ok := cdb.get(key); ok {
+		return app, nil
+	}
+	generation := cdb.currentGeneration()
+	app, err := cdb.DB.AppById(appId)
+	if err != nil {
+		return nil, err
+	}
+	cdb.set(generation, key, appId, app)
+	return app, nil
+}
+
+// AppBySecret method gets the app with the provided secret, and its id, from
+// the cache or, if it is not cached or it is expired, from the wrapped DB,
+// caching it. It returns an error if something goes wrong reading it from the
+// wrapped DB.
+func (cdb *CachingDB) AppBySecret(secret string) (*App, string, error) {
+	key := "secret:" + secret
+	if appId, app, ok := cdb.get(key); ok {
+		return app, appId, nil
+	}
+	generation := cdb.currentGeneration()
+	app, appId, err := cdb.DB.AppBySecret(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	cdb.set(generation, key, appId, app)
+	return app, appId, nil
+}
+
+// SetApp method stores the app in the wrapped DB and invalidates the cached
+// copies of the app. It returns an error if something goes wrong.
+func (cdb *CachingDB) SetApp(appId string, app *App) error {
+	defer cdb.invalidateApp(appId)
+	return cdb.DB.SetApp(appId, app)
+}
+
+// DeleteApp method deletes the app from the wrapped DB and invalidates the
+// cached copies of the app. It returns an error if something goes wrong.
+func (cdb *CachingDB) DeleteApp(appId string) error {
+	defer cdb.invalidateApp(appId)
+	return cdb.DB.DeleteApp(appId)
+}
+
+// SetSecret method stores the secret in the wrapped DB and invalidates the
+// app cached by the secret. It returns an error if something goes wrong.
+func (cdb *CachingDB) SetSecret(secret, appId string, expiration time.Time) error {
+	defer cdb.invalidateKey("secret:" + secret)
+	return cdb.DB.SetSecret(secret, appId, expiration)
+}
+
+// ExpireSecrets method expires the secrets of the app in the wrapped DB and
+// invalidates the cached copies of the app. It returns an error if something
+// goes wrong.
+func (cdb *CachingDB) ExpireSecrets(appId, keepSecret string, expiration time.Time) error {
+	defer cdb.invalidateApp(appId)
+	return cdb.DB.ExpireSecrets(appId, keepSecret, expiration)
+}
+
+// ExpireSecret method expires the secret in the wrapped DB and invalidates
+// the app cached by the secret. It returns the resulting expiration of the
+// secret, or an error if something goes wrong.
+func (cdb *CachingDB) ExpireSecret(secret, appId string, expiration time.Time) (time.Time, error) {
+	defer cdb.invalidateKey("secret:" + secret)
+	return cdb.DB.ExpireSecret(secret, appId, expiration)
+}
+
+// DeleteSecret method deletes the secret from the wrapped DB and invalidates
+// the app cached by the secret. It returns an error if something goes wrong.
+func (cdb *CachingDB) DeleteSecret(secret string) error {
+	defer cdb.invalidateKey("secret:" + secret)
+	return cdb.DB.DeleteSecret(secret)
+}
+
+// get method returns the id and a copy of the app cached with the provided
+// key, if it is cached and not expired, marking it as the most recently used.
+// The expired apps are removed.
+func (cdb *CachingDB) get(key string) (string, *App, bool) {
+	cdb.lock.Lock()
+	defer cdb.lock.Unlock()
+	elem, ok := cdb.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiration) {
+		cdb.remove(elem)
+		return "", nil, false
+	}
+	cdb.lru.MoveToFront(elem)
+	return entry.appId, copyApp(entry.app), true
+}
+
+// set method caches a copy of the provided app with the provided key, evicting
+// the least recently used app if the cache is full. The app is not cached if
+// the cache has been invalidated since the provided generation, because it
+// could be read before the invalidation.
+func (cdb *CachingDB) set(generation uint64, key, appId string, app *App) {
+	cdb.lock.Lock()
+	defer cdb.lock.Unlock()
+	if generation != cdb.generation {
+		return
+	}
+	entry := &cacheEntry{key: key, appId: appId, app: copyApp(app), expiration: time.Now().Add(cdb.ttl)}
+	if elem, ok := cdb.entries[key]; ok {
+		elem.Value = entry
+		cdb.lru.MoveToFront(elem)
+		return
+	}
+	cdb.entries[key] = cdb.lru.PushFront(entry)
+	if cdb.lru.Len() > cdb.size {
+		cdb.remove(cdb.lru.Back())
+	}
+}
+
+// currentGeneration method returns the current generation of the cache, which
+// changes every time that it is invalidated.
+func (cdb *CachingDB) currentGeneration() uint64 {
+	cdb.lock.Lock()
+	defer cdb.lock.Unlock()
+	return cdb.generation
+}
+
+// invalidateApp method removes every cached copy of the app with the provided
+// id, by id and by secret.
+func (cdb *CachingDB) invalidateApp(appId string) {
+	cdb.lock.Lock()
+	defer cdb.lock.Unlock()
+	cdb.generation++
+	for _, elem := range cdb.entries {
+		if elem.Value.(*cacheEntry).appId == appId {
+			cdb.remove(elem)
+		}
+	}
+}
+
+// invalidateKey method removes the app cached with the provided key.
+func (cdb *CachingDB) invalidateKey(key string) {
+	cdb.lock.Lock()
+	defer cdb.lock.Unlock()
+	cdb.generation++
+	if elem, ok := cdb.entries[key]; ok {
+		cdb.remove(elem)
+	}
+}
+
+// remove method removes the provided element from the cache. The lock must be
+// held by the caller.
+func (cdb *CachingDB) remove(elem *list.Element) {
+	cdb.lru.Remove(elem)
+	delete(cdb.entries, elem.Value.(*cacheEntry).key)
+}
+
+// copyApp function returns a deep copy of the provided app, so the callers
+// can modify the apps that they get without modifying the cached ones.
+func copyApp(app *App) *App {
+	appCopy := *app
+	appCopy.Features = maps.Clone(app.Features)
+	appCopy.AllowedOrigins = slices.Clone(app.AllowedOrigins)
+	appCopy.AllowedRedirectDomains = slices.Clone(app.AllowedRedirectDomains)
+	appCopy.Channels = slices.Clone(app.Channels)
+	return &appCopy
+}
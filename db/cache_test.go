@@ -0,0 +1,115 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// countingDB struct wraps the temporal database to count the apps read from
+// it.
+type countingDB struct {
+	*TempDriver
+	reads int
+}
+
+func (cdb *countingDB) AppById(appId string) (*App, error) {
+	cdb.reads++
+	return cdb.TempDriver.AppById(appId)
+}
+
+func (cdb *countingDB) AppBySecret(secret string) (*App, string, error) {
+	cdb.reads++
+	return cdb.TempDriver.AppBySecret(secret)
+}
+
+func TestCachingDB(t *testing.T) {
+	tdb := &countingDB{TempDriver: new(TempDriver)}
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	cdb := NewCachingDB(tdb, 2, time.Minute)
+	if err := cdb.SetApp("appId", &App{Name: "app", AllowedOrigins: []string{"https://simpleauth.link"}}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := cdb.SetSecret("secret", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the first reads hit the database, the following ones the cache
+	for i := 0; i < 3; i++ {
+		if app, err := cdb.AppById("appId"); err != nil || app.Name != "app" {
+			t.Fatalf("expected app, got %+v and %v", app, err)
+		}
+		if app, appId, err := cdb.AppBySecret("secret"); err != nil || appId != "appId" || app.Name != "app" {
+			t.Fatalf("expected app, got %s, %+v and %v", appId, app, err)
+		}
+	}
+	if tdb.reads != 2 {
+		t.Errorf("expected 2 reads, got %d", tdb.reads)
+	}
+	// the cached apps can not be modified by the callers
+	app, _ := cdb.AppById("appId")
+	app.Name, app.AllowedOrigins[0] = "modified", "https://modified.link"
+	if app, _ := cdb.AppById("appId"); app.Name != "app" || app.AllowedOrigins[0] != "https://simpleauth.link" {
+		t.Errorf("expected cached app unchanged, got %+v", app)
+	}
+	// updating the app invalidates it, by id and by secret
+	if err := cdb.SetApp("appId", &App{Name: "updated"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app, _ := cdb.AppById("appId"); app.Name != "updated" {
+		t.Errorf("expected updated app, got %+v", app)
+	}
+	if app, _, _ := cdb.AppBySecret("secret"); app.Name != "updated" {
+		t.Errorf("expected updated app, got %+v", app)
+	}
+	if tdb.reads != 4 {
+		t.Errorf("expected 4 reads, got %d", tdb.reads)
+	}
+	// deleting the secret invalidates the app cached by it
+	if err := cdb.DeleteSecret("secret"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, _, err := cdb.AppBySecret("secret"); err != ErrAppNotFound {
+		t.Errorf("expected %v, got %v", ErrAppNotFound, err)
+	}
+	// deleting the app invalidates it
+	if err := cdb.DeleteApp("appId"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := cdb.AppById("appId"); err != ErrAppNotFound {
+		t.Errorf("expected %v, got %v", ErrAppNotFound, err)
+	}
+	// the least recently used apps are evicted when the cache is full
+	for _, appId := range []string{"a", "b", "c"} {
+		if err := cdb.SetApp(appId, &App{Name: appId}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if _, err := cdb.AppById(appId); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	tdb.reads = 0
+	for _, appId := range []string{"c", "b", "a"} {
+		if _, err := cdb.AppById(appId); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if tdb.reads != 1 {
+		t.Errorf("expected 1 read, got %d", tdb.reads)
+	}
+	// the cached apps expire after the ttl
+	cdb = NewCachingDB(tdb, 0, 10*time.Millisecond)
+	tdb.reads = 0
+	for i := 0; i < 2; i++ {
+		if _, err := cdb.AppById("a"); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := cdb.AppById("a"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tdb.reads != 2 {
+		t.Errorf("expected 2 reads, got %d", tdb.reads)
+	}
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
 	"time"
 )
@@ -15,6 +17,8 @@ var (
 	// ErrCloseConn error is returned when the database connection can't be
 	// closed.
 	ErrCloseConn = fmt.Errorf("error closing database")
+	// ErrPing error is returned when the database connection is not available.
+	ErrPing = fmt.Errorf("database not available")
 	// ErrAppNotFound error is returned when the desired app is not found in the
 	// database.
 	ErrAppNotFound = fmt.Errorf("app not found")
@@ -45,21 +49,195 @@ var (
 	// ErrDelToken error is returned when something fails deleting a token from
 	// the database.
 	ErrDelToken = fmt.Errorf("error deleting the token from database")
+	// ErrGetAttempts error is returned when something fails getting an
+	// attempts counter from the database.
+	ErrGetAttempts = fmt.Errorf("error getting the attempts from database")
+	// ErrSetAttempts error is returned when something fails storing an
+	// attempts counter in the database.
+	ErrSetAttempts = fmt.Errorf("error storing the attempts in database")
+	// ErrDelAttempts error is returned when something fails deleting an
+	// attempts counter from the database.
+	ErrDelAttempts = fmt.Errorf("error deleting the attempts from database")
+	// ErrDeadLetterNotFound error is returned when the desired dead letter is
+	// not found in the database.
+	ErrDeadLetterNotFound = fmt.Errorf("dead letter not found")
+	// ErrGetDeadLetter error is returned when something fails getting a dead
+	// letter from the database.
+	ErrGetDeadLetter = fmt.Errorf("error getting the dead letter from database")
+	// ErrSetDeadLetter error is returned when something fails storing a dead
+	// letter in the database.
+	ErrSetDeadLetter = fmt.Errorf("error storing the dead letter in database")
+	// ErrDelDeadLetter error is returned when something fails deleting a dead
+	// letter from the database.
+	ErrDelDeadLetter = fmt.Errorf("error deleting the dead letter from database")
+	// ErrGetPendingEmail error is returned when something fails getting the
+	// pending emails from the database.
+	ErrGetPendingEmail = fmt.Errorf("error getting the pending emails from database")
+	// ErrSetPendingEmail error is returned when something fails storing a
+	// pending email in the database.
+	ErrSetPendingEmail = fmt.Errorf("error storing the pending email in database")
+	// ErrDelPendingEmail error is returned when something fails deleting a
+	// pending email from the database.
+	ErrDelPendingEmail = fmt.Errorf("error deleting the pending email from database")
 )
 
+// Feature type represents a flag that enables or disables a behavior of the
+// service for an app. The features are stored together in the Features of the
+// app, so new flags can be added without changing the database schema.
+type Feature string
+
+const (
+	// FeatureLinkInResponse flag allows the app to get the magic link and the
+	// token in the response of the token requests.
+	FeatureLinkInResponse Feature = "link_in_response"
+)
+
+// defaultFeatures are the values of the features that are not set by the
+// apps. The features that are not listed are disabled by default.
+var defaultFeatures = map[Feature]bool{
+	FeatureLinkInResponse: false,
+}
+
+// Channel struct represents an additional channel of an app to deliver the
+// magic links, the name of the notifier and its target.
+type Channel struct {
+	Notifier string `json:"notifier"`
+	Target   string `json:"target,omitempty"`
+}
+
 // App struct represents the application information that is stored in the
-// database.
+// database. The ID is filled by the database when the app is read, it is
+// ignored when the app is stored (the app id is provided apart). Unlike the
+// rest of the fields, Features, AllowedOrigins, AllowedRedirectDomains and
+// Channels are always stored, even if they are empty, to allow disabling
+// them.
 type App struct {
+	ID              string
 	Name            string
 	AdminEmail      string
 	SessionDuration uint64
 	RedirectURL     string
 	UsersQuota      int64
+	// MaxRefreshes is the maximum number of consecutive times that a user
+	// token can be refreshed before the user has to request a new one.
+	MaxRefreshes int64
+	// TokenSize is the size in bytes of the random part of the tokens of the
+	// app, the default size (helpers.TokenSize) if it is zero.
+	TokenSize int64
+	// MaxTokenRequests is the maximum number of tokens that can be requested
+	// for the same email in the TokenRequestsWindow (in seconds), the
+	// defaults (helpers.DefaultMaxTokenRequests and
+	// helpers.DefaultTokenRequestsWindow) if they are zero.
+	MaxTokenRequests    int64
+	TokenRequestsWindow uint64
+	Notifier            string
+	NotifierTarget      string
+	// Features are the feature flags set by the app, use the Enabled method
+	// to get the value of a feature including the default ones.
+	Features map[Feature]bool
+	// TokenDelivery is where the token is sent in the token responses if the
+	// app allows it: in the body (default), in a header or in both.
+	TokenDelivery string
+	// AllowedOrigins are the origins of the app frontends that are allowed to
+	// read the responses of the API (CORS), any origin if it is empty.
+	AllowedOrigins []string
+	// AllowedRedirectDomains are the domains, in addition to the domain of the
+	// RedirectURL, that the token requests can use in their redirect URLs.
+	AllowedRedirectDomains []string
+	// AuthMode is how the users of the app log in: with the magic link
+	// (default), with a one-time code or with both.
+	AuthMode string
+	// Channels are the notifiers, and their targets, that receive the magic
+	// links in addition to the Notifier of the app, and DeliveryPolicy is
+	// if all of them must succeed or at least one of them.
+	Channels       []Channel
+	DeliveryPolicy string
+	// WebhookURL is the url that receives the signed events of the tokens of
+	// the app (issued and validated), none if it is empty.
+	WebhookURL string
+	// TokenEmailSubject and AppEmailSubject are the templates of the
+	// subjects of the emails sent to the users with their magic links and
+	// to the app admin when the app is created, the default ones if they are
+	// empty.
+	TokenEmailSubject string
+	AppEmailSubject   string
+}
+
+// Enabled method returns if the provided feature is enabled for the app. If
+// the app does not set the feature, it returns its default value.
+func (app *App) Enabled(feature Feature) bool {
+	if enabled, ok := app.Features[feature]; ok {
+		return enabled
+	}
+	return defaultFeatures[feature]
+}
+
+// SetFeature method enables or disables the provided feature for the app,
+// initializing its features if they are not.
+func (app *App) SetFeature(feature Feature, enabled bool) {
+	if app.Features == nil {
+		app.Features = map[Feature]bool{}
+	}
+	app.Features[feature] = enabled
 }
 
 // Token type represents the token that is stored in the database.
 type Token string
 
+// TokenInfo struct represents a token stored in the database and its
+// expiration time.
+type TokenInfo struct {
+	Token      Token
+	Expiration time.Time
+}
+
+// Reasons of the soft deletion of the tokens, recorded in their tombstones.
+const (
+	DeleteReasonExpired    = "expired"
+	DeleteReasonReplaced   = "replaced"
+	DeleteReasonRefreshed  = "refreshed"
+	DeleteReasonRevoked    = "revoked"
+	DeleteReasonAppDeleted = "app_deleted"
+)
+
+// Tombstone struct represents the record of a soft deleted token, that is
+// kept in the database for audit until it is purged. It includes the token,
+// the reason why it was deleted and the time when it was deleted.
+type Tombstone struct {
+	Token     Token
+	Reason    string
+	DeletedAt time.Time
+}
+
+// DeadLetter struct represents an email that could not be sent after all the
+// attempts, that is stored in the database to be investigated and retried. It
+// includes the id of the dead letter, the fields of the email, the error of
+// the last attempt and the time when it failed.
+type DeadLetter struct {
+	ID       string
+	To       string
+	Subject  string
+	Body     string
+	TextBody string
+	Priority int
+	Error    string
+	FailedAt time.Time
+}
+
+// PendingEmail struct represents an email pushed to the email queue that has
+// not been sent yet, that is stored in the database to recover it if the
+// service stops before sending it. It includes the id of the email, its
+// fields and the time when it was queued.
+type PendingEmail struct {
+	ID       string
+	To       string
+	Subject  string
+	Body     string
+	TextBody string
+	Priority int
+	QueuedAt time.Time
+}
+
 type DB interface {
 	// Init method allows to the interface implementation to receive some config
 	// information and init the database connection. It returns an error if the
@@ -68,44 +246,173 @@ type DB interface {
 	// Close method allows to the interface implementation to close the database
 	// connection. It returns an error if something fails during the closing.
 	Close() error
+	// Ping method checks if the database connection is available, for
+	// example, to report the health of the service. It returns an error if
+	// the database cannot be reached before the provided context is done.
+	Ping(ctx context.Context) error
 	// AppById method gets an app from the database based on the app id. It
 	// returns the app and an error if something goes wrong.
 	AppById(appId string) (*App, error)
-	// AppBySecret method gets an app from the database based on the app secret.
-	// It returns the app, the app id and an error if something goes wrong.
+	// AppBySecret method gets an app from the database based on any of its
+	// active app secrets, the expired ones are ignored, comparing the stored
+	// secret in constant time (see EqualSecrets) when it is read. It returns
+	// the app, the app id and an error if something goes wrong.
 	AppBySecret(secret string) (*App, string, error)
+	// ListApps method gets the apps stored in the database, sorted by app id
+	// to paginate them deterministically. It returns up to limit apps
+	// skipping the first offset ones, if limit is zero or negative, it
+	// returns all the apps from the offset. It returns an error if something
+	// goes wrong.
+	ListApps(limit, offset int) ([]*App, error)
+	// CountApps method counts the number of apps stored in the database. It
+	// returns an error if something goes wrong.
+	CountApps() (int64, error)
 	// SetApp method stores an app in the database. It returns an error if
 	// something goes wrong.
 	SetApp(appId string, app *App) error
-	// DeleteApp method deletes an app from the database. It returns an error if
-	// something goes wrong.
+	// DeleteApp method deletes an app from the database, including its
+	// secrets, so they can not be used to find the app anymore. It returns an
+	// error if something goes wrong.
 	DeleteApp(appId string) error
-	// ValidSecret method checks if a secret is valid. It returns true if the
-	// secret is valid and false if it is not.
-	ValidSecret(secret, appId string) (bool, error)
-	// SetSecret method stores a secret in the database. It returns an error if
+	// SetSecret method stores a secret of the app with the provided id in the
+	// database, keeping the rest of the secrets of the app, so an app can have
+	// several active secrets (for example, while they are rotated). The secret
+	// is valid until the provided expiration, or forever if it is zero. If the
+	// secret is already stored, its expiration is updated. It returns an error
+	// if something goes wrong.
+	SetSecret(secret, appId string, expiration time.Time) error
+	// ExpireSecrets method sets the provided expiration to every secret of
+	// the app with the provided id except the provided one, the one to keep,
+	// so the rest of the secrets stop being valid after it. The secrets that
+	// already expire before it are not extended. It returns an error if
 	// something goes wrong.
-	SetSecret(secret, appId string) error
-	// DeleteSecret method deletes a secret from the database. It returns an
-	// error if something goes wrong.
+	ExpireSecrets(appId, keepSecret string, expiration time.Time) error
+	// ExpireSecret method sets the provided expiration to the provided secret
+	// of the app with the provided id, unless it already expires before it,
+	// so its expiration is never extended. It returns the resulting
+	// expiration of the secret, or an error if the secret is not found for
+	// the app or something goes wrong.
+	ExpireSecret(secret, appId string, expiration time.Time) (time.Time, error)
+	// DeleteSecret method deletes a secret from the database, keeping the
+	// rest of the secrets of its app. It returns an error if something goes
+	// wrong.
 	DeleteSecret(secret string) error
 	// TokenExpiration method gets the token expiration from the database. It
 	// returns the expiration time and an error if something goes wrong.
 	TokenExpiration(token Token) (time.Time, error)
-	// SetToken method stores a token in the database with an expiration time.
-	// It returns an error if something goes wrong.
-	SetToken(token Token, expiration time.Time) error
+	// TokenExists method checks if the token is stored in the database,
+	// without reading its data nor checking if it is expired. It returns
+	// an error if something goes wrong.
+	TokenExists(token Token) (bool, error)
+	// TokenScopes method gets the scopes of the token from the database. It
+	// returns the scopes and an error if something goes wrong.
+	TokenScopes(token Token) ([]string, error)
+	// SetToken method stores a token in the database with an expiration time
+	// and the scopes where it is valid (empty if the token is not scoped). The
+	// time when the token is stored is kept as its issue time. It returns an
+	// error if something goes wrong.
+	SetToken(token Token, expiration time.Time, scopes []string) error
 	// DeleteToken method deletes a token from the database. It returns an error
 	// if something goes wrong.
 	DeleteToken(token Token) error
+	// SoftDeleteToken method deletes a token from the database, so it is not
+	// valid anymore, keeping a tombstone of it with the provided reason and
+	// the deletion time until it is purged. If the token does not exist, it
+	// does nothing. It returns an error if something goes wrong.
+	SoftDeleteToken(token Token, reason string) error
+	// TombstonesByPrefix method gets the tombstones of the soft deleted
+	// tokens with the provided prefix from the database, sorted by token. It
+	// returns an error if something goes wrong.
+	TombstonesByPrefix(prefix string) ([]Tombstone, error)
+	// PurgeTombstones method deletes the tombstones of the tokens soft
+	// deleted more than the provided retention period ago from the
+	// database. It returns an error if something goes wrong.
+	PurgeTombstones(retention time.Duration) error
 	// DeleteTokenByPrefix method deletes all the tokens with the provided
 	// prefix from the database. It returns an error if something goes wrong.
 	DeleteTokensByPrefix(prefix string) error
-	// DeleteExpiredTokens method deletes all the expired tokens from the
-	// database. It returns an error if something goes wrong.
-	DeleteExpiredTokens() error
+	// DeleteExpiredTokens method deletes the tokens that expired more than
+	// the provided grace period ago from the database, the recently expired
+	// ones are kept. It returns an error if something goes wrong.
+	DeleteExpiredTokens(gracePeriod time.Duration) error
 	// CountTokens method counts the number of tokens in the database. It allows
 	// to filter the tokens by the provided prefix. It returns the number of
 	// tokens and an error if something goes wrong.
 	CountTokens(prefix string) (int64, error)
+	// CountTokensIssuedSince method counts the number of tokens in the
+	// database issued at or after the provided time. The tokens already
+	// removed (deleted or expired) are not counted, neither the ones stored
+	// before the issue time was tracked. It returns the number of tokens and
+	// an error if something goes wrong.
+	CountTokensIssuedSince(since time.Time) (int64, error)
+	// TokensByPrefix method gets the tokens with the provided prefix from the
+	// database and their expiration times, sorted by token. It returns an
+	// error if something goes wrong.
+	TokensByPrefix(prefix string) ([]TokenInfo, error)
+	// ListTokensByPrefix method gets a page of the tokens with the provided
+	// prefix from the database and their expiration times, sorted by token
+	// to paginate them deterministically. It returns up to limit tokens
+	// skipping the first offset ones, if limit is zero or negative, it
+	// returns all the tokens from the offset. It returns an error if
+	// something goes wrong.
+	ListTokensByPrefix(prefix string, limit, offset int) ([]TokenInfo, error)
+	// SetTokenCode method stores the one-time code of the provided token,
+	// which must be already hashed, and its expiration time, replacing the
+	// previous one. An empty code deletes the code of the token. The code is
+	// also deleted when the token is replaced or deleted. It returns
+	// ErrTokenNotFound if the token does not exist and an error if something
+	// goes wrong.
+	SetTokenCode(token Token, code string, expiration time.Time) error
+	// TokenCode method gets the one-time code of the provided token and its
+	// expiration time, or an empty code if the token has none. It returns
+	// ErrTokenNotFound if the token does not exist and an error if something
+	// goes wrong.
+	TokenCode(token Token) (string, time.Time, error)
+	// IncrAttempts method increments the attempts counter of the provided key
+	// and returns the resulting value. If the counter does not exist or it is
+	// expired, it is created with the provided ttl. The counters are shared
+	// between the service instances to limit attempts and lock out clients
+	// consistently. It returns an error if something goes wrong.
+	IncrAttempts(key string, ttl time.Duration) (int64, error)
+	// Attempts method gets the current value of the attempts counter of the
+	// provided key. If the counter does not exist or it is expired, it
+	// returns 0. It returns an error if something goes wrong.
+	Attempts(key string) (int64, error)
+	// ResetAttempts method deletes the attempts counter of the provided key.
+	// It returns an error if something goes wrong.
+	ResetAttempts(key string) error
+	// SetDeadLetter method stores a dead letter in the database, using its id
+	// as the key. It returns an error if something goes wrong.
+	SetDeadLetter(letter *DeadLetter) error
+	// DeadLetterById method gets a dead letter from the database based on its
+	// id. It returns ErrDeadLetterNotFound if it does not exist and an error
+	// if something goes wrong.
+	DeadLetterById(id string) (*DeadLetter, error)
+	// ListDeadLetters method gets the dead letters stored in the database,
+	// sorted by the time when they failed (and by id). It returns up to
+	// limit dead letters skipping the first offset ones, if limit is zero or
+	// negative, it returns all the dead letters from the offset. It returns
+	// an error if something goes wrong.
+	ListDeadLetters(limit, offset int) ([]*DeadLetter, error)
+	// DeleteDeadLetter method deletes a dead letter from the database. It
+	// returns an error if something goes wrong.
+	DeleteDeadLetter(id string) error
+	// EnqueueEmail method stores a pending email in the database, using its
+	// id as the key. It returns an error if something goes wrong.
+	EnqueueEmail(email *PendingEmail) error
+	// DequeueEmail method deletes a pending email from the database, once it
+	// is sent. It returns an error if something goes wrong.
+	DequeueEmail(id string) error
+	// PendingEmails method gets all the pending emails stored in the
+	// database, sorted by the time when they were queued (and by id). It
+	// returns an error if something goes wrong.
+	PendingEmails() ([]*PendingEmail, error)
+}
+
+// EqualSecrets function compares the provided (hashed) secrets in constant
+// time, to avoid leaking the stored secret through the time that the
+// comparison takes. The drivers that read the stored secret in AppBySecret
+// must use it to confirm that it matches the provided one.
+func EqualSecrets(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
@@ -12,13 +12,127 @@ import (
 )
 
 type App struct {
-	ID              string `bson:"_id"`
-	Name            string `bson:"name"`
-	AdminEmail      string `bson:"admin_email"`
-	SessionDuration uint64 `bson:"session_duration"`
-	RedirectURL     string `bson:"redirect_url"`
-	UsersQuota      int64  `bson:"users_quota"`
-	Secret          string `bson:"secret"`
+	ID                     string          `bson:"_id"`
+	Name                   string          `bson:"name"`
+	AdminEmail             string          `bson:"admin_email"`
+	SessionDuration        uint64          `bson:"session_duration"`
+	RedirectURL            string          `bson:"redirect_url"`
+	UsersQuota             int64           `bson:"users_quota"`
+	MaxRefreshes           int64           `bson:"max_refreshes"`
+	TokenSize              int64           `bson:"token_size"`
+	MaxTokenRequests       int64           `bson:"max_token_requests"`
+	TokenRequestsWindow    uint64          `bson:"token_requests_window"`
+	Notifier               string          `bson:"notifier"`
+	NotifierTarget         string          `bson:"notifier_target"`
+	Features               map[string]bool `bson:"features"`
+	TokenDelivery          string          `bson:"token_delivery"`
+	AllowedOrigins         []string        `bson:"allowed_origins"`
+	AllowedRedirectDomains []string        `bson:"allowed_redirect_domains"`
+	AuthMode               string          `bson:"auth_mode"`
+	Channels               []Channel       `bson:"channels"`
+	DeliveryPolicy         string          `bson:"delivery_policy"`
+	WebhookURL             string          `bson:"webhook_url"`
+	TokenEmailSubject      string          `bson:"token_email_subject"`
+	AppEmailSubject        string          `bson:"app_email_subject"`
+	Secrets                []Secret        `bson:"secrets"`
+	// Secret is the secret stored before the apps could have several ones,
+	// it is valid until it is deleted or stored again in the Secrets.
+	Secret string `bson:"secret"`
+	// LegacyAllowLink is the flag stored before the features, it is only
+	// read to migrate it to the features (see toDB).
+	LegacyAllowLink bool `bson:"allow_link_in_response"`
+}
+
+// toDB converts the app document into a db.App. If the document has the
+// legacy allow_link_in_response flag and its feature is not set, the flag is
+// migrated to the features.
+func (app *App) toDB() *db.App {
+	dbApp := &db.App{
+		ID:                     app.ID,
+		Name:                   app.Name,
+		AdminEmail:             app.AdminEmail,
+		SessionDuration:        app.SessionDuration,
+		RedirectURL:            app.RedirectURL,
+		UsersQuota:             app.UsersQuota,
+		MaxRefreshes:           app.MaxRefreshes,
+		TokenSize:              app.TokenSize,
+		MaxTokenRequests:       app.MaxTokenRequests,
+		TokenRequestsWindow:    app.TokenRequestsWindow,
+		Notifier:               app.Notifier,
+		NotifierTarget:         app.NotifierTarget,
+		TokenDelivery:          app.TokenDelivery,
+		AllowedOrigins:         app.AllowedOrigins,
+		AllowedRedirectDomains: app.AllowedRedirectDomains,
+		AuthMode:               app.AuthMode,
+		DeliveryPolicy:         app.DeliveryPolicy,
+		WebhookURL:             app.WebhookURL,
+		TokenEmailSubject:      app.TokenEmailSubject,
+		AppEmailSubject:        app.AppEmailSubject,
+	}
+	for _, channel := range app.Channels {
+		dbApp.Channels = append(dbApp.Channels, db.Channel{Notifier: channel.Notifier, Target: channel.Target})
+	}
+	for feature, enabled := range app.Features {
+		dbApp.SetFeature(db.Feature(feature), enabled)
+	}
+	if _, ok := dbApp.Features[db.FeatureLinkInResponse]; !ok && app.LegacyAllowLink {
+		dbApp.SetFeature(db.FeatureLinkInResponse, true)
+	}
+	return dbApp
+}
+
+// Secret struct represents a secret of an app document, which is valid until
+// its expiration, or forever if it has none.
+type Secret struct {
+	Secret     string     `bson:"secret"`
+	Expiration *time.Time `bson:"expiration,omitempty"`
+}
+
+// active method returns if the secret is not expired at the provided time.
+func (s Secret) active(now time.Time) bool {
+	return s.Expiration == nil || now.Before(*s.Expiration)
+}
+
+// hasSecret method checks if the provided secret is one of the active secrets
+// of the app, or the one stored before the apps could have several ones,
+// comparing all of them in constant time (see db.EqualSecrets).
+func (app *App) hasSecret(secret string, now time.Time) bool {
+	valid := app.Secret != "" && db.EqualSecrets(app.Secret, secret)
+	for _, appSecret := range app.Secrets {
+		if appSecret.active(now) && db.EqualSecrets(appSecret.Secret, secret) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Channel struct represents an additional channel of an app document.
+type Channel struct {
+	Notifier string `bson:"notifier"`
+	Target   string `bson:"target"`
+}
+
+// channelsDocument converts the channels of a db.App into the channels of an
+// app document.
+func channelsDocument(channels []db.Channel) []Channel {
+	docs := make([]Channel, 0, len(channels))
+	for _, channel := range channels {
+		docs = append(docs, Channel{Notifier: channel.Notifier, Target: channel.Target})
+	}
+	return docs
+}
+
+// featuresDocument converts the features of a db.App into the features of an
+// app document.
+func featuresDocument(features map[db.Feature]bool) map[string]bool {
+	if features == nil {
+		return nil
+	}
+	doc := make(map[string]bool, len(features))
+	for feature, enabled := range features {
+		doc[string(feature)] = enabled
+	}
+	return doc
 }
 
 func (md *MongoDriver) AppById(appId string) (*db.App, error) {
@@ -33,34 +147,76 @@ func (md *MongoDriver) AppById(appId string) (*db.App, error) {
 		return nil, errors.Join(db.ErrGetApp, err)
 	}
 	// return app
-	return &db.App{
-		Name:            app.Name,
-		AdminEmail:      app.AdminEmail,
-		SessionDuration: app.SessionDuration,
-		RedirectURL:     app.RedirectURL,
-		UsersQuota:      app.UsersQuota,
-	}, nil
+	return app.toDB(), nil
 }
 
 func (md *MongoDriver) AppBySecret(secret string) (*db.App, string, error) {
 	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
 	defer cancel()
-	// get app from the database based on the app secret
+	// get app from the database based on any of its active secrets, or the
+	// one stored before the apps could have several ones
+	filter := bson.M{"$or": bson.A{
+		bson.M{"secret": secret},
+		bson.M{"secrets": bson.M{"$elemMatch": bson.M{
+			"secret": secret,
+			"$or":    bson.A{bson.M{"expiration": nil}, bson.M{"expiration": bson.M{"$gt": time.Now()}}},
+		}}},
+	}}
 	var app App
-	if err := md.apps.FindOne(ctx, bson.M{"secret": secret}).Decode(&app); err != nil {
+	if err := md.apps.FindOne(ctx, filter).Decode(&app); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, "", db.ErrAppNotFound
 		}
 		return nil, "", errors.Join(db.ErrGetApp, err)
 	}
+	if !app.hasSecret(secret, time.Now()) {
+		return nil, "", db.ErrAppNotFound
+	}
 	// return app and app id
-	return &db.App{
-		Name:            app.Name,
-		AdminEmail:      app.AdminEmail,
-		SessionDuration: app.SessionDuration,
-		RedirectURL:     app.RedirectURL,
-		UsersQuota:      app.UsersQuota,
-	}, app.ID, nil
+	return app.toDB(), app.ID, nil
+}
+
+func (md *MongoDriver) ListApps(limit, offset int) ([]*db.App, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// get the apps sorted by app id, skipping the offset and limiting the
+	// results (zero means no limit), without the secrets
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"secret": 0, "secrets": 0})
+	if offset > 0 {
+		opts.SetSkip(int64(offset))
+	}
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := md.apps.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	defer cursor.Close(ctx)
+	apps := []*db.App{}
+	for cursor.Next(ctx) {
+		var app App
+		if err := cursor.Decode(&app); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+		apps = append(apps, app.toDB())
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	return apps, nil
+}
+
+func (md *MongoDriver) CountApps() (int64, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	count, err := md.apps.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, errors.Join(db.ErrGetApp, err)
+	}
+	return count, nil
 }
 
 func (md *MongoDriver) SetApp(appId string, app *db.App) error {
@@ -70,13 +226,29 @@ func (md *MongoDriver) SetApp(appId string, app *db.App) error {
 	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
 	defer cancel()
 	dbApp, err := dynamicUpdateDocument(App{
-		ID:              appId,
-		Name:            app.Name,
-		AdminEmail:      app.AdminEmail,
-		SessionDuration: app.SessionDuration,
-		RedirectURL:     app.RedirectURL,
-		UsersQuota:      app.UsersQuota,
-	}, nil)
+		ID:                     appId,
+		Name:                   app.Name,
+		AdminEmail:             app.AdminEmail,
+		SessionDuration:        app.SessionDuration,
+		RedirectURL:            app.RedirectURL,
+		UsersQuota:             app.UsersQuota,
+		MaxRefreshes:           app.MaxRefreshes,
+		TokenSize:              app.TokenSize,
+		MaxTokenRequests:       app.MaxTokenRequests,
+		TokenRequestsWindow:    app.TokenRequestsWindow,
+		Notifier:               app.Notifier,
+		NotifierTarget:         app.NotifierTarget,
+		Features:               featuresDocument(app.Features),
+		TokenDelivery:          app.TokenDelivery,
+		AllowedOrigins:         app.AllowedOrigins,
+		AllowedRedirectDomains: app.AllowedRedirectDomains,
+		AuthMode:               app.AuthMode,
+		Channels:               channelsDocument(app.Channels),
+		DeliveryPolicy:         app.DeliveryPolicy,
+		WebhookURL:             app.WebhookURL,
+		TokenEmailSubject:      app.TokenEmailSubject,
+		AppEmailSubject:        app.AppEmailSubject,
+	}, []string{"features", "allowed_origins", "allowed_redirect_domains", "channels"}) // always stored to allow disabling them
 	if err != nil {
 		return errors.Join(db.ErrSetApp, err)
 	}
@@ -102,7 +274,37 @@ func (md *MongoDriver) DeleteApp(appId string) error {
 	return nil
 }
 
-func (md *MongoDriver) ValidSecret(secret, appId string) (bool, error) {
+func (md *MongoDriver) SetSecret(secret, appId string, expiration time.Time) error {
+	md.keysLock.Lock()
+	defer md.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// remove the secret from the secrets of the app, if it is already stored,
+	// to replace its expiration
+	res, err := md.apps.UpdateOne(ctx, bson.M{"_id": appId}, bson.M{"$pull": bson.M{"secrets": bson.M{"secret": secret}}})
+	if err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrAppNotFound
+	}
+	// add the secret to the secrets of the app
+	appSecret := Secret{Secret: secret}
+	if !expiration.IsZero() {
+		appSecret.Expiration = &expiration
+	}
+	if _, err := md.apps.UpdateOne(ctx, bson.M{"_id": appId}, bson.M{"$push": bson.M{"secrets": appSecret}}); err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	// remove the secret stored before the apps could have several ones, if
+	// it is the same, because it is now stored in the secrets
+	if _, err := md.apps.UpdateOne(ctx, bson.M{"_id": appId, "secret": secret}, bson.M{"$unset": bson.M{"secret": ""}}); err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	return nil
+}
+
+func (md *MongoDriver) ExpireSecrets(appId, keepSecret string, expiration time.Time) error {
 	md.keysLock.Lock()
 	defer md.keysLock.Unlock()
 	// get app from the database based on the app id
@@ -111,38 +313,86 @@ func (md *MongoDriver) ValidSecret(secret, appId string) (bool, error) {
 	var app App
 	if err := md.apps.FindOne(ctx, bson.M{"_id": appId}).Decode(&app); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false, db.ErrAppNotFound
+			return db.ErrAppNotFound
+		}
+		return errors.Join(db.ErrGetApp, err)
+	}
+	// set the expiration of the secrets, including the secret stored before
+	// the apps could have several ones, which is moved to the secrets, unless
+	// they already expire before it
+	secrets, update := app.Secrets, bson.M{}
+	if app.Secret != "" && app.Secret != keepSecret {
+		secrets = append(secrets, Secret{Secret: app.Secret})
+		update["$unset"] = bson.M{"secret": ""}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	for i := range secrets {
+		current := secrets[i].Expiration
+		if secrets[i].Secret != keepSecret && (current == nil || current.After(expiration)) {
+			secrets[i].Expiration = &expiration
 		}
-		return false, errors.Join(db.ErrGetApp, err)
 	}
-	return app.Secret == secret, nil
+	update["$set"] = bson.M{"secrets": secrets}
+	if _, err := md.apps.UpdateOne(ctx, bson.M{"_id": appId}, update); err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	return nil
 }
 
-func (md *MongoDriver) SetSecret(secret, appId string) error {
+func (md *MongoDriver) ExpireSecret(secret, appId string, expiration time.Time) (time.Time, error) {
 	md.keysLock.Lock()
 	defer md.keysLock.Unlock()
-	// set secret to app in the database by the app id
+	// get app from the database based on the app id
 	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
 	defer cancel()
-	if _, err := md.apps.UpdateOne(ctx, bson.M{"_id": appId}, bson.M{"$set": bson.M{"secret": secret}}); err != nil {
+	var app App
+	if err := md.apps.FindOne(ctx, bson.M{"_id": appId}).Decode(&app); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return db.ErrAppNotFound
+			return time.Time{}, db.ErrAppNotFound
 		}
-		return errors.Join(db.ErrSetSecret, err)
+		return time.Time{}, errors.Join(db.ErrGetApp, err)
 	}
-	return nil
+	// set the expiration of the secret, moving it to the secrets if it is the
+	// one stored before the apps could have several ones, unless it already
+	// expires before it
+	secrets, update := app.Secrets, bson.M{}
+	if app.Secret == secret {
+		secrets = append(secrets, Secret{Secret: app.Secret})
+		update["$unset"] = bson.M{"secret": ""}
+	}
+	var current *time.Time
+	for i := range secrets {
+		if secrets[i].Secret != secret {
+			continue
+		}
+		if secrets[i].Expiration == nil || secrets[i].Expiration.After(expiration) {
+			secrets[i].Expiration = &expiration
+		}
+		current = secrets[i].Expiration
+	}
+	if current == nil {
+		return time.Time{}, db.ErrAppNotFound
+	}
+	update["$set"] = bson.M{"secrets": secrets}
+	if _, err := md.apps.UpdateOne(ctx, bson.M{"_id": appId}, update); err != nil {
+		return time.Time{}, errors.Join(db.ErrSetSecret, err)
+	}
+	return *current, nil
 }
 
 func (md *MongoDriver) DeleteSecret(secret string) error {
 	md.keysLock.Lock()
 	defer md.keysLock.Unlock()
-	// delete secret of the app from the database
+	// delete secret of the app from the database, from its secrets or the
+	// one stored before the apps could have several ones
 	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
 	defer cancel()
 	if _, err := md.apps.UpdateOne(ctx, bson.M{"secret": secret}, bson.M{"$unset": bson.M{"secret": ""}}); err != nil {
-		if err == mongo.ErrNoDocuments {
-			return db.ErrAppNotFound
-		}
+		return errors.Join(db.ErrDelSecret, err)
+	}
+	if _, err := md.apps.UpdateOne(ctx, bson.M{"secrets.secret": secret}, bson.M{"$pull": bson.M{"secrets": bson.M{"secret": secret}}}); err != nil {
 		return errors.Join(db.ErrDelSecret, err)
 	}
 	return nil
@@ -0,0 +1,56 @@
+package mongo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAppDocumentFeatures(t *testing.T) {
+	features := map[db.Feature]bool{db.FeatureLinkInResponse: true}
+	bDoc, err := bson.Marshal(App{ID: "appId", Name: "test app", Features: featuresDocument(features)})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	var doc App
+	if err := bson.Unmarshal(bDoc, &doc); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app := doc.toDB(); !reflect.DeepEqual(app.Features, features) {
+		t.Errorf("expected %v, got %v", features, app.Features)
+	}
+	// the legacy flag is migrated if the feature is not set
+	legacy := App{ID: "appId", LegacyAllowLink: true}
+	if app := legacy.toDB(); !app.Enabled(db.FeatureLinkInResponse) {
+		t.Errorf("expected legacy flag migrated to the features")
+	}
+	legacy.Features = map[string]bool{string(db.FeatureLinkInResponse): false}
+	if app := legacy.toDB(); app.Enabled(db.FeatureLinkInResponse) {
+		t.Errorf("expected feature of the app over the legacy flag")
+	}
+}
+
+func TestAppDocumentDurations(t *testing.T) {
+	for _, duration := range []uint64{0, helpers.MinTokenDuration, helpers.MaxTokenDuration, math.MaxInt64} {
+		bDoc, err := bson.Marshal(App{ID: "appId", SessionDuration: duration, TokenRequestsWindow: duration})
+		if err != nil {
+			t.Fatalf("%d: expected nil, got %v", duration, err)
+		}
+		var doc App
+		if err := bson.Unmarshal(bDoc, &doc); err != nil {
+			t.Fatalf("%d: expected nil, got %v", duration, err)
+		}
+		if app := doc.toDB(); app.SessionDuration != duration || app.TokenRequestsWindow != duration {
+			t.Errorf("expected %d, got %d and %d", duration, app.SessionDuration, app.TokenRequestsWindow)
+		}
+	}
+	// the durations that do not fit in the stored integers are rejected
+	// instead of wrapped around
+	if _, err := bson.Marshal(App{ID: "appId", SessionDuration: math.MaxInt64 + 1}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Attempts struct {
+	Key        string    `bson:"_id"`
+	Count      int64     `bson:"count"`
+	Expiration time.Time `bson:"expiration"`
+}
+
+func (md *MongoDriver) IncrAttempts(key string, ttl time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	// the TTL monitor removes the expired documents periodically, so delete
+	// the counter if it is already expired to start it again
+	if _, err := md.attempts.DeleteOne(ctx, bson.M{
+		"_id":        key,
+		"expiration": bson.M{"$lte": now},
+	}); err != nil {
+		return 0, errors.Join(db.ErrSetAttempts, err)
+	}
+	// increment the counter, setting the expiration only when it is created
+	update := bson.M{
+		"$inc":         bson.M{"count": 1},
+		"$setOnInsert": bson.M{"expiration": now.Add(ttl)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var attempts Attempts
+	if err := md.attempts.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&attempts); err != nil {
+		return 0, errors.Join(db.ErrSetAttempts, err)
+	}
+	return attempts.Count, nil
+}
+
+func (md *MongoDriver) Attempts(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	var attempts Attempts
+	filter := bson.M{"_id": key, "expiration": bson.M{"$gt": time.Now()}}
+	if err := md.attempts.FindOne(ctx, filter).Decode(&attempts); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, errors.Join(db.ErrGetAttempts, err)
+	}
+	return attempts.Count, nil
+}
+
+func (md *MongoDriver) ResetAttempts(key string) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := md.attempts.DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		return errors.Join(db.ErrDelAttempts, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type DeadLetter struct {
+	ID       string    `bson:"_id"`
+	To       string    `bson:"to"`
+	Subject  string    `bson:"subject"`
+	Body     string    `bson:"body"`
+	TextBody string    `bson:"text_body,omitempty"`
+	Priority int       `bson:"priority"`
+	Error    string    `bson:"error"`
+	FailedAt time.Time `bson:"failed_at"`
+}
+
+// toDB converts the dead letter document into a db.DeadLetter.
+func (letter *DeadLetter) toDB() *db.DeadLetter {
+	return &db.DeadLetter{
+		ID:       letter.ID,
+		To:       letter.To,
+		Subject:  letter.Subject,
+		Body:     letter.Body,
+		TextBody: letter.TextBody,
+		Priority: letter.Priority,
+		Error:    letter.Error,
+		FailedAt: letter.FailedAt,
+	}
+}
+
+func (md *MongoDriver) SetDeadLetter(letter *db.DeadLetter) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	dbLetter := DeadLetter{
+		ID:       letter.ID,
+		To:       letter.To,
+		Subject:  letter.Subject,
+		Body:     letter.Body,
+		TextBody: letter.TextBody,
+		Priority: letter.Priority,
+		Error:    letter.Error,
+		FailedAt: letter.FailedAt,
+	}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := md.deadLetters.ReplaceOne(ctx, bson.M{"_id": letter.ID}, dbLetter, opts); err != nil {
+		return errors.Join(db.ErrSetDeadLetter, err)
+	}
+	return nil
+}
+
+func (md *MongoDriver) DeadLetterById(id string) (*db.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	var letter DeadLetter
+	if err := md.deadLetters.FindOne(ctx, bson.M{"_id": id}).Decode(&letter); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, db.ErrDeadLetterNotFound
+		}
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	return letter.toDB(), nil
+}
+
+func (md *MongoDriver) ListDeadLetters(limit, offset int) ([]*db.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// get the dead letters sorted by failure time, skipping the offset and
+	// limiting the results (zero means no limit)
+	opts := options.Find().SetSort(bson.D{{Key: "failed_at", Value: 1}, {Key: "_id", Value: 1}})
+	if offset > 0 {
+		opts.SetSkip(int64(offset))
+	}
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := md.deadLetters.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	defer cursor.Close(ctx)
+	letters := []*db.DeadLetter{}
+	for cursor.Next(ctx) {
+		var letter DeadLetter
+		if err := cursor.Decode(&letter); err != nil {
+			return nil, errors.Join(db.ErrGetDeadLetter, err)
+		}
+		letters = append(letters, letter.toDB())
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	return letters, nil
+}
+
+func (md *MongoDriver) DeleteDeadLetter(id string) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := md.deadLetters.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return errors.Join(db.ErrDelDeadLetter, err)
+	}
+	return nil
+}
@@ -16,14 +16,26 @@ import (
 )
 
 const (
-	tokensCollection  = "tokens"
-	secretsCollection = "secrets"
-	appsCollection    = "apps"
+	tokensCollection      = "tokens"
+	secretsCollection     = "secrets"
+	appsCollection        = "apps"
+	attemptsCollection    = "attempts"
+	deadLettersCollection = "dead_letters"
+	pendingCollection     = "pending_emails"
+	tombstonesCollection  = "token_tombstones"
 )
 
+// DefaultDeleteBatchSize is the default maximum number of expired tokens that
+// are deleted at once, holding the keys lock.
+const DefaultDeleteBatchSize = 1000
+
+// Config struct includes the configuration of the MongoDriver. The
+// DeleteBatchSize is the maximum number of expired tokens deleted in every
+// batch by DeleteExpiredTokens, DefaultDeleteBatchSize if it is not positive.
 type Config struct {
-	MongoURI string
-	Database string
+	MongoURI        string
+	Database        string
+	DeleteBatchSize int
 }
 
 type MongoDriver struct {
@@ -33,8 +45,12 @@ type MongoDriver struct {
 	client   *mongo.Client
 	keysLock sync.RWMutex
 
-	tokens *mongo.Collection
-	apps   *mongo.Collection
+	tokens      *mongo.Collection
+	apps        *mongo.Collection
+	attempts    *mongo.Collection
+	deadLetters *mongo.Collection
+	pending     *mongo.Collection
+	tombstones  *mongo.Collection
 }
 
 func (md *MongoDriver) Init(config any) error {
@@ -49,6 +65,9 @@ func (md *MongoDriver) Init(config any) error {
 	if cfg.MongoURI == "" {
 		return fmt.Errorf("%w: no database url provided", db.ErrInvalidConfig)
 	}
+	if cfg.DeleteBatchSize <= 0 {
+		cfg.DeleteBatchSize = DefaultDeleteBatchSize
+	}
 	// init the client options
 	opts := options.Client()
 	opts.ApplyURI(cfg.MongoURI)
@@ -76,6 +95,10 @@ func (md *MongoDriver) Init(config any) error {
 	// instantiate the collections
 	md.tokens = client.Database(cfg.Database).Collection(tokensCollection)
 	md.apps = client.Database(cfg.Database).Collection(appsCollection)
+	md.attempts = client.Database(cfg.Database).Collection(attemptsCollection)
+	md.deadLetters = client.Database(cfg.Database).Collection(deadLettersCollection)
+	md.pending = client.Database(cfg.Database).Collection(pendingCollection)
+	md.tombstones = client.Database(cfg.Database).Collection(tombstonesCollection)
 	// create the indexes
 	if err := md.createIndexes(); err != nil {
 		return errors.Join(db.ErrOpenConn, err)
@@ -93,16 +116,26 @@ func (md *MongoDriver) Close() error {
 	return nil
 }
 
+func (md *MongoDriver) Ping(ctx context.Context) error {
+	if err := md.client.Ping(ctx, readpref.Primary()); err != nil {
+		return errors.Join(db.ErrPing, err)
+	}
+	return nil
+}
+
 // createIndexes creates the indexes for the collections. It creates an index
-// for the app secrets and an index for the token expiration. It returns an
-// error if something goes wrong.
+// for the app secrets, indexes for the token expiration and issue time, a TTL
+// index for the attempts expiration, an index for the dead letters failure
+// time and an index for the tombstones deletion time. It returns an error if
+// something goes wrong.
 func (md *MongoDriver) createIndexes() error {
 	ctx, cancel := context.WithTimeout(md.ctx, 20*time.Second)
 	defer cancel()
-	// create an index for app secrets
-	if _, err := md.apps.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.D{{Key: "secrets", Value: 1}}, // 1 for ascending order
-		Options: nil,
+	// create indexes for app secrets, including the one stored before the
+	// apps could have several ones
+	if _, err := md.apps.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "secrets.secret", Value: 1}}}, // 1 for ascending order
+		{Keys: bson.D{{Key: "secret", Value: 1}}},
 	}); err != nil {
 		return err
 	}
@@ -113,6 +146,34 @@ func (md *MongoDriver) createIndexes() error {
 	}); err != nil {
 		return err
 	}
+	// create an index to count the tokens issued since a time
+	if _, err := md.tokens.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "issued_at", Value: 1}},
+		Options: nil,
+	}); err != nil {
+		return err
+	}
+	// create a TTL index to remove the expired attempts counters
+	if _, err := md.attempts.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiration", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}); err != nil {
+		return err
+	}
+	// create an index to list the dead letters sorted by failure time
+	if _, err := md.deadLetters.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "failed_at", Value: 1}, {Key: "_id", Value: 1}},
+		Options: nil,
+	}); err != nil {
+		return err
+	}
+	// create an index to purge the tombstones by deletion time
+	if _, err := md.tombstones.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+		Options: nil,
+	}); err != nil {
+		return err
+	}
 	return nil
 }
 
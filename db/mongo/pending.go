@@ -0,0 +1,65 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type PendingEmail struct {
+	ID       string    `bson:"_id"`
+	To       string    `bson:"to"`
+	Subject  string    `bson:"subject"`
+	Body     string    `bson:"body"`
+	TextBody string    `bson:"text_body,omitempty"`
+	Priority int       `bson:"priority"`
+	QueuedAt time.Time `bson:"queued_at"`
+}
+
+func (md *MongoDriver) EnqueueEmail(email *db.PendingEmail) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	dbEmail := PendingEmail(*email)
+	opts := options.Replace().SetUpsert(true)
+	if _, err := md.pending.ReplaceOne(ctx, bson.M{"_id": email.ID}, dbEmail, opts); err != nil {
+		return errors.Join(db.ErrSetPendingEmail, err)
+	}
+	return nil
+}
+
+func (md *MongoDriver) DequeueEmail(id string) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := md.pending.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return errors.Join(db.ErrDelPendingEmail, err)
+	}
+	return nil
+}
+
+func (md *MongoDriver) PendingEmails() ([]*db.PendingEmail, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: "queued_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := md.pending.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetPendingEmail, err)
+	}
+	defer cursor.Close(ctx)
+	emails := []*db.PendingEmail{}
+	for cursor.Next(ctx) {
+		var email PendingEmail
+		if err := cursor.Decode(&email); err != nil {
+			return nil, errors.Join(db.ErrGetPendingEmail, err)
+		}
+		dbEmail := db.PendingEmail(email)
+		emails = append(emails, &dbEmail)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetPendingEmail, err)
+	}
+	return emails, nil
+}
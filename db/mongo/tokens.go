@@ -14,6 +14,20 @@ import (
 type Token struct {
 	Token      db.Token `bson:"_id"`
 	Expiration int64    `bson:"expiration"`
+	IssuedAt   int64    `bson:"issued_at,omitempty"`
+	Scopes     []string `bson:"scopes,omitempty"`
+	// Code is the hashed one-time code of the token, if any, and
+	// CodeExpiration its expiration time.
+	Code           string `bson:"code,omitempty"`
+	CodeExpiration int64  `bson:"code_expiration,omitempty"`
+}
+
+// Tombstone struct represents the tombstone of a soft deleted token, with
+// the deletion time in nanoseconds.
+type Tombstone struct {
+	Token     db.Token `bson:"_id"`
+	Reason    string   `bson:"reason"`
+	DeletedAt int64    `bson:"deleted_at"`
 }
 
 func (md *MongoDriver) TokenExpiration(token db.Token) (time.Time, error) {
@@ -29,7 +43,32 @@ func (md *MongoDriver) TokenExpiration(token db.Token) (time.Time, error) {
 	return time.Unix(0, dbToken.Expiration), nil
 }
 
-func (md *MongoDriver) SetToken(token db.Token, expiration time.Time) error {
+func (md *MongoDriver) TokenExists(token db.Token) (bool, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// count the tokens with the id, stopping at the first one
+	count, err := md.tokens.CountDocuments(ctx, bson.M{"_id": token}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, errors.Join(db.ErrGetToken, err)
+	}
+	return count > 0, nil
+}
+
+func (md *MongoDriver) TokenScopes(token db.Token) ([]string, error) {
+	var dbToken Token
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	opts := options.FindOne().SetProjection(bson.M{"scopes": 1})
+	if err := md.tokens.FindOne(ctx, bson.M{"_id": token}, opts).Decode(&dbToken); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, db.ErrTokenNotFound
+		}
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return dbToken.Scopes, nil
+}
+
+func (md *MongoDriver) SetToken(token db.Token, expiration time.Time, scopes []string) error {
 	md.keysLock.Lock()
 	defer md.keysLock.Unlock()
 	// set token in the database
@@ -38,6 +77,8 @@ func (md *MongoDriver) SetToken(token db.Token, expiration time.Time) error {
 	dbToken := Token{
 		Token:      token,
 		Expiration: expiration.UnixNano(),
+		IssuedAt:   time.Now().UnixNano(),
+		Scopes:     scopes,
 	}
 	opts := options.Replace().SetUpsert(true)
 	if _, err := md.tokens.ReplaceOne(ctx, bson.M{"_id": token}, dbToken, opts); err != nil {
@@ -61,6 +102,67 @@ func (md *MongoDriver) DeleteToken(token db.Token) error {
 	return nil
 }
 
+func (md *MongoDriver) SoftDeleteToken(token db.Token, reason string) error {
+	md.keysLock.Lock()
+	defer md.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// delete the token and store its tombstone only if it existed
+	if err := md.tokens.FindOneAndDelete(ctx, bson.M{"_id": token}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return errors.Join(db.ErrDelToken, err)
+	}
+	tombstone := Tombstone{Token: token, Reason: reason, DeletedAt: time.Now().UnixNano()}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := md.tombstones.ReplaceOne(ctx, bson.M{"_id": token}, tombstone, opts); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (md *MongoDriver) TombstonesByPrefix(prefix string) ([]db.Tombstone, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	filter := bson.M{}
+	if prefix != "" {
+		filter = bson.M{"_id": bson.M{"$regex": "^" + prefix}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := md.tombstones.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	defer cursor.Close(ctx)
+	tombstones := []db.Tombstone{}
+	for cursor.Next(ctx) {
+		var dbTombstone Tombstone
+		if err := cursor.Decode(&dbTombstone); err != nil {
+			return nil, errors.Join(db.ErrGetToken, err)
+		}
+		tombstones = append(tombstones, db.Tombstone{
+			Token:     dbTombstone.Token,
+			Reason:    dbTombstone.Reason,
+			DeletedAt: time.Unix(0, dbTombstone.DeletedAt),
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return tombstones, nil
+}
+
+func (md *MongoDriver) PurgeTombstones(retention time.Duration) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	limit := time.Now().Add(-retention).UnixNano()
+	if _, err := md.tombstones.DeleteMany(ctx, bson.M{"deleted_at": bson.M{"$lt": limit}}); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
 func (md *MongoDriver) DeleteTokensByPrefix(prefix string) error {
 	// check if the prefix is empty and return nil if it is
 	if prefix == "" {
@@ -78,18 +180,61 @@ func (md *MongoDriver) DeleteTokensByPrefix(prefix string) error {
 	return nil
 }
 
-func (md *MongoDriver) DeleteExpiredTokens() error {
+// DeleteExpiredTokens method deletes the tokens expired more than the
+// provided grace period ago from the database in batches of the configured
+// size, releasing the keys lock between them to not block the tokens that are
+// being issued meanwhile on large collections. It returns an error if any
+// batch fails.
+func (md *MongoDriver) DeleteExpiredTokens(gracePeriod time.Duration) error {
+	limit := time.Now().Add(-gracePeriod).UnixNano()
+	for {
+		deleted, err := md.deleteExpiredTokensBatch(limit)
+		if err != nil {
+			return err
+		}
+		if deleted < int64(md.config.DeleteBatchSize) {
+			return nil
+		}
+	}
+}
+
+// deleteExpiredTokensBatch method deletes up to the configured batch size of
+// tokens expired before the provided time (in nanoseconds), holding the keys
+// lock. It returns the number of tokens deleted or an error if something
+// fails.
+func (md *MongoDriver) deleteExpiredTokensBatch(limit int64) (int64, error) {
 	md.keysLock.Lock()
 	defer md.keysLock.Unlock()
-	// delete expired tokens from the database, filter by expiration time less
-	// than now
 	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
 	defer cancel()
-	dbNow := time.Now().UnixNano()
-	if _, err := md.tokens.DeleteMany(ctx, bson.M{"expiration": bson.M{"$lt": dbNow}}); err != nil {
-		return errors.Join(db.ErrDelToken, err)
+	// get the ids of the batch of expired tokens, filter by expiration time
+	// less than the limit
+	filter := bson.M{"expiration": bson.M{"$lt": limit}}
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetLimit(int64(md.config.DeleteBatchSize))
+	cursor, err := md.tokens.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, errors.Join(db.ErrDelToken, err)
 	}
-	return nil
+	var batch []Token
+	if err := cursor.All(ctx, &batch); err != nil {
+		return 0, errors.Join(db.ErrDelToken, err)
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	ids := make([]db.Token, 0, len(batch))
+	for _, token := range batch {
+		ids = append(ids, token.Token)
+	}
+	// delete the tokens of the batch, checking the expiration again in case
+	// any of them has been replaced meanwhile
+	filter["_id"] = bson.M{"$in": ids}
+	if _, err := md.tokens.DeleteMany(ctx, filter); err != nil {
+		return 0, errors.Join(db.ErrDelToken, err)
+	}
+	return int64(len(batch)), nil
 }
 
 func (md *MongoDriver) CountTokens(prefix string) (int64, error) {
@@ -111,3 +256,93 @@ func (md *MongoDriver) CountTokens(prefix string) (int64, error) {
 	}
 	return count, nil
 }
+
+func (md *MongoDriver) CountTokensIssuedSince(since time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// the tokens stored without issue time do not have the field
+	count, err := md.tokens.CountDocuments(ctx, bson.M{"issued_at": bson.M{"$gte": since.UnixNano()}})
+	if err != nil {
+		return 0, errors.Join(db.ErrGetToken, err)
+	}
+	return count, nil
+}
+
+func (md *MongoDriver) TokensByPrefix(prefix string) ([]db.TokenInfo, error) {
+	return md.ListTokensByPrefix(prefix, 0, 0)
+}
+
+func (md *MongoDriver) ListTokensByPrefix(prefix string, limit, offset int) ([]db.TokenInfo, error) {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	// get the tokens filtered by the provided prefix and sorted by token,
+	// without the scopes, skipping the offset and limiting the results (zero
+	// means no limit)
+	filter := bson.M{}
+	if prefix != "" {
+		filter = bson.M{"_id": bson.M{"$regex": "^" + prefix}}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"expiration": 1})
+	if offset > 0 {
+		opts.SetSkip(int64(offset))
+	}
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := md.tokens.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	defer cursor.Close(ctx)
+	tokens := []db.TokenInfo{}
+	for cursor.Next(ctx) {
+		var dbToken Token
+		if err := cursor.Decode(&dbToken); err != nil {
+			return nil, errors.Join(db.ErrGetToken, err)
+		}
+		tokens = append(tokens, db.TokenInfo{
+			Token:      dbToken.Token,
+			Expiration: time.Unix(0, dbToken.Expiration),
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return tokens, nil
+}
+
+func (md *MongoDriver) SetTokenCode(token db.Token, code string, expiration time.Time) error {
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	update := bson.M{"$set": bson.M{"code": code, "code_expiration": expiration.UnixNano()}}
+	if code == "" {
+		update = bson.M{"$unset": bson.M{"code": "", "code_expiration": ""}}
+	}
+	res, err := md.tokens.UpdateOne(ctx, bson.M{"_id": token}, update)
+	if err != nil {
+		return errors.Join(db.ErrSetToken, err)
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrTokenNotFound
+	}
+	return nil
+}
+
+func (md *MongoDriver) TokenCode(token db.Token) (string, time.Time, error) {
+	var dbToken Token
+	ctx, cancel := context.WithTimeout(md.ctx, 5*time.Second)
+	defer cancel()
+	opts := options.FindOne().SetProjection(bson.M{"code": 1, "code_expiration": 1})
+	if err := md.tokens.FindOne(ctx, bson.M{"_id": token}, opts).Decode(&dbToken); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", time.Time{}, db.ErrTokenNotFound
+		}
+		return "", time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	if dbToken.Code == "" {
+		return "", time.Time{}, nil
+	}
+	return dbToken.Code, time.Unix(0, dbToken.CodeExpiration), nil
+}
@@ -0,0 +1,272 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+const appColumns = "id, name, admin_email, session_duration, redirect_url, users_quota, notifier, notifier_target, features, max_refreshes, allowed_origins, token_delivery, allowed_redirect_domains, token_size, max_token_requests, token_requests_window, auth_mode, channels, delivery_policy, webhook_url, token_email_subject, app_email_subject"
+
+func (pd *PostgresDriver) AppById(appId string) (*db.App, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// get app from the database based on the app id
+	row := pd.db.QueryRowContext(ctx, "SELECT "+appColumns+" FROM apps WHERE id = $1", appId)
+	app, err := scanApp(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, db.ErrAppNotFound
+		}
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	return app, nil
+}
+
+func (pd *PostgresDriver) AppBySecret(secret string) (*db.App, string, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// get app and app id from the database based on the app secret, if it is
+	// not expired, with the stored secret to confirm it
+	var storedSecret string
+	row := pd.db.QueryRowContext(ctx, `SELECT app_secrets.secret, `+appColumns+`
+		FROM app_secrets JOIN apps ON apps.id = app_secrets.app_id
+		WHERE app_secrets.secret = $1 AND (app_secrets.expiration IS NULL OR app_secrets.expiration > $2)`,
+		secret, time.Now())
+	app, err := scanApp(secretRow{row: row, secret: &storedSecret})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", db.ErrAppNotFound
+		}
+		return nil, "", errors.Join(db.ErrGetApp, err)
+	}
+	if !db.EqualSecrets(storedSecret, secret) {
+		return nil, "", db.ErrAppNotFound
+	}
+	return app, app.ID, nil
+}
+
+func (pd *PostgresDriver) ListApps(limit, offset int) ([]*db.App, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// get the apps sorted by app id, a NULL limit means no limit
+	var queryLimit sql.NullInt64
+	if limit > 0 {
+		queryLimit = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := pd.db.QueryContext(ctx, "SELECT "+appColumns+" FROM apps ORDER BY id LIMIT $1 OFFSET $2",
+		queryLimit, offset)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	defer rows.Close()
+	apps := []*db.App{}
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+		apps = append(apps, app)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	return apps, nil
+}
+
+func (pd *PostgresDriver) CountApps() (int64, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var count int64
+	if err := pd.db.QueryRowContext(ctx, "SELECT count(*) FROM apps").Scan(&count); err != nil {
+		return 0, errors.Join(db.ErrGetApp, err)
+	}
+	return count, nil
+}
+
+func (pd *PostgresDriver) SetApp(appId string, app *db.App) error {
+	// the durations are stored as BIGINT, reject the ones that do not fit
+	// instead of storing them wrapped around
+	if app.SessionDuration > math.MaxInt64 || app.TokenRequestsWindow > math.MaxInt64 {
+		return fmt.Errorf("%w: duration out of range", db.ErrSetApp)
+	}
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// create or update app in the database, only the non-zero fields are
+	// updated, except the features, the allowed origins, the allowed
+	// redirect domains and the channels, which are always updated to allow
+	// disabling them
+	features := []byte("{}")
+	if len(app.Features) > 0 {
+		var err error
+		if features, err = json.Marshal(app.Features); err != nil {
+			return errors.Join(db.ErrSetApp, err)
+		}
+	}
+	channels := []byte("[]")
+	if len(app.Channels) > 0 {
+		var err error
+		if channels, err = json.Marshal(app.Channels); err != nil {
+			return errors.Join(db.ErrSetApp, err)
+		}
+	}
+	if _, err := pd.db.ExecContext(ctx, `
+		INSERT INTO apps (`+appColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)
+		ON CONFLICT (id) DO UPDATE SET
+			name = COALESCE(NULLIF(EXCLUDED.name, ''), apps.name),
+			admin_email = COALESCE(NULLIF(EXCLUDED.admin_email, ''), apps.admin_email),
+			session_duration = COALESCE(NULLIF(EXCLUDED.session_duration, 0), apps.session_duration),
+			redirect_url = COALESCE(NULLIF(EXCLUDED.redirect_url, ''), apps.redirect_url),
+			users_quota = COALESCE(NULLIF(EXCLUDED.users_quota, 0), apps.users_quota),
+			notifier = COALESCE(NULLIF(EXCLUDED.notifier, ''), apps.notifier),
+			notifier_target = COALESCE(NULLIF(EXCLUDED.notifier_target, ''), apps.notifier_target),
+			features = EXCLUDED.features,
+			max_refreshes = COALESCE(NULLIF(EXCLUDED.max_refreshes, 0), apps.max_refreshes),
+			allowed_origins = EXCLUDED.allowed_origins,
+			token_delivery = COALESCE(NULLIF(EXCLUDED.token_delivery, ''), apps.token_delivery),
+			allowed_redirect_domains = EXCLUDED.allowed_redirect_domains,
+			token_size = COALESCE(NULLIF(EXCLUDED.token_size, 0), apps.token_size),
+			max_token_requests = COALESCE(NULLIF(EXCLUDED.max_token_requests, 0), apps.max_token_requests),
+			token_requests_window = COALESCE(NULLIF(EXCLUDED.token_requests_window, 0), apps.token_requests_window),
+			auth_mode = COALESCE(NULLIF(EXCLUDED.auth_mode, ''), apps.auth_mode),
+			channels = EXCLUDED.channels,
+			delivery_policy = COALESCE(NULLIF(EXCLUDED.delivery_policy, ''), apps.delivery_policy),
+			webhook_url = COALESCE(NULLIF(EXCLUDED.webhook_url, ''), apps.webhook_url),
+			token_email_subject = COALESCE(NULLIF(EXCLUDED.token_email_subject, ''), apps.token_email_subject),
+			app_email_subject = COALESCE(NULLIF(EXCLUDED.app_email_subject, ''), apps.app_email_subject)`,
+		appId, app.Name, app.AdminEmail, int64(app.SessionDuration), app.RedirectURL,
+		app.UsersQuota, app.Notifier, app.NotifierTarget, string(features), app.MaxRefreshes,
+		pq.Array(app.AllowedOrigins), app.TokenDelivery, pq.Array(app.AllowedRedirectDomains), app.TokenSize,
+		app.MaxTokenRequests, int64(app.TokenRequestsWindow), app.AuthMode, string(channels), app.DeliveryPolicy,
+		app.WebhookURL, app.TokenEmailSubject, app.AppEmailSubject); err != nil {
+		return errors.Join(db.ErrSetApp, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) DeleteApp(appId string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// the secrets of the app are deleted in cascade
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM apps WHERE id = $1", appId); err != nil {
+		return errors.Join(db.ErrDelApp, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) SetSecret(secret, appId string, expiration time.Time) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// a NULL expiration means that the secret does not expire
+	var secretExpiration sql.NullTime
+	if !expiration.IsZero() {
+		secretExpiration = sql.NullTime{Time: expiration, Valid: true}
+	}
+	// the secret is only inserted if the app exists
+	res, err := pd.db.ExecContext(ctx, `
+		INSERT INTO app_secrets (secret, app_id, expiration)
+		SELECT $1, id, $3 FROM apps WHERE id = $2
+		ON CONFLICT (secret) DO UPDATE SET app_id = EXCLUDED.app_id, expiration = EXCLUDED.expiration`,
+		secret, appId, secretExpiration)
+	if err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	if updated, err := res.RowsAffected(); err == nil && updated == 0 {
+		return db.ErrAppNotFound
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) ExpireSecrets(appId, keepSecret string, expiration time.Time) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// the secrets that already expire before are not extended
+	if _, err := pd.db.ExecContext(ctx, `
+		UPDATE app_secrets SET expiration = $3
+		WHERE app_id = $1 AND secret <> $2 AND (expiration IS NULL OR expiration > $3)`,
+		appId, keepSecret, expiration); err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) ExpireSecret(secret, appId string, expiration time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// the secret is not extended if it already expires before, LEAST ignores
+	// the NULL expiration of the secrets that do not expire
+	var current time.Time
+	if err := pd.db.QueryRowContext(ctx, `
+		UPDATE app_secrets SET expiration = LEAST(expiration, $3)
+		WHERE secret = $1 AND app_id = $2 RETURNING expiration`,
+		secret, appId, expiration).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, db.ErrAppNotFound
+		}
+		return time.Time{}, errors.Join(db.ErrSetSecret, err)
+	}
+	return current, nil
+}
+
+func (pd *PostgresDriver) DeleteSecret(secret string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM app_secrets WHERE secret = $1", secret); err != nil {
+		return errors.Join(db.ErrDelSecret, err)
+	}
+	return nil
+}
+
+// secretRow wraps a row that starts with a stored secret followed by the app
+// columns, to scan the secret and the app with scanApp.
+type secretRow struct {
+	row    *sql.Row
+	secret *string
+}
+
+func (sr secretRow) Scan(dest ...any) error {
+	return sr.row.Scan(append([]any{sr.secret}, dest...)...)
+}
+
+// scanApp scans the app columns of the provided row (or rows) into a db.App.
+func scanApp(row interface{ Scan(...any) error }) (*db.App, error) {
+	app := &db.App{}
+	var sessionDuration, tokenRequestsWindow int64
+	var features, channels []byte
+	if err := row.Scan(&app.ID, &app.Name, &app.AdminEmail, &sessionDuration, &app.RedirectURL,
+		&app.UsersQuota, &app.Notifier, &app.NotifierTarget, &features, &app.MaxRefreshes,
+		pq.Array(&app.AllowedOrigins), &app.TokenDelivery, pq.Array(&app.AllowedRedirectDomains), &app.TokenSize,
+		&app.MaxTokenRequests, &tokenRequestsWindow, &app.AuthMode, &channels, &app.DeliveryPolicy,
+		&app.WebhookURL, &app.TokenEmailSubject, &app.AppEmailSubject); err != nil {
+		return nil, err
+	}
+	if sessionDuration < 0 || tokenRequestsWindow < 0 {
+		return nil, fmt.Errorf("negative duration")
+	}
+	app.SessionDuration = uint64(sessionDuration)
+	app.TokenRequestsWindow = uint64(tokenRequestsWindow)
+	if err := json.Unmarshal(features, &app.Features); err != nil {
+		return nil, err
+	}
+	if len(app.Features) == 0 {
+		app.Features = nil
+	}
+	if err := json.Unmarshal(channels, &app.Channels); err != nil {
+		return nil, err
+	}
+	if len(app.Channels) == 0 {
+		app.Channels = nil
+	}
+	return app, nil
+}
@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+)
+
+func (pd *PostgresDriver) IncrAttempts(key string, ttl time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// increment the counter, starting it again with the provided ttl if it
+	// does not exist or it is expired
+	now := time.Now()
+	var count int64
+	if err := pd.db.QueryRowContext(ctx, `
+		INSERT INTO attempts (key, count, expiration) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN attempts.expiration <= $3 THEN 1 ELSE attempts.count + 1 END,
+			expiration = CASE WHEN attempts.expiration <= $3 THEN EXCLUDED.expiration ELSE attempts.expiration END
+		RETURNING count`, key, now.Add(ttl), now).Scan(&count); err != nil {
+		return 0, errors.Join(db.ErrSetAttempts, err)
+	}
+	return count, nil
+}
+
+func (pd *PostgresDriver) Attempts(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var count int64
+	if err := pd.db.QueryRowContext(ctx, "SELECT count FROM attempts WHERE key = $1 AND expiration > $2",
+		key, time.Now()).Scan(&count); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, errors.Join(db.ErrGetAttempts, err)
+	}
+	return count, nil
+}
+
+func (pd *PostgresDriver) ResetAttempts(key string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM attempts WHERE key = $1", key); err != nil {
+		return errors.Join(db.ErrDelAttempts, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+)
+
+const deadLetterColumns = "id, recipient, subject, body, text_body, priority, error, failed_at"
+
+func (pd *PostgresDriver) SetDeadLetter(letter *db.DeadLetter) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, `
+		INSERT INTO dead_letters (`+deadLetterColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			recipient = EXCLUDED.recipient,
+			subject = EXCLUDED.subject,
+			body = EXCLUDED.body,
+			text_body = EXCLUDED.text_body,
+			priority = EXCLUDED.priority,
+			error = EXCLUDED.error,
+			failed_at = EXCLUDED.failed_at`,
+		letter.ID, letter.To, letter.Subject, letter.Body, letter.TextBody,
+		letter.Priority, letter.Error, letter.FailedAt); err != nil {
+		return errors.Join(db.ErrSetDeadLetter, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) DeadLetterById(id string) (*db.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	row := pd.db.QueryRowContext(ctx, "SELECT "+deadLetterColumns+" FROM dead_letters WHERE id = $1", id)
+	letter, err := scanDeadLetter(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, db.ErrDeadLetterNotFound
+		}
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	return letter, nil
+}
+
+func (pd *PostgresDriver) ListDeadLetters(limit, offset int) ([]*db.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// get the dead letters sorted by failure time, a NULL limit means no
+	// limit
+	var queryLimit sql.NullInt64
+	if limit > 0 {
+		queryLimit = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := pd.db.QueryContext(ctx, "SELECT "+deadLetterColumns+" FROM dead_letters ORDER BY failed_at, id LIMIT $1 OFFSET $2",
+		queryLimit, offset)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	defer rows.Close()
+	letters := []*db.DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, errors.Join(db.ErrGetDeadLetter, err)
+		}
+		letters = append(letters, letter)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	return letters, nil
+}
+
+func (pd *PostgresDriver) DeleteDeadLetter(id string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = $1", id); err != nil {
+		return errors.Join(db.ErrDelDeadLetter, err)
+	}
+	return nil
+}
+
+// scanDeadLetter scans the dead letter columns of the provided row (or rows)
+// into a db.DeadLetter.
+func scanDeadLetter(row interface{ Scan(...any) error }) (*db.DeadLetter, error) {
+	letter := &db.DeadLetter{}
+	if err := row.Scan(&letter.ID, &letter.To, &letter.Subject, &letter.Body, &letter.TextBody,
+		&letter.Priority, &letter.Error, &letter.FailedAt); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
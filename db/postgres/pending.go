@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+)
+
+const pendingColumns = "id, recipient, subject, body, text_body, priority, queued_at"
+
+func (pd *PostgresDriver) EnqueueEmail(email *db.PendingEmail) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, `
+		INSERT INTO pending_emails (`+pendingColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			recipient = EXCLUDED.recipient,
+			subject = EXCLUDED.subject,
+			body = EXCLUDED.body,
+			text_body = EXCLUDED.text_body,
+			priority = EXCLUDED.priority,
+			queued_at = EXCLUDED.queued_at`,
+		email.ID, email.To, email.Subject, email.Body, email.TextBody,
+		email.Priority, email.QueuedAt); err != nil {
+		return errors.Join(db.ErrSetPendingEmail, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) DequeueEmail(id string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM pending_emails WHERE id = $1", id); err != nil {
+		return errors.Join(db.ErrDelPendingEmail, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) PendingEmails() ([]*db.PendingEmail, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	rows, err := pd.db.QueryContext(ctx, "SELECT "+pendingColumns+" FROM pending_emails ORDER BY queued_at, id")
+	if err != nil {
+		return nil, errors.Join(db.ErrGetPendingEmail, err)
+	}
+	defer rows.Close()
+	emails := []*db.PendingEmail{}
+	for rows.Next() {
+		email := &db.PendingEmail{}
+		if err := rows.Scan(&email.ID, &email.To, &email.Subject, &email.Body, &email.TextBody,
+			&email.Priority, &email.QueuedAt); err != nil {
+			return nil, errors.Join(db.ErrGetPendingEmail, err)
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetPendingEmail, err)
+	}
+	return emails, nil
+}
@@ -0,0 +1,180 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+// migrations contains the statements that create the tables and indexes
+// required by the driver, they are executed in order during the driver
+// initialization.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS apps (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		admin_email TEXT NOT NULL DEFAULT '',
+		session_duration BIGINT NOT NULL DEFAULT 0,
+		redirect_url TEXT NOT NULL DEFAULT '',
+		users_quota BIGINT NOT NULL DEFAULT 0,
+		notifier TEXT NOT NULL DEFAULT '',
+		notifier_target TEXT NOT NULL DEFAULT '',
+		secret TEXT UNIQUE
+	)`,
+	`CREATE TABLE IF NOT EXISTS tokens (
+		token TEXT PRIMARY KEY,
+		expiration TIMESTAMPTZ NOT NULL,
+		scopes TEXT[]
+	)`,
+	`CREATE INDEX IF NOT EXISTS tokens_expiration_idx ON tokens (expiration)`,
+	`CREATE TABLE IF NOT EXISTS attempts (
+		key TEXT PRIMARY KEY,
+		count BIGINT NOT NULL,
+		expiration TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS allow_link_in_response BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS dead_letters (
+		id TEXT PRIMARY KEY,
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		text_body TEXT NOT NULL DEFAULT '',
+		priority INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		failed_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS dead_letters_failed_at_idx ON dead_letters (failed_at, id)`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS max_refreshes BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS allowed_origins TEXT[]`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS token_delivery TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS allowed_redirect_domains TEXT[]`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS token_size BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS features JSONB NOT NULL DEFAULT '{}'`,
+	// migrate the legacy flag to the features, unless the app already sets it
+	`UPDATE apps SET features = jsonb_build_object('link_in_response', TRUE) || features,
+		allow_link_in_response = FALSE
+	WHERE allow_link_in_response`,
+	`CREATE TABLE IF NOT EXISTS pending_emails (
+		id TEXT PRIMARY KEY,
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		text_body TEXT NOT NULL DEFAULT '',
+		priority INTEGER NOT NULL DEFAULT 0,
+		queued_at TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS max_token_requests BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS token_requests_window BIGINT NOT NULL DEFAULT 0`,
+	// the tokens stored before tracking the issue time have no issue time
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS issued_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS tokens_issued_at_idx ON tokens (issued_at)`,
+	// the hashed one-time codes of the tokens of the apps that use them
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS code TEXT`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS code_expiration TIMESTAMPTZ`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS auth_mode TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS channels JSONB NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS delivery_policy TEXT NOT NULL DEFAULT ''`,
+	// the tombstones of the soft deleted tokens, kept for audit
+	`CREATE TABLE IF NOT EXISTS token_tombstones (
+		token TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		deleted_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS token_tombstones_deleted_at_idx ON token_tombstones (deleted_at)`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS webhook_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS token_email_subject TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE apps ADD COLUMN IF NOT EXISTS app_email_subject TEXT NOT NULL DEFAULT ''`,
+	// the apps can have several secrets, each one with its own expiration,
+	// so they are moved from the apps table to their own one
+	`CREATE TABLE IF NOT EXISTS app_secrets (
+		secret TEXT PRIMARY KEY,
+		app_id TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+		expiration TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS app_secrets_app_id_idx ON app_secrets (app_id)`,
+	`INSERT INTO app_secrets (secret, app_id) SELECT secret, id FROM apps WHERE secret IS NOT NULL ON CONFLICT DO NOTHING`,
+	`UPDATE apps SET secret = NULL WHERE secret IS NOT NULL`,
+}
+
+type Config struct {
+	DSN string
+}
+
+type PostgresDriver struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	config Config
+	db     *sql.DB
+}
+
+func (pd *PostgresDriver) Init(config any) error {
+	// validate config
+	cfg, ok := config.(Config)
+	if !ok {
+		return db.ErrInvalidConfig
+	}
+	if cfg.DSN == "" {
+		return fmt.Errorf("%w: no database dsn provided", db.ErrInvalidConfig)
+	}
+	// open the connection and check if it is available
+	conn, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return errors.Join(db.ErrOpenConn, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.PingContext(ctx); err != nil {
+		_ = conn.Close()
+		return errors.Join(db.ErrOpenConn, err)
+	}
+	// create the internal context
+	pd.ctx, pd.cancel = context.WithCancel(context.Background())
+	// set the connection and config
+	pd.db = conn
+	pd.config = cfg
+	// run the migrations
+	if err := pd.migrate(); err != nil {
+		return errors.Join(db.ErrOpenConn, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) Close() error {
+	pd.cancel()
+	if err := pd.db.Close(); err != nil {
+		return errors.Join(db.ErrCloseConn, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) Ping(ctx context.Context) error {
+	if err := pd.db.PingContext(ctx); err != nil {
+		return errors.Join(db.ErrPing, err)
+	}
+	return nil
+}
+
+// migrate runs the migrations to create the tables and indexes if they do not
+// exist. It returns an error if something goes wrong.
+func (pd *PostgresDriver) migrate() error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 20*time.Second)
+	defer cancel()
+	for _, migration := range migrations {
+		if _, err := pd.db.ExecContext(ctx, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeLike escapes the special characters of the LIKE patterns in the
+// provided string, to match it literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,237 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+func (pd *PostgresDriver) TokenExpiration(token db.Token) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var expiration time.Time
+	if err := pd.db.QueryRowContext(ctx, "SELECT expiration FROM tokens WHERE token = $1", string(token)).Scan(&expiration); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, db.ErrTokenNotFound
+		}
+		return time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	return expiration, nil
+}
+
+func (pd *PostgresDriver) TokenExists(token db.Token) (bool, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var exists bool
+	if err := pd.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM tokens WHERE token = $1)", string(token)).Scan(&exists); err != nil {
+		return false, errors.Join(db.ErrGetToken, err)
+	}
+	return exists, nil
+}
+
+func (pd *PostgresDriver) TokenScopes(token db.Token) ([]string, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var scopes []string
+	if err := pd.db.QueryRowContext(ctx, "SELECT scopes FROM tokens WHERE token = $1", string(token)).Scan(pq.Array(&scopes)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, db.ErrTokenNotFound
+		}
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return scopes, nil
+}
+
+func (pd *PostgresDriver) SetToken(token db.Token, expiration time.Time, scopes []string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, `
+		INSERT INTO tokens (token, expiration, scopes, issued_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (token) DO UPDATE SET expiration = EXCLUDED.expiration, scopes = EXCLUDED.scopes,
+			issued_at = EXCLUDED.issued_at, code = NULL, code_expiration = NULL`,
+		string(token), expiration, pq.Array(scopes), time.Now()); err != nil {
+		return errors.Join(db.ErrSetToken, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) DeleteToken(token db.Token) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM tokens WHERE token = $1", string(token)); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) SoftDeleteToken(token db.Token, reason string) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// delete the token and store its tombstone in the same statement, only if
+	// the token exists
+	if _, err := pd.db.ExecContext(ctx, `
+		WITH deleted AS (DELETE FROM tokens WHERE token = $1 RETURNING token)
+		INSERT INTO token_tombstones (token, reason, deleted_at) SELECT token, $2, $3 FROM deleted
+		ON CONFLICT (token) DO UPDATE SET reason = EXCLUDED.reason, deleted_at = EXCLUDED.deleted_at`,
+		string(token), reason, time.Now()); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) TombstonesByPrefix(prefix string) ([]db.Tombstone, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	rows, err := pd.db.QueryContext(ctx, `SELECT token, reason, deleted_at FROM token_tombstones
+		WHERE token LIKE $1 || '%' ORDER BY token`, escapeLike(prefix))
+	if err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	defer rows.Close()
+	tombstones := []db.Tombstone{}
+	for rows.Next() {
+		var tombstone db.Tombstone
+		if err := rows.Scan(&tombstone.Token, &tombstone.Reason, &tombstone.DeletedAt); err != nil {
+			return nil, errors.Join(db.ErrGetToken, err)
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return tombstones, nil
+}
+
+func (pd *PostgresDriver) PurgeTombstones(retention time.Duration) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	limit := time.Now().Add(-retention)
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM token_tombstones WHERE deleted_at < $1", limit); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) DeleteTokensByPrefix(prefix string) error {
+	// check if the prefix is empty and return nil if it is
+	if prefix == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM tokens WHERE token LIKE $1 || '%'", escapeLike(prefix)); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) DeleteExpiredTokens(gracePeriod time.Duration) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	limit := time.Now().Add(-gracePeriod)
+	if _, err := pd.db.ExecContext(ctx, "DELETE FROM tokens WHERE expiration < $1", limit); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) CountTokens(prefix string) (int64, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var count int64
+	if err := pd.db.QueryRowContext(ctx, "SELECT count(*) FROM tokens WHERE token LIKE $1 || '%'", escapeLike(prefix)).Scan(&count); err != nil {
+		return 0, errors.Join(db.ErrGetToken, err)
+	}
+	return count, nil
+}
+
+func (pd *PostgresDriver) CountTokensIssuedSince(since time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var count int64
+	if err := pd.db.QueryRowContext(ctx, "SELECT count(*) FROM tokens WHERE issued_at >= $1", since).Scan(&count); err != nil {
+		return 0, errors.Join(db.ErrGetToken, err)
+	}
+	return count, nil
+}
+
+func (pd *PostgresDriver) TokensByPrefix(prefix string) ([]db.TokenInfo, error) {
+	return pd.ListTokensByPrefix(prefix, 0, 0)
+}
+
+func (pd *PostgresDriver) ListTokensByPrefix(prefix string, limit, offset int) ([]db.TokenInfo, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	// a NULL limit means no limit
+	var queryLimit sql.NullInt64
+	if limit > 0 {
+		queryLimit = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := pd.db.QueryContext(ctx, "SELECT token, expiration FROM tokens WHERE token LIKE $1 || '%' ORDER BY token LIMIT $2 OFFSET $3",
+		escapeLike(prefix), queryLimit, offset)
+	if err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	defer rows.Close()
+	tokens := []db.TokenInfo{}
+	for rows.Next() {
+		var token db.TokenInfo
+		if err := rows.Scan(&token.Token, &token.Expiration); err != nil {
+			return nil, errors.Join(db.ErrGetToken, err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return tokens, nil
+}
+
+func (pd *PostgresDriver) SetTokenCode(token db.Token, code string, expiration time.Time) error {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var codeValue sql.NullString
+	var codeExpiration sql.NullTime
+	if code != "" {
+		codeValue = sql.NullString{String: code, Valid: true}
+		codeExpiration = sql.NullTime{Time: expiration, Valid: true}
+	}
+	res, err := pd.db.ExecContext(ctx, "UPDATE tokens SET code = $2, code_expiration = $3 WHERE token = $1",
+		string(token), codeValue, codeExpiration)
+	if err != nil {
+		return errors.Join(db.ErrSetToken, err)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Join(db.ErrSetToken, err)
+	}
+	if updated == 0 {
+		return db.ErrTokenNotFound
+	}
+	return nil
+}
+
+func (pd *PostgresDriver) TokenCode(token db.Token) (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(pd.ctx, 5*time.Second)
+	defer cancel()
+	var code sql.NullString
+	var expiration sql.NullTime
+	if err := pd.db.QueryRowContext(ctx, "SELECT code, code_expiration FROM tokens WHERE token = $1",
+		string(token)).Scan(&code, &expiration); err != nil {
+		if err == sql.ErrNoRows {
+			return "", time.Time{}, db.ErrTokenNotFound
+		}
+		return "", time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	if !code.Valid {
+		return "", time.Time{}, nil
+	}
+	return code.String, expiration.Time, nil
+}
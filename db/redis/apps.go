@@ -0,0 +1,467 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+// originsSeparator is the separator of the allowed origins and the allowed
+// redirect domains of an app, each list stored in a single field. The origins
+// and the domains can not include it.
+const originsSeparator = " "
+
+// App fields stored in the hash of every app.
+const (
+	nameField                = "name"
+	adminEmailField          = "admin_email"
+	sessionDurationField     = "session_duration"
+	redirectURLField         = "redirect_url"
+	usersQuotaField          = "users_quota"
+	maxRefreshesField        = "max_refreshes"
+	tokenSizeField           = "token_size"
+	maxTokenRequestsField    = "max_token_requests"
+	tokenRequestsWindowField = "token_requests_window"
+	notifierField            = "notifier"
+	notifierTargetField      = "notifier_target"
+	featuresField            = "features"
+	tokenDeliveryField       = "token_delivery"
+	allowedOriginsField      = "allowed_origins"
+	redirectDomainsField     = "allowed_redirect_domains"
+	authModeField            = "auth_mode"
+	channelsField            = "channels"
+	deliveryPolicyField      = "delivery_policy"
+	webhookURLField          = "webhook_url"
+	tokenEmailSubjectField   = "token_email_subject"
+	appEmailSubjectField     = "app_email_subject"
+	// secretField is the field of the secret stored before the apps could
+	// have several ones, it is only read to delete it.
+	secretField = "secret"
+	// legacyAllowLinkField is the field of the flag stored before the
+	// features, it is only read to migrate it to the features.
+	legacyAllowLinkField = "allow_link_in_response"
+)
+
+func (rd *RedisDriver) AppById(appId string) (*db.App, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get app from the database based on the app id
+	fields, err := rd.client.HGetAll(ctx, appKeyPrefix+appId).Result()
+	if err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	if len(fields) == 0 {
+		return nil, db.ErrAppNotFound
+	}
+	return decodeApp(appId, fields)
+}
+
+func (rd *RedisDriver) AppBySecret(secret string) (*db.App, string, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get the app id from the secret index
+	appId, err := rd.client.Get(ctx, secretKeyPrefix+secret).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, "", db.ErrAppNotFound
+		}
+		return nil, "", errors.Join(db.ErrGetApp, err)
+	}
+	app, err := rd.AppById(appId)
+	if err != nil {
+		return nil, "", err
+	}
+	return app, appId, nil
+}
+
+func (rd *RedisDriver) ListApps(limit, offset int) ([]*db.App, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get all the app ids and sort them, because SCAN does not guarantee any
+	// order, to paginate them
+	appIds := []string{}
+	if err := rd.scanKeys(ctx, appKeyPrefix+"*", func(keys []string) error {
+		for _, key := range keys {
+			appIds = append(appIds, strings.TrimPrefix(key, appKeyPrefix))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	sort.Strings(appIds)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(appIds) {
+		return []*db.App{}, nil
+	}
+	appIds = appIds[offset:]
+	if limit > 0 && limit < len(appIds) {
+		appIds = appIds[:limit]
+	}
+	// get the apps of the page in a single round trip
+	cmds := make([]*redis.MapStringStringCmd, len(appIds))
+	if _, err := rd.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, appId := range appIds {
+			cmds[i] = pipe.HGetAll(ctx, appKeyPrefix+appId)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetApp, err)
+	}
+	apps := make([]*db.App, 0, len(appIds))
+	for i, cmd := range cmds {
+		// skip the apps deleted while listing
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		app, err := decodeApp(appIds[i], cmd.Val())
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (rd *RedisDriver) CountApps() (int64, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	var count int64
+	if err := rd.scanKeys(ctx, appKeyPrefix+"*", func(keys []string) error {
+		count += int64(len(keys))
+		return nil
+	}); err != nil {
+		return 0, errors.Join(db.ErrGetApp, err)
+	}
+	return count, nil
+}
+
+func (rd *RedisDriver) SetApp(appId string, app *db.App) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// create or update app in the database, only the non-zero fields are
+	// updated, except the features, the allowed origins, the allowed
+	// redirect domains and the channels, which are always updated to allow
+	// disabling them
+	features := ""
+	if len(app.Features) > 0 {
+		bFeatures, err := json.Marshal(app.Features)
+		if err != nil {
+			return errors.Join(db.ErrSetApp, err)
+		}
+		features = string(bFeatures)
+	}
+	channels := ""
+	if len(app.Channels) > 0 {
+		bChannels, err := json.Marshal(app.Channels)
+		if err != nil {
+			return errors.Join(db.ErrSetApp, err)
+		}
+		channels = string(bChannels)
+	}
+	fields := map[string]any{
+		featuresField:        features,
+		allowedOriginsField:  strings.Join(app.AllowedOrigins, originsSeparator),
+		redirectDomainsField: strings.Join(app.AllowedRedirectDomains, originsSeparator),
+		channelsField:        channels,
+	}
+	if app.Name != "" {
+		fields[nameField] = app.Name
+	}
+	if app.AdminEmail != "" {
+		fields[adminEmailField] = app.AdminEmail
+	}
+	if app.SessionDuration != 0 {
+		fields[sessionDurationField] = app.SessionDuration
+	}
+	if app.RedirectURL != "" {
+		fields[redirectURLField] = app.RedirectURL
+	}
+	if app.UsersQuota != 0 {
+		fields[usersQuotaField] = app.UsersQuota
+	}
+	if app.MaxRefreshes != 0 {
+		fields[maxRefreshesField] = app.MaxRefreshes
+	}
+	if app.TokenSize != 0 {
+		fields[tokenSizeField] = app.TokenSize
+	}
+	if app.MaxTokenRequests != 0 {
+		fields[maxTokenRequestsField] = app.MaxTokenRequests
+	}
+	if app.TokenRequestsWindow != 0 {
+		fields[tokenRequestsWindowField] = app.TokenRequestsWindow
+	}
+	if app.Notifier != "" {
+		fields[notifierField] = app.Notifier
+	}
+	if app.NotifierTarget != "" {
+		fields[notifierTargetField] = app.NotifierTarget
+	}
+	if app.TokenDelivery != "" {
+		fields[tokenDeliveryField] = app.TokenDelivery
+	}
+	if app.AuthMode != "" {
+		fields[authModeField] = app.AuthMode
+	}
+	if app.DeliveryPolicy != "" {
+		fields[deliveryPolicyField] = app.DeliveryPolicy
+	}
+	if app.WebhookURL != "" {
+		fields[webhookURLField] = app.WebhookURL
+	}
+	if app.TokenEmailSubject != "" {
+		fields[tokenEmailSubjectField] = app.TokenEmailSubject
+	}
+	if app.AppEmailSubject != "" {
+		fields[appEmailSubjectField] = app.AppEmailSubject
+	}
+	if err := rd.client.HSet(ctx, appKeyPrefix+appId, fields).Err(); err != nil {
+		return errors.Join(db.ErrSetApp, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) DeleteApp(appId string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// delete the app, its secrets and their index from the database,
+	// including the secret stored before the apps could have several ones
+	secrets, err := rd.client.SMembers(ctx, appSecretsKeyPrefix+appId).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Join(db.ErrDelApp, err)
+	}
+	legacySecret, err := rd.client.HGet(ctx, appKeyPrefix+appId, secretField).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Join(db.ErrDelApp, err)
+	}
+	if legacySecret != "" {
+		secrets = append(secrets, legacySecret)
+	}
+	keys := []string{appKeyPrefix + appId, appSecretsKeyPrefix + appId}
+	for _, secret := range secrets {
+		keys = append(keys, secretKeyPrefix+secret)
+	}
+	if err := rd.client.Del(ctx, keys...).Err(); err != nil {
+		return errors.Join(db.ErrDelApp, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) SetSecret(secret, appId string, expiration time.Time) error {
+	// the secrets expire with the native TTL of redis, if they are already
+	// expired they are deleted
+	var ttl time.Duration
+	if !expiration.IsZero() {
+		if ttl = time.Until(expiration); ttl <= 0 {
+			return rd.DeleteSecret(secret)
+		}
+	}
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// check if the app exists
+	exists, err := rd.client.Exists(ctx, appKeyPrefix+appId).Result()
+	if err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	if exists == 0 {
+		return db.ErrAppNotFound
+	}
+	// add the secret to the secrets of the app and the secret index in a
+	// transaction
+	if _, err := rd.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, appSecretsKeyPrefix+appId, secret)
+		pipe.Set(ctx, secretKeyPrefix+secret, appId, ttl)
+		return nil
+	}); err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) ExpireSecrets(appId, keepSecret string, expiration time.Time) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get the secrets of the app, including the secret stored before the apps
+	// could have several ones
+	secrets, err := rd.client.SMembers(ctx, appSecretsKeyPrefix+appId).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	legacySecret, err := rd.client.HGet(ctx, appKeyPrefix+appId, secretField).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	if legacySecret != "" {
+		secrets = append(secrets, legacySecret)
+	}
+	// set the TTL of their index only if it is lower than the current one (no
+	// TTL is infinite), if they are already expired they are deleted
+	ttl := time.Until(expiration)
+	if _, err := rd.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, secret := range secrets {
+			if secret == keepSecret {
+				continue
+			}
+			if ttl > 0 {
+				pipe.ExpireLT(ctx, secretKeyPrefix+secret, ttl)
+				continue
+			}
+			if secret == legacySecret {
+				pipe.HDel(ctx, appKeyPrefix+appId, secretField)
+			}
+			pipe.SRem(ctx, appSecretsKeyPrefix+appId, secret)
+			pipe.Del(ctx, secretKeyPrefix+secret)
+		}
+		return nil
+	}); err != nil {
+		return errors.Join(db.ErrSetSecret, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) ExpireSecret(secret, appId string, expiration time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// check that the secret belongs to the app
+	secretAppId, err := rd.client.Get(ctx, secretKeyPrefix+secret).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return time.Time{}, db.ErrAppNotFound
+		}
+		return time.Time{}, errors.Join(db.ErrSetSecret, err)
+	}
+	if secretAppId != appId {
+		return time.Time{}, db.ErrAppNotFound
+	}
+	// set the TTL of its index only if it is lower than the current one (no
+	// TTL is infinite), if it is already expired it is deleted
+	ttl := time.Until(expiration)
+	if ttl <= 0 {
+		return expiration, rd.DeleteSecret(secret)
+	}
+	var current *redis.DurationCmd
+	if _, err := rd.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ExpireLT(ctx, secretKeyPrefix+secret, ttl)
+		current = pipe.PTTL(ctx, secretKeyPrefix+secret)
+		return nil
+	}); err != nil {
+		return time.Time{}, errors.Join(db.ErrSetSecret, err)
+	}
+	return time.Now().Add(current.Val()), nil
+}
+
+func (rd *RedisDriver) DeleteSecret(secret string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get the app id from the secret index
+	appId, err := rd.client.Get(ctx, secretKeyPrefix+secret).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return errors.Join(db.ErrDelSecret, err)
+	}
+	legacySecret, err := rd.client.HGet(ctx, appKeyPrefix+appId, secretField).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Join(db.ErrDelSecret, err)
+	}
+	// delete the secret from the secrets of the app and the secret index in a
+	// transaction
+	if _, err := rd.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if legacySecret == secret {
+			pipe.HDel(ctx, appKeyPrefix+appId, secretField)
+		}
+		pipe.SRem(ctx, appSecretsKeyPrefix+appId, secret)
+		pipe.Del(ctx, secretKeyPrefix+secret)
+		return nil
+	}); err != nil {
+		return errors.Join(db.ErrDelSecret, err)
+	}
+	return nil
+}
+
+// decodeApp decodes the fields of the hash of the app with the provided id
+// into a db.App. It returns an error if some numeric field is malformed.
+func decodeApp(appId string, fields map[string]string) (*db.App, error) {
+	app := &db.App{
+		ID:                appId,
+		Name:              fields[nameField],
+		AdminEmail:        fields[adminEmailField],
+		RedirectURL:       fields[redirectURLField],
+		Notifier:          fields[notifierField],
+		NotifierTarget:    fields[notifierTargetField],
+		TokenDelivery:     fields[tokenDeliveryField],
+		AuthMode:          fields[authModeField],
+		DeliveryPolicy:    fields[deliveryPolicyField],
+		WebhookURL:        fields[webhookURLField],
+		TokenEmailSubject: fields[tokenEmailSubjectField],
+		AppEmailSubject:   fields[appEmailSubjectField],
+	}
+	var err error
+	if value, ok := fields[sessionDurationField]; ok {
+		if app.SessionDuration, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value, ok := fields[usersQuotaField]; ok {
+		if app.UsersQuota, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value, ok := fields[maxRefreshesField]; ok {
+		if app.MaxRefreshes, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value, ok := fields[tokenSizeField]; ok {
+		if app.TokenSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value, ok := fields[maxTokenRequestsField]; ok {
+		if app.MaxTokenRequests, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value, ok := fields[tokenRequestsWindowField]; ok {
+		if app.TokenRequestsWindow, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value := fields[allowedOriginsField]; value != "" {
+		app.AllowedOrigins = strings.Split(value, originsSeparator)
+	}
+	if value := fields[redirectDomainsField]; value != "" {
+		app.AllowedRedirectDomains = strings.Split(value, originsSeparator)
+	}
+	if value := fields[featuresField]; value != "" {
+		if err := json.Unmarshal([]byte(value), &app.Features); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	if value := fields[channelsField]; value != "" {
+		if err := json.Unmarshal([]byte(value), &app.Channels); err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+	}
+	// migrate the legacy flag if its feature is not set
+	if value, ok := fields[legacyAllowLinkField]; ok {
+		legacy, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.Join(db.ErrGetApp, err)
+		}
+		if _, ok := app.Features[db.FeatureLinkInResponse]; !ok && legacy {
+			app.SetFeature(db.FeatureLinkInResponse, true)
+		}
+	}
+	return app, nil
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+// incrAttemptsScript increments the counter of the provided key and sets its
+// ttl (in milliseconds) only when it is created, atomically, so the counter
+// expires the provided time after the first attempt.
+var incrAttemptsScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (rd *RedisDriver) IncrAttempts(key string, ttl time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	keys := []string{attemptsKeyPrefix + key}
+	count, err := incrAttemptsScript.Run(ctx, rd.client, keys, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, errors.Join(db.ErrSetAttempts, err)
+	}
+	return count, nil
+}
+
+func (rd *RedisDriver) Attempts(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	count, err := rd.client.Get(ctx, attemptsKeyPrefix+key).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, errors.Join(db.ErrGetAttempts, err)
+	}
+	return count, nil
+}
+
+func (rd *RedisDriver) ResetAttempts(key string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	if err := rd.client.Del(ctx, attemptsKeyPrefix+key).Err(); err != nil {
+		return errors.Join(db.ErrDelAttempts, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+// deadLetter struct represents a dead letter as it is encoded in JSON in
+// the value of its key.
+type deadLetter struct {
+	ID       string    `json:"id"`
+	To       string    `json:"to"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`
+	TextBody string    `json:"text_body,omitempty"`
+	Priority int       `json:"priority"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func (rd *RedisDriver) SetDeadLetter(letter *db.DeadLetter) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	value, err := json.Marshal(deadLetter(*letter))
+	if err != nil {
+		return errors.Join(db.ErrSetDeadLetter, err)
+	}
+	if err := rd.client.Set(ctx, deadLetterKeyPrefix+letter.ID, value, 0).Err(); err != nil {
+		return errors.Join(db.ErrSetDeadLetter, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) DeadLetterById(id string) (*db.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	value, err := rd.client.Get(ctx, deadLetterKeyPrefix+id).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, db.ErrDeadLetterNotFound
+		}
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	var letter deadLetter
+	if err := json.Unmarshal(value, &letter); err != nil {
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	dbLetter := db.DeadLetter(letter)
+	return &dbLetter, nil
+}
+
+func (rd *RedisDriver) ListDeadLetters(limit, offset int) ([]*db.DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get all the dead letters, because they must be sorted by failure time
+	// to paginate them
+	letters := []*db.DeadLetter{}
+	if err := rd.scanKeys(ctx, deadLetterKeyPrefix+"*", func(keys []string) error {
+		values, err := rd.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			// skip the dead letters deleted while listing
+			encoded, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var letter deadLetter
+			if err := json.Unmarshal([]byte(encoded), &letter); err != nil {
+				return err
+			}
+			dbLetter := db.DeadLetter(letter)
+			letters = append(letters, &dbLetter)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetDeadLetter, err)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if !letters[i].FailedAt.Equal(letters[j].FailedAt) {
+			return letters[i].FailedAt.Before(letters[j].FailedAt)
+		}
+		return letters[i].ID < letters[j].ID
+	})
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(letters) {
+		return []*db.DeadLetter{}, nil
+	}
+	letters = letters[offset:]
+	if limit > 0 && limit < len(letters) {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (rd *RedisDriver) DeleteDeadLetter(id string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	if err := rd.client.Del(ctx, deadLetterKeyPrefix+id).Err(); err != nil {
+		return errors.Join(db.ErrDelDeadLetter, err)
+	}
+	return nil
+}
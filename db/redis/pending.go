@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/simpleauthlink/authapi/db"
+)
+
+// pendingEmail struct represents a pending email as it is encoded in JSON in
+// the value of its key.
+type pendingEmail struct {
+	ID       string    `json:"id"`
+	To       string    `json:"to"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`
+	TextBody string    `json:"text_body,omitempty"`
+	Priority int       `json:"priority"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+func (rd *RedisDriver) EnqueueEmail(email *db.PendingEmail) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	value, err := json.Marshal(pendingEmail(*email))
+	if err != nil {
+		return errors.Join(db.ErrSetPendingEmail, err)
+	}
+	if err := rd.client.Set(ctx, pendingKeyPrefix+email.ID, value, 0).Err(); err != nil {
+		return errors.Join(db.ErrSetPendingEmail, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) DequeueEmail(id string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	if err := rd.client.Del(ctx, pendingKeyPrefix+id).Err(); err != nil {
+		return errors.Join(db.ErrDelPendingEmail, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) PendingEmails() ([]*db.PendingEmail, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	emails := []*db.PendingEmail{}
+	if err := rd.scanKeys(ctx, pendingKeyPrefix+"*", func(keys []string) error {
+		values, err := rd.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			// skip the emails dequeued while listing
+			encoded, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var email pendingEmail
+			if err := json.Unmarshal([]byte(encoded), &email); err != nil {
+				return err
+			}
+			dbEmail := db.PendingEmail(email)
+			emails = append(emails, &dbEmail)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetPendingEmail, err)
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].QueuedAt.Equal(emails[j].QueuedAt) {
+			return emails[i].QueuedAt.Before(emails[j].QueuedAt)
+		}
+		return emails[i].ID < emails[j].ID
+	})
+	return emails, nil
+}
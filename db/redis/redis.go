@@ -0,0 +1,130 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+const (
+	appKeyPrefix        = "app:"
+	secretKeyPrefix     = "secret:"
+	appSecretsKeyPrefix = "app_secrets:"
+	tokenKeyPrefix      = "token:"
+	tombstoneKeyPrefix  = "tombstone:"
+	attemptsKeyPrefix   = "attempts:"
+	deadLetterKeyPrefix = "dead_letter:"
+	pendingKeyPrefix    = "pending_email:"
+	// scanCount is the number of keys requested to the server in every
+	// iteration of a SCAN command.
+	scanCount = 100
+)
+
+// Config struct includes the configuration of the RedisDriver. The
+// TokensGracePeriod is the time that the tokens are kept after they expire,
+// because redis removes them with their native TTL instead of when the service
+// cleans the expired tokens.
+type Config struct {
+	RedisURL          string
+	DB                int
+	Password          string
+	TokensGracePeriod time.Duration
+}
+
+type RedisDriver struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	config Config
+	client *redis.Client
+}
+
+func (rd *RedisDriver) Init(config any) error {
+	// validate config
+	cfg, ok := config.(Config)
+	if !ok {
+		return db.ErrInvalidConfig
+	}
+	if cfg.RedisURL == "" {
+		return fmt.Errorf("%w: no database url provided", db.ErrInvalidConfig)
+	}
+	// init the client options, the db index and the password override the
+	// values of the url if they are provided
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", db.ErrInvalidConfig, err)
+	}
+	if cfg.DB != 0 {
+		opts.DB = cfg.DB
+	}
+	if cfg.Password != "" {
+		opts.Password = cfg.Password
+	}
+	client := redis.NewClient(opts)
+	// check if the connection is available
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return errors.Join(db.ErrOpenConn, err)
+	}
+	// create the internal context
+	rd.ctx, rd.cancel = context.WithCancel(context.Background())
+	// set the client and config
+	rd.client = client
+	rd.config = cfg
+	return nil
+}
+
+func (rd *RedisDriver) Close() error {
+	rd.cancel()
+	if err := rd.client.Close(); err != nil {
+		return errors.Join(db.ErrCloseConn, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) Ping(ctx context.Context) error {
+	if err := rd.client.Ping(ctx).Err(); err != nil {
+		return errors.Join(db.ErrPing, err)
+	}
+	return nil
+}
+
+// scanKeys iterates over the keys that match the provided pattern using the
+// SCAN command, calling the provided function with every batch of keys
+// found. It returns an error if something goes wrong.
+func (rd *RedisDriver) scanKeys(ctx context.Context, pattern string, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := rd.client.Scan(ctx, cursor, pattern, scanCount).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// escapePattern escapes the special characters of the glob-style patterns
+// used by the SCAN command in the provided string, to match it literally.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,570 @@
+package redis
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/simpleauthlink/authapi/db"
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// newTestDriver function starts a miniredis server and returns a driver
+// connected to it, both are stopped when the test finishes.
+func newTestDriver(t *testing.T) (*RedisDriver, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rd := new(RedisDriver)
+	if err := rd.Init(Config{RedisURL: "redis://" + mr.Addr()}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	t.Cleanup(func() { _ = rd.Close() })
+	return rd, mr
+}
+
+func TestInit(t *testing.T) {
+	rd := new(RedisDriver)
+	if err := rd.Init(nil); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err := rd.Init(Config{}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("password")
+	if err := rd.Init(Config{RedisURL: "redis://" + mr.Addr()}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err := rd.Init(Config{RedisURL: "redis://" + mr.Addr(), Password: "password", DB: 2}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	_ = rd.Close()
+}
+
+func TestApps(t *testing.T) {
+	rd, _ := newTestDriver(t)
+	app := &db.App{
+		ID:                     "appId",
+		Name:                   "test app",
+		AdminEmail:             "admin@simpleauth.link",
+		SessionDuration:        60,
+		RedirectURL:            "https://simpleauth.link/callback",
+		UsersQuota:             100,
+		MaxRefreshes:           10,
+		TokenSize:              32,
+		MaxTokenRequests:       3,
+		TokenRequestsWindow:    120,
+		AllowedOrigins:         []string{"https://simpleauth.link", "http://localhost:3000"},
+		AllowedRedirectDomains: []string{"app.simpleauth.link"},
+		Notifier:               "webhook",
+		NotifierTarget:         "https://hooks.simpleauth.link",
+		TokenDelivery:          "both",
+		Features:               map[db.Feature]bool{db.FeatureLinkInResponse: true},
+		Channels:               []db.Channel{{Notifier: "email"}, {Notifier: "slack", Target: "https://hooks.slack.com/test"}},
+		DeliveryPolicy:         "all",
+		WebhookURL:             "https://example.com/webhook",
+		TokenEmailSubject:      "Log in to {{.AppName}}",
+		AppEmailSubject:        "{{.AppName}} is ready",
+	}
+	if err := rd.SetApp("appId", app); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.SetSecret("secret", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.SetSecret("secret", "unknown", time.Time{}); err != db.ErrAppNotFound {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+	got, err := rd.AppById("appId")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !reflect.DeepEqual(got, app) {
+		t.Errorf("expected %+v, got %+v", app, got)
+	}
+	got, appId, err := rd.AppBySecret("secret")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if appId != "appId" || !reflect.DeepEqual(got, app) {
+		t.Errorf("expected appId and %+v, got %s and %+v", app, appId, got)
+	}
+	if valid, _ := validSecret(rd, "secret", "appId"); !valid {
+		t.Errorf("expected valid secret")
+	}
+	if valid, _ := validSecret(rd, "wrong", "appId"); valid {
+		t.Errorf("expected invalid secret")
+	}
+	// partial update
+	if err := rd.SetApp("appId", &db.App{Name: "new name"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got, _ := rd.AppById("appId"); got.Name != "new name" || got.AdminEmail != app.AdminEmail {
+		t.Errorf("unexpected updated app: %+v", got)
+	}
+	// delete secret
+	if err := rd.DeleteSecret("secret"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, _, err := rd.AppBySecret("secret"); err != db.ErrAppNotFound {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+	// delete app, including its secret
+	if err := rd.SetSecret("secret2", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.DeleteApp("appId"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := rd.AppById("appId"); err != db.ErrAppNotFound {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+	if _, _, err := rd.AppBySecret("secret2"); err != db.ErrAppNotFound {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+}
+
+// validSecret function checks if the provided secret is one of the active
+// secrets of the app with the provided id, resolving it with AppBySecret.
+func validSecret(d db.DB, secret, appId string) (bool, error) {
+	_, secretAppId, err := d.AppBySecret(secret)
+	if err == db.ErrAppNotFound {
+		return false, nil
+	}
+	return err == nil && secretAppId == appId, err
+}
+
+func TestSecretRotation(t *testing.T) {
+	rd, mr := newTestDriver(t)
+	if err := rd.SetApp("appId", &db.App{Name: "test app"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the app has two valid secrets, the previous one until it expires
+	if err := rd.SetSecret("current", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.SetSecret("previous", "appId", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, secret := range []string{"current", "previous"} {
+		if valid, err := validSecret(rd, secret, "appId"); err != nil || !valid {
+			t.Errorf("%s: expected valid secret, got %v (%v)", secret, valid, err)
+		}
+		if _, appId, err := rd.AppBySecret(secret); err != nil || appId != "appId" {
+			t.Errorf("%s: expected appId, got %s (%v)", secret, appId, err)
+		}
+	}
+	if valid, _ := validSecret(rd, "current", "other"); valid {
+		t.Errorf("expected invalid secret for other app")
+	}
+	// the previous secret expires with its TTL
+	mr.FastForward(2 * time.Hour)
+	if valid, err := validSecret(rd, "previous", "appId"); err != nil || valid {
+		t.Errorf("expected expired secret, got %v (%v)", valid, err)
+	}
+	if _, _, err := rd.AppBySecret("previous"); err != db.ErrAppNotFound {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+	if valid, err := validSecret(rd, "current", "appId"); err != nil || !valid {
+		t.Errorf("expected valid secret, got %v (%v)", valid, err)
+	}
+	// expiring the secrets of the app keeps the provided one, and does not
+	// extend the ones that expire before
+	if err := rd.SetSecret("next", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.SetSecret("short", "appId", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.ExpireSecrets("appId", "next", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if ttl := mr.TTL(secretKeyPrefix + "short"); ttl > time.Minute {
+		t.Errorf("expected TTL not extended, got %s", ttl)
+	}
+	if ttl := mr.TTL(secretKeyPrefix + "next"); ttl != 0 {
+		t.Errorf("expected no TTL for the kept secret, got %s", ttl)
+	}
+	// expiring a secret does not extend its expiration
+	if expiration, err := rd.ExpireSecret("short", "appId", time.Now().Add(time.Hour)); err != nil || time.Until(expiration) > time.Minute {
+		t.Errorf("expected expiration not extended, got %s (%v)", expiration, err)
+	}
+	if ttl := mr.TTL(secretKeyPrefix + "short"); ttl > time.Minute {
+		t.Errorf("expected TTL not extended, got %s", ttl)
+	}
+	if _, err := rd.ExpireSecret("short", "other", time.Now().Add(time.Hour)); err != db.ErrAppNotFound {
+		t.Errorf("expected %v, got %v", db.ErrAppNotFound, err)
+	}
+	mr.FastForward(2 * time.Hour)
+	for secret, expected := range map[string]bool{"current": false, "short": false, "next": true} {
+		if valid, err := validSecret(rd, secret, "appId"); err != nil || valid != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", secret, expected, valid, err)
+		}
+	}
+	if err := rd.SetSecret("current", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the secrets stored before the apps could have several ones are
+	// deleted with the app
+	mr.HSet(appKeyPrefix+"appId", secretField, "legacy")
+	if err := mr.Set(secretKeyPrefix+"legacy", "appId"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, appId, err := rd.AppBySecret("legacy"); err != nil || appId != "appId" {
+		t.Errorf("expected appId, got %s (%v)", appId, err)
+	}
+	if err := rd.DeleteApp("appId"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, key := range []string{secretKeyPrefix + "current", secretKeyPrefix + "legacy", appSecretsKeyPrefix + "appId"} {
+		if mr.Exists(key) {
+			t.Errorf("expected %s deleted", key)
+		}
+	}
+}
+
+func TestAppDurations(t *testing.T) {
+	rd, _ := newTestDriver(t)
+	for _, duration := range []uint64{helpers.MinTokenDuration, helpers.MaxTokenDuration, math.MaxUint64} {
+		if err := rd.SetApp("appId", &db.App{SessionDuration: duration, TokenRequestsWindow: duration}); err != nil {
+			t.Fatalf("%d: expected nil, got %v", duration, err)
+		}
+		app, err := rd.AppById("appId")
+		if err != nil {
+			t.Fatalf("%d: expected nil, got %v", duration, err)
+		}
+		if app.SessionDuration != duration || app.TokenRequestsWindow != duration {
+			t.Errorf("expected %d, got %d and %d", duration, app.SessionDuration, app.TokenRequestsWindow)
+		}
+	}
+}
+
+func TestLegacyAllowLink(t *testing.T) {
+	rd, mr := newTestDriver(t)
+	// the apps stored before the features keep the legacy flag
+	mr.HSet(appKeyPrefix+"appId", nameField, "legacy app", legacyAllowLinkField, "true")
+	app, err := rd.AppById("appId")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !app.Enabled(db.FeatureLinkInResponse) {
+		t.Errorf("expected legacy flag migrated to the features")
+	}
+	// the features set by the app take precedence over the legacy flag
+	app.SetFeature(db.FeatureLinkInResponse, false)
+	if err := rd.SetApp("appId", app); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if app, _ = rd.AppById("appId"); app.Enabled(db.FeatureLinkInResponse) {
+		t.Errorf("expected feature disabled, got %+v", app.Features)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	rd, mr := newTestDriver(t)
+	expiration := time.Now().Add(time.Minute)
+	if err := rd.SetToken("app1-user1-a", expiration, []string{"billing"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.SetToken("app1-user2-b", expiration, nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.SetToken("app2-user1-c", time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	got, err := rd.TokenExpiration("app1-user1-a")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !got.Equal(time.Unix(0, expiration.UnixNano())) {
+		t.Errorf("expected %v, got %v", expiration, got)
+	}
+	if scopes, _ := rd.TokenScopes("app1-user1-a"); len(scopes) != 1 || scopes[0] != "billing" {
+		t.Errorf("expected [billing], got %v", scopes)
+	}
+	if scopes, err := rd.TokenScopes("app1-user2-b"); err != nil || len(scopes) != 0 {
+		t.Errorf("expected no scopes, got %v (%v)", scopes, err)
+	}
+	// one-time codes
+	if err := rd.SetTokenCode("unknown", "hashed", expiration); err != db.ErrTokenNotFound {
+		t.Errorf("expected %v, got %v", db.ErrTokenNotFound, err)
+	}
+	if err := rd.SetTokenCode("app1-user1-a", "hashed", expiration); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if code, exp, err := rd.TokenCode("app1-user1-a"); err != nil || code != "hashed" || !exp.Equal(time.Unix(0, expiration.UnixNano())) {
+		t.Errorf("expected hashed code, got %q %v (%v)", code, exp, err)
+	}
+	if err := rd.SetTokenCode("app1-user1-a", "", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if code, _, err := rd.TokenCode("app1-user1-a"); err != nil || code != "" {
+		t.Errorf("expected no code, got %q (%v)", code, err)
+	}
+	if _, err := rd.TokenExpiration("unknown"); err != db.ErrTokenNotFound {
+		t.Errorf("expected %v, got %v", db.ErrTokenNotFound, err)
+	}
+	if exists, err := rd.TokenExists("app1-user1-a"); err != nil || !exists {
+		t.Errorf("expected existing token, got %v (%v)", exists, err)
+	}
+	if exists, err := rd.TokenExists("unknown"); err != nil || exists {
+		t.Errorf("expected missing token, got %v (%v)", exists, err)
+	}
+	if tokens, err := rd.TokensByPrefix("app1-"); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	} else if len(tokens) != 2 || tokens[0].Token != "app1-user1-a" || tokens[1].Token != "app1-user2-b" {
+		t.Errorf("expected app1 tokens sorted, got %v", tokens)
+	} else if !tokens[0].Expiration.Equal(time.Unix(0, expiration.UnixNano())) {
+		t.Errorf("expected %v, got %v", expiration, tokens[0].Expiration)
+	}
+	if tokens, err := rd.TokensByPrefix("app3-"); err != nil || len(tokens) != 0 {
+		t.Errorf("expected no tokens, got %v (%v)", tokens, err)
+	}
+	if tokens, err := rd.ListTokensByPrefix("app1-", 1, 1); err != nil || len(tokens) != 1 || tokens[0].Token != "app1-user2-b" {
+		t.Errorf("expected the second app1 token, got %v (%v)", tokens, err)
+	}
+	if tokens, err := rd.ListTokensByPrefix("app1-", 1, 2); err != nil || len(tokens) != 0 {
+		t.Errorf("expected no tokens, got %v (%v)", tokens, err)
+	}
+	// count
+	if count, _ := rd.CountTokens(""); count != 3 {
+		t.Errorf("expected 3, got %d", count)
+	}
+	if count, _ := rd.CountTokens("app1"); count != 2 {
+		t.Errorf("expected 2, got %d", count)
+	}
+	// count the tokens issued in the last day
+	mr.HSet(tokenKeyPrefix+"app2-user1-c", issuedAtField, strconv.FormatInt(time.Now().Add(-48*time.Hour).UnixNano(), 10))
+	if count, err := rd.CountTokensIssuedSince(time.Now().Add(-24 * time.Hour)); err != nil || count != 2 {
+		t.Errorf("expected 2 tokens issued in the last day, got %d (%v)", count, err)
+	}
+	// native ttl expiry
+	mr.FastForward(2 * time.Minute)
+	if err := rd.DeleteExpiredTokens(0); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, _ := rd.CountTokens("app1"); count != 0 {
+		t.Errorf("expected 0 after expiry, got %d", count)
+	}
+	// delete by prefix
+	if err := rd.SetToken("app1-user1-d", expiration.Add(time.Hour), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := rd.DeleteTokensByPrefix("app2"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, _ := rd.CountTokens(""); count != 1 {
+		t.Errorf("expected 1, got %d", count)
+	}
+	if err := rd.DeleteToken("app1-user1-d"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, _ := rd.CountTokens(""); count != 0 {
+		t.Errorf("expected 0, got %d", count)
+	}
+}
+
+func TestTokensGracePeriod(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisDriver)
+	if err := rd.Init(Config{RedisURL: "redis://" + mr.Addr(), TokensGracePeriod: 10 * time.Minute}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	t.Cleanup(func() { _ = rd.Close() })
+	expiration := time.Now().Add(time.Minute)
+	if err := rd.SetToken("app1-user1-a", expiration, nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the token survives during the grace period, with its expiration
+	mr.FastForward(5 * time.Minute)
+	if got, err := rd.TokenExpiration("app1-user1-a"); err != nil || !got.Equal(time.Unix(0, expiration.UnixNano())) {
+		t.Errorf("expected %v, got %v (%v)", expiration, got, err)
+	}
+	mr.FastForward(10 * time.Minute)
+	if exists, _ := rd.TokenExists("app1-user1-a"); exists {
+		t.Errorf("expected token removed after the grace period")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	rd, _ := newTestDriver(t)
+	for _, token := range []db.Token{"app1-user1-a", "app1-user2-b", "app2-user1-c"} {
+		if err := rd.SetToken(token, time.Now().Add(time.Hour), nil); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	for token, reason := range map[db.Token]string{
+		"app1-user1-a": db.DeleteReasonRevoked,
+		"app2-user1-c": db.DeleteReasonExpired,
+		"app1-user3-d": db.DeleteReasonRevoked,
+	} {
+		if err := rd.SoftDeleteToken(token, reason); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	// the soft deleted tokens are not valid anymore
+	if _, err := rd.TokenExpiration("app1-user1-a"); err != db.ErrTokenNotFound {
+		t.Errorf("expected %v, got %v", db.ErrTokenNotFound, err)
+	}
+	if exists, _ := rd.TokenExists("app1-user2-b"); !exists {
+		t.Errorf("expected token to exist")
+	}
+	// but their tombstones are visible until they are purged, the missing
+	// tokens are not recorded
+	tombstones, err := rd.TombstonesByPrefix("app1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(tombstones) != 1 || tombstones[0].Token != "app1-user1-a" || tombstones[0].Reason != db.DeleteReasonRevoked ||
+		time.Since(tombstones[0].DeletedAt) > time.Minute {
+		t.Errorf("unexpected tombstones: %+v", tombstones)
+	}
+	if err := rd.PurgeTombstones(time.Hour); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tombstones, _ := rd.TombstonesByPrefix(""); len(tombstones) != 2 {
+		t.Errorf("expected 2 tombstones, got %d", len(tombstones))
+	}
+	if err := rd.PurgeTombstones(0); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tombstones, _ := rd.TombstonesByPrefix(""); len(tombstones) != 0 {
+		t.Errorf("expected no tombstones, got %+v", tombstones)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	rd, mr := newTestDriver(t)
+	for i := int64(1); i <= 3; i++ {
+		count, err := rd.IncrAttempts("key", time.Minute)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if count != i {
+			t.Errorf("expected %d, got %d", i, count)
+		}
+	}
+	if count, _ := rd.Attempts("key"); count != 3 {
+		t.Errorf("expected 3, got %d", count)
+	}
+	if err := rd.ResetAttempts("key"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, _ := rd.Attempts("key"); count != 0 {
+		t.Errorf("expected 0 after reset, got %d", count)
+	}
+	// the ttl is set by the first attempt and not extended by the next ones
+	if _, err := rd.IncrAttempts("ttl", time.Minute); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	mr.FastForward(30 * time.Second)
+	if _, err := rd.IncrAttempts("ttl", time.Minute); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	mr.FastForward(31 * time.Second)
+	if count, _ := rd.Attempts("ttl"); count != 0 {
+		t.Errorf("expected 0 after expiry, got %d", count)
+	}
+}
+
+func TestListApps(t *testing.T) {
+	rd, _ := newTestDriver(t)
+	for _, appId := range []string{"app3", "app1", "app2"} {
+		if err := rd.SetApp(appId, &db.App{Name: appId}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	tests := []struct {
+		limit, offset int
+		expected      []string
+	}{
+		{0, 0, []string{"app1", "app2", "app3"}},
+		{2, 0, []string{"app1", "app2"}},
+		{2, 2, []string{"app3"}},
+		{2, 3, []string{}},
+	}
+	for _, tc := range tests {
+		apps, err := rd.ListApps(tc.limit, tc.offset)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if len(apps) != len(tc.expected) {
+			t.Errorf("expected %d apps, got %d", len(tc.expected), len(apps))
+			continue
+		}
+		for i, app := range apps {
+			if app.ID != tc.expected[i] || app.Name != tc.expected[i] {
+				t.Errorf("expected %s, got %+v", tc.expected[i], app)
+			}
+		}
+	}
+	if count, err := rd.CountApps(); err != nil || count != 3 {
+		t.Errorf("expected 3 apps, got %d (%v)", count, err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	rd, _ := newTestDriver(t)
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		letter := &db.DeadLetter{
+			ID:       id,
+			To:       "user@simpleauth.link",
+			Subject:  "subject",
+			Body:     "body",
+			Error:    "failed",
+			FailedAt: now.Add(time.Duration(i) * time.Second),
+		}
+		if err := rd.SetDeadLetter(letter); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if letter, err := rd.DeadLetterById("a"); err != nil || letter.Body != "body" || letter.Error != "failed" {
+		t.Errorf("expected dead letter, got %v (%v)", letter, err)
+	}
+	// sorted by failure time
+	letters, err := rd.ListDeadLetters(2, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(letters) != 2 || letters[0].ID != "a" || letters[1].ID != "b" {
+		t.Errorf("expected [a b], got %v", letters)
+	}
+	if err := rd.DeleteDeadLetter("a"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := rd.DeadLetterById("a"); err != db.ErrDeadLetterNotFound {
+		t.Errorf("expected %v, got %v", db.ErrDeadLetterNotFound, err)
+	}
+}
+
+func TestPendingEmails(t *testing.T) {
+	rd, _ := newTestDriver(t)
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		email := &db.PendingEmail{
+			ID:       id,
+			To:       "user@simpleauth.link",
+			Subject:  "subject",
+			Body:     "body",
+			QueuedAt: now.Add(time.Duration(i) * time.Second),
+		}
+		if err := rd.EnqueueEmail(email); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if err := rd.DequeueEmail("a"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// sorted by queue time
+	emails, err := rd.PendingEmails()
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(emails) != 2 || emails[0].ID != "c" || emails[1].ID != "b" || emails[0].Body != "body" {
+		t.Errorf("expected [c b], got %v", emails)
+	}
+}
@@ -0,0 +1,406 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/simpleauthlink/authapi/db"
+)
+
+// Token fields stored in the hash of every token.
+const (
+	expirationField     = "expiration"
+	issuedAtField       = "issued_at"
+	scopesField         = "scopes"
+	codeField           = "code"
+	codeExpirationField = "code_expiration"
+)
+
+// Tombstone fields stored in the hash of every soft deleted token.
+const (
+	reasonField    = "reason"
+	deletedAtField = "deleted_at"
+)
+
+// softDeleteTokenScript deletes the hash of a token and stores its tombstone
+// with the provided reason and deletion time, only if the token exists,
+// atomically, to not record tombstones of tokens that were never stored.
+var softDeleteTokenScript = redis.NewScript(`
+if redis.call("DEL", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[2], "` + reasonField + `", ARGV[1], "` + deletedAtField + `", ARGV[2])
+return 1
+`)
+
+// setTokenCodeScript sets or, if the provided code is empty, deletes the code
+// fields of the hash of a token, only if the token exists, atomically, to not
+// create a hash without expiration for a token deleted meanwhile. It returns
+// 0 if the token does not exist.
+var setTokenCodeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[1] == "" then
+	redis.call("HDEL", KEYS[1], "` + codeField + `", "` + codeExpirationField + `")
+else
+	redis.call("HSET", KEYS[1], "` + codeField + `", ARGV[1], "` + codeExpirationField + `", ARGV[2])
+end
+return 1
+`)
+
+func (rd *RedisDriver) TokenExpiration(token db.Token) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	value, err := rd.client.HGet(ctx, tokenKeyPrefix+string(token), expirationField).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return time.Time{}, db.ErrTokenNotFound
+		}
+		return time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	expiration, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	return time.Unix(0, expiration), nil
+}
+
+func (rd *RedisDriver) TokenExists(token db.Token) (bool, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	count, err := rd.client.Exists(ctx, tokenKeyPrefix+string(token)).Result()
+	if err != nil {
+		return false, errors.Join(db.ErrGetToken, err)
+	}
+	return count > 0, nil
+}
+
+func (rd *RedisDriver) TokenScopes(token db.Token) ([]string, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	fields, err := rd.client.HGetAll(ctx, tokenKeyPrefix+string(token)).Result()
+	if err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	if len(fields) == 0 {
+		return nil, db.ErrTokenNotFound
+	}
+	value, ok := fields[scopesField]
+	if !ok {
+		return nil, nil
+	}
+	var scopes []string
+	if err := json.Unmarshal([]byte(value), &scopes); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	return scopes, nil
+}
+
+func (rd *RedisDriver) SetToken(token db.Token, expiration time.Time, scopes []string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	fields := map[string]any{
+		expirationField: expiration.UnixNano(),
+		issuedAtField:   time.Now().UnixNano(),
+	}
+	if len(scopes) > 0 {
+		encScopes, err := json.Marshal(scopes)
+		if err != nil {
+			return errors.Join(db.ErrSetToken, err)
+		}
+		fields[scopesField] = string(encScopes)
+	}
+	// replace the token and let redis remove it when the grace period after
+	// its expiration is over
+	key := tokenKeyPrefix + string(token)
+	if _, err := rd.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields)
+		pipe.PExpireAt(ctx, key, expiration.Add(rd.config.TokensGracePeriod))
+		return nil
+	}); err != nil {
+		return errors.Join(db.ErrSetToken, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) DeleteToken(token db.Token) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	if err := rd.client.Del(ctx, tokenKeyPrefix+string(token)).Err(); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) SoftDeleteToken(token db.Token, reason string) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	keys := []string{tokenKeyPrefix + string(token), tombstoneKeyPrefix + string(token)}
+	if err := softDeleteTokenScript.Run(ctx, rd.client, keys, reason, time.Now().UnixNano()).Err(); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) TombstonesByPrefix(prefix string) ([]db.Tombstone, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get the tombstones with the prefix and sort them, because SCAN does not
+	// guarantee any order
+	tokens := []string{}
+	pattern := tombstoneKeyPrefix + escapePattern(prefix) + "*"
+	if err := rd.scanKeys(ctx, pattern, func(keys []string) error {
+		for _, key := range keys {
+			tokens = append(tokens, strings.TrimPrefix(key, tombstoneKeyPrefix))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	sort.Strings(tokens)
+	// get the fields of the tombstones in a single round trip
+	cmds := make([]*redis.MapStringStringCmd, len(tokens))
+	if _, err := rd.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, token := range tokens {
+			cmds[i] = pipe.HGetAll(ctx, tombstoneKeyPrefix+token)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	result := make([]db.Tombstone, 0, len(tokens))
+	for i, cmd := range cmds {
+		// skip the tombstones purged while listing
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		deletedAt, err := strconv.ParseInt(fields[deletedAtField], 10, 64)
+		if err != nil {
+			return nil, errors.Join(db.ErrGetToken, err)
+		}
+		result = append(result, db.Tombstone{
+			Token:     db.Token(tokens[i]),
+			Reason:    fields[reasonField],
+			DeletedAt: time.Unix(0, deletedAt),
+		})
+	}
+	return result, nil
+}
+
+func (rd *RedisDriver) PurgeTombstones(retention time.Duration) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	limit := time.Now().Add(-retention).UnixNano()
+	// get the deletion times of every batch of tombstones in a single round
+	// trip and delete the old ones
+	if err := rd.scanKeys(ctx, tombstoneKeyPrefix+"*", func(keys []string) error {
+		cmds := make([]*redis.StringCmd, len(keys))
+		if _, err := rd.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				cmds[i] = pipe.HGet(ctx, key, deletedAtField)
+			}
+			return nil
+		}); err != nil && err != redis.Nil {
+			return err
+		}
+		expired := []string{}
+		for i, cmd := range cmds {
+			value, err := cmd.Result()
+			if err == redis.Nil {
+				continue
+			}
+			deletedAt, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			if deletedAt < limit {
+				expired = append(expired, keys[i])
+			}
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		return rd.client.Del(ctx, expired...).Err()
+	}); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+func (rd *RedisDriver) DeleteTokensByPrefix(prefix string) error {
+	// check if the prefix is empty and return nil if it is
+	if prefix == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	pattern := tokenKeyPrefix + escapePattern(prefix) + "*"
+	if err := rd.scanKeys(ctx, pattern, func(keys []string) error {
+		return rd.client.Del(ctx, keys...).Err()
+	}); err != nil {
+		return errors.Join(db.ErrDelToken, err)
+	}
+	return nil
+}
+
+// DeleteExpiredTokens method does nothing because the tokens are stored with
+// their expiration as native TTL, so redis removes them when they expire. The
+// provided grace period is ignored, the TokensGracePeriod of the config is
+// added to the TTL of the tokens instead.
+func (rd *RedisDriver) DeleteExpiredTokens(_ time.Duration) error {
+	return nil
+}
+
+func (rd *RedisDriver) CountTokens(prefix string) (int64, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	var count int64
+	pattern := tokenKeyPrefix + escapePattern(prefix) + "*"
+	if err := rd.scanKeys(ctx, pattern, func(keys []string) error {
+		count += int64(len(keys))
+		return nil
+	}); err != nil {
+		return 0, errors.Join(db.ErrGetToken, err)
+	}
+	return count, nil
+}
+
+func (rd *RedisDriver) CountTokensIssuedSince(since time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get the issue times of every batch of tokens in a single round trip
+	var count int64
+	if err := rd.scanKeys(ctx, tokenKeyPrefix+"*", func(keys []string) error {
+		cmds := make([]*redis.StringCmd, len(keys))
+		if _, err := rd.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				cmds[i] = pipe.HGet(ctx, key, issuedAtField)
+			}
+			return nil
+		}); err != nil && err != redis.Nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			// skip the tokens removed while counting and the ones stored
+			// without issue time
+			value, err := cmd.Result()
+			if err == redis.Nil {
+				continue
+			}
+			issuedAt, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			if issuedAt >= since.UnixNano() {
+				count++
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, errors.Join(db.ErrGetToken, err)
+	}
+	return count, nil
+}
+
+func (rd *RedisDriver) TokensByPrefix(prefix string) ([]db.TokenInfo, error) {
+	return rd.ListTokensByPrefix(prefix, 0, 0)
+}
+
+func (rd *RedisDriver) ListTokensByPrefix(prefix string, limit, offset int) ([]db.TokenInfo, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	// get the tokens with the prefix and sort them, because SCAN does not
+	// guarantee any order
+	tokens := []string{}
+	pattern := tokenKeyPrefix + escapePattern(prefix) + "*"
+	if err := rd.scanKeys(ctx, pattern, func(keys []string) error {
+		for _, key := range keys {
+			tokens = append(tokens, strings.TrimPrefix(key, tokenKeyPrefix))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	sort.Strings(tokens)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(tokens) {
+		return []db.TokenInfo{}, nil
+	}
+	tokens = tokens[offset:]
+	if limit > 0 && limit < len(tokens) {
+		tokens = tokens[:limit]
+	}
+	// get the expirations of the tokens of the page in a single round trip
+	cmds := make([]*redis.StringCmd, len(tokens))
+	if _, err := rd.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, token := range tokens {
+			cmds[i] = pipe.HGet(ctx, tokenKeyPrefix+token, expirationField)
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, errors.Join(db.ErrGetToken, err)
+	}
+	result := make([]db.TokenInfo, 0, len(tokens))
+	for i, cmd := range cmds {
+		// skip the tokens deleted or expired while listing
+		value, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		expiration, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Join(db.ErrGetToken, err)
+		}
+		result = append(result, db.TokenInfo{
+			Token:      db.Token(tokens[i]),
+			Expiration: time.Unix(0, expiration),
+		})
+	}
+	return result, nil
+}
+
+func (rd *RedisDriver) SetTokenCode(token db.Token, code string, expiration time.Time) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	keys := []string{tokenKeyPrefix + string(token)}
+	updated, err := setTokenCodeScript.Run(ctx, rd.client, keys, code, expiration.UnixNano()).Int64()
+	if err != nil {
+		return errors.Join(db.ErrSetToken, err)
+	}
+	if updated == 0 {
+		return db.ErrTokenNotFound
+	}
+	return nil
+}
+
+func (rd *RedisDriver) TokenCode(token db.Token) (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, 5*time.Second)
+	defer cancel()
+	fields, err := rd.client.HGetAll(ctx, tokenKeyPrefix+string(token)).Result()
+	if err != nil {
+		return "", time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	if len(fields) == 0 {
+		return "", time.Time{}, db.ErrTokenNotFound
+	}
+	code, ok := fields[codeField]
+	if !ok {
+		return "", time.Time{}, nil
+	}
+	expiration, err := strconv.ParseInt(fields[codeExpirationField], 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.Join(db.ErrGetToken, err)
+	}
+	return code, time.Unix(0, expiration), nil
+}
@@ -1,22 +1,48 @@
 package db
 
 import (
+	"context"
+	"maps"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+type tempToken struct {
+	expiration     time.Time
+	issuedAt       time.Time
+	scopes         []string
+	code           string
+	codeExpiration time.Time
+}
+
+type tempAttempts struct {
+	count      int64
+	expiration int64
+}
+
 type TempDriver struct {
 	apps        map[string]App
 	secretToApp map[string]string
-	tokens      map[Token]int64
+	secretExp   map[string]time.Time
+	tokens      map[Token]tempToken
+	tombstones  map[Token]Tombstone
+	attempts    map[string]tempAttempts
+	deadLetters map[string]DeadLetter
+	pending     map[string]PendingEmail
 	lock        sync.RWMutex
 }
 
 func (tdb *TempDriver) Init(_ any) error {
 	tdb.apps = make(map[string]App)
 	tdb.secretToApp = make(map[string]string)
-	tdb.tokens = make(map[Token]int64)
+	tdb.secretExp = make(map[string]time.Time)
+	tdb.tokens = make(map[Token]tempToken)
+	tdb.tombstones = make(map[Token]Tombstone)
+	tdb.attempts = make(map[string]tempAttempts)
+	tdb.deadLetters = make(map[string]DeadLetter)
+	tdb.pending = make(map[string]PendingEmail)
 	return nil
 }
 
@@ -24,6 +50,10 @@ func (tdb *TempDriver) Close() error {
 	return nil
 }
 
+func (tdb *TempDriver) Ping(_ context.Context) error {
+	return nil
+}
+
 func (tdb *TempDriver) AppById(appId string) (*App, error) {
 	tdb.lock.RLock()
 	defer tdb.lock.RUnlock()
@@ -31,13 +61,14 @@ func (tdb *TempDriver) AppById(appId string) (*App, error) {
 	if !ok {
 		return nil, ErrAppNotFound
 	}
+	app.Features = maps.Clone(app.Features)
 	return &app, nil
 }
 
 func (tdb *TempDriver) AppBySecret(secret string) (*App, string, error) {
 	tdb.lock.RLock()
 	defer tdb.lock.RUnlock()
-	appId, ok := tdb.secretToApp[secret]
+	appId, ok := tdb.activeSecret(secret)
 	if !ok {
 		return nil, "", ErrAppNotFound
 	}
@@ -45,13 +76,49 @@ func (tdb *TempDriver) AppBySecret(secret string) (*App, string, error) {
 	if !ok {
 		return nil, "", ErrAppNotFound
 	}
+	app.Features = maps.Clone(app.Features)
 	return &app, appId, nil
 }
 
+func (tdb *TempDriver) ListApps(limit, offset int) ([]*App, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	appIds := make([]string, 0, len(tdb.apps))
+	for appId := range tdb.apps {
+		appIds = append(appIds, appId)
+	}
+	sort.Strings(appIds)
+	apps := []*App{}
+	if offset < 0 {
+		offset = 0
+	}
+	for i := offset; i < len(appIds); i++ {
+		if limit > 0 && len(apps) == limit {
+			break
+		}
+		app := tdb.apps[appIds[i]]
+		app.Features = maps.Clone(app.Features)
+		apps = append(apps, &app)
+	}
+	return apps, nil
+}
+
+func (tdb *TempDriver) CountApps() (int64, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	return int64(len(tdb.apps)), nil
+}
+
 func (tdb *TempDriver) SetApp(appId string, app *App) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
-	tdb.apps[appId] = *app
+	storedApp := *app
+	storedApp.ID = appId
+	storedApp.Features = maps.Clone(app.Features)
+	storedApp.AllowedOrigins = append([]string(nil), app.AllowedOrigins...)
+	storedApp.AllowedRedirectDomains = append([]string(nil), app.AllowedRedirectDomains...)
+	storedApp.Channels = append([]Channel(nil), app.Channels...)
+	tdb.apps[appId] = storedApp
 	return nil
 }
 
@@ -59,47 +126,112 @@ func (tdb *TempDriver) DeleteApp(appId string) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
 	delete(tdb.apps, appId)
+	// delete the secrets of the app from the secret index, else they would
+	// be orphaned and resolve to the app if it is created again
+	for secret, secretAppId := range tdb.secretToApp {
+		if secretAppId == appId {
+			delete(tdb.secretToApp, secret)
+			delete(tdb.secretExp, secret)
+		}
+	}
 	return nil
 }
 
-func (tdb *TempDriver) ValidSecret(secret, appId string) (bool, error) {
-	tdb.lock.RLock()
-	defer tdb.lock.RUnlock()
-	appIdFromSecret, ok := tdb.secretToApp[secret]
-	if !ok {
-		return false, nil
+func (tdb *TempDriver) SetSecret(secret, appId string, expiration time.Time) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	tdb.secretToApp[secret] = appId
+	if expiration.IsZero() {
+		delete(tdb.secretExp, secret)
+	} else {
+		tdb.secretExp[secret] = expiration
 	}
-	return appIdFromSecret == appId, nil
+	return nil
 }
 
-func (tdb *TempDriver) SetSecret(secret, appId string) error {
+func (tdb *TempDriver) ExpireSecrets(appId, keepSecret string, expiration time.Time) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
-	tdb.secretToApp[secret] = appId
+	for secret, secretAppId := range tdb.secretToApp {
+		if secretAppId != appId || secret == keepSecret {
+			continue
+		}
+		if current, ok := tdb.secretExp[secret]; !ok || current.After(expiration) {
+			tdb.secretExp[secret] = expiration
+		}
+	}
 	return nil
 }
 
+func (tdb *TempDriver) ExpireSecret(secret, appId string, expiration time.Time) (time.Time, error) {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	if secretAppId, ok := tdb.secretToApp[secret]; !ok || secretAppId != appId {
+		return time.Time{}, ErrAppNotFound
+	}
+	if current, ok := tdb.secretExp[secret]; ok && !current.After(expiration) {
+		return current, nil
+	}
+	tdb.secretExp[secret] = expiration
+	return expiration, nil
+}
+
 func (tdb *TempDriver) DeleteSecret(secret string) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
 	delete(tdb.secretToApp, secret)
+	delete(tdb.secretExp, secret)
 	return nil
 }
 
+// activeSecret method returns the id of the app of the provided secret, if it
+// is stored and it is not expired. The lock must be held by the caller.
+func (tdb *TempDriver) activeSecret(secret string) (string, bool) {
+	appId, ok := tdb.secretToApp[secret]
+	if !ok {
+		return "", false
+	}
+	if expiration, ok := tdb.secretExp[secret]; ok && !time.Now().Before(expiration) {
+		return "", false
+	}
+	return appId, true
+}
+
 func (tdb *TempDriver) TokenExpiration(token Token) (time.Time, error) {
 	tdb.lock.RLock()
 	defer tdb.lock.RUnlock()
-	exp, ok := tdb.tokens[token]
+	t, ok := tdb.tokens[token]
 	if !ok {
 		return time.Time{}, ErrTokenNotFound
 	}
-	return time.Unix(0, exp), nil
+	return t.expiration, nil
+}
+
+func (tdb *TempDriver) TokenExists(token Token) (bool, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	_, ok := tdb.tokens[token]
+	return ok, nil
 }
 
-func (tdb *TempDriver) SetToken(token Token, expiration time.Time) error {
+func (tdb *TempDriver) TokenScopes(token Token) ([]string, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	t, ok := tdb.tokens[token]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return append([]string{}, t.scopes...), nil
+}
+
+func (tdb *TempDriver) SetToken(token Token, expiration time.Time, scopes []string) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
-	tdb.tokens[token] = expiration.UnixNano()
+	tdb.tokens[token] = tempToken{
+		expiration: expiration,
+		issuedAt:   time.Now(),
+		scopes:     append([]string{}, scopes...),
+	}
 	return nil
 }
 
@@ -110,6 +242,44 @@ func (tdb *TempDriver) DeleteToken(token Token) error {
 	return nil
 }
 
+func (tdb *TempDriver) SoftDeleteToken(token Token, reason string) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	if _, ok := tdb.tokens[token]; !ok {
+		return nil
+	}
+	delete(tdb.tokens, token)
+	tdb.tombstones[token] = Tombstone{Token: token, Reason: reason, DeletedAt: time.Now()}
+	return nil
+}
+
+func (tdb *TempDriver) TombstonesByPrefix(prefix string) ([]Tombstone, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	tombstones := []Tombstone{}
+	for token, tombstone := range tdb.tombstones {
+		if strings.HasPrefix(string(token), prefix) {
+			tombstones = append(tombstones, tombstone)
+		}
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		return tombstones[i].Token < tombstones[j].Token
+	})
+	return tombstones, nil
+}
+
+func (tdb *TempDriver) PurgeTombstones(retention time.Duration) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	limit := time.Now().Add(-retention)
+	for token, tombstone := range tdb.tombstones {
+		if limit.After(tombstone.DeletedAt) {
+			delete(tdb.tombstones, token)
+		}
+	}
+	return nil
+}
+
 func (tdb *TempDriver) DeleteTokensByPrefix(prefix string) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
@@ -124,12 +294,12 @@ func (tdb *TempDriver) DeleteTokensByPrefix(prefix string) error {
 	return nil
 }
 
-func (tdb *TempDriver) DeleteExpiredTokens() error {
+func (tdb *TempDriver) DeleteExpiredTokens(gracePeriod time.Duration) error {
 	tdb.lock.Lock()
 	defer tdb.lock.Unlock()
-	now := time.Now().UnixNano()
-	for token, expiration := range tdb.tokens {
-		if now > expiration {
+	limit := time.Now().Add(-gracePeriod)
+	for token, t := range tdb.tokens {
+		if limit.After(t.expiration) {
 			delete(tdb.tokens, token)
 		}
 	}
@@ -150,3 +320,181 @@ func (tdb *TempDriver) CountTokens(prefix string) (int64, error) {
 	}
 	return count, nil
 }
+
+func (tdb *TempDriver) CountTokensIssuedSince(since time.Time) (int64, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	var count int64
+	for _, t := range tdb.tokens {
+		if !t.issuedAt.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (tdb *TempDriver) TokensByPrefix(prefix string) ([]TokenInfo, error) {
+	return tdb.ListTokensByPrefix(prefix, 0, 0)
+}
+
+func (tdb *TempDriver) ListTokensByPrefix(prefix string, limit, offset int) ([]TokenInfo, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	tokens := []TokenInfo{}
+	for token, t := range tdb.tokens {
+		if strings.HasPrefix(string(token), prefix) {
+			tokens = append(tokens, TokenInfo{Token: token, Expiration: t.expiration})
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Token < tokens[j].Token
+	})
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(tokens) {
+		return []TokenInfo{}, nil
+	}
+	tokens = tokens[offset:]
+	if limit > 0 && limit < len(tokens) {
+		tokens = tokens[:limit]
+	}
+	return tokens, nil
+}
+
+func (tdb *TempDriver) SetTokenCode(token Token, code string, expiration time.Time) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	t, ok := tdb.tokens[token]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	t.code, t.codeExpiration = code, expiration
+	if code == "" {
+		t.codeExpiration = time.Time{}
+	}
+	tdb.tokens[token] = t
+	return nil
+}
+
+func (tdb *TempDriver) TokenCode(token Token) (string, time.Time, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	t, ok := tdb.tokens[token]
+	if !ok {
+		return "", time.Time{}, ErrTokenNotFound
+	}
+	return t.code, t.codeExpiration, nil
+}
+
+func (tdb *TempDriver) IncrAttempts(key string, ttl time.Duration) (int64, error) {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	now := time.Now()
+	attempts, ok := tdb.attempts[key]
+	if !ok || now.UnixNano() > attempts.expiration {
+		attempts = tempAttempts{expiration: now.Add(ttl).UnixNano()}
+	}
+	attempts.count++
+	tdb.attempts[key] = attempts
+	return attempts.count, nil
+}
+
+func (tdb *TempDriver) Attempts(key string) (int64, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	attempts, ok := tdb.attempts[key]
+	if !ok || time.Now().UnixNano() > attempts.expiration {
+		return 0, nil
+	}
+	return attempts.count, nil
+}
+
+func (tdb *TempDriver) ResetAttempts(key string) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	delete(tdb.attempts, key)
+	return nil
+}
+
+func (tdb *TempDriver) SetDeadLetter(letter *DeadLetter) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	tdb.deadLetters[letter.ID] = *letter
+	return nil
+}
+
+func (tdb *TempDriver) DeadLetterById(id string) (*DeadLetter, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	letter, ok := tdb.deadLetters[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return &letter, nil
+}
+
+func (tdb *TempDriver) ListDeadLetters(limit, offset int) ([]*DeadLetter, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	letters := make([]*DeadLetter, 0, len(tdb.deadLetters))
+	for _, letter := range tdb.deadLetters {
+		letter := letter
+		letters = append(letters, &letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if !letters[i].FailedAt.Equal(letters[j].FailedAt) {
+			return letters[i].FailedAt.Before(letters[j].FailedAt)
+		}
+		return letters[i].ID < letters[j].ID
+	})
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(letters) {
+		return []*DeadLetter{}, nil
+	}
+	letters = letters[offset:]
+	if limit > 0 && limit < len(letters) {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (tdb *TempDriver) DeleteDeadLetter(id string) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	delete(tdb.deadLetters, id)
+	return nil
+}
+
+func (tdb *TempDriver) EnqueueEmail(email *PendingEmail) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	tdb.pending[email.ID] = *email
+	return nil
+}
+
+func (tdb *TempDriver) DequeueEmail(id string) error {
+	tdb.lock.Lock()
+	defer tdb.lock.Unlock()
+	delete(tdb.pending, id)
+	return nil
+}
+
+func (tdb *TempDriver) PendingEmails() ([]*PendingEmail, error) {
+	tdb.lock.RLock()
+	defer tdb.lock.RUnlock()
+	emails := make([]*PendingEmail, 0, len(tdb.pending))
+	for _, email := range tdb.pending {
+		email := email
+		emails = append(emails, &email)
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].QueuedAt.Equal(emails[j].QueuedAt) {
+			return emails[i].QueuedAt.Before(emails[j].QueuedAt)
+		}
+		return emails[i].ID < emails[j].ID
+	})
+	return emails, nil
+}
@@ -0,0 +1,525 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTempDriverAttempts(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// increment
+	for i := int64(1); i <= 3; i++ {
+		count, err := tdb.IncrAttempts("key", time.Minute)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if count != i {
+			t.Errorf("expected %d, got %d", i, count)
+		}
+	}
+	if count, _ := tdb.Attempts("key"); count != 3 {
+		t.Errorf("expected 3, got %d", count)
+	}
+	if count, _ := tdb.Attempts("other"); count != 0 {
+		t.Errorf("expected 0, got %d", count)
+	}
+	// reset
+	if err := tdb.ResetAttempts("key"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, _ := tdb.Attempts("key"); count != 0 {
+		t.Errorf("expected 0 after reset, got %d", count)
+	}
+	// ttl expiry
+	if _, err := tdb.IncrAttempts("ttl", 10*time.Millisecond); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if count, _ := tdb.Attempts("ttl"); count != 0 {
+		t.Errorf("expected 0 after expiry, got %d", count)
+	}
+	if count, _ := tdb.IncrAttempts("ttl", time.Minute); count != 1 {
+		t.Errorf("expected counter restarted, got %d", count)
+	}
+}
+
+func TestTempDriverListApps(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, appId := range []string{"app3", "app1", "app2"} {
+		if err := tdb.SetApp(appId, &App{Name: appId}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	tests := []struct {
+		limit, offset int
+		expected      []string
+	}{
+		{0, 0, []string{"app1", "app2", "app3"}},
+		{2, 0, []string{"app1", "app2"}},
+		{2, 2, []string{"app3"}},
+		{2, 3, []string{}},
+	}
+	for _, tc := range tests {
+		apps, err := tdb.ListApps(tc.limit, tc.offset)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if len(apps) != len(tc.expected) {
+			t.Errorf("expected %d apps, got %d", len(tc.expected), len(apps))
+			continue
+		}
+		for i, app := range apps {
+			if app.ID != tc.expected[i] || app.Name != tc.expected[i] {
+				t.Errorf("expected %s, got %+v", tc.expected[i], app)
+			}
+		}
+	}
+	if count, _ := tdb.CountApps(); count != 3 {
+		t.Errorf("expected 3 apps, got %d", count)
+	}
+}
+
+// validSecret function checks if the provided secret is one of the active
+// secrets of the app with the provided id, resolving it with AppBySecret.
+func validSecret(d DB, secret, appId string) (bool, error) {
+	_, secretAppId, err := d.AppBySecret(secret)
+	if err == ErrAppNotFound {
+		return false, nil
+	}
+	return err == nil && secretAppId == appId, err
+}
+
+func TestTempDriverAppBySecret(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, appId := range []string{"app1", "app2"} {
+		if err := tdb.SetApp(appId, &App{Name: appId}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if err := tdb.SetSecret("secret-"+appId, appId, time.Time{}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	tests := []struct {
+		secret, appId string
+		expected      bool
+	}{
+		{"secret-app1", "app1", true},
+		{"secret-app2", "app2", true},
+		{"secret-app2", "app1", false},
+		{"secret-app", "app1", false},
+		{"secret-app11", "app1", false},
+		{"", "app1", false},
+		{"secret-app1", "unknown", false},
+	}
+	for _, tc := range tests {
+		if valid, err := validSecret(tdb, tc.secret, tc.appId); err != nil || valid != tc.expected {
+			t.Errorf("%s (%s): expected %t, got %t (%v)", tc.secret, tc.appId, tc.expected, valid, err)
+		}
+	}
+	if !EqualSecrets("secret", "secret") || EqualSecrets("secret", "Secret") || EqualSecrets("secret", "secret2") {
+		t.Errorf("unexpected secrets comparison")
+	}
+}
+
+func TestTempDriverSecretRotation(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.SetApp("appId", &App{Name: "app"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the app has two valid secrets, the previous one until it expires
+	if err := tdb.SetSecret("current", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.SetSecret("previous", "appId", time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, secret := range []string{"current", "previous"} {
+		if valid, err := validSecret(tdb, secret, "appId"); err != nil || !valid {
+			t.Errorf("%s: expected valid secret, got %v (%v)", secret, valid, err)
+		}
+		if _, appId, err := tdb.AppBySecret(secret); err != nil || appId != "appId" {
+			t.Errorf("%s: expected appId, got %s (%v)", secret, appId, err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if valid, err := validSecret(tdb, "previous", "appId"); err != nil || valid {
+		t.Errorf("expected expired secret, got %v (%v)", valid, err)
+	}
+	if _, _, err := tdb.AppBySecret("previous"); err != ErrAppNotFound {
+		t.Errorf("expected %v, got %v", ErrAppNotFound, err)
+	}
+	// storing the secret again replaces its expiration
+	if err := tdb.SetSecret("previous", "appId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if valid, err := validSecret(tdb, "previous", "appId"); err != nil || !valid {
+		t.Errorf("expected valid secret, got %v (%v)", valid, err)
+	}
+	// expiring the secrets of the app keeps the provided one and the secrets
+	// of other apps
+	if err := tdb.SetApp("otherId", &App{Name: "other"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.SetSecret("other", "otherId", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.ExpireSecrets("appId", "current", time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if valid, err := validSecret(tdb, "previous", "appId"); err != nil || !valid {
+		t.Errorf("expected valid secret before its expiration, got %v (%v)", valid, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	for secret, expected := range map[string]bool{"current": true, "previous": false} {
+		if valid, err := validSecret(tdb, secret, "appId"); err != nil || valid != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", secret, expected, valid, err)
+		}
+	}
+	if valid, err := validSecret(tdb, "other", "otherId"); err != nil || !valid {
+		t.Errorf("expected valid secret of other app, got %v (%v)", valid, err)
+	}
+	// expiring a secret does not extend its expiration
+	deadline := time.Now().Add(time.Hour)
+	if expiration, err := tdb.ExpireSecret("current", "appId", deadline); err != nil || !expiration.Equal(deadline) {
+		t.Errorf("expected %s, got %s (%v)", deadline, expiration, err)
+	}
+	if expiration, err := tdb.ExpireSecret("current", "appId", deadline.Add(time.Hour)); err != nil || !expiration.Equal(deadline) {
+		t.Errorf("expected %s, got %s (%v)", deadline, expiration, err)
+	}
+	if _, err := tdb.ExpireSecret("other", "appId", deadline); err != ErrAppNotFound {
+		t.Errorf("expected %v, got %v", ErrAppNotFound, err)
+	}
+}
+
+func TestTempDriverDeleteAppSecret(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, appId := range []string{"app1", "app2"} {
+		if err := tdb.SetApp(appId, &App{Name: appId}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if err := tdb.SetSecret("secret-"+appId, appId, time.Time{}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if err := tdb.DeleteApp("app1"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the secret of the deleted app is removed from the index
+	if _, ok := tdb.secretToApp["secret-app1"]; ok {
+		t.Error("expected the secret of the deleted app to be removed")
+	}
+	// the secret does not resolve to the app if it is created again
+	if err := tdb.SetApp("app1", &App{Name: "app1"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, _, err := tdb.AppBySecret("secret-app1"); err != ErrAppNotFound {
+		t.Errorf("expected %v, got %v", ErrAppNotFound, err)
+	}
+	// the secrets of the other apps are kept
+	if _, appId, err := tdb.AppBySecret("secret-app2"); err != nil || appId != "app2" {
+		t.Errorf("expected app2, got %s (%v)", appId, err)
+	}
+}
+
+func TestTempDriverTokenExists(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.SetToken("app1-user1-a", time.Now().Add(time.Minute), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if exists, err := tdb.TokenExists("app1-user1-a"); err != nil || !exists {
+		t.Errorf("expected existing token, got %v (%v)", exists, err)
+	}
+	if exists, err := tdb.TokenExists("unknown"); err != nil || exists {
+		t.Errorf("expected missing token, got %v (%v)", exists, err)
+	}
+}
+
+func TestTempDriverTokenCode(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.SetTokenCode("unknown", "code", time.Now()); err != ErrTokenNotFound {
+		t.Errorf("expected %v, got %v", ErrTokenNotFound, err)
+	}
+	if err := tdb.SetToken("app1-user1-a", time.Now().Add(time.Minute), nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if code, _, err := tdb.TokenCode("app1-user1-a"); err != nil || code != "" {
+		t.Errorf("expected no code, got %q (%v)", code, err)
+	}
+	expiration := time.Now().Add(time.Minute)
+	if err := tdb.SetTokenCode("app1-user1-a", "hashed", expiration); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if code, exp, err := tdb.TokenCode("app1-user1-a"); err != nil || code != "hashed" || !exp.Equal(expiration) {
+		t.Errorf("expected hashed code, got %q %v (%v)", code, exp, err)
+	}
+	// an empty code deletes it
+	if err := tdb.SetTokenCode("app1-user1-a", "", time.Time{}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if code, _, err := tdb.TokenCode("app1-user1-a"); err != nil || code != "" {
+		t.Errorf("expected no code, got %q (%v)", code, err)
+	}
+}
+
+func TestTempDriverTokensByPrefix(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expiration := time.Now().Add(time.Minute)
+	for _, token := range []Token{"app1-user2-b", "app1-user1-a", "app2-user1-c"} {
+		if err := tdb.SetToken(token, expiration, nil); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	tokens, err := tdb.TokensByPrefix("app1-")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(tokens) != 2 || tokens[0].Token != "app1-user1-a" || tokens[1].Token != "app1-user2-b" {
+		t.Errorf("expected app1 tokens sorted, got %v", tokens)
+	} else if !tokens[0].Expiration.Equal(expiration) {
+		t.Errorf("expected %v, got %v", expiration, tokens[0].Expiration)
+	}
+	if tokens, err := tdb.TokensByPrefix("app3-"); err != nil || len(tokens) != 0 {
+		t.Errorf("expected no tokens, got %v (%v)", tokens, err)
+	}
+	// paginated
+	tests := []struct {
+		limit, offset int
+		expected      []Token
+	}{
+		{1, 0, []Token{"app1-user1-a"}},
+		{1, 1, []Token{"app1-user2-b"}},
+		{5, 1, []Token{"app1-user2-b"}},
+		{0, 0, []Token{"app1-user1-a", "app1-user2-b"}},
+		{1, 2, []Token{}},
+	}
+	for _, tc := range tests {
+		tokens, err := tdb.ListTokensByPrefix("app1-", tc.limit, tc.offset)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if len(tokens) != len(tc.expected) {
+			t.Errorf("limit %d offset %d: expected %v, got %v", tc.limit, tc.offset, tc.expected, tokens)
+			continue
+		}
+		for i, token := range tokens {
+			if token.Token != tc.expected[i] {
+				t.Errorf("limit %d offset %d: expected %v, got %v", tc.limit, tc.offset, tc.expected, tokens)
+				break
+			}
+		}
+	}
+}
+
+func TestTempDriverDeleteExpiredTokens(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	now := time.Now()
+	for token, expiration := range map[Token]time.Time{
+		"app1-user1-a": now.Add(time.Minute),
+		"app1-user2-b": now.Add(-time.Minute),
+		"app1-user3-c": now.Add(-time.Hour),
+	} {
+		if err := tdb.SetToken(token, expiration, nil); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	// the tokens expired during the grace period survive the cleanup
+	if err := tdb.DeleteExpiredTokens(10 * time.Minute); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for token, exists := range map[Token]bool{"app1-user1-a": true, "app1-user2-b": true, "app1-user3-c": false} {
+		if got, _ := tdb.TokenExists(token); got != exists {
+			t.Errorf("%s: expected %v, got %v", token, exists, got)
+		}
+	}
+	// without grace period every expired token is deleted
+	if err := tdb.DeleteExpiredTokens(0); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, _ := tdb.CountTokens(""); count != 1 {
+		t.Errorf("expected 1 token, got %d", count)
+	}
+}
+
+func TestTempDriverSoftDeleteToken(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, token := range []Token{"app1-user1-a", "app1-user2-b", "app2-user1-c"} {
+		if err := tdb.SetToken(token, time.Now().Add(time.Hour), nil); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if err := tdb.SoftDeleteToken("app1-user1-a", DeleteReasonRevoked); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := tdb.SoftDeleteToken("app2-user1-c", DeleteReasonExpired); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the missing tokens are not recorded
+	if err := tdb.SoftDeleteToken("app1-user3-d", DeleteReasonRevoked); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the soft deleted tokens are not valid anymore
+	if _, err := tdb.TokenExpiration("app1-user1-a"); err != ErrTokenNotFound {
+		t.Errorf("expected %v, got %v", ErrTokenNotFound, err)
+	}
+	if exists, _ := tdb.TokenExists("app1-user2-b"); !exists {
+		t.Errorf("expected token to exist")
+	}
+	// but their tombstones are visible until they are purged
+	tombstones, err := tdb.TombstonesByPrefix("app1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(tombstones) != 1 || tombstones[0].Token != "app1-user1-a" || tombstones[0].Reason != DeleteReasonRevoked ||
+		time.Since(tombstones[0].DeletedAt) > time.Minute {
+		t.Errorf("unexpected tombstones: %+v", tombstones)
+	}
+	if err := tdb.PurgeTombstones(time.Hour); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tombstones, _ := tdb.TombstonesByPrefix(""); len(tombstones) != 2 {
+		t.Errorf("expected 2 tombstones, got %d", len(tombstones))
+	}
+	if err := tdb.PurgeTombstones(0); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tombstones, _ := tdb.TombstonesByPrefix(""); len(tombstones) != 0 {
+		t.Errorf("expected no tombstones, got %+v", tombstones)
+	}
+}
+
+func TestTempDriverCountTokens(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if count, err := tdb.CountTokens(""); err != nil || count != 0 {
+		t.Errorf("expected 0, got %d (%v)", count, err)
+	}
+	for _, token := range []Token{"app1-user1-a", "app1-user2-b", "app2-user1-c"} {
+		if err := tdb.SetToken(token, time.Now().Add(time.Minute), nil); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	for prefix, expected := range map[string]int64{"": 3, "app1": 2, "app2-user1": 1, "app3": 0} {
+		if count, err := tdb.CountTokens(prefix); err != nil || count != expected {
+			t.Errorf("%q: expected %d, got %d (%v)", prefix, expected, count, err)
+		}
+	}
+}
+
+func TestTempDriverCountTokensIssuedSince(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	start := time.Now()
+	expiration := start.Add(time.Hour)
+	for _, token := range []Token{"old", "new1", "new2"} {
+		if err := tdb.SetToken(token, expiration, nil); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	// the old token was issued two days ago
+	old := tdb.tokens["old"]
+	old.issuedAt = start.Add(-48 * time.Hour)
+	tdb.tokens["old"] = old
+	if count, _ := tdb.CountTokensIssuedSince(start.Add(-24 * time.Hour)); count != 2 {
+		t.Errorf("expected 2, got %d", count)
+	}
+	if count, _ := tdb.CountTokensIssuedSince(start.Add(-72 * time.Hour)); count != 3 {
+		t.Errorf("expected 3, got %d", count)
+	}
+	if count, _ := tdb.CountTokensIssuedSince(time.Now().Add(time.Minute)); count != 0 {
+		t.Errorf("expected 0, got %d", count)
+	}
+}
+
+func TestTempDriverDeadLetters(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	now := time.Now()
+	for i, id := range []string{"c", "a", "b"} {
+		letter := &DeadLetter{ID: id, To: "user@simpleauth.link", Error: "failed", FailedAt: now.Add(time.Duration(i) * time.Second)}
+		if err := tdb.SetDeadLetter(letter); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	if letter, err := tdb.DeadLetterById("a"); err != nil || letter.Error != "failed" {
+		t.Errorf("expected dead letter, got %v (%v)", letter, err)
+	}
+	// sorted by failure time
+	letters, err := tdb.ListDeadLetters(2, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(letters) != 2 || letters[0].ID != "a" || letters[1].ID != "b" {
+		t.Errorf("expected [a b], got %v", letters)
+	}
+	if err := tdb.DeleteDeadLetter("a"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if _, err := tdb.DeadLetterById("a"); err != ErrDeadLetterNotFound {
+		t.Errorf("expected %v, got %v", ErrDeadLetterNotFound, err)
+	}
+}
+
+func TestTempDriverAppFeatures(t *testing.T) {
+	tdb := new(TempDriver)
+	if err := tdb.Init(nil); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the features that are not set have their default value
+	app := &App{Name: "test app"}
+	if app.Enabled(FeatureLinkInResponse) {
+		t.Errorf("expected feature disabled by default")
+	}
+	app.SetFeature(FeatureLinkInResponse, true)
+	if err := tdb.SetApp("appId", app); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the stored features are not shared with the callers
+	app.SetFeature(FeatureLinkInResponse, false)
+	got, err := tdb.AppById("appId")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !got.Enabled(FeatureLinkInResponse) {
+		t.Errorf("expected feature enabled")
+	}
+	got.SetFeature(FeatureLinkInResponse, false)
+	if got, _ = tdb.AppById("appId"); !got.Enabled(FeatureLinkInResponse) {
+		t.Errorf("expected stored feature not modified")
+	}
+}
@@ -4,20 +4,25 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 )
 
-// domainRgx is the regular expression used to validate a domain.
-var domainRgx = regexp.MustCompile(`^([a-z0-9]+(-[a-z0-9]+)*\.)+[a-z]{2,}$`)
+// DefaultMaxDisposableDomains is the default maximum number of disposable
+// domains that are loaded from the remote source, to bound the memory used by
+// the list.
+const DefaultMaxDisposableDomains = 500000
 
 // LoadRemoteDisposableDomains loads a list of disposable domains from a remote
 // source url. It reads the content of the source url line by line and parses
-// each line as a domain. It returns a list of disposable domains or an error if
-// something fails.
-func LoadRemoteDisposableDomains(ctx context.Context, disposableSrc string) ([]string, error) {
+// each line as a domain, storing at most max domains. It returns a set of
+// disposable domains or an error if something fails or the source does not
+// respond with an OK status.
+func LoadRemoteDisposableDomains(ctx context.Context, disposableSrc string, max int) (map[string]struct{}, error) {
 	internalCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	// prepare the request
@@ -30,26 +35,52 @@ func LoadRemoteDisposableDomains(ctx context.Context, disposableSrc string) ([]s
 	if err != nil {
 		return nil, errors.Join(ErrLoadingDisposableDomains, err)
 	}
-	// read the response body line by line
 	defer resp.Body.Close()
-	scanner := bufio.NewScanner(resp.Body)
-	var domains []string
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: unexpected status code %d", ErrLoadingDisposableDomains, resp.StatusCode)
+	}
+	// parse the response body line by line
+	domains, truncated, err := ParseDisposableDomains(resp.Body, max)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		log.Printf("WRN: disposable domains list truncated to %d domains", len(domains))
+	}
+	return domains, nil
+}
+
+// ParseDisposableDomains reads the provided reader line by line and stores
+// every valid domain in a set. If max is greater than zero, it stops reading
+// after storing max domains and returns true as second value to indicate that
+// the list has been truncated. If max is zero or less, the default maximum is
+// used. It returns an error if something fails reading.
+func ParseDisposableDomains(r io.Reader, max int) (map[string]struct{}, bool, error) {
+	if max <= 0 {
+		max = DefaultMaxDisposableDomains
+	}
+	domains := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		domain := scanner.Text()
-		if domainRgx.MatchString(domain) {
-			domains = append(domains, domain)
+		domain := strings.TrimSpace(scanner.Text())
+		if !validDomain(domain) {
+			continue
 		}
+		if len(domains) >= max {
+			return domains, true, nil
+		}
+		domains[domain] = struct{}{}
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, errors.Join(ErrLoadingDisposableDomains, err)
+		return nil, false, errors.Join(ErrLoadingDisposableDomains, err)
 	}
-	return domains, nil
+	return domains, false, nil
 }
 
-// CheckEmail checks if the email address is valid. It compares the domain with
-// a list of disallowed domains. It returns true if the email address is valid,
+// CheckEmail checks if the email address is valid. It looks for the domain in
+// a set of disallowed domains. It returns true if the email address is valid,
 // otherwise it returns false.
-func CheckEmail(disallowedDomains []string, email string) bool {
+func CheckEmail(disallowedDomains map[string]struct{}, email string) bool {
 	if len(disallowedDomains) == 0 {
 		return true
 	}
@@ -59,10 +90,40 @@ func CheckEmail(disallowedDomains []string, email string) bool {
 		return false
 	}
 	// check the domain
-	for _, domain := range disallowedDomains {
-		if domain == parts[1] {
+	_, disallowed := disallowedDomains[parts[1]]
+	return !disallowed
+}
+
+// validDomain checks if the provided string looks like a lowercase domain. It
+// is a cheaper alternative to a regular expression, that only checks that the
+// domain has at least two labels composed by lowercase letters, digits and
+// hyphens (not at the start or end of the label), and that the last label has
+// only letters and at least two of them.
+func validDomain(domain string) bool {
+	if len(domain) < 4 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for i, label := range labels {
+		if len(label) == 0 || label[0] == '-' || label[len(label)-1] == '-' {
 			return false
 		}
+		tld := i == len(labels)-1
+		if tld && len(label) < 2 {
+			return false
+		}
+		for j := 0; j < len(label); j++ {
+			c := label[j]
+			switch {
+			case c >= 'a' && c <= 'z':
+			case !tld && (c >= '0' && c <= '9' || c == '-'):
+			default:
+				return false
+			}
+		}
 	}
 	return true
 }
@@ -0,0 +1,198 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func syntheticDomainsList(n int) string {
+	var sb strings.Builder
+	sb.WriteString("# disposable domains\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "disposable-%d.example.com\n", i)
+	}
+	sb.WriteString("Invalid_Domain\n\nlocalhost\n")
+	return sb.String()
+}
+
+func TestParseDisposableDomains(t *testing.T) {
+	list := syntheticDomainsList(300000)
+	domains, truncated, err := ParseDisposableDomains(strings.NewReader(list), 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if truncated {
+		t.Errorf("expected not truncated list")
+	}
+	if len(domains) != 300000 {
+		t.Errorf("expected 300000 domains, got %d", len(domains))
+	}
+	if CheckEmail(domains, "user@disposable-1234.example.com") {
+		t.Errorf("expected disposable domain to be disallowed")
+	}
+	if !CheckEmail(domains, "user@simpleauth.link") {
+		t.Errorf("expected regular domain to be allowed")
+	}
+	// check that the list is truncated to the maximum
+	domains, truncated, err = ParseDisposableDomains(strings.NewReader(list), 1000)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !truncated {
+		t.Errorf("expected truncated list")
+	}
+	if len(domains) != 1000 {
+		t.Errorf("expected 1000 domains, got %d", len(domains))
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+	tests := map[string]bool{
+		"simpleauth.link":     true,
+		"mail.simple-auth.io": true,
+		"0-mail.com":          true,
+		"localhost":           false,
+		"-bad.com":            false,
+		"bad-.com":            false,
+		"bad..com":            false,
+		"UPPER.com":           false,
+		"bad.c0m":             false,
+		"bad.c":               false,
+		"":                    false,
+	}
+	for domain, expected := range tests {
+		if got := validDomain(domain); got != expected {
+			t.Errorf("expected %t for %q, got %t", expected, domain, got)
+		}
+	}
+}
+
+func BenchmarkParseDisposableDomains(b *testing.B) {
+	list := syntheticDomainsList(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseDisposableDomains(strings.NewReader(list), 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDisposableDomainsNotLoaded(t *testing.T) {
+	var available atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !available.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("disposable.com\n"))
+	}))
+	defer srv.Close()
+	for _, strict := range []bool{true, false} {
+		available.Store(false)
+		cfg := *testEmailConfig
+		cfg.DisposableSrc = srv.URL
+		cfg.StrictDisposableCheck = strict
+		eq, err := NewEmailQueue(context.Background(), &cfg)
+		if eq == nil || err == nil {
+			t.Fatalf("expected queue and loading error, got %v and %v", eq, err)
+		}
+		// before loading the list, the strict check rejects every address
+		// and the lenient one accepts them
+		for _, address := range []string{"user@simpleauth.link", "user@disposable.com"} {
+			err := eq.CheckAddress(address)
+			if strict && err != ErrDisposableDomainsNotLoaded {
+				t.Errorf("strict: expected %v for %s, got %v", ErrDisposableDomainsNotLoaded, address, err)
+			} else if !strict && err != nil {
+				t.Errorf("lenient: expected nil for %s, got %v", address, err)
+			}
+		}
+		// after loading the list, both filter the disposable domains
+		available.Store(true)
+		if err := eq.loadDisposableDomains(); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if err := eq.CheckAddress("user@simpleauth.link"); err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+		if err := eq.CheckAddress("user@disposable.com"); err != ErrDisallowedDomain {
+			t.Errorf("expected %v, got %v", ErrDisallowedDomain, err)
+		}
+		eq.Stop()
+	}
+}
+
+func TestConcurrentDisposableRefreshes(t *testing.T) {
+	var fetches atomic.Int32
+	var blocked atomic.Bool
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if blocked.Load() {
+			fetches.Add(1)
+			select {
+			case fetching <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		_, _ = w.Write([]byte("disposable.com\n"))
+	}))
+	defer srv.Close()
+	cfg := *testEmailConfig
+	cfg.DisposableSrc = srv.URL
+	eq, err := NewEmailQueue(context.Background(), &cfg)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer eq.Stop()
+	// block the source and request several refreshes at the same time
+	blocked.Store(true)
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- eq.RefreshDisposableDomains()
+		}()
+	}
+	// wait for the first fetch and give time to the other refreshes to wait
+	// for it before releasing the source
+	<-fetching
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected 1 fetch, got %d", n)
+	}
+	// once finished, a new refresh fetches the list again
+	blocked.Store(false)
+	if err := eq.RefreshDisposableDomains(); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if err := eq.CheckAddress("user@disposable.com"); err != ErrDisallowedDomain {
+		t.Errorf("expected %v, got %v", ErrDisallowedDomain, err)
+	}
+	// without source, the domains cannot be refreshed
+	noSrc, err := NewEmailQueue(context.Background(), testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer noSrc.Stop()
+	if err := noSrc.RefreshDisposableDomains(); err != ErrInvalidConfig {
+		t.Errorf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+}
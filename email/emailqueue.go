@@ -1,19 +1,43 @@
 package email
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
-	"net/mail"
-	"net/smtp"
-	"net/textproto"
 	"regexp"
 	"sync"
 	"time"
+
+	"github.com/simpleauthlink/authapi/logger"
+	"github.com/simpleauthlink/authapi/metrics"
 )
 
-// sendRetries is the number of retries to send the email.
-const sendRetries = 3
+// defaultSendRetries is the default number of attempts to send an email.
+const defaultSendRetries = 3
+
+// defaultRetryBaseDelay is the default delay before the second attempt to
+// send an email, it is doubled before every following attempt.
+const defaultRetryBaseDelay = time.Second
+
+// defaultMaxDeadLetters is the default maximum number of dead letters that the
+// queue keeps in memory.
+const defaultMaxDeadLetters = 1000
+
+// disposableRetryCooldown is the time that the queue waits before retrying to
+// load the disposable domains when they could not be loaded.
+const disposableRetryCooldown = 30 * time.Second
+
+// queueCooldown is the time that the queue waits before checking again for
+// new emails when it is empty.
+const queueCooldown = time.Second
+
+// defaultBatchInterval is the default maximum time that the queue waits for
+// more emails to complete a batch, since the first email of the batch.
+const defaultBatchInterval = time.Second
+
+// batchPollInterval is the time that the queue waits before checking again
+// for new emails while it is completing a batch.
+const batchPollInterval = 10 * time.Millisecond
 
 // emailRgx is the regular expression used to validate an email address.
 var emailRgx = regexp.MustCompile(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,}$`)
@@ -21,96 +45,517 @@ var emailRgx = regexp.MustCompile(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,}$`)
 // EmailConfig struct represents the email configuration that is needed to send
 // an email using and SMTP server. It includes the email address (used as the
 // sender address but also as the username for the SMTP server), the email
-// server hostname, its port and the password.
+// server hostname, its port and the password. SendRetries is the maximum
+// number of attempts to send an email (3 by default) and RetryBaseDelay is
+// the delay before the second attempt (1s by default), which is doubled
+// before every following attempt. TLSMode sets how the connection with the
+// SMTP server is secured (see TLSMode constants), using the optional
+// TLSConfig. The disposable domains of the DisposableSrc are loaded when the
+// queue is created and, if they cannot be loaded, they are retried in the
+// background. Until they are loaded, the addresses are rejected if
+// StrictDisposableCheck is enabled, or accepted otherwise. The optional
+// TokenEmailTemplates registers additional token email templates by key, that
+// the token requests can select instead of the TokenEmailTemplate. If the
+// TemplatesDir is set, every template path is resolved relative to it and the
+// paths that escape it are rejected. If BatchSize is greater than one and the
+// sender supports it (see BatchSender), the queue accumulates up to BatchSize
+// emails, waiting up to BatchInterval (1s by default) since the first one,
+// and sends them at once, otherwise, the emails are sent one by one.
+// MaxDeadLetters is the maximum number of dead letters kept in memory (1000
+// by default), when it is reached the oldest ones are dropped, so they are
+// only kept in the dead letter store, if any.
 type EmailConfig struct {
-	Address            string
-	EmailHost          string
-	EmailPort          int
-	Password           string
-	DisposableSrc      string
-	TokenEmailTemplate string
-	AppEmailTemplate   string
+	Address               string
+	EmailHost             string
+	EmailPort             int
+	Password              string
+	DisposableSrc         string
+	MaxDisposableDomains  int
+	TemplatesDir          string
+	TokenEmailTemplate    string
+	TokenEmailTemplates   map[string]string
+	AppEmailTemplate      string
+	SendRetries           int
+	RetryBaseDelay        time.Duration
+	TLSMode               TLSMode
+	TLSConfig             *tls.Config
+	StrictDisposableCheck bool
+	BatchSize             int
+	BatchInterval         time.Duration
+	MaxDeadLetters        int
 }
 
+// EmailPriority type represents the priority of an email in the queue. The
+// emails with high priority are sent before the emails with low priority.
+type EmailPriority int
+
+const (
+	// LowPriority is the default priority of an email, used for bulk emails
+	// like the user magic links.
+	LowPriority EmailPriority = iota
+	// HighPriority is the priority used for transactional admin emails like
+	// the app creation ones, that should not wait behind the user emails.
+	HighPriority
+)
+
 // Email struct represents the email that is going to be sent. It includes the
-// recipient email address, the subject and the body of the email.
+// recipient email address, the subject, the html body of the email, the
+// optional plaintext version of the body and its priority in the queue. The
+// ID identifies the email in the pending store of the queue, if any, and it
+// is set by the store when the email is pushed. The optional RequestID is the
+// id of the request that originated the email, to include it in the logs of
+// the delivery, it is not persisted in the pending store.
 type Email struct {
-	To      string
-	Subject string
-	Body    string
+	ID        string
+	To        string
+	Subject   string
+	Body      string
+	TextBody  string
+	Priority  EmailPriority
+	RequestID string
+}
+
+// Sender interface represents the service used to deliver the emails of the
+// queue, for example, an SMTP server (see SMTPSender) or an HTTP email API.
+// The Send method makes a single attempt to deliver the provided email, the
+// queue handles the retries.
+type Sender interface {
+	Send(e *Email) error
 }
 
-// EmailQueue struct represents the email queue. It includes the context and the
-// cancel function to stop the queue, the configuration of the server to send
-// the email, the list of emails to send, and the waiter to wait for the
-// background process to finish.
+// BatchSender interface represents a Sender that can also deliver several
+// emails at once, for example, in a single SMTP session. The SendBatch method
+// makes a single attempt to deliver the provided emails and returns the error
+// of each one in the same order, nil if it was delivered. The queue retries
+// the failed emails one by one, except the permanent failures.
+type BatchSender interface {
+	Sender
+	SendBatch(emails []*Email) []error
+}
+
+// DeadLetterStore interface represents the storage where the emails that
+// could not be sent after all the attempts are recorded, with the error of
+// the last attempt, to be investigated and retried.
+type DeadLetterStore interface {
+	StoreDeadLetter(e *Email, sendErr error) error
+}
+
+// PendingStore interface represents the storage where the emails pushed to
+// the queue are persisted until they are sent (or moved to the dead letters),
+// so the emails that are pending when the service stops unexpectedly are
+// recovered when the queue starts again. StorePending must set the ID of the
+// email if it is empty.
+type PendingStore interface {
+	StorePending(e *Email) error
+	DeletePending(e *Email) error
+	PendingEmails() ([]*Email, error)
+}
+
+// EmailQueue struct represents the email queue. It includes the context and
+// the cancel function to stop the queue, the configuration of the queue, the
+// sender used to deliver the emails, the lists of emails to send (splitted by
+// priority), the waiter to wait for the background processes to finish, the
+// function used to send each email (Send by default), the emails that could
+// not be sent after all the attempts (dead letters) and the optional store
+// where they are recorded, the optional store where the pending emails are
+// persisted, the logger and the metrics sink of the queue, and the disposable
+// domains that are not allowed, with a flag that indicates if they are loaded,
+// a channel that is closed when they are loaded for the first time, and the
+// load of the domains that is in progress (if any), shared by the concurrent
+// refreshes.
 type EmailQueue struct {
 	ctx               context.Context
 	cancel            context.CancelFunc
 	cfg               *EmailConfig
+	sender            Sender
+	send              func(*Email) error
 	items             []*Email
+	priorityItems     []*Email
+	deadLetters       []*Email
+	deadLetterStore   DeadLetterStore
+	pendingStore      PendingStore
 	itemsMtx          sync.Mutex
+	log               logger.Logger
+	logMtx            sync.RWMutex
+	sink              metrics.Sink
+	sinkMtx           sync.RWMutex
 	waiter            sync.WaitGroup
-	disallowedDomains []string
+	domainsMtx        sync.RWMutex
+	disallowedDomains map[string]struct{}
+	domainsLoaded     bool
+	domainsReady      chan struct{}
+	refreshMtx        sync.Mutex
+	refresh           *disposableRefresh
 }
 
-// NewEmailQueue creates a new EmailQueue with the provided configuration.
-func NewEmailQueue(ctx context.Context, cfg *EmailConfig) (*EmailQueue, error) {
+// disposableRefresh struct represents a load of the disposable domains that
+// is in progress. The done channel is closed when it finishes, after setting
+// the resulting error.
+type disposableRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// NewEmailQueue creates a new EmailQueue with the provided configuration. The
+// emails are delivered using the provided sender or, if it is not provided,
+// using an SMTPSender created with the same configuration. The SMTP server
+// params of the configuration are only required for the SMTPSender. If the
+// provided context is already done, the queue would never send any email, so
+// it returns ErrQueueStopped.
+func NewEmailQueue(ctx context.Context, cfg *EmailConfig, sender ...Sender) (*EmailQueue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrQueueStopped, err)
+	}
 	// check if the configuration is valid
-	if cfg.Address == "" || !emailRgx.MatchString(cfg.Address) ||
-		cfg.EmailHost == "" || cfg.EmailPort == 0 || cfg.Password == "" {
+	if cfg.Address == "" || !emailRgx.MatchString(cfg.Address) {
 		return nil, ErrInvalidConfig
 	}
-	internalCtx, cancel := context.WithCancel(ctx)
-	// load the disposable domains if a source is provided
-	var err error
-	disallowedDomains := []string{}
-	if cfg.DisposableSrc != "" {
-		disallowedDomains, err = LoadRemoteDisposableDomains(internalCtx, cfg.DisposableSrc)
+	var queueSender Sender
+	if len(sender) > 0 && sender[0] != nil {
+		queueSender = sender[0]
+	} else {
+		if cfg.EmailHost == "" || cfg.EmailPort == 0 || cfg.Password == "" || !cfg.TLSMode.valid() {
+			return nil, ErrInvalidConfig
+		}
+		queueSender = NewSMTPSender(cfg)
 	}
-	// return the email queue
-	return &EmailQueue{
+	internalCtx, cancel := context.WithCancel(ctx)
+	eq := &EmailQueue{
 		ctx:               internalCtx,
 		cancel:            cancel,
 		cfg:               cfg,
+		sender:            queueSender,
+		log:               logger.Default(),
+		sink:              metrics.Default(),
 		items:             []*Email{},
-		disallowedDomains: disallowedDomains,
-	}, err
+		priorityItems:     []*Email{},
+		disallowedDomains: map[string]struct{}{},
+		domainsLoaded:     cfg.DisposableSrc == "",
+		domainsReady:      make(chan struct{}),
+	}
+	if eq.domainsLoaded {
+		close(eq.domainsReady)
+	}
+	eq.send = eq.Send
+	// load the disposable domains if a source is provided, before returning
+	// the queue, so the addresses are never checked against a partial list,
+	// and keep retrying in the background if it fails
+	var err error
+	if cfg.DisposableSrc != "" {
+		if err = eq.loadDisposableDomains(); err != nil {
+			eq.retryDisposableDomains()
+		}
+	}
+	return eq, err
+}
+
+// RefreshDisposableDomains method loads again the disposable domains from the
+// configured source, for example, to pick up the changes of the list without
+// restarting the service. Only one load runs at a time, the refreshes
+// requested while other is in progress wait for it and return its result,
+// instead of fetching the list again. It returns ErrInvalidConfig if no
+// source is configured, or an error if the domains cannot be loaded, keeping
+// the current ones.
+func (eq *EmailQueue) RefreshDisposableDomains() error {
+	if eq.cfg.DisposableSrc == "" {
+		return ErrInvalidConfig
+	}
+	return eq.loadDisposableDomains()
+}
+
+// loadDisposableDomains method loads the disposable domains from the
+// configured source and replaces the current ones. If other load is in
+// progress, it waits for it and returns its result instead of fetching the
+// domains again. It returns an error if they cannot be loaded.
+func (eq *EmailQueue) loadDisposableDomains() error {
+	eq.refreshMtx.Lock()
+	if current := eq.refresh; current != nil {
+		eq.refreshMtx.Unlock()
+		<-current.done
+		return current.err
+	}
+	current := &disposableRefresh{done: make(chan struct{})}
+	eq.refresh = current
+	eq.refreshMtx.Unlock()
+	// fetch the domains and release the waiting refreshes
+	current.err = eq.fetchDisposableDomains()
+	eq.refreshMtx.Lock()
+	eq.refresh = nil
+	eq.refreshMtx.Unlock()
+	close(current.done)
+	return current.err
+}
+
+// fetchDisposableDomains method fetches the disposable domains from the
+// configured source and replaces the current ones. It returns an error if
+// they cannot be loaded.
+func (eq *EmailQueue) fetchDisposableDomains() error {
+	domains, err := LoadRemoteDisposableDomains(eq.ctx, eq.cfg.DisposableSrc, eq.cfg.MaxDisposableDomains)
+	if err != nil {
+		return err
+	}
+	eq.domainsMtx.Lock()
+	defer eq.domainsMtx.Unlock()
+	eq.disallowedDomains = domains
+	if !eq.domainsLoaded {
+		close(eq.domainsReady)
+	}
+	eq.domainsLoaded = true
+	return nil
+}
+
+// retryDisposableDomains method retries to load the disposable domains in the
+// background, waiting disposableRetryCooldown between attempts, until they are
+// loaded or the queue is stopped.
+func (eq *EmailQueue) retryDisposableDomains() {
+	eq.waiter.Add(1)
+	go func() {
+		defer eq.waiter.Done()
+		for {
+			select {
+			case <-eq.ctx.Done():
+				return
+			case <-time.After(disposableRetryCooldown):
+			}
+			if err := eq.loadDisposableDomains(); err != nil {
+				eq.logger().Warn("error loading disposable domains", "error", err)
+				continue
+			}
+			return
+		}
+	}()
 }
 
 // Start method starts the email queue. It listens for new emails in the queue
-// and sends them using the provided configuration.
+// and sends them using the provided configuration. Every email is removed from
+// the queue exactly once, before sending it, the emails that fail to be sent
+// are moved to the dead letters by Send. If the batches are enabled, the
+// emails are sent in batches instead (see nextBatch and deliverBatch). When
+// the queue is empty, it waits queueCooldown before checking it again. If the
+// queue has a pending store, the emails that were pending when the queue
+// stopped are recovered from it before starting, and every email is deleted
+// from it once it is sent or moved to the dead letters. If the disposable
+// domains are not loaded yet and the check is strict, the recovery is delayed
+// until they are loaded, because the recovered emails would be rejected.
 func (eq *EmailQueue) Start() {
+	recovered := !eq.cfg.StrictDisposableCheck || eq.disposableDomainsLoaded()
+	if recovered {
+		eq.recoverPending()
+	}
 	eq.waiter.Add(1)
 	go func() {
 		defer eq.waiter.Done()
-		for {
+		if !recovered {
 			select {
 			case <-eq.ctx.Done():
 				return
-			default:
-				e := eq.Pop()
-				if e == nil {
-					continue
-				}
-				if err := eq.Send(e); err != nil {
-					fmt.Println(err)
-				} else {
-					eq.Pop()
+			case <-eq.domainsReady:
+			}
+			eq.recoverPending()
+		}
+		for {
+			if eq.ctx.Err() != nil {
+				return
+			}
+			e := eq.Pop()
+			if e == nil {
+				select {
+				case <-eq.ctx.Done():
+					return
+				case <-time.After(queueCooldown):
 				}
+				continue
+			}
+			if batchSender, ok := eq.batchSender(); ok {
+				eq.deliverBatch(batchSender, eq.nextBatch(e))
+				continue
 			}
-			time.Sleep(time.Second)
+			eq.deliver(e)
 		}
 	}()
 }
 
+// disposableDomainsLoaded method returns true if the disposable domains have been
+// loaded at least once.
+func (eq *EmailQueue) disposableDomainsLoaded() bool {
+	eq.domainsMtx.RLock()
+	defer eq.domainsMtx.RUnlock()
+	return eq.domainsLoaded
+}
+
+// batchSender method returns the sender of the queue as a BatchSender if the
+// batches are enabled in the configuration and the sender supports them.
+func (eq *EmailQueue) batchSender() (BatchSender, bool) {
+	if eq.cfg.BatchSize <= 1 {
+		return nil, false
+	}
+	batchSender, ok := eq.sender.(BatchSender)
+	return batchSender, ok
+}
+
+// nextBatch method composes a batch that starts with the provided email,
+// removing the following emails from the queue until the batch has the
+// configured size or the configured interval (1s by default) has elapsed
+// since it started. The batch is not delayed if it includes a high priority
+// email, then it only includes the emails that are already in the queue. It
+// also stops waiting if the queue is stopped.
+func (eq *EmailQueue) nextBatch(first *Email) []*Email {
+	interval := eq.cfg.BatchInterval
+	if interval <= 0 {
+		interval = defaultBatchInterval
+	}
+	deadline := time.NewTimer(interval)
+	defer deadline.Stop()
+	batch := []*Email{first}
+	urgent := first.Priority == HighPriority
+	for len(batch) < eq.cfg.BatchSize {
+		if e := eq.Pop(); e != nil {
+			batch = append(batch, e)
+			urgent = urgent || e.Priority == HighPriority
+			continue
+		}
+		if urgent {
+			break
+		}
+		select {
+		case <-eq.ctx.Done():
+			return batch
+		case <-deadline.C:
+			return batch
+		case <-time.After(batchPollInterval):
+		}
+	}
+	return batch
+}
+
+// deliverBatch method sends the provided batch of emails at once using the
+// provided sender. The emails that are sent are deleted from the pending
+// store like in deliver, the ones that fail permanently (see
+// permanentFailure) are moved to the dead letters, and the rest of the failed
+// ones are retried one by one using deliver. The emails that are not allowed
+// are not included in the batch, they are handled by deliver too.
+func (eq *EmailQueue) deliverBatch(batchSender BatchSender, batch []*Email) {
+	allowed := make([]*Email, 0, len(batch))
+	for _, e := range batch {
+		if eq.Allowed(e.To) {
+			allowed = append(allowed, e)
+		} else {
+			eq.deliver(e)
+		}
+	}
+	if len(allowed) == 0 {
+		return
+	}
+	errs := batchSender.SendBatch(allowed)
+	for i, e := range allowed {
+		// retry the emails without result one by one
+		if len(errs) != len(allowed) {
+			eq.deliver(e)
+			continue
+		}
+		switch err := errs[i]; {
+		case err == nil:
+			eq.delivered(e, nil)
+		case permanentFailure(err):
+			eq.delivered(e, eq.deadLetter(e, err))
+		default:
+			eq.deliver(e)
+		}
+	}
+}
+
+// deliver method sends the provided email and, once it is sent or moved to
+// the dead letters, deletes it from the pending store, if any (see
+// delivered).
+func (eq *EmailQueue) deliver(e *Email) {
+	eq.delivered(e, eq.send(e))
+}
+
+// delivered method records the result of the delivery of the provided email,
+// which is not retried anymore, so it is deleted from the pending store, if
+// any. The provided error is only logged.
+func (eq *EmailQueue) delivered(e *Email, err error) {
+	if err != nil {
+		eq.logger().Error("error sending email", "email_id", e.ID, "request_id", e.RequestID, "error", err)
+	} else {
+		eq.metrics().IncrCounter(metrics.EmailsSent, 1)
+	}
+	eq.itemsMtx.Lock()
+	store := eq.pendingStore
+	eq.itemsMtx.Unlock()
+	if store != nil {
+		if err := store.DeletePending(e); err != nil {
+			eq.logger().Error("error deleting pending email", "email_id", e.ID, "request_id", e.RequestID, "error", err)
+		}
+	}
+}
+
+// recoverPending method adds the emails of the pending store, if any, to the
+// front of the queue, without storing them again. The errors are only logged,
+// to start the queue anyway.
+func (eq *EmailQueue) recoverPending() {
+	eq.itemsMtx.Lock()
+	store := eq.pendingStore
+	eq.itemsMtx.Unlock()
+	if store == nil {
+		return
+	}
+	pending, err := store.PendingEmails()
+	if err != nil {
+		eq.logger().Error("error recovering pending emails", "error", err)
+		return
+	}
+	// the recovered emails are older than the ones already in the queue
+	var items, priorityItems []*Email
+	for _, e := range pending {
+		if e.Priority == HighPriority {
+			priorityItems = append(priorityItems, e)
+		} else {
+			items = append(items, e)
+		}
+	}
+	eq.itemsMtx.Lock()
+	defer eq.itemsMtx.Unlock()
+	eq.priorityItems = append(priorityItems, eq.priorityItems...)
+	eq.items = append(items, eq.items...)
+}
+
+// Stop method stops the email queue. After calling it, the queue does not
+// accept new emails. It waits for the email that is being sent (if any) to
+// finish. The emails that remain in the queue can be sent using Drain.
 func (eq *EmailQueue) Stop() {
 	eq.cancel()
 	eq.waiter.Wait()
 }
 
-// Push method adds a new email to the queue.
+// Drain method sends the emails that remain in the queue, usually after
+// stopping it, until the queue is empty or the provided context is done. As
+// the queue is stopped, every email is only tried once, and the emails that
+// fail to be sent are moved to the dead letters. It returns an error if the
+// context is done before the queue is empty.
+func (eq *EmailQueue) Drain(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("emails pending after drain: %w", err)
+		}
+		e := eq.Pop()
+		if e == nil {
+			return nil
+		}
+		eq.deliver(e)
+	}
+}
+
+// Push method adds a new email to the queue. The high priority emails are
+// added to a separate list that is drained before the low priority one. If
+// the queue is stopped or its context is done, it returns ErrQueueStopped,
+// because the email would never be sent. If the queue has a pending store, the
+// email is persisted in it before adding it to the queue, and if it cannot be
+// persisted, it returns an error.
 func (eq *EmailQueue) Push(e *Email) error {
+	if eq.ctx.Err() != nil {
+		return ErrQueueStopped
+	}
 	// check if the email is valid
 	if e.To == "" || !emailRgx.MatchString(e.To) || e.Subject == "" || e.Body == "" {
 		return ErrInvalidEmail
@@ -119,106 +564,223 @@ func (eq *EmailQueue) Push(e *Email) error {
 	if !eq.Allowed(e.To) {
 		return ErrDisallowedDomain
 	}
+	// persist the email before adding it to the queue
+	eq.itemsMtx.Lock()
+	store := eq.pendingStore
+	eq.itemsMtx.Unlock()
+	if store != nil {
+		if err := store.StorePending(e); err != nil {
+			return fmt.Errorf("error storing pending email: %w", err)
+		}
+	}
 	eq.itemsMtx.Lock()
-	eq.items = append(eq.items, e)
+	if e.Priority == HighPriority {
+		eq.priorityItems = append(eq.priorityItems, e)
+	} else {
+		eq.items = append(eq.items, e)
+	}
+	depth := len(eq.priorityItems) + len(eq.items)
 	eq.itemsMtx.Unlock()
+	eq.metrics().SetGauge(metrics.EmailQueueDepth, int64(depth))
 	return nil
 }
 
-// Top method returns the first email in the queue.
+// Top method returns the first email in the queue. If there are high priority
+// emails, it returns the first of them.
 func (eq *EmailQueue) Top() *Email {
 	eq.itemsMtx.Lock()
 	defer eq.itemsMtx.Unlock()
+	if len(eq.priorityItems) > 0 {
+		return eq.priorityItems[0]
+	}
 	if len(eq.items) == 0 {
 		return nil
 	}
 	return eq.items[0]
 }
 
-// Pop method removes the first email in the queue and returns it.
+// Pop method removes the first email in the queue and returns it. If there
+// are high priority emails, it removes and returns the first of them.
 func (eq *EmailQueue) Pop() *Email {
 	eq.itemsMtx.Lock()
-	defer eq.itemsMtx.Unlock()
-	if len(eq.items) == 0 {
-		return nil
+	var e *Email
+	switch {
+	case len(eq.priorityItems) > 0:
+		e = eq.priorityItems[0]
+		eq.priorityItems = eq.priorityItems[1:]
+	case len(eq.items) > 0:
+		e = eq.items[0]
+		eq.items = eq.items[1:]
+	}
+	depth := len(eq.priorityItems) + len(eq.items)
+	eq.itemsMtx.Unlock()
+	if e != nil {
+		eq.metrics().SetGauge(metrics.EmailQueueDepth, int64(depth))
 	}
-	e := eq.items[0]
-	eq.items = eq.items[1:]
 	return e
 }
 
-// Send method sends the email using the queue configuration. It uses the
-// email address as the sender address and the username for the SMTP server.
-// It composes the email message, creates the auth object with the email
-// credentials, the server string with the host and the port, and the receipts.
-// Finally, it sends the email. If something fails during the process, it
-// returns an error.
+// Len method returns the number of emails in the queue waiting to be sent,
+// including the high priority ones.
+func (eq *EmailQueue) Len() int {
+	eq.itemsMtx.Lock()
+	defer eq.itemsMtx.Unlock()
+	return len(eq.priorityItems) + len(eq.items)
+}
+
+// DeadLetters method returns a copy of the emails that could not be sent
+// after all the attempts, in the order they failed. Only the last ones are
+// kept, up to the MaxDeadLetters of the configuration.
+func (eq *EmailQueue) DeadLetters() []*Email {
+	eq.itemsMtx.Lock()
+	defer eq.itemsMtx.Unlock()
+	return append([]*Email{}, eq.deadLetters...)
+}
+
+// SetDeadLetterStore method sets the store where the emails that could not be
+// sent after all the attempts are recorded, in addition to the dead letters
+// of the queue. It must be called before starting the queue.
+func (eq *EmailQueue) SetDeadLetterStore(store DeadLetterStore) {
+	eq.itemsMtx.Lock()
+	defer eq.itemsMtx.Unlock()
+	eq.deadLetterStore = store
+}
+
+// SetPendingStore method sets the store where the pending emails are
+// persisted until they are sent, to recover them after a restart. It must be
+// called before starting the queue and pushing emails to it.
+func (eq *EmailQueue) SetPendingStore(store PendingStore) {
+	eq.itemsMtx.Lock()
+	defer eq.itemsMtx.Unlock()
+	eq.pendingStore = store
+}
+
+// SetLogger method sets the logger used by the queue to report the errors,
+// instead of the default one (see logger.Default).
+func (eq *EmailQueue) SetLogger(l logger.Logger) {
+	eq.logMtx.Lock()
+	defer eq.logMtx.Unlock()
+	eq.log = l
+}
+
+// logger method returns the logger of the queue.
+func (eq *EmailQueue) logger() logger.Logger {
+	eq.logMtx.RLock()
+	defer eq.logMtx.RUnlock()
+	return eq.log
+}
+
+// SetMetrics method sets the sink used by the queue to emit the number of
+// emails sent and the emails waiting in the queue, instead of the default one
+// (see metrics.Default).
+func (eq *EmailQueue) SetMetrics(sink metrics.Sink) {
+	eq.sinkMtx.Lock()
+	defer eq.sinkMtx.Unlock()
+	eq.sink = sink
+}
+
+// metrics method returns the metrics sink of the queue.
+func (eq *EmailQueue) metrics() metrics.Sink {
+	eq.sinkMtx.RLock()
+	defer eq.sinkMtx.RUnlock()
+	return eq.sink
+}
+
+// Send method sends the email using the queue sender. It checks if the email
+// is allowed and sends it, retrying with an exponential backoff between
+// attempts. The backoff is interrupted if the queue is stopped. The permanent
+// failures (see permanentFailure) are not retried, the email fails fast
+// and the returned error wraps ErrPermanentFailure. If the email cannot be
+// sent after all the attempts, it is moved to the dead letters and recorded
+// in the dead letter store, if any, with the error of the last attempt, which
+// includes the reply of the SMTP server. If something fails during the
+// process, it returns an error.
 func (eq *EmailQueue) Send(e *Email) error {
-	// compose the email body
-	body, err := eq.encodeEmail(e)
-	if err != nil {
-		return fmt.Errorf("error composing email: %w", err)
-	}
 	// check if the email is allowed
 	if !eq.Allowed(e.To) {
 		return ErrDisallowedDomain
 	}
-	// create the auth object with the email credentials
-	auth := smtp.PlainAuth("", eq.cfg.Address, eq.cfg.Password, eq.cfg.EmailHost)
-	// create the server string with the host and the port and the receipts
-	server := fmt.Sprintf("%s:%d", eq.cfg.EmailHost, eq.cfg.EmailPort)
-	receipts := []string{e.To}
-	// send the email
-	for i := 0; i < sendRetries; i++ {
-		if err = smtp.SendMail(server, auth, eq.cfg.Address, receipts, body); err == nil {
+	// send the email, waiting before every retry
+	var err error
+	retries, delay := eq.cfg.SendRetries, eq.cfg.RetryBaseDelay
+	if retries <= 0 {
+		retries = defaultSendRetries
+	}
+	if delay <= 0 {
+		delay = defaultRetryBaseDelay
+	}
+	for i := 0; i < retries; i++ {
+		if i > 0 {
+			select {
+			case <-eq.ctx.Done():
+			case <-time.After(delay):
+				delay *= 2
+			}
+			if eq.ctx.Err() != nil {
+				break
+			}
+		}
+		if err = eq.sender.Send(e); err == nil {
+			return nil
+		}
+		if permanentFailure(err) {
 			break
 		}
 	}
-	if err != nil {
-		return fmt.Errorf("error sending email: %w", err)
+	return eq.deadLetter(e, err)
+}
+
+// deadLetter method moves the provided email to the dead letters, dropping
+// the oldest one if they are full, and records it in the dead letter store,
+// if any, with the provided error of its last attempt. It returns the provided error wrapped, including ErrPermanentFailure
+// if it is a permanent failure.
+func (eq *EmailQueue) deadLetter(e *Email, err error) error {
+	maxDeadLetters := eq.cfg.MaxDeadLetters
+	if maxDeadLetters <= 0 {
+		maxDeadLetters = defaultMaxDeadLetters
 	}
-	return nil
+	eq.itemsMtx.Lock()
+	if len(eq.deadLetters) >= maxDeadLetters {
+		eq.deadLetters = eq.deadLetters[len(eq.deadLetters)-maxDeadLetters+1:]
+	}
+	eq.deadLetters = append(eq.deadLetters, e)
+	store := eq.deadLetterStore
+	eq.itemsMtx.Unlock()
+	if store != nil {
+		if storeErr := store.StoreDeadLetter(e, err); storeErr != nil {
+			eq.logger().Error("error storing dead letter", "email_id", e.ID, "request_id", e.RequestID, "error", storeErr)
+		}
+	}
+	if permanentFailure(err) {
+		return fmt.Errorf("error sending email: %w: %w", ErrPermanentFailure, err)
+	}
+	return fmt.Errorf("error sending email: %w", err)
 }
 
-// Allowed method checks if the email address is allowed. It compares the domain
-// with a list of disallowed domains. It returns true if the email address is
-// allowed, otherwise it returns false.
+// Allowed method checks if the email address is allowed. It checks the email
+// format and looks for its domain in the set of disallowed domains. It returns
+// true if the email address is allowed, otherwise it returns false.
 func (eq *EmailQueue) Allowed(address string) bool {
-	if !emailRgx.MatchString(address) {
-		return false
-	}
-	return CheckEmail(eq.disallowedDomains, address)
+	return eq.CheckAddress(address) == nil
 }
 
-// encodeEmail method encodes the email to a byte slice. It validates the from
-// and to addresses, sets the headers for the html email, and writes the body.
-// It returns the encoded email or an error if something fails during the
-// process.
-func (eq *EmailQueue) encodeEmail(email *Email) ([]byte, error) {
-	// validate from address
-	from, err := mail.ParseAddress(eq.cfg.Address)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing address: %w", err)
+// CheckAddress method checks if the email address is allowed and returns the
+// reason if it is not. It returns ErrInvalidEmail if the address has not a
+// valid format and ErrDisallowedDomain if its domain is in the set of
+// disallowed domains. If the disposable domains are not loaded yet and the
+// check is strict, it returns ErrDisposableDomainsNotLoaded. If the address
+// is allowed, it returns nil.
+func (eq *EmailQueue) CheckAddress(address string) error {
+	if !emailRgx.MatchString(address) {
+		return ErrInvalidEmail
 	}
-	// validate to address
-	to, err := mail.ParseAddress(email.To)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing address: %w", err)
-	}
-	// set headers for html email
-	header := textproto.MIMEHeader{}
-	header.Set(textproto.CanonicalMIMEHeaderKey("from"), from.Address)
-	header.Set(textproto.CanonicalMIMEHeaderKey("to"), to.Address)
-	header.Set(textproto.CanonicalMIMEHeaderKey("content-type"), "text/html; charset=UTF-8")
-	header.Set(textproto.CanonicalMIMEHeaderKey("mime-version"), "1.0")
-	header.Set(textproto.CanonicalMIMEHeaderKey("subject"), email.Subject)
-	// init empty message
-	var buffer bytes.Buffer
-	// write header
-	for key, value := range header {
-		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", key, value[0]))
-	}
-	// write body
-	buffer.WriteString(fmt.Sprintf("\r\n%s", email.Body))
-	return buffer.Bytes(), nil
+	eq.domainsMtx.RLock()
+	defer eq.domainsMtx.RUnlock()
+	if !eq.domainsLoaded && eq.cfg.StrictDisposableCheck {
+		return ErrDisposableDomainsNotLoaded
+	}
+	if !CheckEmail(eq.disallowedDomains, address) {
+		return ErrDisallowedDomain
+	}
+	return nil
 }
@@ -0,0 +1,615 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/simpleauthlink/authapi/logger"
+)
+
+var testEmailConfig = &EmailConfig{
+	Address:   "test@simpleauth.link",
+	EmailHost: "smtp.simpleauth.link",
+	EmailPort: 587,
+	Password:  "password",
+}
+
+func TestPushPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eq, err := NewEmailQueue(ctx, testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	low := &Email{To: "user@simpleauth.link", Subject: "low", Body: "low"}
+	high := &Email{To: "admin@simpleauth.link", Subject: "high", Body: "high", Priority: HighPriority}
+	if err := eq.Push(low); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := eq.Push(high); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if e := eq.Top(); e != high {
+		t.Errorf("expected high priority email on top, got %v", e)
+	}
+	if e := eq.Pop(); e != high {
+		t.Errorf("expected high priority email first, got %v", e)
+	}
+	if e := eq.Pop(); e != low {
+		t.Errorf("expected low priority email second, got %v", e)
+	}
+	if e := eq.Pop(); e != nil {
+		t.Errorf("expected empty queue, got %v", e)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	// an already cancelled context is rejected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if eq, err := NewEmailQueue(ctx, testEmailConfig); !errors.Is(err, ErrQueueStopped) || eq != nil {
+		t.Errorf("expected nil queue and %v, got %v and %v", ErrQueueStopped, eq, err)
+	}
+	// the emails are rejected once the context of the queue is done, even
+	// if the queue is not stopped
+	ctx, cancel = context.WithCancel(context.Background())
+	eq, err := NewEmailQueue(ctx, testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	eq.Start()
+	defer eq.Stop()
+	cancel()
+	if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("expected %v, got %v", ErrQueueStopped, err)
+	}
+	if e := eq.Top(); e != nil {
+		t.Errorf("expected empty queue, got %v", e)
+	}
+}
+
+func TestStopDuringFailingSend(t *testing.T) {
+	eq, err := NewEmailQueue(context.Background(), testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	sending := make(chan struct{}, 1)
+	eq.send = func(e *Email) error {
+		select {
+		case sending <- struct{}{}:
+		default:
+		}
+		time.Sleep(50 * time.Millisecond)
+		return fmt.Errorf("smtp server unavailable")
+	}
+	for i := 0; i < 3; i++ {
+		if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	eq.Start()
+	// stop the queue while the first email is being sent
+	<-sending
+	eq.Stop()
+	if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}); err != ErrQueueStopped {
+		t.Errorf("expected %v, got %v", ErrQueueStopped, err)
+	}
+	// drain the remaining emails, even if they fail
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := eq.Drain(ctx); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if e := eq.Top(); e != nil {
+		t.Errorf("expected empty queue, got %v", e)
+	}
+}
+
+func TestStartDeliversInOrder(t *testing.T) {
+	eq, err := NewEmailQueue(context.Background(), testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	var sentMtx sync.Mutex
+	sent := []string{}
+	delivered := make(chan struct{}, 3)
+	eq.send = func(e *Email) error {
+		sentMtx.Lock()
+		sent = append(sent, e.Subject)
+		sentMtx.Unlock()
+		delivered <- struct{}{}
+		return nil
+	}
+	expected := []string{"first", "second", "third"}
+	for _, subject := range expected {
+		if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: subject, Body: "test"}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	eq.Start()
+	defer eq.Stop()
+	for range expected {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d emails delivered", len(expected))
+		}
+	}
+	sentMtx.Lock()
+	defer sentMtx.Unlock()
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, sent)
+	}
+	if e := eq.Top(); e != nil {
+		t.Errorf("expected empty queue, got %v", e)
+	}
+}
+
+// senderFunc type allows to use a function as a Sender.
+type senderFunc func(e *Email) error
+
+func (fn senderFunc) Send(e *Email) error {
+	return fn(e)
+}
+
+func TestSendBackoff(t *testing.T) {
+	cfg := *testEmailConfig
+	cfg.SendRetries = 3
+	cfg.RetryBaseDelay = 20 * time.Millisecond
+	var send senderFunc
+	eq, err := NewEmailQueue(context.Background(), &cfg, senderFunc(func(e *Email) error {
+		return send(e)
+	}))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// fails twice and then succeeds
+	attempts := []time.Time{}
+	send = func(*Email) error {
+		attempts = append(attempts, time.Now())
+		if len(attempts) <= 2 {
+			return fmt.Errorf("smtp server unavailable")
+		}
+		return nil
+	}
+	e := &Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}
+	if err := eq.Send(e); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	if delay := attempts[1].Sub(attempts[0]); delay < cfg.RetryBaseDelay {
+		t.Errorf("expected first delay of at least %v, got %v", cfg.RetryBaseDelay, delay)
+	}
+	if delay := attempts[2].Sub(attempts[1]); delay < 2*cfg.RetryBaseDelay {
+		t.Errorf("expected second delay of at least %v, got %v", 2*cfg.RetryBaseDelay, delay)
+	}
+	if deadLetters := eq.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("expected no dead letters, got %v", deadLetters)
+	}
+	// always fails, so it is moved to the dead letters
+	attempts = []time.Time{}
+	send = func(*Email) error {
+		attempts = append(attempts, time.Now())
+		return fmt.Errorf("smtp server unavailable")
+	}
+	if err := eq.Send(e); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if len(attempts) != 3 {
+		t.Errorf("expected 3 attempts, got %d", len(attempts))
+	}
+	if deadLetters := eq.DeadLetters(); len(deadLetters) != 1 || deadLetters[0] != e {
+		t.Errorf("expected %v in dead letters, got %v", e, deadLetters)
+	}
+	// the backoff is interrupted when the queue is stopped
+	cfg.RetryBaseDelay = time.Minute
+	attempts = []time.Time{}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		eq.Stop()
+	}()
+	start := time.Now()
+	if err := eq.Send(e); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected backoff interrupted, took %v", elapsed)
+	}
+	if len(attempts) != 1 {
+		t.Errorf("expected 1 attempt, got %d", len(attempts))
+	}
+	if deadLetters := eq.DeadLetters(); len(deadLetters) != 2 {
+		t.Errorf("expected 2 dead letters, got %d", len(deadLetters))
+	}
+}
+
+func TestNewEmailQueueSender(t *testing.T) {
+	// a custom sender does not require the SMTP server config
+	sent := []*Email{}
+	sender := senderFunc(func(e *Email) error {
+		sent = append(sent, e)
+		return nil
+	})
+	eq, err := NewEmailQueue(context.Background(), &EmailConfig{Address: "test@simpleauth.link"}, sender)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	e := &Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}
+	if err := eq.Send(e); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(sent) != 1 || sent[0] != e {
+		t.Errorf("expected %v sent, got %v", e, sent)
+	}
+	// without sender, the SMTP server config is required
+	if _, err := NewEmailQueue(context.Background(), &EmailConfig{Address: "test@simpleauth.link"}); err != ErrInvalidConfig {
+		t.Errorf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+	if eq, err := NewEmailQueue(context.Background(), testEmailConfig); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	} else if _, ok := eq.sender.(*SMTPSender); !ok {
+		t.Errorf("expected SMTPSender by default, got %T", eq.sender)
+	}
+}
+
+// deadLetterStoreFunc type allows to use a function as a DeadLetterStore.
+type deadLetterStoreFunc func(e *Email, sendErr error) error
+
+func (fn deadLetterStoreFunc) StoreDeadLetter(e *Email, sendErr error) error {
+	return fn(e, sendErr)
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	cfg := *testEmailConfig
+	cfg.SendRetries = 2
+	cfg.RetryBaseDelay = time.Millisecond
+	eq, err := NewEmailQueue(context.Background(), &cfg, senderFunc(func(*Email) error {
+		return fmt.Errorf("smtp server unavailable")
+	}))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	var stored []*Email
+	var storedErr error
+	eq.SetDeadLetterStore(deadLetterStoreFunc(func(e *Email, sendErr error) error {
+		stored = append(stored, e)
+		storedErr = sendErr
+		return nil
+	}))
+	e := &Email{To: "user@simpleauth.link", Subject: "test", Body: "test"}
+	if err := eq.Send(e); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if len(stored) != 1 || stored[0] != e {
+		t.Errorf("expected %v stored, got %v", e, stored)
+	}
+	if storedErr == nil || storedErr.Error() != "smtp server unavailable" {
+		t.Errorf("expected the last error stored, got %v", storedErr)
+	}
+}
+
+func TestMaxDeadLetters(t *testing.T) {
+	cfg := *testEmailConfig
+	cfg.MaxDeadLetters = 2
+	eq, err := NewEmailQueue(context.Background(), &cfg)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	stored := 0
+	eq.SetDeadLetterStore(deadLetterStoreFunc(func(*Email, error) error {
+		stored++
+		return nil
+	}))
+	for _, subject := range []string{"first", "second", "third"} {
+		_ = eq.deadLetter(&Email{To: "user@simpleauth.link", Subject: subject, Body: "test"}, fmt.Errorf("failed"))
+	}
+	// only the last dead letters are kept in memory, but all are stored
+	deadLetters := eq.DeadLetters()
+	if len(deadLetters) != 2 || deadLetters[0].Subject != "second" || deadLetters[1].Subject != "third" {
+		t.Errorf("expected second and third dead letters, got %v", deadLetters)
+	}
+	if stored != 3 {
+		t.Errorf("expected 3 stored dead letters, got %d", stored)
+	}
+}
+
+// memoryPendingStore struct implements the PendingStore interface keeping the
+// pending emails in memory, in the order they are stored.
+type memoryPendingStore struct {
+	mtx    sync.Mutex
+	nextId int
+	emails []*Email
+}
+
+func (store *memoryPendingStore) StorePending(e *Email) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	store.nextId++
+	e.ID = fmt.Sprint(store.nextId)
+	store.emails = append(store.emails, e)
+	return nil
+}
+
+func (store *memoryPendingStore) DeletePending(e *Email) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	for i, pending := range store.emails {
+		if pending.ID == e.ID {
+			store.emails = append(store.emails[:i], store.emails[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *memoryPendingStore) PendingEmails() ([]*Email, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	return append([]*Email{}, store.emails...), nil
+}
+
+func TestPendingStoreRestart(t *testing.T) {
+	store := &memoryPendingStore{}
+	// push some emails and stop the queue before sending them, like a crash
+	eq, err := NewEmailQueue(context.Background(), testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	eq.SetPendingStore(store)
+	for _, subject := range []string{"first", "second"} {
+		if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: subject, Body: "test"}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	eq.Stop()
+	if pending, _ := store.PendingEmails(); len(pending) != 2 {
+		t.Fatalf("expected 2 pending emails, got %d", len(pending))
+	}
+	// a new queue with the same store recovers and sends them
+	eq, err = NewEmailQueue(context.Background(), testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	eq.SetPendingStore(store)
+	sent := make(chan string, 2)
+	eq.send = func(e *Email) error {
+		sent <- e.Subject
+		return nil
+	}
+	eq.Start()
+	defer eq.Stop()
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case subject := <-sent:
+			if subject != expected {
+				t.Errorf("expected %s, got %s", expected, subject)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s sent", expected)
+		}
+	}
+	// the sent emails are deleted from the store
+	deadline := time.Now().Add(time.Second)
+	for {
+		pending, _ := store.PendingEmails()
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no pending emails, got %d", len(pending))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPendingStoreRestartDomainsNotLoaded(t *testing.T) {
+	var available atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !available.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("disposable.com\n"))
+	}))
+	defer srv.Close()
+	store := &memoryPendingStore{}
+	if err := store.StorePending(&Email{To: "user@simpleauth.link", Subject: "pending", Body: "test"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// the queue restarts with the strict check before loading the domains
+	cfg := *testEmailConfig
+	cfg.DisposableSrc = srv.URL
+	cfg.StrictDisposableCheck = true
+	eq, err := NewEmailQueue(context.Background(), &cfg)
+	if eq == nil || err == nil {
+		t.Fatalf("expected queue and loading error, got %v and %v", eq, err)
+	}
+	eq.SetPendingStore(store)
+	sent := make(chan string, 1)
+	eq.send = func(e *Email) error {
+		sent <- e.Subject
+		return nil
+	}
+	eq.Start()
+	defer eq.Stop()
+	// the pending email is kept until the domains are loaded
+	select {
+	case subject := <-sent:
+		t.Fatalf("expected no email sent, got %s", subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if pending, _ := store.PendingEmails(); len(pending) != 1 {
+		t.Fatalf("expected 1 pending email, got %d", len(pending))
+	}
+	available.Store(true)
+	if err := eq.loadDisposableDomains(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	select {
+	case subject := <-sent:
+		if subject != "pending" {
+			t.Errorf("expected pending, got %s", subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected pending email sent")
+	}
+}
+
+func TestDeliverLogsRequestID(t *testing.T) {
+	eq, err := NewEmailQueue(context.Background(), testEmailConfig)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	buf := &bytes.Buffer{}
+	eq.SetLogger(logger.NewSlogLogger(slog.New(slog.NewTextHandler(buf, nil))))
+	eq.send = func(e *Email) error {
+		return fmt.Errorf("smtp server unavailable")
+	}
+	e := &Email{To: "user@simpleauth.link", Subject: "test", Body: "test", RequestID: "test-request"}
+	if err := eq.Push(e); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := eq.Drain(ctx); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	out := buf.String()
+	for _, expected := range []string{`msg="error sending email"`, "request_id=test-request", "smtp server unavailable"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in %q", expected, out)
+		}
+	}
+}
+
+// batchRecorder struct implements the BatchSender interface recording the
+// subjects of the emails of every batch and of every single send. The batch
+// errors are returned by subject.
+type batchRecorder struct {
+	mtx       sync.Mutex
+	batches   [][]string
+	singles   []string
+	batchErrs map[string]error
+	sent      chan struct{}
+}
+
+func (br *batchRecorder) Send(e *Email) error {
+	br.mtx.Lock()
+	br.singles = append(br.singles, e.Subject)
+	br.mtx.Unlock()
+	br.sent <- struct{}{}
+	return nil
+}
+
+func (br *batchRecorder) SendBatch(emails []*Email) []error {
+	br.mtx.Lock()
+	batch := []string{}
+	errs := make([]error, len(emails))
+	for i, e := range emails {
+		batch = append(batch, e.Subject)
+		errs[i] = br.batchErrs[e.Subject]
+	}
+	br.batches = append(br.batches, batch)
+	br.mtx.Unlock()
+	br.sent <- struct{}{}
+	return errs
+}
+
+// wait method waits for the provided number of sends, batched or not.
+func (br *batchRecorder) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-br.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d sends, got %d", n, i)
+		}
+	}
+}
+
+func TestBatchSend(t *testing.T) {
+	newQueue := func(cfg EmailConfig, recorder *batchRecorder, subjects ...string) *EmailQueue {
+		t.Helper()
+		eq, err := NewEmailQueue(context.Background(), &cfg, recorder)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		for _, subject := range subjects {
+			if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: subject, Body: "test"}); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+		}
+		return eq
+	}
+	cfg := *testEmailConfig
+	cfg.RetryBaseDelay = time.Millisecond
+	// the emails are sent one by one by default
+	recorder := &batchRecorder{sent: make(chan struct{}, 10)}
+	eq := newQueue(cfg, recorder, "1", "2")
+	eq.Start()
+	recorder.wait(t, 2)
+	eq.Stop()
+	if len(recorder.batches) != 0 || fmt.Sprint(recorder.singles) != "[1 2]" {
+		t.Errorf("expected single sends, got %v and %v", recorder.batches, recorder.singles)
+	}
+	// the emails are grouped up to the batch size, the last batch is sent
+	// once the interval elapses
+	cfg.BatchSize, cfg.BatchInterval = 3, 100*time.Millisecond
+	recorder = &batchRecorder{sent: make(chan struct{}, 10)}
+	eq = newQueue(cfg, recorder, "1", "2", "3", "4", "5")
+	start := time.Now()
+	eq.Start()
+	recorder.wait(t, 2)
+	elapsed := time.Since(start)
+	eq.Stop()
+	if fmt.Sprint(recorder.batches) != "[[1 2 3] [4 5]]" || len(recorder.singles) != 0 {
+		t.Errorf("expected two batches, got %v and %v", recorder.batches, recorder.singles)
+	}
+	if elapsed < cfg.BatchInterval {
+		t.Errorf("expected the last batch sent after %v, got %v", cfg.BatchInterval, elapsed)
+	}
+	// the high priority emails are not delayed
+	cfg.BatchInterval = time.Minute
+	recorder = &batchRecorder{sent: make(chan struct{}, 10)}
+	eq = newQueue(cfg, recorder)
+	if err := eq.Push(&Email{To: "user@simpleauth.link", Subject: "urgent", Body: "test", Priority: HighPriority}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	eq.Start()
+	recorder.wait(t, 1)
+	eq.Stop()
+	if fmt.Sprint(recorder.batches) != "[[urgent]]" {
+		t.Errorf("expected the urgent batch, got %v", recorder.batches)
+	}
+	// the transient failures are retried one by one and the permanent ones
+	// are moved to the dead letters
+	cfg.BatchInterval = 10 * time.Millisecond
+	recorder = &batchRecorder{sent: make(chan struct{}, 10), batchErrs: map[string]error{
+		"transient": &textproto.Error{Code: 451, Msg: "try again later"},
+		"permanent": &textproto.Error{Code: 550, Msg: "no such user"},
+	}}
+	eq = newQueue(cfg, recorder, "sent", "transient", "permanent")
+	eq.Start()
+	recorder.wait(t, 2)
+	eq.Stop()
+	if fmt.Sprint(recorder.batches) != "[[sent transient permanent]]" || fmt.Sprint(recorder.singles) != "[transient]" {
+		t.Errorf("expected the transient email retried, got %v and %v", recorder.batches, recorder.singles)
+	}
+	if deadLetters := eq.DeadLetters(); len(deadLetters) != 1 || deadLetters[0].Subject != "permanent" {
+		t.Errorf("expected the permanent email in dead letters, got %v", deadLetters)
+	}
+}
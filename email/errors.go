@@ -12,8 +12,20 @@ var (
 	// ErrLoadingDisposableDomains is the error returned when the disposable
 	// domains cannot be loaded.
 	ErrLoadingDisposableDomains = fmt.Errorf("error loading disposable domains")
+	// ErrDisposableDomainsNotLoaded is the error returned when an address is
+	// checked strictly before the disposable domains are loaded.
+	ErrDisposableDomainsNotLoaded = fmt.Errorf("disposable domains not loaded")
 	// ErrDisallowedDomain is the error returned when the domain is disallowed.
 	ErrDisallowedDomain = fmt.Errorf("disallowed domain")
 	// ErrInvalidEmail is the error returned when the email is invalid.
 	ErrInvalidEmail = fmt.Errorf("invalid email")
+	// ErrInvalidTemplatePath is the error returned when a template path
+	// escapes the templates root directory.
+	ErrInvalidTemplatePath = fmt.Errorf("invalid template path")
+	// ErrQueueStopped is the error returned when an email is pushed to a
+	// stopped queue.
+	ErrQueueStopped = fmt.Errorf("email queue stopped")
+	// ErrPermanentFailure is the error returned when an email is rejected
+	// permanently by the SMTP server (a 5xx reply), so it is not retried.
+	ErrPermanentFailure = fmt.Errorf("permanent delivery failure")
 )
@@ -0,0 +1,313 @@
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// htmlContentType and textContentType are the content types of the html and
+// the plaintext parts of the emails.
+const (
+	htmlContentType = "text/html; charset=UTF-8"
+	textContentType = "text/plain; charset=UTF-8"
+)
+
+// smtpTimeout is the maximum time to connect to the SMTP server and deliver
+// an email.
+const smtpTimeout = time.Minute
+
+// TLSMode type represents how the connection with the SMTP server is secured.
+type TLSMode string
+
+const (
+	// TLSModeDefault mode uses smtp.SendMail, that upgrades the connection
+	// with STARTTLS if the server supports it. It is the default mode.
+	TLSModeDefault TLSMode = ""
+	// TLSModeNone mode uses a plaintext connection, even if the server
+	// supports STARTTLS. The credentials are only sent over plaintext
+	// connections to localhost.
+	TLSModeNone TLSMode = "none"
+	// TLSModeSTARTTLS mode requires to upgrade the connection with STARTTLS,
+	// it fails if the server does not support it.
+	TLSModeSTARTTLS TLSMode = "starttls"
+	// TLSModeImplicit mode uses a TLS connection from the start, usually on
+	// port 465.
+	TLSModeImplicit TLSMode = "implicit"
+)
+
+// valid method returns if the TLS mode is one of the supported ones.
+func (mode TLSMode) valid() bool {
+	switch mode {
+	case TLSModeDefault, TLSModeNone, TLSModeSTARTTLS, TLSModeImplicit:
+		return true
+	}
+	return false
+}
+
+// SMTPSender struct represents the Sender that delivers the emails using an
+// SMTP server. It includes the email configuration, with the server params
+// and the credentials, and the function used to deliver the messages to the
+// server (smtp.SendMail by default, sendMailTLS if a TLS mode is set).
+type SMTPSender struct {
+	cfg      *EmailConfig
+	sendMail func(string, smtp.Auth, string, []string, []byte) error
+}
+
+// NewSMTPSender function creates a new SMTPSender with the provided
+// configuration.
+func NewSMTPSender(cfg *EmailConfig) *SMTPSender {
+	sender := &SMTPSender{cfg: cfg, sendMail: smtp.SendMail}
+	if cfg.TLSMode != TLSModeDefault {
+		sender.sendMail = sender.sendMailTLS
+	}
+	return sender
+}
+
+// Send method sends the email using the SMTP server of the configuration. It
+// uses the email address as the sender address and the username for the SMTP
+// server. It composes the email message, creates the auth object with the
+// email credentials, the server string with the host and the port, and the
+// receipts. Finally, it sends the email. If something fails during the
+// process, it returns an error.
+func (ss *SMTPSender) Send(e *Email) error {
+	// compose the email body
+	body, err := ss.encodeEmail(e)
+	if err != nil {
+		return fmt.Errorf("error composing email: %w", err)
+	}
+	// create the auth object with the email credentials
+	auth := smtp.PlainAuth("", ss.cfg.Address, ss.cfg.Password, ss.cfg.EmailHost)
+	// create the server string with the host and the port and the receipts
+	server := fmt.Sprintf("%s:%d", ss.cfg.EmailHost, ss.cfg.EmailPort)
+	receipts := []string{e.To}
+	// send the email
+	if err := ss.sendMail(server, auth, ss.cfg.Address, receipts, body); err != nil {
+		return fmt.Errorf("error sending email: %w", err)
+	}
+	return nil
+}
+
+// SendBatch method sends the provided emails in a single session with the
+// SMTP server of the configuration, one transaction per email, like Send
+// does for each one. It returns the error of each email in the same order,
+// nil if it was sent. If the connection with the server fails, every email
+// gets the same error, and if the server rejects an email, the transaction
+// is reset to continue with the next one.
+func (ss *SMTPSender) SendBatch(emails []*Email) []error {
+	errs := make([]error, len(emails))
+	// connect to the server with the email credentials
+	auth := smtp.PlainAuth("", ss.cfg.Address, ss.cfg.Password, ss.cfg.EmailHost)
+	server := fmt.Sprintf("%s:%d", ss.cfg.EmailHost, ss.cfg.EmailPort)
+	client, conn, err := ss.connect(server, auth)
+	if err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("error sending email: %w", err)
+		}
+		return errs
+	}
+	defer client.Close()
+	for i, e := range emails {
+		body, err := ss.encodeEmail(e)
+		if err != nil {
+			errs[i] = fmt.Errorf("error composing email: %w", err)
+			continue
+		}
+		// extend the deadline of the connection for every email
+		if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+			errs[i] = fmt.Errorf("error sending email: %w", err)
+			continue
+		}
+		if err := sendMessage(client, ss.cfg.Address, []string{e.To}, body); err != nil {
+			errs[i] = fmt.Errorf("error sending email: %w", err)
+			// reset the transaction to continue with the next email, the
+			// rest of the emails fail if the session is broken
+			if err := client.Reset(); err != nil {
+				for j := i + 1; j < len(emails); j++ {
+					errs[j] = fmt.Errorf("error sending email: %w", err)
+				}
+				return errs
+			}
+		}
+	}
+	// the emails are already accepted by the server
+	_ = client.Quit()
+	return errs
+}
+
+// permanentFailure function returns if the provided error of a sender is a
+// permanent failure, which is a 5xx reply of the SMTP server (for example,
+// "550 no such user"), that would fail again if the email is retried. The
+// rest of the errors, including the transient 4xx replies and the connection
+// errors, can be retried.
+func permanentFailure(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500 && smtpErr.Code < 600
+}
+
+// sendMailTLS method delivers the provided message to the SMTP server on the
+// provided address, like smtp.SendMail, but securing the connection as the
+// configured TLS mode sets (see connect). If something fails during the
+// process, it returns an error.
+func (ss *SMTPSender) sendMailTLS(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	client, _, err := ss.connect(addr, auth)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := sendMessage(client, from, to, msg); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// connect method opens a session with the SMTP server on the provided
+// address, securing the connection as the configured TLS mode sets, and
+// authenticates it with the provided auth, if any. It uses the configured TLS
+// config (if any), setting the email host as the server name if it is empty.
+// In the default mode, the connection is upgraded with STARTTLS if the
+// server supports it, like smtp.SendMail does. It returns the client of the
+// session and its connection, which expires after smtpTimeout. If something
+// fails during the process, it returns an error.
+func (ss *SMTPSender) connect(addr string, auth smtp.Auth) (*smtp.Client, net.Conn, error) {
+	tlsConfig := &tls.Config{}
+	if ss.cfg.TLSConfig != nil {
+		tlsConfig = ss.cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = ss.cfg.EmailHost
+	}
+	// connect to the server, using TLS from the start in implicit mode
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if ss.cfg.TLSMode == TLSModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to smtp server: %w", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	client, err := smtp.NewClient(conn, ss.cfg.EmailHost)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error connecting to smtp server: %w", err)
+	}
+	// upgrade the connection in starttls mode, and in the default mode if
+	// the server supports it
+	if ss.cfg.TLSMode == TLSModeSTARTTLS || ss.cfg.TLSMode == TLSModeDefault {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, nil, fmt.Errorf("error starting tls: %w", err)
+			}
+		} else if ss.cfg.TLSMode == TLSModeSTARTTLS {
+			client.Close()
+			return nil, nil, fmt.Errorf("smtp server does not support STARTTLS")
+		}
+	}
+	// authenticate the session
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			client.Close()
+			return nil, nil, fmt.Errorf("smtp server does not support AUTH")
+		}
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+	}
+	return client, conn, nil
+}
+
+// sendMessage function delivers the provided message from the provided
+// address to the provided recipients in a transaction of the provided
+// session. If the server rejects the transaction, it returns an error.
+func sendMessage(client *smtp.Client, from string, to []string, msg []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// encodeEmail method encodes the email to a byte slice. It validates the from
+// and to addresses, sets the headers for the html email, and writes the body.
+// If the email has a plaintext body, it composes a multipart/alternative
+// message with the plaintext and the html parts. It returns the encoded email
+// or an error if something fails during the process.
+func (ss *SMTPSender) encodeEmail(email *Email) ([]byte, error) {
+	// validate from address
+	from, err := mail.ParseAddress(ss.cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing address: %w", err)
+	}
+	// validate to address
+	to, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing address: %w", err)
+	}
+	// compose the multipart body if the email has a plaintext version
+	body := email.Body
+	contentType := htmlContentType
+	if email.TextBody != "" {
+		var parts bytes.Buffer
+		writer := multipart.NewWriter(&parts)
+		for _, part := range []struct{ contentType, body string }{
+			{textContentType, email.TextBody},
+			{htmlContentType, email.Body},
+		} {
+			partWriter, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+			if err != nil {
+				return nil, fmt.Errorf("error composing email: %w", err)
+			}
+			if _, err := partWriter.Write([]byte(part.body)); err != nil {
+				return nil, fmt.Errorf("error composing email: %w", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("error composing email: %w", err)
+		}
+		body = parts.String()
+		contentType = fmt.Sprintf("multipart/alternative; boundary=%q", writer.Boundary())
+	}
+	// set headers for the email
+	header := textproto.MIMEHeader{}
+	header.Set(textproto.CanonicalMIMEHeaderKey("from"), from.Address)
+	header.Set(textproto.CanonicalMIMEHeaderKey("to"), to.Address)
+	header.Set(textproto.CanonicalMIMEHeaderKey("content-type"), contentType)
+	header.Set(textproto.CanonicalMIMEHeaderKey("mime-version"), "1.0")
+	header.Set(textproto.CanonicalMIMEHeaderKey("subject"), email.Subject)
+	// init empty message
+	var buffer bytes.Buffer
+	// write header
+	for key, value := range header {
+		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", key, value[0]))
+	}
+	// write body
+	buffer.WriteString(fmt.Sprintf("\r\n%s", body))
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,402 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTLSConfigs function generates a self-signed certificate for localhost
+// and returns the TLS config for the test server and the TLS config for the
+// client that trusts it.
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return serverConfig, &tls.Config{RootCAs: roots}
+}
+
+// testSMTPServer struct represents a minimal SMTP server for testing. It
+// records the messages received and if they were received over TLS. The
+// rcptReplies are the replies to the next RCPT commands, in order, which are
+// accepted once there are no more replies, rcpts counts the RCPT commands
+// received and sessions counts the connections.
+type testSMTPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	starttls    bool
+	mtx         sync.Mutex
+	messages    []string
+	secured     []bool
+	rcptReplies []string
+	rcpts       int
+	sessions    int
+}
+
+// startTestSMTPServer function starts a test SMTP server on a random port of
+// localhost. If implicit is true, it only accepts TLS connections. If
+// starttls is true, it supports upgrading the connections with STARTTLS. It
+// returns the server and its port.
+func startTestSMTPServer(t *testing.T, tlsConfig *tls.Config, implicit, starttls bool) (*testSMTPServer, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	srv := &testSMTPServer{listener: listener, tlsConfig: tlsConfig, starttls: starttls}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn, implicit)
+		}
+	}()
+	return srv, listener.Addr().(*net.TCPAddr).Port
+}
+
+// serve method handles the SMTP session of the provided connection.
+func (srv *testSMTPServer) serve(conn net.Conn, secured bool) {
+	defer func() { conn.Close() }()
+	srv.mtx.Lock()
+	srv.sessions++
+	srv.mtx.Unlock()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			_, _ = writer.WriteString(line + "\r\n")
+		}
+		_ = writer.Flush()
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			if srv.starttls && !secured {
+				reply("250-localhost", "250-STARTTLS", "250 AUTH PLAIN")
+			} else {
+				reply("250-localhost", "250 AUTH PLAIN")
+			}
+		case cmd == "STARTTLS":
+			reply("220 ready to start tls")
+			tlsConn := tls.Server(conn, srv.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secured = tlsConn, true
+			reader, writer = bufio.NewReader(conn), bufio.NewWriter(conn)
+		case strings.HasPrefix(cmd, "AUTH"):
+			reply("235 authenticated")
+		case strings.HasPrefix(cmd, "RCPT"):
+			srv.mtx.Lock()
+			srv.rcpts++
+			rcptReply := "250 ok"
+			if len(srv.rcptReplies) > 0 {
+				rcptReply, srv.rcptReplies = srv.rcptReplies[0], srv.rcptReplies[1:]
+			}
+			srv.mtx.Unlock()
+			reply(rcptReply)
+		case cmd == "DATA":
+			reply("354 send the message")
+			var msg strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			srv.mtx.Lock()
+			srv.messages = append(srv.messages, msg.String())
+			srv.secured = append(srv.secured, secured)
+			srv.mtx.Unlock()
+			reply("250 ok")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSendTLSModes(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	tests := []struct {
+		name            string
+		mode            TLSMode
+		implicit        bool
+		starttls        bool
+		expectedErr     bool
+		expectedSecured bool
+	}{
+		{"implicit", TLSModeImplicit, true, false, false, true},
+		{"starttls", TLSModeSTARTTLS, false, true, false, true},
+		{"starttls not supported", TLSModeSTARTTLS, false, false, true, false},
+		{"none", TLSModeNone, false, true, false, false},
+	}
+	for _, tc := range tests {
+		srv, port := startTestSMTPServer(t, serverConfig, tc.implicit, tc.starttls)
+		cfg := &EmailConfig{
+			Address:     "test@simpleauth.link",
+			EmailHost:   "localhost",
+			EmailPort:   port,
+			Password:    "password",
+			SendRetries: 1,
+			TLSMode:     tc.mode,
+			TLSConfig:   clientConfig,
+		}
+		eq, err := NewEmailQueue(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("%s: expected nil, got %v", tc.name, err)
+		}
+		err = eq.Send(&Email{To: "user@simpleauth.link", Subject: "test", Body: "hello"})
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got nil", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expected nil, got %v", tc.name, err)
+		}
+		srv.mtx.Lock()
+		if len(srv.messages) != 1 || !strings.Contains(srv.messages[0], "hello") {
+			t.Errorf("%s: expected 1 message with the body, got %v", tc.name, srv.messages)
+		} else if srv.secured[0] != tc.expectedSecured {
+			t.Errorf("%s: expected secured %v, got %v", tc.name, tc.expectedSecured, srv.secured[0])
+		}
+		srv.mtx.Unlock()
+	}
+	// unknown modes are rejected
+	cfg := *testEmailConfig
+	cfg.TLSMode = "ssl"
+	if _, err := NewEmailQueue(context.Background(), &cfg); err != ErrInvalidConfig {
+		t.Errorf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+}
+
+func TestSendSMTPFailures(t *testing.T) {
+	srv, port := startTestSMTPServer(t, nil, false, false)
+	cfg := &EmailConfig{
+		Address:        "test@simpleauth.link",
+		EmailHost:      "localhost",
+		EmailPort:      port,
+		Password:       "password",
+		SendRetries:    3,
+		RetryBaseDelay: 10 * time.Millisecond,
+		TLSMode:        TLSModeNone,
+	}
+	eq, err := NewEmailQueue(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	var storedErr error
+	eq.SetDeadLetterStore(deadLetterStoreFunc(func(_ *Email, sendErr error) error {
+		storedErr = sendErr
+		return nil
+	}))
+	e := &Email{To: "user@simpleauth.link", Subject: "test", Body: "hello"}
+	// the transient failures (4xx) are retried
+	srv.mtx.Lock()
+	srv.rcptReplies = []string{"451 4.3.0 try again later", "421 4.7.0 too many connections"}
+	srv.mtx.Unlock()
+	if err := eq.Send(e); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	srv.mtx.Lock()
+	if srv.rcpts != 3 || len(srv.messages) != 1 {
+		t.Errorf("expected 3 attempts and 1 message, got %d and %d", srv.rcpts, len(srv.messages))
+	}
+	// the permanent failures (5xx) fail fast and are dead-lettered with the
+	// reply of the server
+	srv.rcpts, srv.rcptReplies = 0, []string{"550 5.1.1 no such user"}
+	srv.mtx.Unlock()
+	if err := eq.Send(e); !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected %v, got %v", ErrPermanentFailure, err)
+	}
+	srv.mtx.Lock()
+	if srv.rcpts != 1 {
+		t.Errorf("expected 1 attempt, got %d", srv.rcpts)
+	}
+	srv.mtx.Unlock()
+	if deadLetters := eq.DeadLetters(); len(deadLetters) != 1 || deadLetters[0] != e {
+		t.Errorf("expected %v in dead letters, got %v", e, deadLetters)
+	}
+	if storedErr == nil || !strings.Contains(storedErr.Error(), "550") || !strings.Contains(storedErr.Error(), "no such user") {
+		t.Errorf("expected the smtp reply stored, got %v", storedErr)
+	}
+	// the transient failures are dead-lettered after all the attempts
+	srv.mtx.Lock()
+	srv.rcpts, srv.rcptReplies = 0, []string{"450 busy", "450 busy", "450 busy"}
+	srv.mtx.Unlock()
+	if err := eq.Send(e); err == nil || errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	srv.mtx.Lock()
+	if srv.rcpts != 3 {
+		t.Errorf("expected 3 attempts, got %d", srv.rcpts)
+	}
+	srv.mtx.Unlock()
+}
+
+func TestSendBatchSMTP(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	srv, port := startTestSMTPServer(t, serverConfig, false, true)
+	sender := NewSMTPSender(&EmailConfig{
+		Address:   "test@simpleauth.link",
+		EmailHost: "localhost",
+		EmailPort: port,
+		Password:  "password",
+		TLSConfig: clientConfig,
+	})
+	// the second recipient is rejected, the rest of the emails are sent
+	srv.mtx.Lock()
+	srv.rcptReplies = []string{"250 ok", "550 5.1.1 no such user"}
+	srv.mtx.Unlock()
+	errs := sender.SendBatch([]*Email{
+		{To: "first@simpleauth.link", Subject: "test", Body: "first"},
+		{To: "unknown@simpleauth.link", Subject: "test", Body: "second"},
+		{To: "third@simpleauth.link", Subject: "test", Body: "third"},
+	})
+	if len(errs) != 3 || errs[0] != nil || !permanentFailure(errs[1]) || errs[2] != nil {
+		t.Fatalf("expected only the second email rejected, got %v", errs)
+	}
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	if srv.sessions != 1 {
+		t.Errorf("expected 1 session, got %d", srv.sessions)
+	}
+	if len(srv.messages) != 2 || !strings.Contains(srv.messages[0], "first") || !strings.Contains(srv.messages[1], "third") {
+		t.Errorf("expected the first and third messages, got %v", srv.messages)
+	}
+	// the default mode upgrades the connection if the server supports it
+	if len(srv.secured) != 2 || !srv.secured[0] || !srv.secured[1] {
+		t.Errorf("expected secured messages, got %v", srv.secured)
+	}
+	// the connection errors are returned for every email
+	srv.listener.Close()
+	for _, err := range sender.SendBatch([]*Email{{To: "user@simpleauth.link", Subject: "test", Body: "test"}}) {
+		if err == nil || permanentFailure(err) {
+			t.Errorf("expected connection error, got %v", err)
+		}
+	}
+}
+
+func TestEncodeEmailMultipart(t *testing.T) {
+	sender := NewSMTPSender(testEmailConfig)
+	// without plaintext body, it is a single html part
+	encoded, err := sender.encodeEmail(&Email{To: "user@simpleauth.link", Subject: "test", Body: "<p>hello</p>"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if contentType := msg.Header.Get("Content-Type"); contentType != htmlContentType {
+		t.Errorf("expected %s, got %s", htmlContentType, contentType)
+	}
+	// with plaintext body, it is a multipart/alternative message with the
+	// plaintext part first
+	textBody, err := UserEmailText(NewUserEmailData("Test App", "user@simpleauth.link",
+		"https://simpleauth.link/callback?token=test", "test", ""))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !strings.Contains(textBody, "https://simpleauth.link/callback?token=test") {
+		t.Errorf("expected magic link in text body, got %s", textBody)
+	}
+	encoded, err = sender.encodeEmail(&Email{
+		To:       "user@simpleauth.link",
+		Subject:  "test",
+		Body:     "<p>hello</p>",
+		TextBody: textBody,
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	msg, err = mail.ReadMessage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if mediaType != "multipart/alternative" || params["boundary"] == "" {
+		t.Fatalf("expected multipart/alternative with boundary, got %s %v", mediaType, params)
+	}
+	if !bytes.Contains(encoded, []byte("--"+params["boundary"]+"--")) {
+		t.Errorf("expected closing boundary in the message")
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for _, expected := range []struct{ contentType, body string }{
+		{textContentType, textBody},
+		{htmlContentType, "<p>hello</p>"},
+	} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if contentType := part.Header.Get("Content-Type"); contentType != expected.contentType {
+			t.Errorf("expected %s, got %s", expected.contentType, contentType)
+		}
+		if body, _ := io.ReadAll(part); string(body) != expected.body {
+			t.Errorf("expected %q, got %q", expected.body, string(body))
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected only two parts, got %v", err)
+	}
+}
@@ -2,18 +2,85 @@ package email
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"text/template"
 )
 
+// templateKeyRgx is the regular expression used to validate the keys of the
+// token email templates, which are short identifiers, to prevent them from
+// being used as paths.
+var templateKeyRgx = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// localeRgx is the regular expression used to validate the locales of the
+// recipients, which are language tags like "es" or "pt-BR", to prevent them
+// from being used as paths when the localized templates are resolved.
+var localeRgx = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8}){0,2}$`)
+
+// userTextTemplate and appTextTemplate are the templates of the plaintext
+// versions of the token and app emails, sent as fallback of the html ones.
+var (
+	userTextTemplate = template.Must(template.New("user").Parse(`Hi, {{.EmailHandler}}!
+{{if .MagicLink}}
+Your magic link to login to '{{.AppName}}' is ready. Open the following link in your browser to login to your account:
+
+{{.MagicLink}}
+
+Your token: {{.Token}}
+{{end}}{{if .Code}}
+Your code to login to '{{.AppName}}': {{.Code}}
+
+It expires in {{.CodeMinutes}} minutes.
+{{end}}
+If you did not request this, please ignore this email.
+`))
+	appTextTemplate = template.Must(template.New("app").Parse(`Hi, {{.EmailHandler}}!
+
+Your app '{{.AppName}}' has been successfully created. Here are the details of your app:
+
+App ID: {{.AppID}}
+App Name: {{.AppName}}
+App Secret: {{.Secret}}
+Redirect URL: {{.RedirectURL}}
+
+Check out the documentation to get started integrating SimpleAuth with your app: https://docs.simpleauth.link/
+
+Remember to keep your app secret safe and secure. You can always regenerate a new app secret.
+`))
+	quotaTextTemplate = template.Must(template.New("quota").Parse(`Hi, {{.EmailHandler}}!
+
+Your app '{{.AppName}}' ({{.AppID}}) has {{.CurrentUsers}} active users of its quota of {{.UsersQuota}} users. Once the quota is reached, the new users will not be able to login.
+
+Update the users quota of your app or revoke the sessions that are not needed anymore.
+`))
+)
+
+// quotaHTMLTemplate is the template of the html version of the users quota
+// warning emails. Unlike the token and app emails, it is not configurable.
+var quotaHTMLTemplate = htmltemplate.Must(htmltemplate.New("quota").Parse(`<p>Hi, {{.EmailHandler}}!</p>
+<p>Your app '{{.AppName}}' ({{.AppID}}) has {{.CurrentUsers}} active users of its quota of {{.UsersQuota}} users. Once the quota is reached, the new users will not be able to login.</p>
+<p>Update the users quota of your app or revoke the sessions that are not needed anymore.</p>
+`))
+
 // UserEmailData struct includes the data required to fill the user email
-// template.
+// template. The MagicLink and the Token are empty if the app only uses
+// one-time codes, and the Code is empty if the app only uses magic links. The
+// Locale is the normalized locale of the recipient, if it is provided, to
+// allow the templates to include conditionals by language.
 type UserEmailData struct {
 	AppName      string
 	EmailHandler string
 	MagicLink    string
 	Token        string
+	Code         string
+	CodeMinutes  int
+	Locale       string
 }
 
 // AppEmailData struct includes the data required to fill the app email
@@ -26,13 +93,25 @@ type AppEmailData struct {
 	EmailHandler string
 }
 
-// NewUserEmailData creates a new UserEmailData with the provided data.
-func NewUserEmailData(appName, email, magicLink, token string) *UserEmailData {
+// QuotaEmailData struct includes the data required to fill the users quota
+// warning email template: the app, its current users and its users quota.
+type QuotaEmailData struct {
+	AppID        string
+	AppName      string
+	CurrentUsers int64
+	UsersQuota   int64
+	EmailHandler string
+}
+
+// NewUserEmailData creates a new UserEmailData with the provided data. The
+// locale is normalized (see NormalizeLocale).
+func NewUserEmailData(appName, email, magicLink, token, locale string) *UserEmailData {
 	return &UserEmailData{
 		AppName:      appName,
 		EmailHandler: emailHandler(email),
 		MagicLink:    magicLink,
 		Token:        token,
+		Locale:       NormalizeLocale(locale),
 	}
 }
 
@@ -47,12 +126,25 @@ func NewAppEmailData(appID, appName, redirectURL, secret, email string) *AppEmai
 	}
 }
 
-// ParseTemplate parses the template file provided with the data provided. It
+// NewQuotaEmailData creates a new QuotaEmailData with the provided data.
+func NewQuotaEmailData(appID, appName string, currentUsers, usersQuota int64, email string) *QuotaEmailData {
+	return &QuotaEmailData{
+		AppID:        appID,
+		AppName:      appName,
+		CurrentUsers: currentUsers,
+		UsersQuota:   usersQuota,
+		EmailHandler: emailHandler(email),
+	}
+}
+
+// ParseTemplate parses the template file provided with the data provided. If
+// a locale is provided, the locale-specific version of the template is used
+// if it exists (see LocalizedTemplatePath), the provided one otherwise. It
 // returns the parsed template as a string. If an error occurs, it returns the
 // error.
-func ParseTemplate(templatePath string, data interface{}) (string, error) {
-	// parse the template file provided
-	t, err := template.ParseFiles(templatePath)
+func ParseTemplate(templatePath, locale string, data interface{}) (string, error) {
+	// parse the template file provided, or its localized version
+	t, err := template.ParseFiles(LocalizedTemplatePath(templatePath, locale))
 	if err != nil {
 		return "", err
 	}
@@ -64,6 +156,178 @@ func ParseTemplate(templatePath string, data interface{}) (string, error) {
 	return buf.String(), nil
 }
 
+// UserEmailText returns the plaintext version of the token email filled with
+// the provided data. If an error occurs, it returns the error.
+func UserEmailText(data *UserEmailData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := userTextTemplate.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// AppEmailText returns the plaintext version of the app email filled with the
+// provided data. If an error occurs, it returns the error.
+func AppEmailText(data *AppEmailData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := appTextTemplate.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// QuotaEmailText returns the plaintext version of the users quota warning
+// email filled with the provided data. If an error occurs, it returns the
+// error.
+func QuotaEmailText(data *QuotaEmailData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := quotaTextTemplate.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// QuotaEmailHTML returns the html version of the users quota warning email
+// filled with the provided data, escaping it. If an error occurs, it returns
+// the error.
+func QuotaEmailHTML(data *QuotaEmailData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := quotaHTMLTemplate.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// ValidTemplateKey function returns if the provided key is a valid token
+// email template key, which only includes lowercase letters, digits, dashes
+// and underscores, up to 32 characters.
+func ValidTemplateKey(key string) bool {
+	return templateKeyRgx.MatchString(key)
+}
+
+// TokenTemplate method returns the path of the token email template
+// registered with the provided key. If the key is empty or there is no
+// template registered with it, it returns the default token email template.
+func (cfg *EmailConfig) TokenTemplate(key string) string {
+	if templatePath, ok := cfg.TokenEmailTemplates[key]; ok && key != "" {
+		return templatePath
+	}
+	return cfg.TokenEmailTemplate
+}
+
+// ValidLocale function returns if the provided locale is a valid language tag,
+// like "es" or "pt-BR", which only includes letters and digits separated by
+// dashes or underscores.
+func ValidLocale(locale string) bool {
+	return localeRgx.MatchString(locale)
+}
+
+// NormalizeLocale function returns the provided locale in lowercase and
+// using dashes as separators, for example, "pt-br" for "pt_BR". If the locale
+// is not valid, it returns an empty string.
+func NormalizeLocale(locale string) string {
+	if !ValidLocale(locale) {
+		return ""
+	}
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
+
+// LocalizedTemplatePath function returns the path of the version of the
+// provided template for the provided locale, which includes the normalized
+// locale before the extension of the file (for example,
+// "token_email_template.es.html" for "token_email_template.html" and "es").
+// If there is no template for the full locale, the one of its language is
+// used (for example, "es" for "es-MX"). If the locale is empty or not valid,
+// or there is no localized template, it returns the provided path.
+func LocalizedTemplatePath(templatePath, locale string) string {
+	locale = NormalizeLocale(locale)
+	if locale == "" {
+		return templatePath
+	}
+	ext := filepath.Ext(templatePath)
+	base := strings.TrimSuffix(templatePath, ext)
+	candidates := []string{locale}
+	if lang, _, found := strings.Cut(locale, "-"); found {
+		candidates = append(candidates, lang)
+	}
+	for _, candidate := range candidates {
+		localized := base + "." + candidate + ext
+		if _, err := os.Stat(localized); err == nil {
+			return localized
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return templatePath
+}
+
+// TemplatePath method resolves the provided template path relative to the
+// templates root directory of the config. The path is cleaned and, if it is
+// relative, joined to the root, then it must be contained in the root, so the
+// paths that escape it (for example, using "../") are rejected with an error
+// that wraps ErrInvalidTemplatePath. If the root is not set, the path is
+// returned as it is.
+func (cfg *EmailConfig) TemplatePath(templatePath string) (string, error) {
+	if cfg.TemplatesDir == "" {
+		return templatePath, nil
+	}
+	root, err := filepath.Abs(cfg.TemplatesDir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidTemplatePath, err)
+	}
+	resolved := filepath.Clean(templatePath)
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(root, resolved)
+	}
+	// the resolved path must be a file inside the root, not the root itself
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: '%s' is outside of '%s'", ErrInvalidTemplatePath, templatePath, cfg.TemplatesDir)
+	}
+	return resolved, nil
+}
+
+// ParseConfigTemplate method parses the template of the provided path,
+// resolved relative to the templates root directory of the config, with the
+// provided data, using its version for the provided locale if it exists. If
+// the path escapes the root or the template can not be parsed, it returns an
+// error.
+func (cfg *EmailConfig) ParseConfigTemplate(templatePath, locale string, data interface{}) (string, error) {
+	resolved, err := cfg.TemplatePath(templatePath)
+	if err != nil {
+		return "", err
+	}
+	return ParseTemplate(resolved, locale, data)
+}
+
+// ValidateTemplates checks that the token and app email templates of the
+// provided config, including the additional token email templates, can be
+// parsed and filled with sample data, to detect syntax errors or references
+// to missing fields before sending any email. It returns an error that
+// identifies the invalid template if any of them fails, escapes the templates
+// root directory or any additional template is registered with an invalid key.
+func ValidateTemplates(cfg *EmailConfig) error {
+	tokenData := NewUserEmailData("Sample App", "user@simpleauth.link",
+		"https://simpleauth.link/callback?token=sample", "sample", "")
+	if _, err := cfg.ParseConfigTemplate(cfg.TokenEmailTemplate, "", tokenData); err != nil {
+		return fmt.Errorf("invalid token email template '%s': %w", cfg.TokenEmailTemplate, err)
+	}
+	for key, templatePath := range cfg.TokenEmailTemplates {
+		if !ValidTemplateKey(key) {
+			return fmt.Errorf("invalid token email template key '%s'", key)
+		}
+		if _, err := cfg.ParseConfigTemplate(templatePath, "", tokenData); err != nil {
+			return fmt.Errorf("invalid token email template '%s': %w", templatePath, err)
+		}
+	}
+	appData := NewAppEmailData("sample", "Sample App", "https://simpleauth.link/callback",
+		"sample", "admin@simpleauth.link")
+	if _, err := cfg.ParseConfigTemplate(cfg.AppEmailTemplate, "", appData); err != nil {
+		return fmt.Errorf("invalid app email template '%s': %w", cfg.AppEmailTemplate, err)
+	}
+	return nil
+}
+
 // emailHandler method extracts the email handler from the email address. It
 // splits the email address by the "@" symbol and returns the first part.
 func emailHandler(emailAddress string) string {
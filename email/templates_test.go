@@ -0,0 +1,111 @@
+package email
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplatePath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "token.html"), []byte("<p>{{ .Token }}</p>"), 0o600); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	cfg := &EmailConfig{TemplatesDir: root}
+	tests := []struct {
+		templatePath string
+		expected     string
+		err          bool
+	}{
+		{"token.html", filepath.Join(root, "token.html"), false},
+		{"./emails/../token.html", filepath.Join(root, "token.html"), false},
+		{filepath.Join(root, "token.html"), filepath.Join(root, "token.html"), false},
+		{"../token.html", "", true},
+		{"emails/../../token.html", "", true},
+		{"../../../../etc/passwd", "", true},
+		{filepath.Join(root, "..", "token.html"), "", true},
+		{"/etc/passwd", "", true},
+		{root + "-other/token.html", "", true},
+		{".", "", true},
+		{"", "", true},
+	}
+	for _, tc := range tests {
+		got, err := cfg.TemplatePath(tc.templatePath)
+		if tc.err {
+			if !errors.Is(err, ErrInvalidTemplatePath) {
+				t.Errorf("%q: expected %v, got %v (%s)", tc.templatePath, ErrInvalidTemplatePath, err, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected nil, got %v", tc.templatePath, err)
+		} else if got != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.templatePath, tc.expected, got)
+		}
+	}
+	// the templates are parsed from the root
+	body, err := cfg.ParseConfigTemplate("token.html", "", &UserEmailData{Token: "sample"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !strings.Contains(body, "sample") {
+		t.Errorf("expected the token in the template, got %s", body)
+	}
+	if _, err := cfg.ParseConfigTemplate("../token.html", "", &UserEmailData{}); !errors.Is(err, ErrInvalidTemplatePath) {
+		t.Errorf("expected %v, got %v", ErrInvalidTemplatePath, err)
+	}
+	// without root, the paths are used as they are provided
+	if got, err := (&EmailConfig{}).TemplatePath("../token.html"); err != nil || got != "../token.html" {
+		t.Errorf("expected ../token.html, got %s (%v)", got, err)
+	}
+}
+
+func TestLocalizedTemplatePath(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"token.html":       "<p>Hi {{ .Token }}</p>",
+		"token.es.html":    "<p>Hola {{ .Token }} ({{ .Locale }})</p>",
+		"token.pt-br.html": "<p>Olá {{ .Token }}</p>",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	defaultPath := filepath.Join(root, "token.html")
+	tests := []struct {
+		locale   string
+		expected string
+	}{
+		{"", "token.html"},
+		{"es", "token.es.html"},
+		{"ES", "token.es.html"},
+		{"es-MX", "token.es.html"},
+		{"pt_BR", "token.pt-br.html"},
+		{"pt-BR", "token.pt-br.html"},
+		{"pt", "token.html"},
+		{"fr", "token.html"},
+		{"../es", "token.html"},
+		{"es/../../etc", "token.html"},
+	}
+	for _, tc := range tests {
+		if got := LocalizedTemplatePath(defaultPath, tc.locale); got != filepath.Join(root, tc.expected) {
+			t.Errorf("%q: expected %s, got %s", tc.locale, tc.expected, got)
+		}
+	}
+	// the localized templates are parsed with the locale of the data
+	cfg := &EmailConfig{TemplatesDir: root}
+	data := NewUserEmailData("app", "user@simpleauth.link", "", "sample", "es_MX")
+	body, err := cfg.ParseConfigTemplate("token.html", "es_MX", data)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if body != "<p>Hola sample (es-mx)</p>" {
+		t.Errorf("expected the spanish template, got %s", body)
+	}
+	// the unknown locales fall back to the default template
+	if body, err := cfg.ParseConfigTemplate("token.html", "fr", data); err != nil || body != "<p>Hi sample</p>" {
+		t.Errorf("expected the default template, got %s (%v)", body, err)
+	}
+}
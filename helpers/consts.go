@@ -1,15 +1,52 @@
 package helpers
 
+import (
+	"math"
+	"time"
+)
+
 const (
 	// TokenSeparator constant is the separator used to split the token into
 	// parts. It is a string with a value of "-".
 	TokenSeparator = "-"
 	// TokenQueryParam constant is the query parameter used to send the token in
-	// the request. It is a string with a value of "token".
+	// the request. It is a string with a value of "token". The token is sent as
+	// it was issued, the surrounding whitespace is ignored.
 	TokenQueryParam = "token"
+	// ScopeQueryParam constant is the query parameter used to require a scope
+	// when a token is validated. It is a string with a value of "scope".
+	ScopeQueryParam = "scope"
 	// AppSecretHeader constant is the header used to send the app secret in the
-	// request. It is a string with a value of "APP_SECRET".
+	// request. It is a string with a value of "APP_SECRET". The name of the
+	// header is case-insensitive and the secret is sent as it was issued, the
+	// surrounding whitespace is ignored.
 	AppSecretHeader = "APP_SECRET"
+	// AdminSecretHeader constant is the header used to send the service admin
+	// secret in the requests to the admin endpoints. It is a string with a
+	// value of "ADMIN_SECRET". Like the app secret, the surrounding whitespace
+	// is ignored.
+	AdminSecretHeader = "ADMIN_SECRET"
+	// TokenHeader constant is the header used to send the user token in the
+	// responses of the token requests, if the app allows it. It is a string
+	// with a value of "X-Auth-Token".
+	TokenHeader = "X-Auth-Token"
+	// RequestIDHeader constant is the header used to identify every request in
+	// the logs of the service. The clients can provide it, else it is
+	// generated, and it is always included in the response. It is a string
+	// with a value of "X-Request-ID".
+	RequestIDHeader = "X-Request-ID"
+	// WebhookSignatureHeader constant is the header used to send the
+	// signature of the events posted to the app webhooks, the hex encoded
+	// HMAC-SHA256 of the body using the app secret as the key. It is a string
+	// with a value of "X-Webhook-Signature".
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// LimitQueryParam constant is the query parameter used to limit the number
+	// of items of a paginated response. It is a string with a value of
+	// "limit".
+	LimitQueryParam = "limit"
+	// OffsetQueryParam constant is the query parameter used to skip items of a
+	// paginated response. It is a string with a value of "offset".
+	OffsetQueryParam = "offset"
 	// DefaultAPIEndpoint constant is the default API endpoint used by the
 	// client. It is a string with a value of "https://api.simpleauth.link/".
 	DefaultAPIEndpoint = "https://api.simpleauth.link/"
@@ -19,15 +56,139 @@ const (
 	// AppEndpointPath constant is the path used to API endpoints related to
 	// apps. It is a string with a value of "/app".
 	AppEndpointPath = "/app"
+	// AppConfigPath constant is the path used to get the integration config
+	// snippet of an app. It is a string with a value of "/app/config".
+	AppConfigPath = "/app/config"
+	// AppAttemptsPath constant is the path used to manage the attempts
+	// counters (rate limits and lockouts) of an app. It is a string with a
+	// value of "/app/attempts".
+	AppAttemptsPath = "/app/attempts"
+	// AppUsersPath constant is the path used to list the active sessions of
+	// the users of an app. It is a string with a value of "/app/users".
+	AppUsersPath = "/app/users"
+	// AppUserPath constant is the path used to revoke the tokens of a user of
+	// an app. It is a string with a value of "/app/user".
+	AppUserPath = "/app/user"
+	// AppTokensPath constant is the path used to list the tokens of an app,
+	// paginated. It is a string with a value of "/app/tokens".
+	AppTokensPath = "/app/tokens"
+	// AppSecretRotatePath constant is the path used to rotate the secret of
+	// an app. It is a string with a value of "/app/secret/rotate".
+	AppSecretRotatePath = "/app/secret/rotate"
+	// AppResendPath constant is the path used to send a new secret of an app
+	// to its admin email. It is a string with a value of "/app/resend".
+	AppResendPath = "/app/resend"
+	// AdminAppsPath constant is the path used by the service admins to list
+	// the registered apps. It is a string with a value of "/admin/apps".
+	AdminAppsPath = "/admin/apps"
+	// AdminDeadLettersPath constant is the path used by the service admins to
+	// list the emails that could not be sent. It is a string with a value of
+	// "/admin/dead-letters".
+	AdminDeadLettersPath = "/admin/dead-letters"
+	// AdminDeadLettersRetryPath constant is the path used by the service
+	// admins to retry sending an email that could not be sent. It is a string
+	// with a value of "/admin/dead-letters/retry".
+	AdminDeadLettersRetryPath = "/admin/dead-letters/retry"
+	// AdminStatsPath constant is the path used by the service admins to get
+	// the aggregate statistics of the service. It is a string with a value of
+	// "/admin/stats".
+	AdminStatsPath = "/admin/stats"
+	// AdminMetricsPath constant is the path used by the service admins to
+	// scrape the metrics of the service, when the metrics sink serves them. It
+	// is a string with a value of "/admin/metrics".
+	AdminMetricsPath = "/admin/metrics"
 	// UserEndpointPath constant is the path used to API endpoints related to
 	// users. It is a string with a value of "/user".
 	UserEndpointPath = "/user"
+	// UserCheckEmailPath constant is the path used to check if an email would
+	// be accepted by the API. It is a string with a value of
+	// "/user/check-email".
+	UserCheckEmailPath = "/user/check-email"
+	// UserQRPath constant is the path used to get the magic link of a token as
+	// a QR code. It is a string with a value of "/user/qr".
+	UserQRPath = "/user/qr"
+	// UserLinkPath constant is the path used to get the magic link of a valid
+	// token again, to resend it without issuing a new token. It is a string
+	// with a value of "/user/link".
+	UserLinkPath = "/user/link"
+	// UserRefreshPath constant is the path used to refresh a valid token,
+	// extending the user session. It is a string with a value of
+	// "/user/refresh".
+	UserRefreshPath = "/user/refresh"
+	// UserVerifyPath constant is the path used to exchange a one-time code
+	// sent to a user by its token. It is a string with a value of
+	// "/user/verify".
+	UserVerifyPath = "/user/verify"
+	// FormatQueryParam constant is the query parameter used to select the
+	// format of a response. It is a string with a value of "format".
+	FormatQueryParam = "format"
 	// MinTokenDuration constant is the minimum duration allowed for a token to
 	// be valid, which is an integer with a value of 60 (seconds).
 	MinTokenDuration = 60 // seconds
+	// MaxTokenDuration constant is the maximum duration allowed for a token to
+	// be valid, which is the greatest number of seconds that fits in a
+	// time.Duration without overflowing it.
+	MaxTokenDuration = uint64(math.MaxInt64 / time.Second) // seconds
 	// defaultUsersQuota constant is the default number of users allowed for an
 	// app, which is an integer with a value of 100.
 	DefaultUsersQuota = 100 // users
+	// MaxUsersQuota constant is the maximum number of users that an app can
+	// request when it is created, which is an integer with a value of 10000.
+	MaxUsersQuota = 10000 // users
+	// DefaultMaxRefreshes constant is the default number of consecutive times
+	// that a token of an app can be refreshed, which is an integer with a
+	// value of 10.
+	DefaultMaxRefreshes = 10 // refreshes
+	// MaxRefreshesLimit constant is the maximum number of consecutive token
+	// refreshes that an app can allow, which is an integer with a value of
+	// 1000.
+	MaxRefreshesLimit = 1000 // refreshes
+	// DefaultMaxTokenRequests constant is the default number of tokens that
+	// can be requested for the same email of an app in the token requests
+	// window, which is an integer with a value of 5.
+	DefaultMaxTokenRequests = 5 // requests
+	// MaxTokenRequestsLimit constant is the maximum number of token requests
+	// for the same email that an app can allow in the token requests window,
+	// which is an integer with a value of 1000.
+	MaxTokenRequestsLimit = 1000 // requests
+	// MaxAppChannels constant is the maximum number of additional channels
+	// that an app can use to deliver the magic links, which is an integer
+	// with a value of 5.
+	MaxAppChannels = 5 // channels
+	// DefaultTokenRequestsWindow constant is the default duration of the
+	// window of the token requests limit, which is an integer with a value of
+	// 900 (seconds).
+	DefaultTokenRequestsWindow = 900 // seconds
+	// MinTokenRequestsWindow constant is the minimum duration of the window
+	// of the token requests limit, which is an integer with a value of 60
+	// (seconds).
+	MinTokenRequestsWindow = 60 // seconds
+	// MaxTokenRequestsWindow constant is the maximum duration of the window
+	// of the token requests limit, which is an integer with a value of 86400
+	// (seconds), a day.
+	MaxTokenRequestsWindow = 86400 // seconds
+	// CodeDigits constant is the number of digits of the one-time codes sent
+	// to the users of the apps that use them, which is an integer with a
+	// value of 6.
+	CodeDigits = 6
+	// CodeDuration constant is the duration of the one-time codes, which is
+	// an integer with a value of 600 (seconds).
+	CodeDuration = 600 // seconds
+	// MaxCodeAttempts constant is the maximum number of wrong one-time codes
+	// that can be tried for the same user before the code is invalidated,
+	// which is an integer with a value of 5.
+	MaxCodeAttempts = 5
+	// DefaultMaxAppNameLength constant is the default maximum length of the
+	// app names, used in the subjects and the content of the emails, which
+	// is an integer with a value of 64 (characters).
+	DefaultMaxAppNameLength = 64 // characters
+	// MaxEmailSubjectLength constant is the maximum length of the custom
+	// email subject templates of the apps, which is an integer with a value
+	// of 200 (characters).
+	MaxEmailSubjectLength = 200 // characters
+	// MaxRequestBodySize constant is the maximum size of the JSON bodies of
+	// the requests, which is an integer with a value of 1MB (bytes).
+	MaxRequestBodySize = 1 << 20 // bytes
 	// UserIdSize constant is the size of the user id, which is an integer with a
 	// value of 4 (bytes).
 	UserIdSize = 4
@@ -44,7 +205,12 @@ const (
 	// SecretSize constant is the size of the secret, which is an integer with a
 	// value of 16 (bytes).
 	SecretSize = 16
-	// TokenSize constant is the size of the token, which is an integer with a
-	// value of 8 (bytes).
+	// TokenSize constant is the default size of the random part of the
+	// tokens, which is an integer with a value of 8 (bytes). It is also the
+	// minimum size that an app can choose.
 	TokenSize = 8
+	// MaxTokenSize constant is the maximum size of the random part of the
+	// tokens that an app can choose, which is an integer with a value of 64
+	// (bytes).
+	MaxTokenSize = 64
 )
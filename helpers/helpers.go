@@ -1,39 +1,126 @@
 package helpers
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
+	"hash"
 	"net/url"
 	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
 )
 
-// EncodeUserToken function encodes the user information into a token and
-// returns it. It receives the app id and the email of the user and returns the
-// token and the user id. If the app id or the email are empty, it returns an
-// error. The token is composed of three parts separated by a token separator.
-// The first part is a random sequence of 8 bytes encoded as a hexadecimal
-// string. The second part is the app id and the third part is the user id. The
-// user id is generated hashing the email with a length of 4 bytes. The token
-// is returned following the token format:
-//
-//	[appId(8)]-[userId(8)]-[randomPart(16)]
-func EncodeUserToken(appId, email string) (string, string, error) {
+// HashAlgorithm type represents the algorithm used to hash the emails to
+// generate the app ids and the user ids. The ids generated with different
+// algorithms are different, so it must not change within a deployment. The
+// empty value is the default algorithm, SHA-256.
+type HashAlgorithm string
+
+const (
+	// SHA256 algorithm is the default hash algorithm.
+	SHA256 HashAlgorithm = "sha256"
+	// SHA512 algorithm uses SHA-512.
+	SHA512 HashAlgorithm = "sha512"
+	// SHA3_256 algorithm uses SHA3-256.
+	SHA3_256 HashAlgorithm = "sha3-256"
+	// BLAKE2b256 algorithm uses BLAKE2b-256.
+	BLAKE2b256 HashAlgorithm = "blake2b-256"
+)
+
+// Valid method returns if the hash algorithm is supported, which includes the
+// empty one (the default algorithm).
+func (alg HashAlgorithm) Valid() bool {
+	_, err := alg.new()
+	return err == nil
+}
+
+// new method returns a new hash of the algorithm, or an error if the algorithm
+// is not supported.
+func (alg HashAlgorithm) new() (hash.Hash, error) {
+	switch alg {
+	case "", SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	case SHA3_256:
+		return sha3.New256(), nil
+	case BLAKE2b256:
+		return blake2b.New256(nil)
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", alg)
+	}
+}
+
+// Hash method generates a hash of the input string using the algorithm, like
+// the Hash function does with SHA-256. If the algorithm is not supported or
+// something fails during the hashing process, it returns an error.
+func (alg HashAlgorithm) Hash(input string, n int) (string, error) {
+	if input == "" {
+		return "", nil
+	}
+	hash, err := alg.new()
+	if err != nil {
+		return "", err
+	}
+	if _, err := hash.Write([]byte(input)); err != nil {
+		return "", err
+	}
+	bHash := hash.Sum(nil)
+	if n > 0 && n < len(bHash) {
+		bHash = bHash[:n]
+	}
+	return hex.EncodeToString(bHash), nil
+}
+
+// EncodeUserToken method encodes the user information into a token like the
+// EncodeUserToken function, but generating the user id with the algorithm. If
+// the algorithm is not supported, it returns an error.
+func (alg HashAlgorithm) EncodeUserToken(appId, email string, randSize int) (string, string, error) {
 	// check if the app id and email are not empty
 	if len(appId) == 0 || len(email) == 0 {
 		return "", "", fmt.Errorf("appId and email are required")
 	}
-	bToken := RandBytes(TokenSize)
+	// check if the size of the random part is valid, by default, the default
+	// token size is used
+	if randSize == 0 {
+		randSize = TokenSize
+	}
+	if randSize < TokenSize || randSize > MaxTokenSize {
+		return "", "", fmt.Errorf("token size must be between %d and %d bytes", TokenSize, MaxTokenSize)
+	}
+	bToken, err := RandBytes(randSize)
+	if err != nil {
+		return "", "", err
+	}
 	hexToken := hex.EncodeToString(bToken)
 	// hash email
-	userId, err := Hash(email, UserIdSize)
+	userId, err := alg.Hash(email, UserIdSize)
 	if err != nil {
 		return "", "", err
 	}
 	return strings.Join([]string{appId, userId, hexToken}, TokenSeparator), userId, nil
 }
 
+// EncodeUserToken function encodes the user information into a token and
+// returns it. It receives the app id and the email of the user and returns the
+// token and the user id. If the app id or the email are empty, it returns an
+// error. The token is composed of three parts separated by a token separator.
+// The first part is the app id, the second part is the user id and the third
+// part is a random sequence of randSize bytes (TokenSize if it is zero)
+// encoded as a hexadecimal string. The user id is generated hashing the email
+// with SHA-256 and a length of 4 bytes. If the random size is not between
+// TokenSize and MaxTokenSize, it returns an error. The token is returned
+// following the token format (with the default size):
+//
+//	[appId(8)]-[userId(8)]-[randomPart(16)]
+func EncodeUserToken(appId, email string, randSize int) (string, string, error) {
+	return SHA256.EncodeUserToken(appId, email, randSize)
+}
+
 // DecodeUserToken function decodes the user information from the token provided
 // and returns the app id and the user id. If the token is invalid, it returns
 // an error. It splits the provided token by the token separator and returns the
@@ -49,22 +136,40 @@ func DecodeUserToken(token string) (string, string, error) {
 	return tokenParts[0], tokenParts[1], nil
 }
 
-// RandBytes generates a random byte slice of length n. It returns nil if n is
-// less than 1.
-func RandBytes(n int) []byte {
+// RenewUserToken function generates a new token for the same app and user of
+// the token provided, replacing its random part by a new one of the same
+// size. It returns the new token and the user id. If the token is invalid, it
+// returns an error.
+func RenewUserToken(token string) (string, string, error) {
+	appId, userId, err := DecodeUserToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	randSize := (len(token) - len(appId) - len(userId) - 2*len(TokenSeparator)) / 2
+	if randSize < TokenSize {
+		randSize = TokenSize
+	}
+	bToken, err := RandBytes(randSize)
+	if err != nil {
+		return "", "", err
+	}
+	hexToken := hex.EncodeToString(bToken)
+	return strings.Join([]string{appId, userId, hexToken}, TokenSeparator), userId, nil
+}
+
+// RandBytes generates a random byte slice of length n using a
+// cryptographically secure random number generator, because it is used to
+// generate the tokens and the secrets. It returns nil if n is less than 1 or
+// an error if the random bytes cannot be read.
+func RandBytes(n int) ([]byte, error) {
 	if n < 1 {
-		return nil
+		return nil, nil
 	}
 	b := make([]byte, n)
-	for i := 0; i < n; {
-		val := rand.Uint64()
-		for j := 0; j < 8 && i < n; j++ {
-			b[i] = byte(val & 0xff)
-			val >>= 8
-			i++
-		}
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error generating random bytes: %w", err)
 	}
-	return b
+	return b, nil
 }
 
 // Hash generates a hash of the input string using SHA-256 algorithm. The n
@@ -74,18 +179,61 @@ func RandBytes(n int) []byte {
 // If the input string is empty, it returns an empty string. If something fails
 // during the hashing process, it returns an error.
 func Hash(input string, n int) (string, error) {
-	if input == "" {
-		return "", nil
+	return SHA256.Hash(input, n)
+}
+
+// BuildMagicLink function composes the magic link of the provided token,
+// adding it to the provided base URL (usually, the redirect URL of an app) as
+// the provided query param (TokenQueryParam if it is empty). If the base URL
+// has no scheme (e.g. "app.com/callback"), https is used. The path, the query
+// params, except a previous value of the token param, and the fragment of the
+// base URL are preserved. If the fragment is a client-side route (it starts
+// with "/" or "!/", e.g. "https://app.com/#/callback"), the token is added to
+// the query of the fragment, where the single page apps that use hash routing
+// read it, else it is added to the query of the URL, before the fragment. It
+// returns an error if the token is empty or the base URL is empty, malformed,
+// has no host or its scheme is not http or https.
+func BuildMagicLink(baseURL, tokenParam, token string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("token is required")
 	}
-	hash := sha256.New()
-	if _, err := hash.Write([]byte(input)); err != nil {
-		return "", err
+	if tokenParam == "" {
+		tokenParam = TokenQueryParam
 	}
-	bHash := hash.Sum(nil)
-	if n > 0 && n < len(bHash) {
-		bHash = bHash[:n]
+	baseURL = strings.TrimSpace(baseURL)
+	if baseURL == "" {
+		return "", fmt.Errorf("base URL is required")
 	}
-	return hex.EncodeToString(bHash), nil
+	// without scheme, url.Parse takes the host as part of the path, so add
+	// the default one
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + strings.TrimPrefix(baseURL, "//")
+	}
+	link, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	if link.Scheme = strings.ToLower(link.Scheme); link.Scheme != "http" && link.Scheme != "https" {
+		return "", fmt.Errorf("unsupported base URL scheme %q", link.Scheme)
+	}
+	if link.Host == "" {
+		return "", fmt.Errorf("base URL host is required")
+	}
+	// add the token to the query of the fragment if it is a route
+	if strings.HasPrefix(link.Fragment, "/") || strings.HasPrefix(link.Fragment, "!/") {
+		route, rawQuery, _ := strings.Cut(link.Fragment, "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return "", fmt.Errorf("invalid base URL fragment: %w", err)
+		}
+		query.Set(tokenParam, token)
+		link.Fragment, link.RawFragment = route+"?"+query.Encode(), ""
+		return link.String(), nil
+	}
+	query := link.Query()
+	query.Set(tokenParam, token)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
 }
 
 // SafeURL function returns a safe URL string from the provided URL. It returns
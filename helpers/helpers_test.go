@@ -0,0 +1,113 @@
+package helpers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeUserTokenSizes(t *testing.T) {
+	appId := "0123456789abcdef"
+	email := "user@simpleauth.link"
+	expectedUserId, err := Hash(email, UserIdSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	tests := []struct {
+		size, expected int
+	}{
+		{0, TokenSize},
+		{TokenSize, TokenSize},
+		{16, 16},
+		{32, 32},
+		{MaxTokenSize, MaxTokenSize},
+	}
+	for _, tc := range tests {
+		token, userId, err := EncodeUserToken(appId, email, tc.size)
+		if err != nil {
+			t.Fatalf("%d: expected nil, got %v", tc.size, err)
+		}
+		parts := strings.Split(token, TokenSeparator)
+		if len(parts) != 3 || len(parts[2]) != 2*tc.expected {
+			t.Errorf("%d: expected random part of %d bytes, got %s", tc.size, tc.expected, token)
+		}
+		// the token can be decoded regardless of its size
+		decodedAppId, decodedUserId, err := DecodeUserToken(token)
+		if err != nil || decodedAppId != appId || decodedUserId != expectedUserId || userId != expectedUserId {
+			t.Errorf("%d: expected %s and %s, got %s and %s (%v)", tc.size, appId, expectedUserId, decodedAppId, decodedUserId, err)
+		}
+		// and renewed keeping its size
+		renewed, _, err := RenewUserToken(token)
+		if err != nil || len(renewed) != len(token) || renewed == token {
+			t.Errorf("%d: expected a different token of the same size, got %s (%v)", tc.size, renewed, err)
+		}
+	}
+	for _, size := range []int{-1, TokenSize - 1, MaxTokenSize + 1} {
+		if _, _, err := EncodeUserToken(appId, email, size); err == nil {
+			t.Errorf("%d: expected error, got nil", size)
+		}
+	}
+}
+
+func TestRandBytes(t *testing.T) {
+	for _, n := range []int{-1, 0} {
+		if b, err := RandBytes(n); err != nil || b != nil {
+			t.Errorf("%d: expected nil, got %v and %v", n, b, err)
+		}
+	}
+	first, err := RandBytes(SecretSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	second, err := RandBytes(SecretSize)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(first) != SecretSize || len(second) != SecretSize {
+		t.Errorf("expected %d bytes, got %d and %d", SecretSize, len(first), len(second))
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf("expected different random bytes, got %x twice", first)
+	}
+}
+
+func TestBuildMagicLink(t *testing.T) {
+	tests := []struct {
+		name       string
+		baseURL    string
+		tokenParam string
+		expected   string
+	}{
+		{"simple", "https://app.com/callback", "", "https://app.com/callback?token=tok"},
+		{"no path", "https://app.com", "", "https://app.com?token=tok"},
+		{"query preserved", "https://app.com/callback?lang=en&next=%2Fhome", "", "https://app.com/callback?lang=en&next=%2Fhome&token=tok"},
+		{"previous token replaced", "https://app.com/callback?token=old", "", "https://app.com/callback?token=tok"},
+		{"fragment preserved", "https://app.com/callback?lang=en#top", "", "https://app.com/callback?lang=en&token=tok#top"},
+		{"hash route", "https://app.com/#/login", "", "https://app.com/#/login?token=tok"},
+		{"hash route with query", "https://app.com/#/login?next=home", "", "https://app.com/#/login?next=home&token=tok"},
+		{"hashbang route", "https://app.com/?lang=en#!/login", "", "https://app.com/?lang=en#!/login?token=tok"},
+		{"custom param", "https://app.com/callback?lang=en", "magic", "https://app.com/callback?lang=en&magic=tok"},
+		{"schemeless", "app.com/callback", "", "https://app.com/callback?token=tok"},
+		{"protocol relative", "//app.com/callback", "", "https://app.com/callback?token=tok"},
+		{"uppercase scheme", "HTTP://app.com:8080/callback", "", "http://app.com:8080/callback?token=tok"},
+		{"surrounding whitespace", "  https://app.com/callback\n", "", "https://app.com/callback?token=tok"},
+	}
+	for _, tc := range tests {
+		link, err := BuildMagicLink(tc.baseURL, tc.tokenParam, "tok")
+		if err != nil {
+			t.Errorf("%s: expected nil, got %v", tc.name, err)
+			continue
+		}
+		if link != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, link)
+		}
+	}
+	for _, baseURL := range []string{"", " ", "ftp://app.com/callback", "https://", "https://app.com/%zz", "https://app.com/#/login?%zz"} {
+		if link, err := BuildMagicLink(baseURL, "", "tok"); err == nil {
+			t.Errorf("%q: expected error, got %s", baseURL, link)
+		}
+	}
+	if link, err := BuildMagicLink("https://app.com/callback", "", ""); err == nil {
+		t.Errorf("expected error without token, got %s", link)
+	}
+}
@@ -0,0 +1,113 @@
+// Package logger defines the Logger interface used by the service to write
+// structured logs, and its default implementation based on log/slog, to allow
+// the consumers to plug their own loggers.
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger interface defines the methods to write a log entry for every level.
+// Every entry has a message and a list of fields as alternating keys and
+// values (for example, "app_id", appId).
+type Logger interface {
+	Debug(msg string, fields ...any)
+	Info(msg string, fields ...any)
+	Warn(msg string, fields ...any)
+	Error(msg string, fields ...any)
+}
+
+// SlogLogger struct implements the Logger interface writing the entries with
+// a slog.Logger.
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger function creates a new SlogLogger that writes the entries with
+// the provided slog.Logger, or with the default one (slog.Default) if it is
+// nil.
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{logger: logger}
+}
+
+// Default function returns the default Logger of the service, a SlogLogger
+// that writes the entries with the default slog.Logger.
+func Default() Logger {
+	return NewSlogLogger(nil)
+}
+
+// Debug method writes a debug entry with the provided message and fields.
+func (sl *SlogLogger) Debug(msg string, fields ...any) {
+	sl.log(slog.LevelDebug, msg, fields)
+}
+
+// Info method writes an info entry with the provided message and fields.
+func (sl *SlogLogger) Info(msg string, fields ...any) {
+	sl.log(slog.LevelInfo, msg, fields)
+}
+
+// Warn method writes a warning entry with the provided message and fields.
+func (sl *SlogLogger) Warn(msg string, fields ...any) {
+	sl.log(slog.LevelWarn, msg, fields)
+}
+
+// Error method writes an error entry with the provided message and fields.
+func (sl *SlogLogger) Error(msg string, fields ...any) {
+	sl.log(slog.LevelError, msg, fields)
+}
+
+// log method writes an entry with the provided level, message and fields
+// using the slog.Logger of the SlogLogger, resolving the default one when the
+// entry is written, so the changes of the default logger are applied.
+func (sl *SlogLogger) log(level slog.Level, msg string, fields []any) {
+	logger := sl.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Log(context.Background(), level, msg, fields...)
+}
+
+// fieldsLogger struct wraps a Logger to include some fields in every entry.
+type fieldsLogger struct {
+	logger Logger
+	fields []any
+}
+
+// With function returns a Logger that writes the entries with the provided
+// Logger, including the provided fields before the fields of every entry. It
+// allows to include the context of the entries (for example, the request id)
+// without repeating it.
+func With(logger Logger, fields ...any) Logger {
+	if len(fields) == 0 {
+		return logger
+	}
+	if fl, ok := logger.(*fieldsLogger); ok {
+		return &fieldsLogger{
+			logger: fl.logger,
+			fields: append(append([]any{}, fl.fields...), fields...),
+		}
+	}
+	return &fieldsLogger{logger: logger, fields: fields}
+}
+
+func (fl *fieldsLogger) Debug(msg string, fields ...any) {
+	fl.logger.Debug(msg, fl.with(fields)...)
+}
+
+func (fl *fieldsLogger) Info(msg string, fields ...any) {
+	fl.logger.Info(msg, fl.with(fields)...)
+}
+
+func (fl *fieldsLogger) Warn(msg string, fields ...any) {
+	fl.logger.Warn(msg, fl.with(fields)...)
+}
+
+func (fl *fieldsLogger) Error(msg string, fields ...any) {
+	fl.logger.Error(msg, fl.with(fields)...)
+}
+
+// with method returns the fields of the logger followed by the provided ones.
+func (fl *fieldsLogger) with(fields []any) []any {
+	return append(append([]any{}, fl.fields...), fields...)
+}
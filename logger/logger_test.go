@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	for _, tc := range []struct {
+		log   func(string, ...any)
+		level string
+	}{
+		{l.Debug, "level=DEBUG"},
+		{l.Info, "level=INFO"},
+		{l.Warn, "level=WARN"},
+		{l.Error, "level=ERROR"},
+	} {
+		buf.Reset()
+		tc.log("test entry", "app_id", "app", "attempts", 3)
+		out := buf.String()
+		for _, expected := range []string{tc.level, `msg="test entry"`, "app_id=app", "attempts=3"} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("expected %q in %q", expected, out)
+			}
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := NewSlogLogger(slog.New(slog.NewTextHandler(buf, nil)))
+	if With(base) != Logger(base) {
+		t.Errorf("expected the same logger without fields")
+	}
+	requestLogger := With(base, "request_id", "req")
+	appLogger := With(requestLogger, "app_id", "app")
+	appLogger.Warn("test entry", "error", "failed")
+	out := buf.String()
+	if !strings.Contains(out, "request_id=req app_id=app error=failed") {
+		t.Errorf("expected the fields in order, got %q", out)
+	}
+	// the parent logger does not include the fields of the child
+	buf.Reset()
+	requestLogger.Info("other entry")
+	if out := buf.String(); strings.Contains(out, "app_id") || !strings.Contains(out, "request_id=req") {
+		t.Errorf("unexpected fields in %q", out)
+	}
+}
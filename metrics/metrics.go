@@ -0,0 +1,40 @@
+// Package metrics defines the Sink interface used by the service to emit its
+// metrics, and the implementations that export them in the Prometheus and the
+// StatsD formats, to allow the operators to choose the monitoring backend.
+package metrics
+
+const (
+	// TokensIssued is the counter of the user tokens issued and delivered.
+	TokensIssued = "tokens_issued"
+	// TokensValidated is the counter of the user tokens validated
+	// successfully.
+	TokensValidated = "tokens_validated"
+	// EmailsSent is the counter of the emails sent by the email queue.
+	EmailsSent = "emails_sent"
+	// EmailQueueDepth is the gauge of the emails waiting in the email queue.
+	EmailQueueDepth = "email_queue_depth"
+)
+
+// Sink interface defines the methods to emit the metrics of the service: the
+// counters, which are incremented by the provided delta, and the gauges,
+// which are set to the provided value. The implementations must be safe for
+// concurrent use.
+type Sink interface {
+	IncrCounter(name string, delta int64)
+	SetGauge(name string, value int64)
+}
+
+// NoopSink struct implements the Sink interface discarding every metric.
+type NoopSink struct{}
+
+// IncrCounter method discards the counter increment.
+func (NoopSink) IncrCounter(string, int64) {}
+
+// SetGauge method discards the gauge value.
+func (NoopSink) SetGauge(string, int64) {}
+
+// Default function returns the default Sink of the service, a NoopSink that
+// discards every metric.
+func Default() Sink {
+	return NoopSink{}
+}
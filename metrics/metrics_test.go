@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// emitTestMetrics function emits the same metric events to the provided sink.
+func emitTestMetrics(sink Sink) {
+	sink.IncrCounter(TokensIssued, 1)
+	sink.IncrCounter(TokensIssued, 2)
+	sink.IncrCounter(TokensValidated, 1)
+	sink.SetGauge(EmailQueueDepth, 5)
+	sink.SetGauge(EmailQueueDepth, 3)
+}
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink("authapi")
+	emitTestMetrics(sink)
+	expected := "# TYPE authapi_tokens_issued_total counter\n" +
+		"authapi_tokens_issued_total 3\n" +
+		"# TYPE authapi_tokens_validated_total counter\n" +
+		"authapi_tokens_validated_total 1\n" +
+		"# TYPE authapi_email_queue_depth gauge\n" +
+		"authapi_email_queue_depth 3\n"
+	res := httptest.NewRecorder()
+	sink.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if res.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, res.Body.String())
+	}
+	if ct := res.Header().Get("Content-Type"); ct != prometheusContentType {
+		t.Errorf("expected %q, got %q", prometheusContentType, ct)
+	}
+	// without namespace, the names are not prefixed
+	sink = NewPrometheusSink("")
+	sink.IncrCounter(EmailsSent, 1)
+	if got := sink.Export(); got != "# TYPE emails_sent_total counter\nemails_sent_total 1\n" {
+		t.Errorf("unexpected export: %q", got)
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	emitTestMetrics(NewStatsDSink(buf, "authapi"))
+	expected := "authapi.tokens_issued:1|c\n" +
+		"authapi.tokens_issued:2|c\n" +
+		"authapi.tokens_validated:1|c\n" +
+		"authapi.email_queue_depth:5|g\n" +
+		"authapi.email_queue_depth:3|g\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	// the metrics are sent to the statsd server over udp
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer conn.Close()
+	sink, err := DialStatsD(conn.LocalAddr().String(), "")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	sink.IncrCounter(EmailsSent, 1)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	packet := make([]byte, 512)
+	n, _, err := conn.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got := string(packet[:n]); got != "emails_sent:1|c\n" {
+		t.Errorf("expected %q, got %q", "emails_sent:1|c\n", got)
+	}
+}
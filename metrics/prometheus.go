@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prometheusContentType is the content type of the Prometheus text
+// exposition format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusSink struct implements the Sink interface keeping the current
+// value of every metric in memory, to expose them in the Prometheus text
+// format when it is scraped. It also implements the http.Handler interface to
+// serve them. The names of the metrics are prefixed with the namespace, if
+// any, and the counters are suffixed with "_total".
+type PrometheusSink struct {
+	namespace string
+	mtx       sync.Mutex
+	counters  map[string]int64
+	gauges    map[string]int64
+}
+
+// NewPrometheusSink function creates a new PrometheusSink that prefixes the
+// names of the metrics with the provided namespace (for example, "authapi"),
+// none if it is empty.
+func NewPrometheusSink(namespace string) *PrometheusSink {
+	return &PrometheusSink{
+		namespace: namespace,
+		counters:  map[string]int64{},
+		gauges:    map[string]int64{},
+	}
+}
+
+// IncrCounter method increments the counter with the provided name by the
+// provided delta.
+func (ps *PrometheusSink) IncrCounter(name string, delta int64) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	ps.counters[name] += delta
+}
+
+// SetGauge method sets the gauge with the provided name to the provided
+// value.
+func (ps *PrometheusSink) SetGauge(name string, value int64) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	ps.gauges[name] = value
+}
+
+// ServeHTTP method writes the current value of every metric in the Prometheus
+// text format, sorted by name.
+func (ps *PrometheusSink) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	_, _ = w.Write([]byte(ps.Export()))
+}
+
+// Export method returns the current value of every metric in the Prometheus
+// text format, sorted by name.
+func (ps *PrometheusSink) Export() string {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	var sb strings.Builder
+	for _, name := range sortedNames(ps.counters) {
+		ps.writeMetric(&sb, ps.metricName(name)+"_total", "counter", ps.counters[name])
+	}
+	for _, name := range sortedNames(ps.gauges) {
+		ps.writeMetric(&sb, ps.metricName(name), "gauge", ps.gauges[name])
+	}
+	return sb.String()
+}
+
+// metricName method returns the provided name prefixed with the namespace of
+// the sink, if any.
+func (ps *PrometheusSink) metricName(name string) string {
+	if ps.namespace == "" {
+		return name
+	}
+	return ps.namespace + "_" + name
+}
+
+// writeMetric method writes the type and the value of a metric to the
+// provided builder.
+func (ps *PrometheusSink) writeMetric(sb *strings.Builder, name, kind string, value int64) {
+	fmt.Fprintf(sb, "# TYPE %s %s\n%s %d\n", name, kind, name, value)
+}
+
+// sortedNames function returns the keys of the provided metrics sorted
+// alphabetically.
+func sortedNames(metrics map[string]int64) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
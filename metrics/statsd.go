@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// StatsDSink struct implements the Sink interface sending every metric as a
+// StatsD line ("name:value|c" for the counters and "name:value|g" for the
+// gauges) to the provided writer, usually an UDP connection to the StatsD
+// server. The names of the metrics are prefixed with the prefix, if any. The
+// write errors are ignored, because the metrics must not affect the service.
+type StatsDSink struct {
+	prefix string
+	mtx    sync.Mutex
+	w      io.Writer
+}
+
+// NewStatsDSink function creates a new StatsDSink that writes the metrics to
+// the provided writer, prefixing their names with the provided prefix (for
+// example, "authapi"), none if it is empty.
+func NewStatsDSink(w io.Writer, prefix string) *StatsDSink {
+	return &StatsDSink{prefix: prefix, w: w}
+}
+
+// DialStatsD function creates a new StatsDSink that sends the metrics to the
+// StatsD server at the provided address (for example, "127.0.0.1:8125") over
+// UDP, prefixing their names with the provided prefix. It returns an error if
+// the address is not valid.
+func DialStatsD(addr, prefix string) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd: %w", err)
+	}
+	return NewStatsDSink(conn, prefix), nil
+}
+
+// IncrCounter method sends the increment of the counter with the provided
+// name.
+func (ss *StatsDSink) IncrCounter(name string, delta int64) {
+	ss.send(name, delta, "c")
+}
+
+// SetGauge method sends the value of the gauge with the provided name.
+func (ss *StatsDSink) SetGauge(name string, value int64) {
+	ss.send(name, value, "g")
+}
+
+// send method writes a StatsD line with the provided name, value and type,
+// serializing the writes to keep the lines intact.
+func (ss *StatsDSink) send(name string, value int64, kind string) {
+	if ss.prefix != "" {
+		name = ss.prefix + "." + name
+	}
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	_, _ = fmt.Fprintf(ss.w, "%s:%d|%s\n", name, value, kind)
+}
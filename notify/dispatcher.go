@@ -0,0 +1,163 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDispatchTimeout is the default maximum time that a notifier has
+	// to deliver a message in every attempt.
+	DefaultDispatchTimeout = 5 * time.Second
+	// DefaultDispatchAttempts is the default number of attempts to deliver a
+	// message when the notifier times out.
+	DefaultDispatchAttempts = 3
+	// DefaultDispatchRetryDelay is the default delay between the attempts to
+	// deliver a message.
+	DefaultDispatchRetryDelay = 500 * time.Millisecond
+	// DefaultMaxConcurrentDispatches is the default maximum number of
+	// messages that are delivered at the same time to the same target.
+	DefaultMaxConcurrentDispatches = 10
+)
+
+var (
+	// ErrDispatchTimeout error is returned when the notifier does not deliver
+	// the message before the timeout in any of the attempts.
+	ErrDispatchTimeout = fmt.Errorf("notification dispatch timed out")
+	// ErrTargetBusy error is returned when the target has too many messages
+	// being delivered and no one finishes before the timeout.
+	ErrTargetBusy = fmt.Errorf("too many notifications in progress for the target")
+)
+
+// DispatcherConfig struct includes the configuration of a Dispatcher. The
+// Timeout is the maximum time of every attempt to deliver a message, the
+// attempts that time out are retried up to Attempts times in total, waiting
+// RetryDelay between them. MaxConcurrentPerTarget limits the messages that are
+// delivered at the same time to the same target. The zero values are replaced
+// by the defaults.
+type DispatcherConfig struct {
+	Timeout                time.Duration
+	Attempts               int
+	RetryDelay             time.Duration
+	MaxConcurrentPerTarget int
+}
+
+// Dispatcher struct delivers the messages using the provided notifiers,
+// bounding the time of every attempt and the number of messages delivered at
+// the same time to every target, so a slow or hanging receiver can not block
+// the delivery of the messages to the rest of the targets. It includes the
+// configuration and the slots in use of every target.
+type Dispatcher struct {
+	cfg      DispatcherConfig
+	slotsMtx sync.Mutex
+	slots    map[string]*targetSlots
+}
+
+// targetSlots struct represents the slots of a target, a buffered channel
+// with a value per message being delivered, and the number of dispatches that
+// are using or waiting for them, to release the slots of the targets that are
+// not in use.
+type targetSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+// NewDispatcher creates a new Dispatcher with the provided configuration,
+// using the default values for the zero ones.
+func NewDispatcher(cfg DispatcherConfig) *Dispatcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultDispatchTimeout
+	}
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = DefaultDispatchAttempts
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultDispatchRetryDelay
+	}
+	if cfg.MaxConcurrentPerTarget <= 0 {
+		cfg.MaxConcurrentPerTarget = DefaultMaxConcurrentDispatches
+	}
+	return &Dispatcher{
+		cfg:   cfg,
+		slots: map[string]*targetSlots{},
+	}
+}
+
+// Dispatch method delivers the message to the target using the provided
+// notifier. It waits up to the configured timeout for a free slot of the
+// target, if there is none, it returns ErrTargetBusy. Every attempt is
+// cancelled when it reaches the timeout, and the attempts that time out are
+// retried, up to the configured attempts, before returning
+// ErrDispatchTimeout. The rest of the errors are not retried and are returned
+// as they are. If the provided context is done, it returns its error.
+func (d *Dispatcher) Dispatch(ctx context.Context, notifier Notifier, target string, msg *Message) error {
+	// get a slot of the target
+	slots := d.acquireSlots(target)
+	defer d.releaseSlots(target)
+	timer := time.NewTimer(d.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case slots.sem <- struct{}{}:
+		defer func() { <-slots.sem }()
+	case <-timer.C:
+		return ErrTargetBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// deliver the message retrying the attempts that time out
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+		err := notifier.Notify(attemptCtx, target, msg)
+		timedOut := errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !timedOut {
+			return err
+		}
+		if attempt >= d.cfg.Attempts {
+			return fmt.Errorf("%w after %d attempts: %v", ErrDispatchTimeout, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.cfg.RetryDelay):
+		}
+	}
+}
+
+// acquireSlots method returns the slots of the provided target, creating
+// them if they do not exist, and registers the caller as a user of them.
+func (d *Dispatcher) acquireSlots(target string) *targetSlots {
+	d.slotsMtx.Lock()
+	defer d.slotsMtx.Unlock()
+	slots, ok := d.slots[target]
+	if !ok {
+		slots = &targetSlots{sem: make(chan struct{}, d.cfg.MaxConcurrentPerTarget)}
+		d.slots[target] = slots
+	}
+	slots.users++
+	return slots
+}
+
+// releaseSlots method unregisters the caller as a user of the slots of the
+// provided target, and deletes them if they are not used anymore.
+func (d *Dispatcher) releaseSlots(target string) {
+	d.slotsMtx.Lock()
+	defer d.slotsMtx.Unlock()
+	slots, ok := d.slots[target]
+	if !ok {
+		return
+	}
+	slots.users--
+	if slots.users <= 0 {
+		delete(d.slots, target)
+	}
+}
@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// notifierFunc type allows to use a function as a Notifier.
+type notifierFunc func(ctx context.Context, target string, msg *Message) error
+
+func (fn notifierFunc) Notify(ctx context.Context, target string, msg *Message) error {
+	return fn(ctx, target, msg)
+}
+
+func TestDispatchTimeout(t *testing.T) {
+	// a receiver that hangs until the test finishes
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	dispatcher := NewDispatcher(DispatcherConfig{
+		Timeout:    50 * time.Millisecond,
+		Attempts:   3,
+		RetryDelay: time.Millisecond,
+	})
+	msg := &Message{AppName: "test app", Email: "user@simpleauth.link"}
+	start := time.Now()
+	err := dispatcher.Dispatch(context.Background(), NewWebhookNotifier(nil), srv.URL, msg)
+	if !errors.Is(err, ErrDispatchTimeout) {
+		t.Fatalf("expected %v, got %v", ErrDispatchTimeout, err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected dispatch to time out, took %s", elapsed)
+	}
+	// the timeouts are retried until the receiver responds
+	var attempts atomic.Int32
+	slowOnce := notifierFunc(func(ctx context.Context, _ string, _ *Message) error {
+		if attempts.Add(1) == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err := dispatcher.Dispatch(context.Background(), slowOnce, "target", msg); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+	// the rest of the errors are not retried
+	attempts.Store(0)
+	failing := notifierFunc(func(_ context.Context, _ string, _ *Message) error {
+		attempts.Add(1)
+		return errors.New("unexpected status code: 500")
+	})
+	if err := dispatcher.Dispatch(context.Background(), failing, "target", msg); err == nil || errors.Is(err, ErrDispatchTimeout) {
+		t.Errorf("expected receiver error, got %v", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
+
+func TestDispatchConcurrencyPerTarget(t *testing.T) {
+	dispatcher := NewDispatcher(DispatcherConfig{
+		Timeout:                50 * time.Millisecond,
+		Attempts:               1,
+		MaxConcurrentPerTarget: 1,
+	})
+	msg := &Message{AppName: "test app", Email: "user@simpleauth.link"}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	hanging := notifierFunc(func(ctx context.Context, _ string, _ *Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- dispatcher.Dispatch(context.Background(), hanging, "slow", msg)
+	}()
+	<-started
+	// the slow target does not block the rest of the targets
+	ok := notifierFunc(func(_ context.Context, _ string, _ *Message) error { return nil })
+	if err := dispatcher.Dispatch(context.Background(), ok, "other", msg); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	// but the messages to the slow target wait for a free slot
+	if err := dispatcher.Dispatch(context.Background(), ok, "slow", msg); !errors.Is(err, ErrTargetBusy) {
+		t.Errorf("expected %v, got %v", ErrTargetBusy, err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if err := dispatcher.Dispatch(context.Background(), ok, "slow", msg); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultTimeout is the timeout of the http client used by the built-in
+// notifiers when no client is provided.
+const defaultTimeout = 10 * time.Second
+
+// Message struct includes the information required to deliver a magic link to
+// a user: the app name, the user email, the magic link and the raw token. It
+// also includes the optional key of the template requested to compose it and
+// the one-time code of the apps that use them, in which case the magic link
+// and the token can be empty if the app only uses codes, the optional custom
+// subject of the app, the default one of the channel if it is empty, and the
+// optional locale of the user, to localize the message if the channel
+// supports it.
+type Message struct {
+	AppName   string `json:"app_name"`
+	Email     string `json:"email"`
+	MagicLink string `json:"magic_link"`
+	Token     string `json:"token"`
+	Template  string `json:"template,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Locale    string `json:"locale,omitempty"`
+}
+
+// Notifier interface defines the method that a delivery channel must
+// implement to send the magic link to the user. The target is channel
+// specific (for example, the url of a webhook) and is configured per app.
+type Notifier interface {
+	Notify(ctx context.Context, target string, msg *Message) error
+}
+
+// WebhookNotifier struct implements the Notifier interface sending the
+// message as a JSON body of a POST request to the target url.
+type WebhookNotifier struct {
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a new WebhookNotifier with the provided http
+// client. If no client is provided, a client with a default timeout is used.
+func NewWebhookNotifier(client *http.Client) *WebhookNotifier {
+	if client == nil {
+		client = &http.Client{Timeout: defaultTimeout}
+	}
+	return &WebhookNotifier{client: client}
+}
+
+// Notify method sends the message encoded as JSON to the target url. It
+// returns an error if the target is empty, the request fails or the receiver
+// responds with a non 2xx status code.
+func (wn *WebhookNotifier) Notify(ctx context.Context, target string, msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	return post(ctx, wn.client, target, body)
+}
+
+// SlackNotifier struct implements the Notifier interface sending the magic
+// link as a text message to a Slack incoming webhook, which is the target url.
+type SlackNotifier struct {
+	client *http.Client
+}
+
+// NewSlackNotifier creates a new SlackNotifier with the provided http client.
+// If no client is provided, a client with a default timeout is used.
+func NewSlackNotifier(client *http.Client) *SlackNotifier {
+	if client == nil {
+		client = &http.Client{Timeout: defaultTimeout}
+	}
+	return &SlackNotifier{client: client}
+}
+
+// Notify method sends the magic link, the one-time code or both to the Slack
+// incoming webhook provided as target. It returns an error if the target is
+// empty, the request fails or Slack responds with a non 2xx status code.
+func (sn *SlackNotifier) Notify(ctx context.Context, target string, msg *Message) error {
+	text := fmt.Sprintf("Magic link for %s in '%s': %s", msg.Email, msg.AppName, msg.MagicLink)
+	switch {
+	case msg.MagicLink == "":
+		text = fmt.Sprintf("Login code for %s in '%s': %s", msg.Email, msg.AppName, msg.Code)
+	case msg.Code != "":
+		text += fmt.Sprintf(" (code: %s)", msg.Code)
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	return post(ctx, sn.client, target, body)
+}
+
+// post function sends the provided body as JSON to the target url using the
+// client provided. It returns an error if the target is empty, the request
+// fails or the response has a non 2xx status code.
+func post(ctx context.Context, client *http.Client, target string, body []byte) error {
+	if target == "" {
+		return fmt.Errorf("no target url provided")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer res.Body.Close()
+	// drain the body to allow the connection to be reused
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
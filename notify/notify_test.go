@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var received Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	msg := &Message{
+		AppName:   "test app",
+		Email:     "user@simpleauth.link",
+		MagicLink: "https://simpleauth.link/callback?token=token",
+		Token:     "token",
+	}
+	notifier := NewWebhookNotifier(nil)
+	if err := notifier.Notify(context.Background(), srv.URL, msg); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if received != *msg {
+		t.Errorf("expected %+v, got %+v", *msg, received)
+	}
+	if err := notifier.Notify(context.Background(), "", msg); err == nil {
+		t.Errorf("expected error with empty target, got nil")
+	}
+}
@@ -0,0 +1,198 @@
+// Package verify provides the verification of the tokens issued by the
+// service without a database or a running service, to allow the resource
+// servers to check the tokens offline, without importing the server.
+package verify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// jwtAlgorithm is the only signing algorithm supported for the JWTs.
+const jwtAlgorithm = "HS256"
+
+var (
+	// ErrInvalidToken error is returned when the token is malformed.
+	ErrInvalidToken = fmt.Errorf("invalid token")
+	// ErrInvalidSignature error is returned when the signature of a JWT does
+	// not match its content and the provided key.
+	ErrInvalidSignature = fmt.Errorf("invalid token signature")
+	// ErrExpiredToken error is returned when a JWT is expired.
+	ErrExpiredToken = fmt.Errorf("token expired")
+	// ErrKeyRequired error is returned when a JWT is verified without a key.
+	ErrKeyRequired = fmt.Errorf("key required to verify the token signature")
+	// ErrAppMismatch error is returned when the token does not belong to the
+	// expected app.
+	ErrAppMismatch = fmt.Errorf("token of other app")
+	// ErrIssuerMismatch error is returned when a JWT is not issued by the
+	// expected issuer.
+	ErrIssuerMismatch = fmt.Errorf("token of other issuer")
+)
+
+// VerifyOptions struct includes the options of the token verification. The
+// AppID is the id of the app that the token must belong to, any app if it is
+// empty. The Key is the HMAC key used to verify the signature of the JWTs,
+// they are rejected if it is empty. The Now function returns the current time
+// to check the expiration of the JWTs (time.Now by default). The Issuer is the
+// issuer that the JWTs must include in their "iss" claim, any issuer if it is
+// empty. The tokens issued by the service carry no issuer, it is only known
+// when they are validated by the service (see api.TokenValidation), so it is
+// not checked for them.
+type VerifyOptions struct {
+	AppID  string
+	Key    []byte
+	Now    func() time.Time
+	Issuer string
+}
+
+// Claims struct includes the information of a verified token: the id of the
+// app and the id of the user of the token, and its issuer and expiration,
+// which are only known for the JWTs (empty otherwise).
+type Claims struct {
+	AppID      string    `json:"app_id"`
+	UserID     string    `json:"sub"`
+	Issuer     string    `json:"iss,omitempty"`
+	Expiration time.Time `json:"-"`
+}
+
+// jwtClaims struct represents the payload of a JWT, with the expiration as a
+// unix timestamp.
+type jwtClaims struct {
+	Claims
+	ExpiresAt int64 `json:"exp,omitempty"`
+}
+
+// VerifyToken function verifies the provided token and returns its claims. It
+// supports the tokens issued by the service, whose structure is checked (their
+// expiration is only known by the service), and the JWTs signed with HS256,
+// whose signature and expiration are checked with the key of the options. If
+// the token does not belong to the app of the options, it returns
+// ErrAppMismatch, and if a JWT is not issued by the issuer of the options, it
+// returns ErrIssuerMismatch. If the token is not valid, it returns an error.
+func VerifyToken(token string, opts VerifyOptions) (Claims, error) {
+	var claims Claims
+	var err error
+	if strings.Count(token, ".") == 2 {
+		claims, err = verifyJWT(token, opts)
+	} else {
+		claims, err = verifyUserToken(token)
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+	if opts.AppID != "" && claims.AppID != opts.AppID {
+		return Claims{}, ErrAppMismatch
+	}
+	return claims, nil
+}
+
+// verifyUserToken function checks the structure of a token issued by the
+// service, following the token format:
+//
+//	[appId(8)]-[userId(8)]-[randomPart(16)]
+//
+// Every part must be hexadecimal and have the expected size (the random part
+// can have any size allowed to the apps), else it returns ErrInvalidToken.
+func verifyUserToken(token string) (Claims, error) {
+	appId, userId, err := helpers.DecodeUserToken(token)
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	parts := strings.Split(token, helpers.TokenSeparator)
+	if !isHex(appId, helpers.EmailHashSize+helpers.AppNonceSize) || !isHex(userId, helpers.UserIdSize) {
+		return Claims{}, ErrInvalidToken
+	}
+	// the size of the random part depends on the app
+	randSize := len(parts[2]) / 2
+	if randSize < helpers.TokenSize || randSize > helpers.MaxTokenSize || !isHex(parts[2], randSize) {
+		return Claims{}, ErrInvalidToken
+	}
+	return Claims{AppID: appId, UserID: userId}, nil
+}
+
+// verifyJWT function verifies a JWT signed with HS256 using the key of the
+// options, and checks its expiration, if it has one, and its issuer, if the
+// options include one. It returns the claims of the token or an error if the
+// key is empty, the token is malformed, the signature does not match, the
+// token is expired or it is issued by other issuer.
+func verifyJWT(token string, opts VerifyOptions) (Claims, error) {
+	if len(opts.Key) == 0 {
+		return Claims{}, ErrKeyRequired
+	}
+	parts := strings.Split(token, ".")
+	// decode and check the header
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if header.Alg != jwtAlgorithm {
+		return Claims{}, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	// check the signature before decoding the payload
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !hmac.Equal(signature, sign(parts[0]+"."+parts[1], opts.Key)) {
+		return Claims{}, ErrInvalidSignature
+	}
+	// decode the payload and check the expiration
+	rawPayload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	payload := &jwtClaims{}
+	if err := json.Unmarshal(rawPayload, payload); err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if payload.AppID == "" || payload.UserID == "" {
+		return Claims{}, fmt.Errorf("%w: missing app or user", ErrInvalidToken)
+	}
+	claims := payload.Claims
+	if opts.Issuer != "" && claims.Issuer != opts.Issuer {
+		return Claims{}, ErrIssuerMismatch
+	}
+	if payload.ExpiresAt != 0 {
+		claims.Expiration = time.Unix(payload.ExpiresAt, 0)
+		now := time.Now
+		if opts.Now != nil {
+			now = opts.Now
+		}
+		if !now().Before(claims.Expiration) {
+			return Claims{}, ErrExpiredToken
+		}
+	}
+	return claims, nil
+}
+
+// sign function returns the HMAC-SHA256 of the provided input with the
+// provided key.
+func sign(input string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+// isHex function returns if the provided string is the hexadecimal encoding
+// of n bytes.
+func isHex(s string, n int) bool {
+	if len(s) != 2*n {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,130 @@
+package verify
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simpleauthlink/authapi/helpers"
+)
+
+// testJWT function composes a JWT with the provided header and payload,
+// signed with the provided key.
+func testJWT(header, payload string, key []byte) string {
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign(input, key))
+}
+
+func TestVerifyUserToken(t *testing.T) {
+	appId := "0123456789abcdef"
+	token, userId, err := helpers.EncodeUserToken(appId, "user@simpleauth.link", 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	claims, err := VerifyToken(token, VerifyOptions{AppID: appId})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if claims.AppID != appId || claims.UserID != userId || !claims.Expiration.IsZero() {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if _, err := VerifyToken(token, VerifyOptions{AppID: "fedcba9876543210"}); !errors.Is(err, ErrAppMismatch) {
+		t.Errorf("expected %v, got %v", ErrAppMismatch, err)
+	}
+	for _, invalid := range []string{
+		"",
+		"invalid-token",
+		appId + "-" + userId,
+		appId + "-" + userId + "-0123456789abcdef-00",
+		appId + "-" + userId + "-0123456789abcdeg",
+		appId + "-" + userId + "-0123456789abcd",
+		"0123456789abcde-" + userId + "-0123456789abcdef",
+		appId + "-xyz12345-0123456789abcdef",
+	} {
+		if _, err := VerifyToken(invalid, VerifyOptions{}); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%q: expected %v, got %v", invalid, ErrInvalidToken, err)
+		}
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	key := []byte("secret-key")
+	now := time.Now()
+	header := `{"alg":"HS256","typ":"JWT"}`
+	valid := testJWT(header, `{"app_id":"app","sub":"user","exp":`+strconv.FormatInt(now.Add(time.Hour).Unix(), 10)+`}`, key)
+	claims, err := VerifyToken(valid, VerifyOptions{AppID: "app", Key: key})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if claims.AppID != "app" || claims.UserID != "user" || claims.Expiration.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	// the expiration is checked against the provided clock
+	later := func() time.Time { return now.Add(2 * time.Hour) }
+	if _, err := VerifyToken(valid, VerifyOptions{Key: key, Now: later}); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expected %v, got %v", ErrExpiredToken, err)
+	}
+	// a token with the payload of other token and the valid signature
+	validParts := strings.Split(valid, ".")
+	otherParts := strings.Split(testJWT(header, `{"app_id":"app","sub":"admin"}`, key), ".")
+	tampered := validParts[0] + "." + otherParts[1] + "." + validParts[2]
+	tests := []struct {
+		name  string
+		token string
+		key   []byte
+		err   error
+	}{
+		{"without key", valid, nil, ErrKeyRequired},
+		{"wrong key", valid, []byte("other-key"), ErrInvalidSignature},
+		{"other app", valid, key, ErrAppMismatch},
+		{"expired", testJWT(header, `{"app_id":"app","sub":"user","exp":`+strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)+`}`, key), key, ErrExpiredToken},
+		{"tampered", tampered, key, ErrInvalidSignature},
+		{"unsigned", testJWT(`{"alg":"none"}`, `{"app_id":"app","sub":"user"}`, key), key, ErrInvalidToken},
+		{"missing user", testJWT(header, `{"app_id":"app"}`, key), key, ErrInvalidToken},
+		{"malformed payload", testJWT(header, `not json`, key), key, ErrInvalidToken},
+		{"malformed header", "%%%.e30.sig", key, ErrInvalidToken},
+	}
+	for _, tc := range tests {
+		appId := "app"
+		if tc.err == ErrAppMismatch {
+			appId = "other"
+		}
+		if _, err := VerifyToken(tc.token, VerifyOptions{AppID: appId, Key: tc.key}); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+	// without expiration, the token does not expire
+	if _, err := VerifyToken(testJWT(header, `{"app_id":"app","sub":"user"}`, key), VerifyOptions{Key: key}); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestVerifyJWTIssuer(t *testing.T) {
+	key := []byte("secret-key")
+	header := `{"alg":"HS256","typ":"JWT"}`
+	issued := testJWT(header, `{"app_id":"app","sub":"user","iss":"https://simpleauth.link"}`, key)
+	// the issuer is included in the claims and checked if it is expected
+	for _, issuer := range []string{"", "https://simpleauth.link"} {
+		claims, err := VerifyToken(issued, VerifyOptions{Key: key, Issuer: issuer})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if claims.Issuer != "https://simpleauth.link" {
+			t.Errorf("expected issuer https://simpleauth.link, got %q", claims.Issuer)
+		}
+	}
+	// the tokens of other issuer or without issuer are rejected if it is
+	// expected
+	for _, token := range []string{
+		issued,
+		testJWT(header, `{"app_id":"app","sub":"user"}`, key),
+	} {
+		if _, err := VerifyToken(token, VerifyOptions{Key: key, Issuer: "https://other.link"}); !errors.Is(err, ErrIssuerMismatch) {
+			t.Errorf("expected %v, got %v", ErrIssuerMismatch, err)
+		}
+	}
+}